@@ -0,0 +1,378 @@
+package main
+
+import "math/bits"
+
+const (
+	flagCF uint64 = 1 << 0
+	flagPF uint64 = 1 << 2
+	flagAF uint64 = 1 << 4
+	flagZF uint64 = 1 << 6
+	flagSF uint64 = 1 << 7
+	flagDF uint64 = 1 << 10
+	flagOF uint64 = 1 << 11
+
+	// flagReserved always reads as set
+	flagReserved uint64 = 1 << 1
+	flagIF       uint64 = 1 << 9
+
+	// userFlags are the flags POPFQ can change from user space. The
+	// others, such as IF and IOPL, keep their value.
+	userFlags = flagCF | flagPF | flagAF | flagZF | flagSF | 1<<8 | flagDF | flagOF | 1<<14 | 1<<18 | 1<<21
+)
+
+// lahfFlags are the flags LAHF and SAHF transfer through AH. Bit 1 of
+// the transferred byte is always set (flagReserved) and bits 3 and 5
+// are always clear.
+const lahfFlags = flagSF | flagZF | flagAF | flagPF | flagCF
+
+func widthMask(width int) uint64 {
+	if width == 64 {
+		return ^uint64(0)
+	}
+
+	return (uint64(1) << width) - 1
+}
+
+func signBit(width int) uint64 {
+	return uint64(1) << (width - 1)
+}
+
+// signExtend widens the low width bits of v to 64 bits
+func signExtend(v uint64, width int) uint64 {
+	shift := 64 - width
+	return uint64(int64(v<<shift) >> shift)
+}
+
+func (c *cpu) flag(f uint64) bool {
+	return c.regfile.get(rflags)&f != 0
+}
+
+func (c *cpu) setFlag(f uint64, on bool) {
+	flags := c.regfile.get(rflags)
+	if on {
+		flags |= f
+	} else {
+		flags &^= f
+	}
+
+	c.regfile.set(rflags, flags)
+}
+
+func parity(b byte) bool {
+	b ^= b >> 4
+	b ^= b >> 2
+	b ^= b >> 1
+	return b&1 == 0
+}
+
+// setResultFlags sets ZF, SF and PF from an already truncated result
+func (c *cpu) setResultFlags(result uint64, width int) {
+	c.setFlag(flagZF, result == 0)
+	c.setFlag(flagSF, result&signBit(width) != 0)
+	c.setFlag(flagPF, parity(byte(result)))
+}
+
+func (c *cpu) add(a, b uint64, width int) uint64 {
+	return c.addWithCarry(a, b, 0, width)
+}
+
+func (c *cpu) adc(a, b uint64, width int) uint64 {
+	return c.addWithCarry(a, b, c.carry(), width)
+}
+
+func (c *cpu) sub(a, b uint64, width int) uint64 {
+	return c.subWithBorrow(a, b, 0, width)
+}
+
+func (c *cpu) sbb(a, b uint64, width int) uint64 {
+	return c.subWithBorrow(a, b, c.carry(), width)
+}
+
+// carry is CF as a number to add or subtract
+func (c *cpu) carry() uint64 {
+	if c.flag(flagCF) {
+		return 1
+	}
+
+	return 0
+}
+
+// addWithCarry computes a + b + carry, where carry is 0 or 1, setting CF
+// when the sum does not fit in width bits.
+func (c *cpu) addWithCarry(a, b, carry uint64, width int) uint64 {
+	mask := widthMask(width)
+	a, b = a&mask, b&mask
+	sum, carryOut := bits.Add64(a, b, carry)
+	result := sum & mask
+	if width < 64 {
+		carryOut = sum >> width
+	}
+
+	c.setFlag(flagCF, carryOut != 0)
+	c.setFlag(flagOF, (a^result)&(b^result)&signBit(width) != 0)
+	c.setFlag(flagAF, (a^b^result)&0x10 != 0)
+	c.setResultFlags(result, width)
+	return result
+}
+
+// subWithBorrow computes a - b - borrow, where borrow is 0 or 1, setting
+// CF when the subtraction borrows.
+func (c *cpu) subWithBorrow(a, b, borrow uint64, width int) uint64 {
+	mask := widthMask(width)
+	a, b = a&mask, b&mask
+	diff, borrowOut := bits.Sub64(a, b, borrow)
+	result := diff & mask
+
+	c.setFlag(flagCF, borrowOut != 0)
+	c.setFlag(flagOF, (a^b)&(a^result)&signBit(width) != 0)
+	c.setFlag(flagAF, (a^b^result)&0x10 != 0)
+	c.setResultFlags(result, width)
+	return result
+}
+
+// logic sets flags for the result of and/or/xor/test
+func (c *cpu) logic(result uint64, width int) uint64 {
+	result &= widthMask(width)
+	c.setFlag(flagCF, false)
+	c.setFlag(flagOF, false)
+	c.setFlag(flagAF, false)
+	c.setResultFlags(result, width)
+	return result
+}
+
+// imul is the signed multiply of the two and three operand forms. CF
+// and OF are set when the product does not fit in width bits.
+func (c *cpu) imul(a, b uint64, width int) uint64 {
+	a, b = signExtend(a, width), signExtend(b, width)
+	lo := a * b
+	result := lo & widthMask(width)
+
+	var overflow bool
+	if width == 64 {
+		hi, _ := bits.Mul64(a, b)
+		if int64(a) < 0 {
+			hi -= b
+		}
+		if int64(b) < 0 {
+			hi -= a
+		}
+
+		overflow = hi != uint64(int64(lo)>>63)
+	} else {
+		// The full product of two sign extended values of at most 32
+		// bits always fits in 64 bits
+		overflow = signExtend(result, width) != lo
+	}
+
+	c.setFlag(flagCF, overflow)
+	c.setFlag(flagOF, overflow)
+	return result
+}
+
+// aluOps are indexed by the operation encoded in bits 5:3 of the
+// classic ALU opcodes (0x00-0x3F) and the /digit of the 0x80-0x83
+// immediate groups.
+var aluOps = [8]func(c *cpu, a, b uint64, width int) uint64{
+	0: (*cpu).add,
+	1: func(c *cpu, a, b uint64, width int) uint64 { return c.logic(a|b, width) },
+	2: (*cpu).adc,
+	3: (*cpu).sbb,
+	4: func(c *cpu, a, b uint64, width int) uint64 { return c.logic(a&b, width) },
+	5: (*cpu).sub,
+	6: func(c *cpu, a, b uint64, width int) uint64 { return c.logic(a^b, width) },
+	7: (*cpu).sub,
+}
+
+// aluCmp is the aluOps index of cmp, which only sets flags
+const aluCmp = 7
+
+// condition evaluates the condition code in the low nibble of the
+// Jcc/SETcc/CMOVcc opcodes.
+func (c *cpu) condition(cc byte) bool {
+	var result bool
+	switch cc >> 1 {
+	case 0: // o
+		result = c.flag(flagOF)
+	case 1: // b
+		result = c.flag(flagCF)
+	case 2: // e
+		result = c.flag(flagZF)
+	case 3: // be
+		result = c.flag(flagCF) || c.flag(flagZF)
+	case 4: // s
+		result = c.flag(flagSF)
+	case 5: // p
+		result = c.flag(flagPF)
+	case 6: // l
+		result = c.flag(flagSF) != c.flag(flagOF)
+	case 7: // le
+		result = c.flag(flagZF) || c.flag(flagSF) != c.flag(flagOF)
+	}
+
+	// Odd condition codes are the negated forms
+	if cc&1 == 1 {
+		return !result
+	}
+
+	return result
+}
+
+// divide divides the unsigned double width value hi:lo by divisor, as
+// div does, returning false when the divisor is zero or the quotient
+// doesn't fit in width bits.
+func divide(hi, lo, divisor uint64, width int) (uint64, uint64, bool) {
+	if divisor == 0 {
+		return 0, 0, false
+	}
+
+	if width == 64 {
+		if hi >= divisor {
+			return 0, 0, false
+		}
+
+		q, r := bits.Div64(hi, lo, divisor)
+		return q, r, true
+	}
+
+	dividend := hi<<width | lo
+	q := dividend / divisor
+	if q > widthMask(width) {
+		return 0, 0, false
+	}
+
+	return q, dividend % divisor, true
+}
+
+// divideSigned is divide for idiv: the quotient is truncated toward
+// zero, the remainder has the sign of the dividend and the quotient
+// must fit in width bits as a signed value, which INT_MIN / -1 doesn't.
+func divideSigned(hi, lo, divisor uint64, width int) (uint64, uint64, bool) {
+	if width < 64 {
+		dividend := int64(signExtend(hi<<width|lo, 2*width))
+		d := int64(signExtend(divisor, width))
+		if d == 0 {
+			return 0, 0, false
+		}
+
+		// Go defines MinInt64 / -1 as MinInt64, which the range check
+		// rejects
+		q := dividend / d
+		if q < -int64(signBit(width)) || q > int64(signBit(width)-1) {
+			return 0, 0, false
+		}
+
+		return uint64(q) & widthMask(width), uint64(dividend%d) & widthMask(width), true
+	}
+
+	// Divide the magnitudes and apply the signs afterwards
+	negative := int64(hi) < 0
+	if negative {
+		hi, lo = ^hi, -lo
+		if lo == 0 {
+			hi++
+		}
+	}
+
+	negativeDivisor := int64(divisor) < 0
+	if negativeDivisor {
+		divisor = -divisor
+	}
+
+	q, r, ok := divide(hi, lo, divisor, 64)
+	if !ok {
+		return 0, 0, false
+	}
+
+	if negative != negativeDivisor {
+		if q > signBit(64) {
+			return 0, 0, false
+		}
+
+		q = -q
+	} else if q >= signBit(64) {
+		return 0, 0, false
+	}
+
+	if negative {
+		r = -r
+	}
+
+	return q, r, true
+}
+
+// shiftNames are indexed by the /digit of the 0xC0, 0xC1 and 0xD0-0xD3
+// shift and rotate groups, /6 being an alias of shl
+var shiftNames = [8]string{"rol", "ror", "rcl", "rcr", "shl", "shr", "sal", "sar"}
+
+// shift shifts or rotates v by count as the /digit op selects. The
+// count is masked to 5 bits, or 6 for 64 bit operands, and a masked
+// count of zero changes neither the operand nor the flags. OF is only
+// defined for a count of one but is set as the processor does for any
+// count; AF is left alone.
+func (c *cpu) shift(op byte, v, count uint64, width int) uint64 {
+	if width == 64 {
+		count &= 0x3F
+	} else {
+		count &= 0x1F
+	}
+
+	if count == 0 {
+		return v
+	}
+
+	mask := widthMask(width)
+	v &= mask
+	msb := func(x uint64) bool { return x&signBit(width) != 0 }
+	var result uint64
+	switch op {
+	case 0: // rol
+		n := count % uint64(width)
+		result = (v<<n | v>>(uint64(width)-n)) & mask
+		c.setFlag(flagCF, result&1 != 0)
+		c.setFlag(flagOF, msb(result) != (result&1 != 0))
+		return result
+	case 1: // ror
+		n := count % uint64(width)
+		result = (v>>n | v<<(uint64(width)-n)) & mask
+		c.setFlag(flagCF, msb(result))
+		c.setFlag(flagOF, msb(result) != msb(result<<1))
+		return result
+	case 2, 3: // rcl, rcr rotate through CF, a width+1 bit rotation
+		n := count % uint64(width+1)
+		carry := c.carry()
+		for ; n > 0; n-- {
+			if op == 2 {
+				out := v >> (width - 1) & 1
+				v = (v<<1 | carry) & mask
+				carry = out
+			} else {
+				out := v & 1
+				v = v>>1 | carry<<(width-1)
+				carry = out
+			}
+		}
+
+		c.setFlag(flagCF, carry != 0)
+		if op == 2 {
+			c.setFlag(flagOF, msb(v) != (carry != 0))
+		} else {
+			c.setFlag(flagOF, msb(v) != msb(v<<1))
+		}
+		return v
+	case 4, 6: // shl
+		result = v << count & mask
+		c.setFlag(flagCF, count <= uint64(width) && v>>(uint64(width)-count)&1 != 0)
+		c.setFlag(flagOF, msb(result) != c.flag(flagCF))
+	case 5: // shr
+		result = v >> count
+		c.setFlag(flagCF, v>>(count-1)&1 != 0)
+		c.setFlag(flagOF, msb(v))
+	case 7: // sar
+		result = uint64(int64(signExtend(v, width))>>count) & mask
+		c.setFlag(flagCF, int64(signExtend(v, width))>>(count-1)&1 != 0)
+		c.setFlag(flagOF, false)
+	}
+
+	c.setResultFlags(result, width)
+	return result
+}
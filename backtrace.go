@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxBacktraceFrames bounds the walk in case the frame pointers form a
+// cycle that still looks valid
+const maxBacktraceFrames = 1024
+
+var errCorruptFrame = errors.New("corrupt frame pointer")
+
+// backtrace returns the return addresses of the active calls, innermost
+// first, starting with rip. It follows the chain of saved rbp and
+// return address pairs pushed by functions compiled with frame
+// pointers, stopping at the entry function's return to the exit
+// address or a zero rbp. The frames found so far are returned along
+// with errCorruptFrame when a saved rbp doesn't point further up the
+// stack.
+func (c *cpu) backtrace() ([]uint64, error) {
+	ip := c.regfile.get(rip)
+	frames := []uint64{ip}
+
+	// In the prologue rbp still belongs to the caller, and the return
+	// address is found relative to rsp instead
+	sp := c.regfile.get(rsp)
+	text, _, _ := disassemble(c.codeAt(ip), ip)
+	switch text {
+	case "push rbp":
+		frames = append(frames, readBytes(c.mem, sp, 8))
+	case "mov rbp, rsp":
+		frames = append(frames, readBytes(c.mem, sp+8, 8))
+	}
+
+	if frames[len(frames)-1] == c.exitTrampoline() {
+		return frames[:len(frames)-1], nil
+	}
+
+	bottom := c.stackTop() - c.stackSize
+	rbpValue := c.regfile.get(rbp)
+	for len(frames) < maxBacktraceFrames && rbpValue != 0 {
+		if rbpValue < bottom || rbpValue > c.stackTop()-16 || rbpValue%8 != 0 {
+			return frames, errCorruptFrame
+		}
+
+		returnAddress := readBytes(c.mem, rbpValue+8, 8)
+		if returnAddress == c.exitTrampoline() {
+			return frames, nil
+		}
+
+		if returnAddress >= uint64(len(c.mem)) {
+			return frames, errCorruptFrame
+		}
+
+		frames = append(frames, returnAddress)
+		next := readBytes(c.mem, rbpValue, 8)
+		// Callers' frames are always further up the stack
+		if next <= rbpValue {
+			return frames, errCorruptFrame
+		}
+
+		rbpValue = next
+	}
+
+	return frames, nil
+}
+
+func (c *cpu) printBacktrace(w io.Writer) {
+	frames, err := c.backtrace()
+	symbols := c.symbolTable()
+	for i, address := range frames {
+		line := fmt.Sprintf("#%-3d 0x%x", i, address)
+		if name, ok := symbols.lookup(address); ok {
+			line += " in " + name
+		}
+
+		fmt.Fprintln(w, line)
+	}
+
+	if err != nil {
+		fmt.Fprintf(w, "Backtrace stopped: %s\n", err)
+	}
+}
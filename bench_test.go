@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+// benchLoop counts rcx down from 1000, adding to rax on the way, then
+// returns: 3 instructions a pass
+var benchLoop = []byte{
+	0xb9, 0xe8, 0x03, 0x00, 0x00, // mov ecx, 1000
+	0x48, 0x83, 0xc0, 0x01, // add rax, 1
+	0x48, 0x83, 0xe9, 0x01, // sub rcx, 1
+	0x75, 0xf6, // jne -10
+	0xc3, // ret
+}
+
+// benchCPU returns a machine with benchLoop at 0x1000, called so that it
+// returns to the exit trampoline
+func benchCPU() *cpu {
+	c := fuzzCPU()
+	c.regfile.set(rax, 0)
+	copy(c.mem[0x1000:], benchLoop)
+	return c
+}
+
+// runBenchLoop runs benchLoop b.N times, reporting the instructions
+// executed per second
+func runBenchLoop(b *testing.B, c *cpu) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.regfile.set(rsp, c.entryStackPointer())
+		c.push(c.exitTrampoline())
+		c.regfile.set(rip, 0x1000)
+		c.loop()
+	}
+
+	b.ReportMetric(float64(c.retired)/b.Elapsed().Seconds(), "insns/s")
+	if c.regfile.get(rax) != uint64(1000*b.N) {
+		b.Fatalf("rax %d after %d runs, want %d", c.regfile.get(rax), b.N, 1000*b.N)
+	}
+}
+
+func BenchmarkLoop(b *testing.B) {
+	runBenchLoop(b, benchCPU())
+}
+
+// BenchmarkHooks compares the loop without hooks, which costs execute a
+// nil check, with one pre- and one post-instruction hook that do
+// nothing but count
+func BenchmarkHooks(b *testing.B) {
+	b.Run("none", func(b *testing.B) {
+		runBenchLoop(b, benchCPU())
+	})
+
+	b.Run("pre and post", func(b *testing.B) {
+		c := benchCPU()
+		var pre, post uint64
+		c.addPreHook(func(c *cpu, ev *instructionEvent) hookAction {
+			pre++
+			return hookContinue
+		})
+		c.addPostHook(func(c *cpu, ev *instructionEvent) {
+			post++
+		})
+
+		runBenchLoop(b, c)
+		if pre != c.retired || post != c.retired {
+			b.Fatalf("hooks ran %d and %d times for %d instructions", pre, post, c.retired)
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type breakpoint struct {
+	id      int
+	address uint64
+	// hits counts every time execution reached the breakpoint, including
+	// the ones ignored
+	hits uint64
+	// ignore is how many more hits continue without stopping
+	ignore uint64
+	// condition, when set, is evaluated whenever execution reaches the
+	// breakpoint, which only counts as a hit when it holds
+	condition string
+}
+
+// breakpoints are checked before each instruction the debugger runs
+// rather than patched into memory, so the guest never sees them.
+type breakpoints struct {
+	byAddress map[uint64]*breakpoint
+	nextID    int
+
+	// stopped is the breakpoint execution is paused at, if any
+	stopped *breakpoint
+
+	// watchpoints share numbering with breakpoints
+	watchpoints []*watchpoint
+	// watchHit is the first watched access of the instruction being
+	// executed
+	watchHit *watchHit
+}
+
+func newBreakpoints() *breakpoints {
+	return &breakpoints{byAddress: map[uint64]*breakpoint{}, nextID: 1}
+}
+
+// add sets a breakpoint at address, returning the existing one if the
+// address already has a breakpoint.
+func (b *breakpoints) add(address uint64) (*breakpoint, bool) {
+	if bp, ok := b.byAddress[address]; ok {
+		return bp, false
+	}
+
+	bp := &breakpoint{id: b.nextID, address: address}
+	b.nextID++
+	b.byAddress[address] = bp
+	return bp, true
+}
+
+// remove deletes the breakpoint or watchpoint numbered id
+func (b *breakpoints) remove(id int) bool {
+	for i, wp := range b.watchpoints {
+		if wp.id == id {
+			b.watchpoints = append(b.watchpoints[:i], b.watchpoints[i+1:]...)
+			return true
+		}
+	}
+
+	for address, bp := range b.byAddress {
+		if bp.id == id {
+			delete(b.byAddress, address)
+			if b.stopped == bp {
+				b.stopped = nil
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *breakpoints) at(address uint64) *breakpoint {
+	return b.byAddress[address]
+}
+
+// byID returns the breakpoint numbered id, which is not a watchpoint
+func (b *breakpoints) byID(id int) *breakpoint {
+	for _, bp := range b.byAddress {
+		if bp.id == id {
+			return bp
+		}
+	}
+
+	return nil
+}
+
+// list returns the breakpoints in the order they were set
+func (b *breakpoints) list() []*breakpoint {
+	list := make([]*breakpoint, 0, len(b.byAddress))
+	for _, bp := range b.byAddress {
+		list = append(list, bp)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// resolveLocation resolves a symbol name, falling back to the forms
+// accepted by resolveDebuggerValue.
+func (c *cpu) resolveLocation(location string) (uint64, error) {
+	if c.proc != nil {
+		if address, ok := c.proc.symbols[location]; ok {
+			return address, nil
+		}
+	}
+
+	return c.resolveDebuggerValue(location)
+}
+
+// debugStop says why debugContinue paused execution
+type debugStop struct {
+	breakpoint *breakpoint
+	watch      *watchHit
+	// budget is set when --max-instructions ran out
+	budget bool
+	// interrupted is set when Ctrl-C paused execution
+	interrupted bool
+}
+
+// debugContinue runs until a breakpoint or watchpoint is reached, the
+// program exits or faults, the instruction budget runs out, Ctrl-C is
+// pressed, or stop returns true after an instruction. The breakpoint
+// execution last stopped at is stepped over so that continuing after a
+// hit makes progress, and breakpoints with an ignore count only count
+// the hit. It returns why execution paused, if it was not for stop, the
+// number of instructions executed, and true when execution cannot
+// continue.
+func (c *cpu) debugContinue(w io.Writer, stop func() bool) (*debugStop, uint64, bool) {
+	// A Ctrl-C pressed at the prompt is not meant for this run
+	c.takeInterrupt()
+	executed := uint64(0)
+	for {
+		if c.takeInterrupt() {
+			return &debugStop{interrupted: true}, executed, false
+		}
+
+		bp := c.breakpoints.at(c.regfile.get(rip))
+		if bp != nil && bp != c.breakpoints.stopped && c.conditionHolds(w, bp) {
+			bp.hits++
+			if bp.ignore == 0 {
+				c.breakpoints.stopped = bp
+				return &debugStop{breakpoint: bp}, executed, false
+			}
+
+			bp.ignore--
+		}
+
+		if c.maxInstructions != 0 && executed >= c.maxInstructions {
+			return &debugStop{budget: true}, executed, false
+		}
+
+		c.breakpoints.watchHit = nil
+		done := c.debugStep(w)
+		executed++
+		if hit := c.breakpoints.watchHit; hit != nil {
+			c.breakpoints.watchHit = nil
+			return &debugStop{watch: hit}, executed, done
+		}
+
+		if done {
+			return nil, executed, true
+		}
+
+		if stop != nil && stop() {
+			return nil, executed, false
+		}
+	}
+}
+
+// conditionHolds evaluates the condition of bp, if it has one. A
+// condition that can't be evaluated, such as one reading unmapped
+// memory, stops execution so that it can be fixed.
+func (c *cpu) conditionHolds(w io.Writer, bp *breakpoint) bool {
+	if bp.condition == "" {
+		return true
+	}
+
+	holds, err := c.evaluateCondition(bp.condition)
+	if err != nil {
+		fmt.Fprintf(w, "Error in the condition of breakpoint %d: %s\n", bp.id, err)
+		return true
+	}
+
+	return holds
+}
+
+// debugNext steps one instruction, running calls until they return to
+// the following instruction.
+func (c *cpu) debugNext(w io.Writer, intFormat string) {
+	ip := c.regfile.get(rip)
+	text, n, err := disassemble(c.codeAt(ip), ip)
+	if c.exited() || err != nil || !strings.HasPrefix(text, "call") {
+		executed := c.disassemblyLine(ip, c.symbolTable())
+		if !c.debugStep(w) {
+			fmt.Fprintln(w, executed)
+		}
+
+		return
+	}
+
+	// Recursive calls come back to the same address, but only the
+	// outermost one returns with the stack pointer as it was
+	returnAddress := ip + uint64(n)
+	sp := c.regfile.get(rsp)
+	executed := c.disassemblyLine(ip, c.symbolTable())
+	stop, _, done := c.debugContinue(w, func() bool {
+		return c.regfile.get(rip) == returnAddress && c.regfile.get(rsp) >= sp
+	})
+	if stop != nil {
+		c.reportStop(w, stop, intFormat)
+	} else if !done {
+		fmt.Fprintln(w, executed)
+	}
+}
+
+// debugFinish runs until a ret leaves the current function, which is
+// when the stack pointer rises above where it was, and reports the
+// value returned in rax.
+func (c *cpu) debugFinish(w io.Writer, intFormat string) {
+	sp := c.regfile.get(rsp)
+	last := c.regfile.get(rip)
+	returned := false
+	stop, _, done := c.debugContinue(w, func() bool {
+		text, _, _ := disassemble(c.codeAt(last), last)
+		last = c.regfile.get(rip)
+		returned = text == "ret" && c.regfile.get(rsp) > sp
+		return returned
+	})
+
+	if stop != nil {
+		c.reportStop(w, stop, intFormat)
+		return
+	}
+
+	if returned && !done {
+		fmt.Fprintf(w, "Returned to "+intFormat+", rax = "+intFormat+"\n", c.regfile.get(rip), c.regfile.get(rax))
+	}
+}
+
+func (c *cpu) reportStop(w io.Writer, stop *debugStop, intFormat string) {
+	if stop.interrupted {
+		c.reportInterrupt(w, intFormat)
+		return
+	}
+
+	if stop.budget {
+		fmt.Fprintf(w, "Stopped at "+intFormat+" after %d instructions: --max-instructions exhausted\n", c.regfile.get(rip), c.maxInstructions)
+		return
+	}
+
+	if bp := stop.breakpoint; bp != nil {
+		fmt.Fprintf(w, "Breakpoint %d at "+intFormat+", hit %d time(s)\n", bp.id, bp.address, bp.hits)
+		return
+	}
+
+	hit := stop.watch
+	kind := "Watchpoint"
+	if !hit.watchpoint.write {
+		kind = "Read watchpoint"
+	}
+
+	fmt.Fprintf(w, "%s %d: rip "+intFormat+" accessed %d byte(s) at "+intFormat+"\n", kind, hit.watchpoint.id, hit.rip, hit.size, hit.address)
+	fmt.Fprintf(w, "Old value = "+intFormat+"\nNew value = "+intFormat+"\n", hit.old, hit.new)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// budgetExitStatus is the status of a run stopped by --max-insns or
+// --timeout, as timeout(1) exits with
+const budgetExitStatus = 124
+
+// timeoutGrace is how long a guest blocked in a syscall when --timeout
+// expires has to pause before the emulator exits anyway
+const timeoutGrace = time.Second
+
+// checkBudget raises a BudgetExceeded fault once executed reaches
+// --max-instructions or --timeout has expired
+func (c *cpu) checkBudget(executed uint64) {
+	if c.maxInstructions != 0 && executed >= c.maxInstructions {
+		c.budgetExceeded(fmt.Sprintf("instruction budget of %d exhausted", c.maxInstructions), executed)
+	}
+
+	if atomic.LoadInt32(&c.timedOut) != 0 {
+		c.budgetExceeded(fmt.Sprintf("timeout of %s expired", c.timeout), executed)
+	}
+}
+
+func (c *cpu) budgetExceeded(reason string, executed uint64) {
+	ip := c.regfile.get(rip)
+	panic(&fault{
+		kind:   budgetExceeded,
+		rip:    ip,
+		detail: fmt.Sprintf("%s in %s after %d instructions", reason, c.describeAddress(ip), executed),
+	})
+}
+
+// startTimeout arms --timeout for a run, returning the function that
+// disarms it. A guest blocked in a syscall can't be stopped between
+// instructions, so it is abandoned if it hasn't stopped timeoutGrace
+// after the deadline.
+func (c *cpu) startTimeout() func() {
+	if c.timeout == 0 {
+		return func() {}
+	}
+
+	var stopped int32
+	deadline := time.AfterFunc(c.timeout, func() {
+		atomic.StoreInt32(&c.timedOut, 1)
+		time.Sleep(timeoutGrace)
+		if atomic.LoadInt32(&stopped) == 0 {
+			log.Printf("Timeout of %s expired while the program was blocked", c.timeout)
+			c.abandon(budgetExitStatus)
+		}
+	})
+
+	return func() {
+		atomic.StoreInt32(&stopped, 1)
+		deadline.Stop()
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// callTracer prints only calls and returns, indented by call depth so
+// that the trace reads as the program's call tree. It keeps the return
+// address of every call it has seen; a ret to anywhere else, such as a
+// jump made with push and ret, is flagged as unmatched.
+type callTracer struct {
+	w *bufio.Writer
+	// f is closed with the tracer unless the trace goes to stderr
+	f       *os.File
+	returns []uint64
+	symbols *symbolTable
+	loaded  bool
+}
+
+func newCallTracer(filename string) (*callTracer, error) {
+	t := &callTracer{}
+	if filename == "" {
+		t.w = bufio.NewWriter(os.Stderr)
+		return t, nil
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	t.f = f
+	t.w = bufio.NewWriter(f)
+	return t, nil
+}
+
+func (t *callTracer) after(c *cpu, ev *instructionEvent) {
+	call := false
+	switch ev.opcode {
+	case 0xE8:
+		call = true
+	case 0xFF:
+		// Only the call forms of group 5
+		if text, _, _ := disassemble(ev.code, ev.rip); !strings.HasPrefix(text, "call") {
+			return
+		}
+
+		call = true
+	case 0xC2, 0xC3:
+	default:
+		return
+	}
+
+	// The program is loaded after the tracer is registered
+	if !t.loaded {
+		t.symbols = c.symbolTable()
+		t.loaded = true
+	}
+
+	if call {
+		t.printf("call %s from %s", t.name(c.regfile.get(rip)), t.name(ev.rip))
+		t.returns = append(t.returns, ev.rip+uint64(len(ev.code)))
+	} else {
+		t.ret(c, ev)
+	}
+}
+
+// ret pops the calls up to the one returned to. The entry function's
+// return to the exit trampoline matches the call that started the
+// program.
+func (t *callTracer) ret(c *cpu, ev *instructionEvent) {
+	target := c.regfile.get(rip)
+	result := c.regfile.get(rax)
+	for depth := len(t.returns) - 1; depth >= 0; depth-- {
+		if t.returns[depth] == target {
+			t.returns = t.returns[:depth]
+			t.printf("ret from %s = 0x%x", t.function(ev.rip), result)
+			return
+		}
+	}
+
+	if len(t.returns) == 0 && target == c.exitTrampoline() {
+		t.printf("ret from %s = 0x%x, exiting", t.function(ev.rip), result)
+		return
+	}
+
+	t.printf("ret from %s to %s without a matching call", t.function(ev.rip), t.name(target))
+}
+
+// name describes address as name+0xoffset, or in hex outside all
+// symbols
+func (t *callTracer) name(address uint64) string {
+	if name, ok := t.symbols.lookup(address); ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%x", address)
+}
+
+// function names the symbol address is in, without the offset
+func (t *callTracer) function(address uint64) string {
+	name := t.name(address)
+	if i := strings.Index(name, "+"); i >= 0 {
+		return name[:i]
+	}
+
+	return name
+}
+
+func (t *callTracer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(t.w, "%s%s\n", strings.Repeat("  ", len(t.returns)), fmt.Sprintf(format, args...))
+	// Keep the trace in step with the program's own output
+	if t.f == nil {
+		t.w.Flush()
+	}
+}
+
+func (t *callTracer) close() error {
+	err := t.w.Flush()
+	if t.f == nil {
+		return err
+	}
+
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// instructionCase is one case of tests/cases/*.json: machine code, the
+// state to run it from and the state it must leave, as recorded on real
+// hardware by tests/cases/generate.py. Numbers are hex strings, as in
+// stateDump.
+type instructionCase struct {
+	Name string `json:"name"`
+	// Asm is the source of Code, for readers
+	Asm       string            `json:"asm"`
+	Code      string            `json:"code"`
+	Registers map[string]string `json:"registers"`
+	RFlags    string            `json:"rflags"`
+	Memory    []memoryDump      `json:"memory"`
+	Expect    caseState         `json:"expect"`
+}
+
+// caseState is the expected final state of a case. Only the rflags bits
+// in FlagsMask are compared, leaving out flags the instructions leave
+// undefined, and only the memory listed.
+type caseState struct {
+	Registers map[string]string `json:"registers"`
+	RFlags    string            `json:"rflags"`
+	FlagsMask string            `json:"flagsMask"`
+	Memory    []memoryDump      `json:"memory"`
+}
+
+// caseCodeAddress is where the code of a case is run from
+const caseCodeAddress = defaultRawBase
+
+// maxCaseInstructions stops cases that loop forever
+const maxCaseInstructions = 10000
+
+// TestInstructionCases runs every case of tests/cases/*.json, each
+// group of cases a file
+func TestInstructionCases(t *testing.T) {
+	filenames, err := filepath.Glob("tests/cases/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var cases []instructionCase
+		if err := json.Unmarshal(data, &cases); err != nil {
+			t.Fatalf("%s: %s", filename, err)
+		}
+
+		group := strings.TrimSuffix(filepath.Base(filename), ".json")
+		for _, ic := range cases {
+			ic := ic
+			t.Run(group+"/"+ic.Name, func(t *testing.T) {
+				diffs, err := ic.run()
+				if err != nil {
+					t.Fatalf("%s: %s", ic.Asm, err)
+				}
+
+				for _, diff := range diffs {
+					t.Errorf("%s: %s", ic.Asm, diff)
+				}
+			})
+		}
+	}
+}
+
+// run executes the case on a fresh cpu, returning how the final state
+// differs from the expected one.
+func (ic *instructionCase) run() ([]string, error) {
+	code, err := hex.DecodeString(ic.Code)
+	if err != nil {
+		return nil, fmt.Errorf("invalid code: %s", err)
+	}
+
+	c := newCPU(0x400000 * 10)
+	for name, value := range ic.Registers {
+		reg, err := caseRegister(name)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+
+		c.regfile.set(reg, v)
+	}
+
+	flags, err := strconv.ParseUint(ic.RFlags, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rflags: %s", err)
+	}
+
+	c.regfile.set(rflags, flags)
+	for _, m := range ic.Memory {
+		buf, data, err := c.caseMemory(m)
+		if err != nil {
+			return nil, err
+		}
+
+		copy(buf, data)
+	}
+
+	end := caseCodeAddress + uint64(len(code))
+	copy(c.mem[caseCodeAddress:], code)
+	c.regfile.set(rip, caseCodeAddress)
+	for executed := 0; c.regfile.get(rip) != end; executed++ {
+		ip := c.regfile.get(rip)
+		if ip < caseCodeAddress || ip > end {
+			return nil, fmt.Errorf("jumped to 0x%x, outside the code", ip)
+		}
+
+		if executed == maxCaseInstructions {
+			return nil, fmt.Errorf("still running after %d instructions", executed)
+		}
+
+		if _, err := c.executeCode(c.mem[ip:end]); err != nil {
+			return nil, err
+		}
+	}
+
+	return ic.compare(&c)
+}
+
+func (ic *instructionCase) compare(c *cpu) ([]string, error) {
+	var diffs []string
+	var names []string
+	for name := range ic.Expect.Registers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		reg, err := caseRegister(name)
+		if err != nil {
+			return nil, err
+		}
+
+		want, err := strconv.ParseUint(ic.Expect.Registers[name], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expected value for %s: %s", name, err)
+		}
+
+		if got := c.regfile.get(reg); got != want {
+			diffs = append(diffs, fmt.Sprintf("%s = 0x%x, want 0x%x", name, got, want))
+		}
+	}
+
+	want, err := strconv.ParseUint(ic.Expect.RFlags, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected rflags: %s", err)
+	}
+
+	mask, err := strconv.ParseUint(ic.Expect.FlagsMask, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flags mask: %s", err)
+	}
+
+	if got := c.regfile.get(rflags) & mask; got != want {
+		diffs = append(diffs, fmt.Sprintf("rflags = %s, want %s", formatFlags(got), formatFlags(want)))
+	}
+
+	for _, m := range ic.Expect.Memory {
+		buf, data, err := c.caseMemory(m)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, b := range data {
+			if buf[i] != b {
+				diffs = append(diffs, fmt.Sprintf("memory at %s+%d = 0x%02x, want 0x%02x", m.Address, i, buf[i], b))
+			}
+		}
+	}
+
+	return diffs, nil
+}
+
+func caseRegister(name string) (register, error) {
+	for reg, n := range registerMap {
+		if n == name {
+			return reg, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown register %q", name)
+}
+
+// caseMemory returns the guest memory m describes along with the bytes
+// it holds
+func (c *cpu) caseMemory(m memoryDump) ([]byte, []byte, error) {
+	address, err := strconv.ParseUint(m.Address, 0, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid address %q: %s", m.Address, err)
+	}
+
+	data, err := hex.DecodeString(m.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid bytes at %s: %s", m.Address, err)
+	}
+
+	buf, ok := c.guestBuffer(address, uint64(len(data)))
+	if !ok {
+		return nil, nil, fmt.Errorf("memory at %s is out of bounds", m.Address)
+	}
+
+	return buf, data, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import "time"
+
+const (
+	clockRealtime        = 0
+	clockMonotonic       = 1
+	clockProcessCPUTime  = 2
+	clockThreadCPUTime   = 3
+	clockMonotonicRaw    = 4
+	clockRealtimeCoarse  = 5
+	clockMonotonicCoarse = 6
+	clockBoottime        = 7
+)
+
+// fixedTime is the wall clock time, in seconds since the epoch, that
+// --deterministic-time reports. Monotonic clocks stay at zero.
+const fixedTime = 1700000000
+
+// hostStart is the origin of the monotonic clocks
+var hostStart = time.Now()
+
+// clockTime returns the time of clock as seconds and nanoseconds, or
+// false for clocks that don't exist.
+func (c *cpu) clockTime(clock uint64) (int64, int64, bool) {
+	var realtime bool
+	switch clock {
+	case clockRealtime, clockRealtimeCoarse:
+		realtime = true
+	case clockMonotonic, clockMonotonicRaw, clockMonotonicCoarse, clockBoottime,
+		clockProcessCPUTime, clockThreadCPUTime:
+	default:
+		return 0, 0, false
+	}
+
+	if c.deterministicTime {
+		if realtime {
+			return fixedTime, 0, true
+		}
+
+		return 0, 0, true
+	}
+
+	if realtime {
+		now := time.Now()
+		return now.Unix(), int64(now.Nanosecond()), true
+	}
+
+	elapsed := time.Since(hostStart)
+	return int64(elapsed / time.Second), int64(elapsed % time.Second), true
+}
+
+// sysClockGettime fills in the struct timespec at rsi, two 64 bit
+// fields: seconds and nanoseconds.
+func (c *cpu) sysClockGettime() uint64 {
+	sec, nsec, ok := c.clockTime(c.regfile.get(rdi))
+	if !ok {
+		return errno(errnoEINVAL)
+	}
+
+	addr := c.regfile.get(rsi)
+	if _, ok := c.guestBuffer(addr, 16); !ok {
+		return errno(errnoEFAULT)
+	}
+
+	c.writeMemory(addr, 8, uint64(sec))
+	c.writeMemory(addr+8, 8, uint64(nsec))
+	return 0
+}
+
+// sysGettimeofday fills in the struct timeval at rdi, seconds and
+// microseconds, and the obsolete struct timezone at rsi with zeros.
+// Either may be NULL.
+func (c *cpu) sysGettimeofday() uint64 {
+	tv, tz := c.regfile.get(rdi), c.regfile.get(rsi)
+	if _, ok := c.guestBuffer(tv, 16); tv != 0 && !ok {
+		return errno(errnoEFAULT)
+	}
+
+	if _, ok := c.guestBuffer(tz, 8); tz != 0 && !ok {
+		return errno(errnoEFAULT)
+	}
+
+	if tv != 0 {
+		sec, nsec, _ := c.clockTime(clockRealtime)
+		c.writeMemory(tv, 8, uint64(sec))
+		c.writeMemory(tv+8, 8, uint64(nsec/1000))
+	}
+
+	if tz != 0 {
+		c.writeMemory(tz, 8, 0)
+	}
+
+	return 0
+}
+
+// tsc is the time stamp counter: the number of instructions executed,
+// so that runs are reproducible, or with --rdtsc-host nanoseconds of
+// host time since the emulator started.
+func (c *cpu) tsc() uint64 {
+	if c.hostTSC && !c.deterministicTime {
+		return uint64(time.Since(hostStart))
+	}
+
+	return c.retired
+}
+
+// rdtsc splits the counter into edx:eax, clearing the upper halves of
+// rax and rdx
+func execRdtsc(c *cpu, ctx *decodeContext) {
+	tsc := c.tsc()
+	c.regfile.set(rax, tsc&0xFFFFFFFF)
+	c.regfile.set(rdx, tsc>>32)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// setCodeRange records the span of the program's executable segments,
+// where writes are self-modifying code.
+func (c *cpu) setCodeRange() {
+	c.codeStart, c.codeEnd = 0, 0
+	if c.proc == nil {
+		return
+	}
+
+	for _, seg := range c.proc.segments {
+		if seg.flags&elf.PF_X == 0 {
+			continue
+		}
+
+		if c.codeEnd == 0 || seg.address < c.codeStart {
+			c.codeStart = seg.address
+		}
+
+		if end := seg.address + seg.memsz; end > c.codeEnd {
+			c.codeEnd = end
+		}
+	}
+}
+
+// writesCode reports whether a write of size bytes at address touches
+// the program's code
+func (c *cpu) writesCode(address uint64, size int) bool {
+	return address < c.codeEnd && address+uint64(size) > c.codeStart
+}
+
+// codeWritten notes a write into the program's code. Anything caching
+// decoded instructions must drop them when codeVersion changes.
+func (c *cpu) codeWritten(address uint64) {
+	c.codeVersion++
+	if c.codeWriteWarnings != nil {
+		fmt.Fprintf(c.codeWriteWarnings, "self-modifying write at 0x%x (rip 0x%x)\n", address, c.regfile.get(rip))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// opcodeCoverage records which opcodes a run executed, as step returns
+// them: one-byte opcodes, and 0x0F00 | the second byte for the two-byte
+// map. --opcode-coverage merges them into a file shared by the runs of a
+// test corpus, one formatOpcode per line, which --coverage-report then
+// compares against the opcodes that have handlers.
+type opcodeCoverage struct {
+	filename string
+	executed map[uint16]bool
+}
+
+func newOpcodeCoverage(filename string) *opcodeCoverage {
+	return &opcodeCoverage{filename: filename, executed: map[uint16]bool{}}
+}
+
+func (o *opcodeCoverage) record(c *cpu, ev *instructionEvent) {
+	o.executed[ev.opcode] = true
+}
+
+// readCoverageFile reads the opcodes listed in filename, none when it
+// doesn't exist yet
+func readCoverageFile(filename string) (map[uint16]bool, error) {
+	opcodes := map[uint16]bool{}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return opcodes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var opcode uint64
+		for _, field := range strings.Fields(scanner.Text()) {
+			b, err := strconv.ParseUint(field, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid opcode %q", filename, line, scanner.Text())
+			}
+
+			opcode = opcode<<8 | b
+		}
+
+		opcodes[uint16(opcode)] = true
+	}
+
+	return opcodes, scanner.Err()
+}
+
+// sortedOpcodes lists the opcodes in a set in increasing order
+func sortedOpcodes(set map[uint16]bool) []uint16 {
+	var opcodes []uint16
+	for opcode := range set {
+		opcodes = append(opcodes, opcode)
+	}
+
+	sort.Slice(opcodes, func(i, j int) bool { return opcodes[i] < opcodes[j] })
+	return opcodes
+}
+
+// write merges the opcodes of this run into the file
+func (o *opcodeCoverage) write() error {
+	opcodes, err := readCoverageFile(o.filename)
+	if err != nil {
+		return err
+	}
+
+	for opcode := range o.executed {
+		opcodes[opcode] = true
+	}
+
+	var b strings.Builder
+	for _, opcode := range sortedOpcodes(opcodes) {
+		fmt.Fprintln(&b, formatOpcode(opcode))
+	}
+
+	return os.WriteFile(o.filename, []byte(b.String()), 0644)
+}
+
+// implementedOpcodes are the opcodes with a handler, two-byte ones in
+// any of their mandatory prefix tables
+func implementedOpcodes() map[uint16]bool {
+	opcodes := map[uint16]bool{}
+	for op := range oneByteOpcodes {
+		// 0x0F escapes to the two-byte map rather than being an
+		// instruction of its own
+		if oneByteOpcodes[op].exec != nil && op != 0x0F {
+			opcodes[uint16(op)] = true
+		}
+	}
+
+	for _, table := range []*[256]opcode{&twoByteOpcodes, &twoByteOpcodes66, &twoByteOpcodesF3, &twoByteOpcodesF2} {
+		for op := range table {
+			if table[op].exec != nil {
+				opcodes[0x0F00|uint16(op)] = true
+			}
+		}
+	}
+
+	return opcodes
+}
+
+// coverageReport lists the implemented opcodes that the coverage file
+// doesn't, which no test executes
+func coverageReport(w io.Writer, filename string) error {
+	executed, err := readCoverageFile(filename)
+	if err != nil {
+		return err
+	}
+
+	implemented := implementedOpcodes()
+	var untested []uint16
+	for _, opcode := range sortedOpcodes(implemented) {
+		if !executed[opcode] {
+			untested = append(untested, opcode)
+		}
+	}
+
+	for _, opcode := range untested {
+		fmt.Fprintf(w, "%-12s %s\n", formatOpcode(opcode), opcodeName(opcode))
+	}
+
+	fmt.Fprintf(w, "%d of %d implemented opcodes executed\n", len(implemented)-len(untested), len(implemented))
+	return nil
+}
@@ -0,0 +1,86 @@
+//go:build opcodecoverage
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestCoverageReport checks the report of the coverage file
+// $OPCODE_COVERAGE, which tests/run.sh collects from its programs:
+// every program runs ret and syscall, and the opcodes listed as
+// untested are exactly the implemented ones the file lacks. Run it
+// with go test -tags opcodecoverage.
+func TestCoverageReport(t *testing.T) {
+	filename := os.Getenv("OPCODE_COVERAGE")
+	if filename == "" {
+		t.Skip("OPCODE_COVERAGE names no coverage file")
+	}
+
+	executed, err := readCoverageFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	implemented := implementedOpcodes()
+	for _, opcode := range []uint16{0xC3, 0x0F05} {
+		if !executed[opcode] {
+			t.Errorf("%s (%s) was not executed", formatOpcode(opcode), opcodeName(opcode))
+		}
+	}
+
+	tested := 0
+	for opcode := range executed {
+		if !implemented[opcode] {
+			t.Errorf("%s was executed without a handler", formatOpcode(opcode))
+			continue
+		}
+
+		tested++
+	}
+
+	var report bytes.Buffer
+	if err := coverageReport(&report, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(report.String(), "\n"), "\n")
+	summary := fmt.Sprintf("%d of %d implemented opcodes executed", tested, len(implemented))
+	if lines[len(lines)-1] != summary {
+		t.Errorf("summary %q, want %q", lines[len(lines)-1], summary)
+	}
+
+	untested := lines[:len(lines)-1]
+	if len(untested) != len(implemented)-tested {
+		t.Errorf("%d opcodes listed as untested, want %d", len(untested), len(implemented)-tested)
+	}
+
+	for _, line := range untested {
+		opcode, ok := parseReportOpcode(line)
+		if !ok || !implemented[opcode] || executed[opcode] {
+			t.Errorf("%q listed as untested", line)
+		}
+	}
+}
+
+// parseReportOpcode reads the opcode a line of the report starts with,
+// one or two bytes as formatOpcode writes them
+func parseReportOpcode(line string) (uint16, bool) {
+	var opcode uint16
+	fields := strings.Fields(line)
+	for i := 0; i < len(fields) && i < 2 && strings.HasPrefix(fields[i], "0x"); i++ {
+		b, err := strconv.ParseUint(fields[i], 0, 8)
+		if err != nil {
+			return 0, false
+		}
+
+		opcode = opcode<<8 | uint16(b)
+	}
+
+	return opcode, len(fields) > 0 && strings.HasPrefix(fields[0], "0x")
+}
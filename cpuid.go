@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// cpuidVendor is the vendor string of leaf 0, returned in ebx, edx and
+// ecx in that order
+const cpuidVendor = "GenuineIntel"
+
+// cpuidSignature is the leaf 1 eax of an Ivy Bridge: family 6, model
+// 0x3a, stepping 9
+const cpuidSignature = 0x000306a9
+
+const (
+	cpuidMaxBasicLeaf    = 7
+	cpuidMaxExtendedLeaf = 0x80000001
+)
+
+// cpuidFeature locates a feature flag: bit of reg in the output of leaf
+// (with ecx zero for leaf 7).
+type cpuidFeature struct {
+	leaf uint32
+	reg  register
+	bit  uint
+}
+
+var cpuidFeatures = map[string]cpuidFeature{
+	"fpu":     {1, rdx, 0},
+	"tsc":     {1, rdx, 4},
+	"cx8":     {1, rdx, 8},
+	"cmov":    {1, rdx, 15},
+	"mmx":     {1, rdx, 23},
+	"fxsr":    {1, rdx, 24},
+	"sse":     {1, rdx, 25},
+	"sse2":    {1, rdx, 26},
+	"sse3":    {1, rcx, 0},
+	"ssse3":   {1, rcx, 9},
+	"cx16":    {1, rcx, 13},
+	"sse4.1":  {1, rcx, 19},
+	"sse4.2":  {1, rcx, 20},
+	"popcnt":  {1, rcx, 23},
+	"avx":     {1, rcx, 28},
+	"bmi1":    {7, rbx, 3},
+	"avx2":    {7, rbx, 5},
+	"bmi2":    {7, rbx, 8},
+	"erms":    {7, rbx, 9},
+	"lahf_lm": {0x80000001, rcx, 0},
+	"syscall": {0x80000001, rdx, 11},
+	"nx":      {0x80000001, rdx, 20},
+	"lm":      {0x80000001, rdx, 29},
+}
+
+// defaultCPUIDFeatures is the x86-64 baseline every 64 bit processor
+// has
+var defaultCPUIDFeatures = []string{"fpu", "tsc", "cx8", "cmov", "mmx", "fxsr", "sse", "sse2", "lahf_lm", "syscall", "nx", "lm"}
+
+func newCPUIDFeatures() map[string]bool {
+	features := map[string]bool{}
+	for _, name := range defaultCPUIDFeatures {
+		features[name] = true
+	}
+
+	return features
+}
+
+// parseCPUIDFeatures applies a comma separated list of features to
+// advertise, as name or +name, or to hide, as -name.
+func parseCPUIDFeatures(features map[string]bool, list string) error {
+	for _, name := range strings.Split(list, ",") {
+		enable := !strings.HasPrefix(name, "-")
+		name = strings.TrimLeft(name, "+-")
+		if _, ok := cpuidFeatures[name]; !ok {
+			var known []string
+			for name := range cpuidFeatures {
+				known = append(known, name)
+			}
+
+			sort.Strings(known)
+			return fmt.Errorf("Unknown CPUID feature %q, known features: %s", name, strings.Join(known, ", "))
+		}
+
+		features[name] = enable
+	}
+
+	return nil
+}
+
+// cpuid returns eax, ebx, ecx and edx for leaf and subleaf. Leaves
+// beyond the ones implemented return zeros.
+func (c *cpu) cpuid(leaf, subleaf uint32) [4]uint32 {
+	var out [4]uint32
+	switch leaf {
+	case 0:
+		out[0] = cpuidMaxBasicLeaf
+		out[1] = uint32(readBytes([]byte(cpuidVendor), 0, 4))
+		out[3] = uint32(readBytes([]byte(cpuidVendor), 4, 4))
+		out[2] = uint32(readBytes([]byte(cpuidVendor), 8, 4))
+		return out
+	case 1:
+		// 64 byte clflush lines, one logical processor
+		out[0] = cpuidSignature
+		out[1] = 0x00010800
+	case 7:
+		if subleaf != 0 {
+			return out
+		}
+	case 0x80000000:
+		out[0] = cpuidMaxExtendedLeaf
+		return out
+	case 0x80000001:
+	default:
+		return out
+	}
+
+	for name, f := range cpuidFeatures {
+		if f.leaf == leaf && c.cpuidFeatures[name] {
+			out[cpuidOutput(f.reg)] |= 1 << f.bit
+		}
+	}
+
+	return out
+}
+
+// cpuidOutput is the index of reg in the result of cpuid
+func cpuidOutput(reg register) int {
+	switch reg {
+	case rbx:
+		return 1
+	case rcx:
+		return 2
+	case rdx:
+		return 3
+	}
+
+	return 0
+}
+
+// cpuid writes zero extended 32 bit results, as any 32 bit register
+// write does
+func execCpuid(c *cpu, ctx *decodeContext) {
+	out := c.cpuid(uint32(c.regfile.get(rax)), uint32(c.regfile.get(rcx)))
+	for i, reg := range []register{rax, rbx, rcx, rdx} {
+		c.regfile.set(reg, uint64(out[i]))
+	}
+}
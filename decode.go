@@ -0,0 +1,277 @@
+package main
+
+import "fmt"
+
+// decodeContext carries the state decoded so far for the instruction
+// being executed. ip points at the last byte consumed; handlers advance
+// it past their operands and step moves rip to ip+1 afterwards, unless
+// the handler jumped.
+type decodeContext struct {
+	start       uint64
+	ip          uint64
+	widthPrefix int
+	segment     segment
+	rex         byte
+	// mandatoryPrefix is 0x66, 0xF2 or 0xF3 when present, the latter
+	// two taking precedence, and selects among the SSE instructions
+	// sharing a 0x0F opcode
+	mandatoryPrefix byte
+	// lock is set by the LOCK prefix, which changes nothing with a
+	// single thread
+	lock bool
+	// addressSize32 is set by the 0x67 prefix, which truncates
+	// effective addresses to 32 bits
+	addressSize32 bool
+
+	opcode  byte
+	escaped bool
+
+	jumped bool
+	target uint64
+}
+
+// REX prefix bits
+const (
+	rexB = 1 << 0 // extends ModRM rm, SIB base and opcode registers
+	rexX = 1 << 1 // extends SIB index
+	rexR = 1 << 2 // extends ModRM reg
+	rexW = 1 << 3 // 64 bit operand size
+)
+
+// legacyPrefixes are the prefixes other than REX that are decoded:
+// operand and address size, LOCK, REPNE and REP, and the segment
+// overrides. cs, ds, es and ss overrides have no effect in 64 bit mode
+// but pad instructions such as "cs nopw".
+var legacyPrefixes = []byte{0x66, 0x67, 0xF0, 0xF2, 0xF3, 0x64, 0x65, 0x2E, 0x3E, 0x26, 0x36}
+
+func isREX(b byte) bool {
+	return b&0xF0 == 0x40
+}
+
+func isPrefix(b byte) bool {
+	if isREX(b) {
+		return true
+	}
+
+	for _, prefix := range legacyPrefixes {
+		if prefix == b {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rexBit returns 8 when the REX prefix has bit set, to be added to a 3
+// bit register number
+func rexBit(rex, bit byte) byte {
+	if rex&bit != 0 {
+		return 8
+	}
+
+	return 0
+}
+
+// opcodeRegister is the register encoded in the low bits of opcodes
+// such as push and bswap, base being the opcode for rax
+func (ctx *decodeContext) opcodeRegister(base byte) register {
+	return register(ctx.opcode - base + rexBit(ctx.rex, rexB))
+}
+
+// jump makes target the next instruction executed
+func (ctx *decodeContext) jump(target uint64) {
+	ctx.jumped = true
+	ctx.target = target
+}
+
+func (c *cpu) dispatch(table *[256]opcode, ctx *decodeContext) {
+	handler := table[ctx.opcode].exec
+	if handler == nil {
+		c.invalidOpcode(ctx)
+	}
+
+	handler(c, ctx)
+}
+
+// invalidOpcode raises the fault for an opcode with no handler
+func (c *cpu) invalidOpcode(ctx *decodeContext) {
+	panic(newInvalidOpcodeFault(ctx))
+}
+
+// invalidGroupOpcode raises the fault for an unhandled /digit of a
+// group opcode
+func (c *cpu) invalidGroupOpcode(ctx *decodeContext, digit byte) {
+	f := newInvalidOpcodeFault(ctx)
+	f.detail += fmt.Sprintf(" /%d", digit)
+	panic(f)
+}
+
+func newInvalidOpcodeFault(ctx *decodeContext) *fault {
+	if ctx.escaped && ctx.mandatoryPrefix != 0 {
+		return &fault{kind: invalidOpcode, rip: ctx.start, bytes: []byte{ctx.mandatoryPrefix, 0x0F, ctx.opcode}, detail: "two-byte opcode map"}
+	}
+
+	if ctx.escaped {
+		return &fault{kind: invalidOpcode, rip: ctx.start, bytes: []byte{0x0F, ctx.opcode}, detail: "two-byte opcode map"}
+	}
+
+	return &fault{kind: invalidOpcode, rip: ctx.start, bytes: []byte{ctx.opcode}, detail: "one-byte opcode map"}
+}
+
+type segment int
+
+const (
+	segmentDefault segment = iota
+	segmentFS
+	segmentGS
+)
+
+func (c *cpu) segmentBase(s segment) uint64 {
+	switch s {
+	case segmentFS:
+		return c.fsBase
+	case segmentGS:
+		return c.gsBase
+	}
+
+	return 0
+}
+
+type modrm struct {
+	mod byte
+	// reg and rm include the REX extension bits. digit is the reg
+	// field as encoded, which selects the operation of group opcodes.
+	reg   byte
+	rm    byte
+	digit byte
+
+	// highByte is set when a byte sized register rm names ah, ch, dh
+	// or bh, which is how 4-7 are encoded without a REX prefix
+	highByte bool
+
+	// address is the effective address of a memory operand (mod != 3)
+	address     uint64
+	ripRelative bool
+}
+
+// decodeModRM reads the ModRM byte following ctx.ip along with any SIB
+// byte and displacement, leaving ctx.ip on the last byte consumed.
+func (c *cpu) decodeModRM(ctx *decodeContext) modrm {
+	ctx.ip++
+	b := byte(c.fetch(ctx.ip, 1))
+	digit, rm := (b>>3)&0b111, b&0b111
+	m := modrm{
+		mod:   b >> 6,
+		reg:   digit + rexBit(ctx.rex, rexR),
+		rm:    rm + rexBit(ctx.rex, rexB),
+		digit: digit,
+
+		highByte: ctx.rex == 0 && rm >= 4,
+	}
+
+	if m.mod == 0b11 {
+		return m
+	}
+
+	// The SIB and rip-relative encodings are selected by the rm field
+	// before REX extension, so they also apply to r12 and r13
+	if rm == 0b100 { // SIB byte follows
+		ctx.ip++
+		sib := byte(c.fetch(ctx.ip, 1))
+		scale := uint64(1) << (sib >> 6)
+		index := register((sib>>3)&0b111 + rexBit(ctx.rex, rexX))
+		base := sib & 0b111
+
+		// An index of rsp means none; r12 can be an index
+		if index != rsp {
+			m.address = c.regfile.get(index) * scale
+		}
+
+		if base == byte(rbp) && m.mod == 0b00 {
+			m.address += uint64(int32(c.fetch(ctx.ip+1, 4)))
+			ctx.ip += 4
+		} else {
+			m.address += c.regfile.get(register(base + rexBit(ctx.rex, rexB)))
+		}
+	} else if rm == 0b101 && m.mod == 0b00 { // rip-relative
+		disp := uint64(int32(c.fetch(ctx.ip+1, 4)))
+		ctx.ip += 4
+		// Relative to the next instruction, which is only known once
+		// any immediate has been consumed; see immediate.
+		m.address = ctx.addressMask(ctx.ip+1+disp) + c.segmentBase(ctx.segment)
+		m.ripRelative = true
+		return m
+	} else {
+		m.address = c.regfile.get(register(m.rm))
+	}
+
+	switch m.mod {
+	case 0b01:
+		m.address += uint64(int8(c.fetch(ctx.ip+1, 1)))
+		ctx.ip++
+	case 0b10:
+		m.address += uint64(int32(c.fetch(ctx.ip+1, 4)))
+		ctx.ip += 4
+	}
+
+	m.address = ctx.addressMask(m.address) + c.segmentBase(ctx.segment)
+	return m
+}
+
+// addressMask truncates an effective address to the address size. The
+// sum of the full registers truncated is the sum of their low halves.
+func (ctx *decodeContext) addressMask(address uint64) uint64 {
+	if ctx.addressSize32 {
+		return address & 0xFFFFFFFF
+	}
+
+	return address
+}
+
+// immediate reads a little endian immediate of size bytes following
+// ctx.ip. m, when not nil, is the instruction's ModRM operand whose
+// rip-relative address must account for the immediate.
+func (c *cpu) immediate(ctx *decodeContext, m *modrm, size int) uint64 {
+	v := c.fetch(ctx.ip+1, size)
+	ctx.ip += uint64(size)
+	if m != nil && m.ripRelative {
+		m.address += uint64(size)
+	}
+
+	return v
+}
+
+// regOperand returns the reg field of m as a register operand, for the
+// instructions whose reg operand may name ah, ch, dh or bh
+func (m modrm) regOperand(ctx *decodeContext) modrm {
+	return modrm{mod: 0b11, reg: m.reg, rm: m.reg, digit: m.digit, highByte: ctx.rex == 0 && m.digit >= 4}
+}
+
+// readRM reads the register or memory operand of m
+func (c *cpu) readRM(m modrm, width int) uint64 {
+	if m.mod == 0b11 && width == 8 && m.highByte {
+		return c.regfile.get(register(m.rm-4)) >> 8 & 0xFF
+	}
+
+	if m.mod == 0b11 {
+		return c.regfile.get(register(m.rm)) & widthMask(width)
+	}
+
+	return c.readMemory(m.address, width/8)
+}
+
+// writeRM writes the register or memory operand of m
+func (c *cpu) writeRM(m modrm, width int, v uint64) {
+	if m.mod == 0b11 && width == 8 && m.highByte {
+		r := register(m.rm - 4)
+		c.regfile.set(r, c.regfile.get(r)&^0xFF00|(v&0xFF)<<8)
+		return
+	}
+
+	if m.mod == 0b11 {
+		c.regfile.setWidth(register(m.rm), width, v)
+		return
+	}
+
+	c.writeMemory(m.address, width/8, v)
+}
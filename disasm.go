@@ -0,0 +1,986 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+var registerNames = map[int][16]string{
+	64: {"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi", "r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15"},
+	32: {"eax", "ecx", "edx", "ebx", "esp", "ebp", "esi", "edi", "r8d", "r9d", "r10d", "r11d", "r12d", "r13d", "r14d", "r15d"},
+	16: {"ax", "cx", "dx", "bx", "sp", "bp", "si", "di", "r8w", "r9w", "r10w", "r11w", "r12w", "r13w", "r14w", "r15w"},
+	8:  {"al", "cl", "dl", "bl", "ah", "ch", "dh", "bh", "r8b", "r9b", "r10b", "r11b", "r12b", "r13b", "r14b", "r15b"},
+
+	128: {"xmm0", "xmm1", "xmm2", "xmm3", "xmm4", "xmm5", "xmm6", "xmm7", "xmm8", "xmm9", "xmm10", "xmm11", "xmm12", "xmm13", "xmm14", "xmm15"},
+}
+
+// rexByteRegisterNames replace ah, ch, dh and bh when any REX prefix is
+// present
+var rexByteRegisterNames = [4]string{"spl", "bpl", "sil", "dil"}
+
+var ptrNames = map[int]string{
+	8:  "byte ptr ",
+	16: "word ptr ",
+	32: "dword ptr ",
+	64: "qword ptr ",
+
+	128: "xmmword ptr ",
+}
+
+var aluNames = [8]string{"add", "or", "adc", "sbb", "and", "sub", "xor", "cmp"}
+
+// group3Names and group5Names are indexed by the /digit of 0xF6/0xF7
+// and 0xFF, test and inc/dec being formatted apart
+var group3Names = [8]string{2: "not", 3: "neg", 4: "mul", 5: "imul", 6: "div", 7: "idiv"}
+var group5Names = [8]string{2: "call", 4: "jmp", 6: "push"}
+
+var conditionNames = [16]string{"o", "no", "b", "ae", "e", "ne", "be", "a", "s", "ns", "p", "np", "l", "ge", "le", "g"}
+
+var errTruncated = errors.New("truncated instruction")
+
+type unknownOpcodeError struct {
+	bytes []byte
+}
+
+func (e *unknownOpcodeError) Error() string {
+	var bs []string
+	for _, b := range e.bytes {
+		bs = append(bs, fmt.Sprintf("0x%02x", b))
+	}
+
+	return "unknown opcode " + strings.Join(bs, " ")
+}
+
+// disassembler decodes a single instruction from code, which holds the
+// bytes starting at addr.
+type disassembler struct {
+	code    []byte
+	addr    uint64
+	pos     int
+	width   int
+	segment string
+	rex     byte
+	// mandatoryPrefix is as in decodeContext
+	mandatoryPrefix byte
+	lock            bool
+	// addressWidth is 32 with the 0x67 prefix, else 64
+	addressWidth int
+
+	// symbols, when set, names branch targets
+	symbols *symbolTable
+}
+
+// opcodeRegister is the register encoded in the low bits of op, base
+// being the opcode for rax
+func (d *disassembler) opcodeRegister(op, base byte) byte {
+	return op - base + rexBit(d.rex, rexB)
+}
+
+// target formats a branch target, followed by the symbol it falls in
+// when symbols are available.
+func (d *disassembler) target(addr uint64) string {
+	if name, ok := d.symbols.lookup(addr); ok {
+		return fmt.Sprintf("0x%x <%s>", addr, name)
+	}
+
+	return fmt.Sprintf("0x%x", addr)
+}
+
+func (d *disassembler) next() (byte, error) {
+	if d.pos >= len(d.code) {
+		return 0, errTruncated
+	}
+
+	b := d.code[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *disassembler) immediate(size int) (uint64, error) {
+	if d.pos+size > len(d.code) {
+		return 0, errTruncated
+	}
+
+	v := readBytes(d.code, uint64(d.pos), size)
+	d.pos += size
+	return v, nil
+}
+
+func formatHex(v int64) string {
+	if v < 0 {
+		return fmt.Sprintf("-0x%x", -v)
+	}
+
+	return fmt.Sprintf("0x%x", v)
+}
+
+func formatDisplacement(v int64) string {
+	if v < 0 {
+		return fmt.Sprintf("-0x%x", -v)
+	}
+
+	return fmt.Sprintf("+0x%x", v)
+}
+
+// registerName names the register reg of width, which for byte sized
+// registers depends on whether there is a REX prefix
+func (d *disassembler) registerName(width int, reg byte) string {
+	if width == 8 && d.rex != 0 && reg >= 4 && reg < 8 {
+		return rexByteRegisterNames[reg-4]
+	}
+
+	return registerNames[width][reg]
+}
+
+// modrm decodes a ModRM operand, returning the reg field, extended by
+// REX.R, and the formatted r/m operand at the given width.
+func (d *disassembler) modrm(width int) (byte, string, error) {
+	b, err := d.next()
+	if err != nil {
+		return 0, "", err
+	}
+
+	mod, reg, rm := b>>6, (b>>3)&0b111, b&0b111
+	reg += rexBit(d.rex, rexR)
+	if mod == 0b11 {
+		if width == 8 && d.rex != 0 && rm >= 4 && d.rex&rexB == 0 {
+			return reg, rexByteRegisterNames[rm-4], nil
+		}
+
+		return reg, registerNames[width][rm+rexBit(d.rex, rexB)], nil
+	}
+
+	var address string
+	if rm == 0b100 { // SIB byte follows
+		sib, err := d.next()
+		if err != nil {
+			return 0, "", err
+		}
+
+		scale := 1 << (sib >> 6)
+		index := (sib>>3)&0b111 + rexBit(d.rex, rexX)
+		base := sib & 0b111
+
+		var parts []string
+		if !(base == byte(rbp) && mod == 0b00) {
+			parts = append(parts, registerNames[d.addressWidth][base+rexBit(d.rex, rexB)])
+		}
+
+		if index != byte(rsp) {
+			parts = append(parts, fmt.Sprintf("%s*%d", registerNames[d.addressWidth][index], scale))
+		}
+
+		address = strings.Join(parts, "+")
+		if base == byte(rbp) && mod == 0b00 {
+			disp, err := d.immediate(4)
+			if err != nil {
+				return 0, "", err
+			}
+
+			if address == "" {
+				address = formatHex(int64(int32(disp)))
+			} else {
+				address += formatDisplacement(int64(int32(disp)))
+			}
+		}
+	} else if rm == 0b101 && mod == 0b00 { // rip-relative
+		disp, err := d.immediate(4)
+		if err != nil {
+			return 0, "", err
+		}
+
+		ip := "rip"
+		if d.addressWidth == 32 {
+			ip = "eip"
+		}
+
+		address = ip + formatDisplacement(int64(int32(disp)))
+	} else {
+		address = registerNames[d.addressWidth][rm+rexBit(d.rex, rexB)]
+	}
+
+	switch mod {
+	case 0b01:
+		disp, err := d.immediate(1)
+		if err != nil {
+			return 0, "", err
+		}
+
+		address += formatDisplacement(int64(int8(disp)))
+	case 0b10:
+		disp, err := d.immediate(4)
+		if err != nil {
+			return 0, "", err
+		}
+
+		address += formatDisplacement(int64(int32(disp)))
+	}
+
+	return reg, ptrNames[width] + d.segment + "[" + address + "]", nil
+}
+
+// immediateOperand reads an immediate of the operand width, at most 4
+// bytes, sign extended to width.
+func (d *disassembler) immediateOperand(width int) (string, error) {
+	size := width / 8
+	if size > 4 {
+		size = 4
+	}
+
+	imm, err := d.immediate(size)
+	if err != nil {
+		return "", err
+	}
+
+	return formatHex(int64(signExtend(imm, size*8))), nil
+}
+
+// disassemble decodes the instruction at the start of code, which is
+// located at addr, returning its Intel syntax text and length. On error
+// the length is the number of bytes examined.
+func disassemble(code []byte, addr uint64) (string, int, error) {
+	return disassembleWithSymbols(code, addr, nil)
+}
+
+// disassembleWithSymbols is disassemble naming branch targets from
+// symbols.
+func disassembleWithSymbols(code []byte, addr uint64, symbols *symbolTable) (string, int, error) {
+	d := &disassembler{code: code, addr: addr, width: 32, addressWidth: 64, symbols: symbols}
+	text, err := d.decode()
+	if d.lock && err == nil {
+		text = "lock " + text
+	}
+
+	return text, d.pos, err
+}
+
+func (d *disassembler) decode() (string, error) {
+	op, err := d.next()
+	if err != nil {
+		return "", err
+	}
+
+	operandSize := false
+	for isPrefix(op) {
+		if isREX(op) {
+			d.rex = op
+		} else {
+			d.rex = 0
+			switch op {
+			case 0x66:
+				operandSize = true
+				if d.mandatoryPrefix == 0 {
+					d.mandatoryPrefix = op
+				}
+			case 0xF2, 0xF3:
+				d.mandatoryPrefix = op
+			case 0xF0:
+				d.lock = true
+			case 0x67:
+				d.addressWidth = 32
+			case 0x64:
+				d.segment = "fs:"
+			case 0x65:
+				d.segment = "gs:"
+			}
+		}
+
+		if op, err = d.next(); err != nil {
+			return "", err
+		}
+	}
+
+	if d.rex&rexW != 0 {
+		d.width = 64
+	} else if operandSize {
+		d.width = 16
+	}
+
+	width := d.width
+	switch {
+	case op < 0x40 && op&7 <= 3, op >= 0x84 && op <= 0x8B:
+		if op&1 == 0 {
+			width = 8
+		}
+
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		mnemonic := "mov"
+		switch {
+		case op < 0x40:
+			mnemonic = aluNames[op>>3]
+		case op < 0x86:
+			mnemonic = "test"
+		case op < 0x88:
+			mnemonic = "xchg"
+		}
+
+		if op&0b10 == 0 || op < 0x88 && op >= 0x40 {
+			return fmt.Sprintf("%s %s, %s", mnemonic, rm, d.registerName(width, reg)), nil
+		}
+
+		return fmt.Sprintf("%s %s, %s", mnemonic, d.registerName(width, reg), rm), nil
+
+	case op < 0x40 && (op&7 == 4 || op&7 == 5), op == 0xA8 || op == 0xA9:
+		mnemonic := "test"
+		if op < 0x40 {
+			mnemonic = aluNames[op>>3]
+		}
+
+		var imm string
+		if op&1 == 0 {
+			width = 8
+			var v uint64
+			v, err = d.immediate(1)
+			imm = fmt.Sprintf("0x%x", v)
+		} else {
+			imm, err = d.immediateOperand(width)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s %s, %s", mnemonic, registerNames[width][rax], imm), nil
+
+	case op >= 0x50 && op < 0x58:
+		return "push " + registerNames[64][d.opcodeRegister(op, 0x50)], nil
+
+	case op >= 0x58 && op < 0x60:
+		return "pop " + registerNames[64][d.opcodeRegister(op, 0x58)], nil
+
+	case op == 0x63:
+		reg, rm, err := d.modrm(32)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("movsxd %s, %s", registerNames[width][reg], rm), nil
+
+	case op == 0x68 || op == 0x6A:
+		var imm string
+		if op == 0x6A {
+			imm, err = d.immediateOperand(8)
+		} else {
+			imm, err = d.immediateOperand(32)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return "push " + imm, nil
+
+	case op == 0x69 || op == 0x6B:
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		var imm string
+		if op == 0x6B {
+			imm, err = d.immediateOperand(8)
+		} else {
+			imm, err = d.immediateOperand(width)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("imul %s, %s, %s", registerNames[width][reg], rm, imm), nil
+
+	case op >= 0x70 && op < 0x80:
+		rel, err := d.immediate(1)
+		if err != nil {
+			return "", err
+		}
+
+		target := d.addr + uint64(d.pos) + signExtend(rel, 8)
+		return fmt.Sprintf("j%s %s", conditionNames[op&0xF], d.target(target)), nil
+
+	case op >= 0x80 && op <= 0x83 && op != 0x82:
+		if op == 0x80 {
+			width = 8
+		}
+
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		var imm string
+		if op == 0x80 {
+			var v uint64
+			v, err = d.immediate(1)
+			imm = fmt.Sprintf("0x%x", v)
+		} else if op == 0x83 {
+			imm, err = d.immediateOperand(8)
+		} else {
+			imm, err = d.immediateOperand(width)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s %s, %s", aluNames[reg&7], rm, imm), nil
+
+	case op == 0x8D:
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		if !strings.HasSuffix(rm, "]") {
+			return "", &unknownOpcodeError{[]byte{op}}
+		}
+
+		return fmt.Sprintf("lea %s, %s", registerNames[width][reg], strings.TrimPrefix(rm, ptrNames[width])), nil
+
+	case op >= 0xB8 && op < 0xC0:
+		imm, err := d.immediate(width / 8)
+		if err != nil {
+			return "", err
+		}
+
+		mnemonic := "mov"
+		if width == 64 {
+			mnemonic = "movabs"
+		}
+
+		return fmt.Sprintf("%s %s, 0x%x", mnemonic, registerNames[width][d.opcodeRegister(op, 0xB8)], imm), nil
+
+	case op >= 0x90 && op < 0x98:
+		reg := d.opcodeRegister(op, 0x90)
+		if reg == 0 {
+			return "nop", nil
+		}
+
+		return fmt.Sprintf("xchg %s, %s", registerNames[width][reg], registerNames[width][rax]), nil
+
+	case op == 0x98 || op == 0x99:
+		names := map[int][2]string{16: {"cbw", "cwd"}, 32: {"cwde", "cdq"}, 64: {"cdqe", "cqo"}}
+		return names[width][op-0x98], nil
+
+	case op == 0x9C:
+		return "pushfq", nil
+
+	case op >= 0xA4 && op <= 0xA7 || op >= 0xAA && op <= 0xAF:
+		if op&1 == 0 {
+			width = 8
+		}
+
+		mnemonic := oneByteOpcodes[op].mnemonic
+		compare := mnemonic == "cmps" || mnemonic == "scas"
+		switch {
+		case d.mandatoryPrefix == 0xF2 && compare:
+			mnemonic = "repne " + mnemonic
+		case d.mandatoryPrefix == 0xF3 && compare:
+			mnemonic = "repe " + mnemonic
+		case d.mandatoryPrefix == 0xF2 || d.mandatoryPrefix == 0xF3:
+			mnemonic = "rep " + mnemonic
+		}
+
+		return mnemonic + stringSuffixes[width], nil
+
+	case op == 0xFC:
+		return "cld", nil
+
+	case op == 0xFD:
+		return "std", nil
+
+	case op == 0x9D:
+		return "popfq", nil
+
+	case op == 0x9E:
+		return "sahf", nil
+
+	case op == 0x9F:
+		return "lahf", nil
+
+	case op == 0xC0 || op == 0xC1 || op >= 0xD0 && op <= 0xD3:
+		if op&1 == 0 {
+			width = 8
+		}
+
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		count := "cl"
+		switch op {
+		case 0xC0, 0xC1:
+			imm, err := d.immediate(1)
+			if err != nil {
+				return "", err
+			}
+
+			count = fmt.Sprintf("0x%x", imm)
+		case 0xD0, 0xD1:
+			count = "1"
+		}
+
+		return fmt.Sprintf("%s %s, %s", shiftNames[reg&7], rm, count), nil
+
+	case op == 0xC3:
+		return "ret", nil
+
+	case op == 0xC6 || op == 0xC7:
+		if op == 0xC6 {
+			width = 8
+		}
+
+		_, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		imm, err := d.immediateOperand(width)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("mov %s, %s", rm, imm), nil
+
+	case op == 0xC9:
+		return "leave", nil
+
+	case op == 0xE8:
+		rel, err := d.immediate(4)
+		if err != nil {
+			return "", err
+		}
+
+		return "call " + d.target(d.addr+uint64(d.pos)+signExtend(rel, 32)), nil
+
+	case op == 0xF6 || op == 0xF7:
+		if op == 0xF6 {
+			width = 8
+		}
+
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		switch reg & 7 {
+		case 0, 1:
+			var imm string
+			if width == 8 {
+				var v uint64
+				v, err = d.immediate(1)
+				imm = fmt.Sprintf("0x%x", v)
+			} else {
+				imm, err = d.immediateOperand(width)
+			}
+			if err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("test %s, %s", rm, imm), nil
+		default:
+			return group3Names[reg&7] + " " + rm, nil
+		}
+
+	case op == 0xFE || op == 0xFF:
+		if op == 0xFE {
+			width = 8
+		}
+
+		// The branches and push of group 5 always take 64 bit operands
+		if op == 0xFF && d.pos < len(d.code) && d.code[d.pos]>>3&0b111 >= 2 {
+			width = 64
+		}
+
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		switch reg & 7 {
+		case 0:
+			return "inc " + rm, nil
+		case 1:
+			return "dec " + rm, nil
+		case 2, 4, 6:
+			if op == 0xFF {
+				return group5Names[reg&7] + " " + rm, nil
+			}
+		}
+
+	case op >= 0xE4 && op <= 0xE7 || op >= 0xEC && op <= 0xEF:
+		if op&1 == 0 {
+			width = 8
+		} else if width == 64 {
+			width = 32
+		}
+
+		port := "dx"
+		if op < 0xE8 {
+			imm, err := d.immediate(1)
+			if err != nil {
+				return "", err
+			}
+
+			port = fmt.Sprintf("0x%x", imm)
+		}
+
+		if op&2 == 0 {
+			return fmt.Sprintf("in %s, %s", registerNames[width][rax], port), nil
+		}
+
+		return fmt.Sprintf("out %s, %s", port, registerNames[width][rax]), nil
+
+	case op == 0xE9 || op == 0xEB:
+		size := 4
+		if op == 0xEB {
+			size = 1
+		}
+
+		rel, err := d.immediate(size)
+		if err != nil {
+			return "", err
+		}
+
+		return "jmp " + d.target(d.addr+uint64(d.pos)+signExtend(rel, size*8)), nil
+
+	case op == 0x0F:
+		return d.decodeTwoByte()
+	}
+
+	return "", &unknownOpcodeError{[]byte{op}}
+}
+
+func (d *disassembler) decodeTwoByte() (string, error) {
+	op, err := d.next()
+	if err != nil {
+		return "", err
+	}
+
+	switch op {
+	case 0x05:
+		return "syscall", nil
+
+	case 0x31:
+		return "rdtsc", nil
+
+	case 0xA2:
+		return "cpuid", nil
+
+	case 0x1E, 0x1F:
+		if op == 0x1E && d.mandatoryPrefix == 0xF3 && d.pos < len(d.code) && d.code[d.pos] == 0xFA {
+			d.pos++
+			return "endbr64", nil
+		}
+
+		_, rm, err := d.modrm(d.width)
+		if err != nil {
+			return "", err
+		}
+
+		return "nop " + rm, nil
+
+	case 0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49, 0x4A, 0x4B, 0x4C, 0x4D, 0x4E, 0x4F, 0xAF, 0xBC, 0xBD:
+		reg, rm, err := d.modrm(d.width)
+		if err != nil {
+			return "", err
+		}
+
+		mnemonic := twoByteOpcodes[op].mnemonic
+		if op == 0xBC && d.mandatoryPrefix == 0xF3 {
+			mnemonic = "tzcnt"
+		}
+
+		return fmt.Sprintf("%s %s, %s", mnemonic, registerNames[d.width][reg], rm), nil
+
+	case 0x80, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89, 0x8A, 0x8B, 0x8C, 0x8D, 0x8E, 0x8F:
+		rel, err := d.immediate(4)
+		if err != nil {
+			return "", err
+		}
+
+		target := d.addr + uint64(d.pos) + signExtend(rel, 32)
+		return fmt.Sprintf("j%s %s", conditionNames[op&0xF], d.target(target)), nil
+
+	case 0x90, 0x91, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9A, 0x9B, 0x9C, 0x9D, 0x9E, 0x9F:
+		_, rm, err := d.modrm(8)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("set%s %s", conditionNames[op&0xF], rm), nil
+
+	case 0xB6, 0xB7, 0xBE, 0xBF:
+		source := 8
+		if op&1 != 0 {
+			source = 16
+		}
+
+		reg, rm, err := d.modrm(source)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s %s, %s", twoByteOpcodes[op].mnemonic, registerNames[d.width][reg], rm), nil
+
+	case 0xA3, 0xAB, 0xB3, 0xBB:
+		reg, rm, err := d.modrm(d.width)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s %s, %s", bitOpNames[(op-0xA3)>>3], rm, registerNames[d.width][reg]), nil
+
+	case 0xB0, 0xB1, 0xC0, 0xC1:
+		width := d.width
+		if op&1 == 0 {
+			width = 8
+		}
+
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		name := "cmpxchg"
+		if op >= 0xC0 {
+			name = "xadd"
+		}
+
+		return fmt.Sprintf("%s %s, %s", name, rm, d.registerName(width, reg)), nil
+
+	case 0xBA:
+		reg, rm, err := d.modrm(d.width)
+		if err != nil {
+			return "", err
+		}
+
+		imm, err := d.immediate(1)
+		if err != nil {
+			return "", err
+		}
+
+		reg &= 7
+		if reg < 4 {
+			return "", &unknownOpcodeError{[]byte{0x0F, op}}
+		}
+
+		return fmt.Sprintf("%s %s, 0x%x", bitOpNames[reg-4], rm, imm), nil
+
+	case 0xC8, 0xC9, 0xCA, 0xCB, 0xCC, 0xCD, 0xCE, 0xCF:
+		return "bswap " + registerNames[d.width][d.opcodeRegister(op, 0xC8)], nil
+	}
+
+	// What is left of the 0x0F map are the SSE instructions
+	if table := twoByteTable(d.mandatoryPrefix, op); table[op].exec != nil {
+		return d.decodeSSE(table[op].mnemonic, op)
+	}
+
+	if d.mandatoryPrefix != 0 {
+		return "", &unknownOpcodeError{[]byte{d.mandatoryPrefix, 0x0F, op}}
+	}
+
+	return "", &unknownOpcodeError{[]byte{0x0F, op}}
+}
+
+// xmmModRM decodes a ModRM operand naming an xmm register, or memory of
+// the given width
+func (d *disassembler) xmmModRM(width int) (byte, string, error) {
+	if d.pos < len(d.code) && d.code[d.pos]>>6 == 0b11 {
+		width = 128
+	}
+
+	return d.modrm(width)
+}
+
+func (d *disassembler) decodeSSE(mnemonic string, op byte) (string, error) {
+	// The width of a general register or memory operand of movd and
+	// the conversions
+	width := 32
+	if d.rex&rexW != 0 {
+		width = 64
+	}
+
+	memWidth := 128
+	switch mnemonic {
+	case "movd":
+		if width == 64 {
+			mnemonic = "movq"
+		}
+
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		if op == 0x6E {
+			return fmt.Sprintf("%s %s, %s", mnemonic, registerNames[128][reg], rm), nil
+		}
+
+		return fmt.Sprintf("%s %s, %s", mnemonic, rm, registerNames[128][reg]), nil
+
+	case "cvtsi2sd":
+		reg, rm, err := d.modrm(width)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s %s, %s", mnemonic, registerNames[128][reg], rm), nil
+
+	case "cvttsd2si":
+		reg, rm, err := d.xmmModRM(64)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s %s, %s", mnemonic, registerNames[width][reg], rm), nil
+
+	case "pmovmskb":
+		reg, rm, err := d.modrm(128)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s %s, %s", mnemonic, registerNames[width][reg], rm), nil
+
+	case "pshufd":
+		reg, rm, err := d.xmmModRM(128)
+		if err != nil {
+			return "", err
+		}
+
+		imm, err := d.immediate(1)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s %s, %s, 0x%x", mnemonic, registerNames[128][reg], rm, imm), nil
+
+	case "grp12", "grp13", "grp14":
+		reg, rm, err := d.xmmModRM(128)
+		if err != nil {
+			return "", err
+		}
+
+		imm, err := d.immediate(1)
+		if err != nil {
+			return "", err
+		}
+
+		name := packedShiftNames[op][reg&7]
+		if name == "" || !strings.HasPrefix(rm, "xmm") {
+			return "", &unknownOpcodeError{[]byte{d.mandatoryPrefix, 0x0F, op}}
+		}
+
+		return fmt.Sprintf("%s %s, 0x%x", name, rm, imm), nil
+
+	case "movlps", "movlpd", "movhps", "movhpd":
+		if d.pos < len(d.code) && d.code[d.pos]>>6 == 0b11 && op&1 == 0 {
+			mnemonic = map[byte]string{0x12: "movhlps", 0x16: "movlhps"}[op]
+		}
+
+		memWidth = 64
+	case "movss":
+		memWidth = 32
+	case "movsd", "addsd", "subsd", "mulsd", "divsd", "comisd", "ucomisd", "movq":
+		memWidth = 64
+	}
+
+	reg, rm, err := d.xmmModRM(memWidth)
+	if err != nil {
+		return "", err
+	}
+
+	switch op {
+	case 0x11, 0x13, 0x17, 0x29, 0x7F, 0xD6:
+		return fmt.Sprintf("%s %s, %s", mnemonic, rm, registerNames[128][reg]), nil
+	}
+
+	return fmt.Sprintf("%s %s, %s", mnemonic, registerNames[128][reg], rm), nil
+}
+
+func formatInstructionBytes(bs []byte) string {
+	var parts []string
+	for _, b := range bs {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// disassembleELF linearly disassembles the executable section of the
+// ELF file containing start from start onwards, stopping at the first
+// instruction that cannot be decoded.
+func disassembleELF(w io.Writer, filename string, start uint64) error {
+	bin, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	elffile, err := elf.NewFile(bytes.NewReader(bin))
+	if err != nil {
+		return err
+	}
+
+	labels := map[uint64]string{}
+	functions := map[string]uint64{}
+	sizes := map[string]uint64{}
+	if symbols, err := elffile.Symbols(); err == nil {
+		for _, sym := range symbols {
+			if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value != 0 {
+				labels[sym.Value] = sym.Name
+				functions[sym.Name] = sym.Value
+				sizes[sym.Name] = sym.Size
+			}
+		}
+	}
+
+	targets := newSymbolTable(functions, sizes)
+
+	var sections []*elf.Section
+	for _, sec := range elffile.Sections {
+		if sec.Flags&elf.SHF_EXECINSTR != 0 {
+			sections = append(sections, sec)
+		}
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Addr < sections[j].Addr })
+
+	for _, sec := range sections {
+		if start < sec.Addr || start >= sec.Addr+sec.Size {
+			continue
+		}
+
+		code, err := sec.Data()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "Disassembly of section %s:\n", sec.Name)
+		for addr := start; addr < sec.Addr+sec.Size; {
+			if label, ok := labels[addr]; ok {
+				fmt.Fprintf(w, "\n%016x <%s>:\n", addr, label)
+			}
+
+			offset := addr - sec.Addr
+			text, n, err := disassembleWithSymbols(code[offset:], addr, targets)
+			if err != nil {
+				fmt.Fprintf(w, "%8x:\t%-30s\t(bad)\n", addr, formatInstructionBytes(code[offset:offset+uint64(n)]))
+				return fmt.Errorf("Stopped at 0x%x: %s", addr, err)
+			}
+
+			fmt.Fprintf(w, "%8x:\t%-30s\t%s\n", addr, formatInstructionBytes(code[offset:offset+uint64(n)]), text)
+			addr += uint64(n)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Address 0x%x is not in an executable section", start)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// display is an expression printed whenever execution stops: a register
+// or, when width is set, the width bytes at location.
+type display struct {
+	id       int
+	location string
+	width    int
+}
+
+// formatFlags names the flags set in rflags, or "-" when none are
+func formatFlags(rflags uint64) string {
+	var set []string
+	for _, f := range flagNames {
+		if rflags&f.flag != 0 {
+			set = append(set, f.name)
+		}
+	}
+
+	if len(set) == 0 {
+		return "-"
+	}
+
+	return strings.Join(set, " ")
+}
+
+// formatRegisterChanges lists the registers that differ between before
+// and after, other than rip, on one line.
+func formatRegisterChanges(before, after *registerFile, intFormat string) string {
+	var changes []string
+	for i := 0; i < len(registerMap); i++ {
+		reg := register(i)
+		old, cur := before.get(reg), after.get(reg)
+		if reg == rip || old == cur {
+			continue
+		}
+
+		if reg == rflags {
+			changes = append(changes, fmt.Sprintf("rflags: %s -> %s", formatFlags(old), formatFlags(cur)))
+			continue
+		}
+
+		changes = append(changes, fmt.Sprintf("%s: "+intFormat+" -> "+intFormat, registerMap[reg], old, cur))
+	}
+
+	return strings.Join(changes, ", ")
+}
+
+// addDisplay registers an expression to print after every stop
+func (d *debugger) addDisplay(location string, width int) *display {
+	d.nextDisplay++
+	disp := &display{id: d.nextDisplay, location: location, width: width}
+	d.displays = append(d.displays, disp)
+	return disp
+}
+
+func (d *debugger) removeDisplay(id int) bool {
+	for i, disp := range d.displays {
+		if disp.id == id {
+			d.displays = append(d.displays[:i], d.displays[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// printDisplay prints one display expression. Locations are resolved
+// each time, so "display rsp 8" follows the stack pointer.
+func (d *debugger) printDisplay(disp *display) {
+	c := d.c
+	if disp.width == 0 {
+		v, _ := c.resolveDebuggerValue(disp.location)
+		if disp.location == "rflags" {
+			fmt.Fprintf(d.out, "%d: rflags = %s\n", disp.id, formatFlags(v))
+			return
+		}
+
+		fmt.Fprintf(d.out, "%d: %s = "+d.intFormat+"\n", disp.id, disp.location, v)
+		return
+	}
+
+	name := disp.location + " " + strconv.Itoa(disp.width)
+	addr, err := c.resolveLocation(disp.location)
+	if err != nil {
+		fmt.Fprintf(d.out, "%d: %s = %s\n", disp.id, name, err)
+		return
+	}
+
+	v, err := c.debugRead(addr, disp.width)
+	if err != nil {
+		fmt.Fprintf(d.out, "%d: %s = %s\n", disp.id, name, err)
+		return
+	}
+
+	fmt.Fprintf(d.out, "%d: %s = "+d.intFormat+"\n", disp.id, name, v)
+}
+
+// printDisplays prints every display expression, after execution stops
+func (d *debugger) printDisplays() {
+	for _, disp := range d.displays {
+		d.printDisplay(disp)
+	}
+}
+
+func isRegisterName(name string) bool {
+	for _, n := range registerMap {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
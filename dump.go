@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// stateDumpVersion is bumped whenever a field of stateDump changes
+// meaning or is removed; new fields may be added without it.
+const stateDumpVersion = 1
+
+// stateDump is the JSON form of the machine state. Numbers are hex
+// strings so that 64 bit values survive tools that parse JSON numbers
+// as doubles.
+type stateDump struct {
+	Version   int               `json:"version"`
+	Registers map[string]string `json:"registers"`
+	FSBase    string            `json:"fsBase"`
+	GSBase    string            `json:"gsBase"`
+	Flags     map[string]bool   `json:"flags"`
+	RIP       string            `json:"rip"`
+	Symbol    string            `json:"symbol,omitempty"`
+	Exited    bool              `json:"exited"`
+	Status    *int              `json:"status,omitempty"`
+	Memory    *memoryDump       `json:"memory,omitempty"`
+}
+
+type memoryDump struct {
+	Address string `json:"address"`
+	// Bytes is hex encoded
+	Bytes string `json:"bytes,omitempty"`
+	// Error says why a requested range could not be read
+	Error string `json:"error,omitempty"`
+}
+
+var flagNames = []struct {
+	name string
+	flag uint64
+}{
+	{"CF", flagCF},
+	{"PF", flagPF},
+	{"AF", flagAF},
+	{"ZF", flagZF},
+	{"SF", flagSF},
+	{"IF", flagIF},
+	{"DF", flagDF},
+	{"OF", flagOF},
+}
+
+// dumpState captures the machine state, with count bytes of memory at
+// address when count is not zero.
+func (c *cpu) dumpState(address, count uint64) (*stateDump, error) {
+	d := &stateDump{
+		Version:   stateDumpVersion,
+		Registers: map[string]string{},
+		FSBase:    fmt.Sprintf("0x%x", c.fsBase),
+		GSBase:    fmt.Sprintf("0x%x", c.gsBase),
+		Flags:     map[string]bool{},
+		RIP:       fmt.Sprintf("0x%x", c.regfile.get(rip)),
+		Exited:    c.exited(),
+	}
+
+	for reg, name := range registerMap {
+		d.Registers[name] = fmt.Sprintf("0x%x", c.regfile.get(reg))
+	}
+
+	for _, f := range flagNames {
+		d.Flags[f.name] = c.flag(f.flag)
+	}
+
+	if name, ok := c.symbolTable().lookup(c.regfile.get(rip)); ok {
+		d.Symbol = name
+	}
+
+	if d.Exited {
+		status := c.exitStatus() & 0xFF
+		d.Status = &status
+	}
+
+	if count > 0 {
+		if address > uint64(len(c.mem)) || count > uint64(len(c.mem))-address {
+			return nil, fmt.Errorf("Memory range 0x%x+%d is out of bounds", address, count)
+		}
+
+		d.Memory = &memoryDump{
+			Address: fmt.Sprintf("0x%x", address),
+			Bytes:   hex.EncodeToString(c.mem[address : address+count]),
+		}
+	}
+
+	return d, nil
+}
+
+func (c *cpu) writeStateDump(filename string, address, count uint64) error {
+	d, err := c.dumpState(address, count)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
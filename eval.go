@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// parseHexBytes parses machine code written as hex bytes separated by
+// spaces or commas, optionally as \x escapes or with a 0x prefix:
+// "48 c7 c0", "48,c7,c0", "\x48\xc7\xc0" and "48c7c0" are the same.
+// Errors give the offset of the malformed token in s.
+func parseHexBytes(s string) ([]byte, error) {
+	var code []byte
+	for i := 0; i < len(s); {
+		if s[i] == ' ' || s[i] == ',' || s[i] == '\t' || s[i] == '\n' {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(s) && s[i] != ' ' && s[i] != ',' && s[i] != '\t' && s[i] != '\n' && !(i > start && s[i] == '\\') {
+			i++
+		}
+
+		token := s[start:i]
+		digits := strings.TrimPrefix(strings.TrimPrefix(token, `\x`), "0x")
+		if len(digits) == 1 {
+			digits = "0" + digits
+		}
+		b, err := hex.DecodeString(digits)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("Invalid byte %q at offset %d", token, start)
+		}
+
+		code = append(code, b...)
+	}
+
+	if len(code) == 0 {
+		return nil, fmt.Errorf("No bytes given")
+	}
+
+	return code, nil
+}
+
+// evalCode runs --eval: the bytes in code, followed by a ret when they
+// don't end in one, loaded at the raw base address. The registers are
+// printed afterwards, in hex with --hex.
+func evalCode(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Missing value for --eval")
+	}
+
+	code, err := parseHexBytes(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if code[len(code)-1] != 0xC3 {
+		code = append(code, 0xC3)
+	}
+
+	proc, err := newRawProcess("--eval", code, defaultRawBase, defaultRawBase)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cpu := newCPU(0x400000 * 10)
+	cpu.load(proc)
+	d := newDebugger(&cpu, os.Stdin, os.Stdout)
+	for _, arg := range args[1:] {
+		if arg == "--hex" {
+			d.intFormat = "0x%x"
+		}
+	}
+
+	if _, err := cpu.run(); err != nil {
+		fmt.Println(err)
+	}
+
+	d.printRegisters("", false)
+}
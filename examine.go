@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// examineFormat is the /<count><format><size> suffix of the x command
+type examineFormat struct {
+	count  uint64
+	format byte
+	size   int
+}
+
+// maxExamineString bounds how far an x/s string is read looking for its
+// terminator
+const maxExamineString = 256
+
+var examineSizes = map[byte]int{'b': 1, 'h': 2, 'w': 4, 'g': 8}
+
+// parseExamineFormat parses the text after "x/". The format and size
+// default to those of last, as in gdb, and the count to 1.
+func parseExamineFormat(spec string, last examineFormat) (examineFormat, error) {
+	f := examineFormat{count: 1, format: last.format, size: last.size}
+	digits := 0
+	for digits < len(spec) && spec[digits] >= '0' && spec[digits] <= '9' {
+		digits++
+	}
+
+	if digits > 0 {
+		count, err := strconv.ParseUint(spec[:digits], 10, 64)
+		if err != nil || count == 0 {
+			return f, fmt.Errorf("invalid count %q", spec[:digits])
+		}
+
+		f.count = count
+	}
+
+	for _, b := range []byte(spec[digits:]) {
+		if size, ok := examineSizes[b]; ok {
+			f.size = size
+		} else if strings.IndexByte("xdusi", b) >= 0 {
+			f.format = b
+		} else {
+			return f, fmt.Errorf("invalid format letter %q", b)
+		}
+	}
+
+	return f, nil
+}
+
+// examineMemory prints memory at addr in the given format, a line at a
+// time with the address of the line first.
+func (d *debugger) examineMemory(f examineFormat, addr uint64) error {
+	c := d.c
+	switch f.format {
+	case 'i':
+		c.printDisassembly(d.out, addr, f.count)
+		return nil
+	case 's':
+		for i := uint64(0); i < f.count; i++ {
+			s, next, err := c.debugReadString(addr)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(d.out, d.intFormat+":\t%s\n", addr, strconv.Quote(s))
+			addr = next
+		}
+
+		return nil
+	}
+
+	// As gdb does: 16 bytes per line, but at most 8 values
+	perLine := uint64(16 / f.size)
+	if perLine > 8 {
+		perLine = 8
+	}
+
+	var line []string
+	lineAddr := addr
+	for i := uint64(0); i < f.count; i++ {
+		v, err := c.debugRead(addr, f.size)
+		if err != nil {
+			if len(line) > 0 {
+				fmt.Fprintf(d.out, d.intFormat+":\t%s\n", lineAddr, strings.Join(line, "\t"))
+			}
+
+			return err
+		}
+
+		line = append(line, formatExamineValue(v, f))
+		addr += uint64(f.size)
+		if uint64(len(line)) == perLine || i == f.count-1 {
+			fmt.Fprintf(d.out, d.intFormat+":\t%s\n", lineAddr, strings.Join(line, "\t"))
+			line, lineAddr = nil, addr
+		}
+	}
+
+	return nil
+}
+
+func formatExamineValue(v uint64, f examineFormat) string {
+	switch f.format {
+	case 'd':
+		return strconv.FormatInt(int64(signExtend(v, f.size*8)), 10)
+	case 'u':
+		return strconv.FormatUint(v, 10)
+	}
+
+	return fmt.Sprintf("0x%0*x", f.size*2, v)
+}
+
+// debugRead reads guest memory for the debugger without triggering
+// watchpoints, returning the fault raised for addresses out of range.
+func (c *cpu) debugRead(addr uint64, size int) (v uint64, err error) {
+	defer func() {
+		if ferr := recoverFault(recover()); ferr != nil {
+			err = ferr
+		}
+	}()
+
+	c.checkAccess(addr, size, "read")
+	return readBytes(c.mem, addr, size), nil
+}
+
+// debugReadString reads the NUL terminated string at addr, stopping
+// after maxExamineString bytes. It returns the address following the
+// string.
+func (c *cpu) debugReadString(addr uint64) (string, uint64, error) {
+	var s []byte
+	for len(s) < maxExamineString {
+		b, err := c.debugRead(addr, 1)
+		if err != nil {
+			return "", addr, err
+		}
+
+		addr++
+		if b == 0 {
+			break
+		}
+
+		s = append(s, byte(b))
+	}
+
+	return string(s), addr, nil
+}
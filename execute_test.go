@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+// fuzzMemorySize keeps each fuzzed machine small, with a stack at the
+// top of it
+const fuzzMemorySize = 0x100000
+
+// fuzzCPU returns a machine to run one instruction in. rax holds a
+// syscall number nothing handles, so that syscall returns ENOSYS rather
+// than reading stdin or exiting.
+func fuzzCPU() *cpu {
+	c := newCPU(fuzzMemorySize)
+	c.stackSize = 0x10000
+	c.regfile.set(rsp, c.entryStackPointer())
+	c.regfile.set(rax, 0xFFFF)
+	c.initPermissions()
+	c.setPermissions(0, fuzzMemorySize, permRead|permWrite|permExec)
+	return &c
+}
+
+// FuzzExecuteCode runs arbitrary bytes as an instruction, at the start
+// of memory or ending at its last byte, where decoding runs off the
+// end. Faults are expected; anything else going wrong in the emulator is
+// an InternalError.
+func FuzzExecuteCode(f *testing.F) {
+	for _, seed := range [][]byte{
+		{0x48, 0xb8, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00},
+		{0xc3},
+		{0x48},
+		{0x0f},
+		{0x66, 0x0f, 0x28, 0x04, 0x24},
+		{0x8b, 0x04, 0x25, 0xff, 0xff, 0xff, 0x7f},
+		{0xf3, 0x48, 0xa7},
+		{0x0f, 0x05},
+		{0x41, 0x90},
+	} {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+
+	f.Fuzz(func(t *testing.T, code []byte, atEnd bool) {
+		c := fuzzCPU()
+		ip := uint64(0x1000)
+		if atEnd && len(code) > 0 && len(code) <= maxInstructionLength {
+			ip = fuzzMemorySize - uint64(len(code))
+		}
+
+		c.regfile.set(rip, ip)
+		_, err := c.executeCode(code)
+		if f, ok := err.(*fault); ok && f.kind == internalError {
+			t.Fatalf("% x: %s", code, err)
+		}
+	})
+}
+
+func TestFetchOutsideMemory(t *testing.T) {
+	c := fuzzCPU()
+	c.regfile.set(rip, 0xFFFFFFFFFF)
+	err := c.tryExecute()
+	if f, ok := err.(*fault); !ok || f.kind != memoryAccess {
+		t.Fatalf("got %v, want a MemoryAccess fault", err)
+	}
+}
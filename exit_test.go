@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+// entryCPU returns a machine about to run code as its entry function,
+// with the exit trampoline as its return address
+func entryCPU(code []byte) *cpu {
+	c := fuzzCPU()
+	copy(c.mem[0x1000:], code)
+	c.regfile.set(rip, 0x1000)
+	writeBytes(c.mem, c.regfile.get(rsp), 8, c.exitTrampoline())
+	return c
+}
+
+func TestExit(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    []byte
+		status  int
+		called  bool
+		message string
+	}{
+		{
+			"exit",
+			// mov edi, 300; mov eax, 60; syscall; ud2
+			[]byte{0xbf, 0x2c, 0x01, 0x00, 0x00, 0xb8, 0x3c, 0x00, 0x00, 0x00, 0x0f, 0x05, 0x0f, 0x0b},
+			300, true, "program called exit with status 44",
+		},
+		{
+			"exit_group",
+			// mov edi, 7; mov eax, 231; syscall; ud2
+			[]byte{0xbf, 0x07, 0x00, 0x00, 0x00, 0xb8, 0xe7, 0x00, 0x00, 0x00, 0x0f, 0x05, 0x0f, 0x0b},
+			7, true, "program called exit with status 7",
+		},
+		{
+			"return",
+			// mov eax, 300; ret
+			[]byte{0xb8, 0x2c, 0x01, 0x00, 0x00, 0xc3},
+			300, false, "program returned from its entry function with status 44",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := entryCPU(tt.code)
+			status, err := c.run()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status != tt.status || c.exitCalled != tt.called {
+				t.Errorf("status %d, exit called %v; want %d, %v", status, c.exitCalled, tt.status, tt.called)
+			}
+
+			if message := c.exitMessage(); message != tt.message {
+				t.Errorf("%q, want %q", message, tt.message)
+			}
+		})
+	}
+}
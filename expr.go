@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expressionParser evaluates the debugger's expressions: registers,
+// symbols and numbers combined with +, - and *, grouped with
+// parentheses, and prefixed with * to read the 8 bytes at an address.
+// Arithmetic wraps as on 64 bit registers.
+type expressionParser struct {
+	c    *cpu
+	expr string
+	pos  int
+}
+
+// evaluate returns the value of expr, as in rbp-0x20, rsp+8*2 or
+// *(rsp+8)
+func (c *cpu) evaluate(expr string) (uint64, error) {
+	p := &expressionParser{c: c, expr: expr}
+	v, err := p.sum()
+	if err != nil {
+		return 0, err
+	}
+
+	if p.pos < len(p.expr) {
+		return 0, fmt.Errorf("Unexpected %q in %s", p.expr[p.pos:], expr)
+	}
+
+	return v, nil
+}
+
+// peek skips spaces and returns the next byte, or 0 at the end
+func (p *expressionParser) peek() byte {
+	for p.pos < len(p.expr) && p.expr[p.pos] == ' ' {
+		p.pos++
+	}
+
+	if p.pos == len(p.expr) {
+		return 0
+	}
+
+	return p.expr[p.pos]
+}
+
+func (p *expressionParser) sum() (uint64, error) {
+	v, err := p.product()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return v, nil
+		}
+
+		p.pos++
+		w, err := p.product()
+		if err != nil {
+			return 0, err
+		}
+
+		if op == '+' {
+			v += w
+		} else {
+			v -= w
+		}
+	}
+}
+
+func (p *expressionParser) product() (uint64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+
+	for p.peek() == '*' {
+		p.pos++
+		w, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+
+		v *= w
+	}
+
+	return v, nil
+}
+
+func (p *expressionParser) unary() (uint64, error) {
+	switch p.peek() {
+	case '*':
+		p.pos++
+		addr, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+
+		return p.c.debugRead(addr, 8)
+
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+
+	case '(':
+		p.pos++
+		v, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("Missing ) in %s", p.expr)
+		}
+
+		p.pos++
+		return v, nil
+	}
+
+	return p.operand()
+}
+
+// operand is a register, a symbol or a number, decimal unless it starts
+// with 0x
+func (p *expressionParser) operand() (uint64, error) {
+	p.peek()
+	start := p.pos
+	for p.pos < len(p.expr) && isOperandByte(p.expr[p.pos]) {
+		p.pos++
+	}
+
+	token := p.expr[start:p.pos]
+	if token == "" {
+		if start == len(p.expr) {
+			return 0, fmt.Errorf("Missing value at the end of %s", p.expr)
+		}
+
+		return 0, fmt.Errorf("Unexpected %q in %s", p.expr[start:], p.expr)
+	}
+
+	c := p.c
+	for reg, name := range registerMap {
+		if name == token {
+			return c.regfile.get(reg), nil
+		}
+	}
+
+	switch token {
+	case "fs_base":
+		return c.fsBase, nil
+	case "gs_base":
+		return c.gsBase, nil
+	}
+
+	if c.proc != nil {
+		if address, ok := c.proc.symbols[token]; ok {
+			return address, nil
+		}
+	}
+
+	if strings.HasPrefix(token, "0x") || strings.HasPrefix(token, "0X") {
+		return strconv.ParseUint(token[2:], 16, 64)
+	}
+
+	return strconv.ParseUint(token, 10, 64)
+}
+
+// comparisons are the operators of conditions, the two character ones
+// first so that <= isn't taken for <
+var comparisons = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// evaluateCondition reports whether cond holds: two expressions compared
+// unsigned with one of comparisons, as in rdi == 0 or *(rsp+8) > rax, or
+// a single expression that isn't zero
+func (c *cpu) evaluateCondition(cond string) (bool, error) {
+	for _, op := range comparisons {
+		i := strings.Index(cond, op)
+		if i < 0 {
+			continue
+		}
+
+		a, err := c.evaluate(cond[:i])
+		if err != nil {
+			return false, err
+		}
+
+		b, err := c.evaluate(cond[i+len(op):])
+		if err != nil {
+			return false, err
+		}
+
+		switch op {
+		case "==":
+			return a == b, nil
+		case "!=":
+			return a != b, nil
+		case "<=":
+			return a <= b, nil
+		case ">=":
+			return a >= b, nil
+		case "<":
+			return a < b, nil
+		}
+
+		return a > b, nil
+	}
+
+	v, err := c.evaluate(cond)
+	return v != 0, err
+}
+
+func isOperandByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_' || b == '.'
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type faultKind int
+
+const (
+	invalidOpcode faultKind = iota
+	stackOverflow
+	stackUnderflow
+	aborted
+	pageFault
+	// truncatedInstruction is an instruction running past the end of
+	// the code given to executeCode
+	truncatedInstruction
+	// internalError is a panic in the emulator itself rather than a
+	// fault of the guest
+	internalError
+	// divideError is #DE: division by zero or a quotient too large for
+	// its register
+	divideError
+	// generalProtection is #GP, as for a misaligned SSE memory operand
+	generalProtection
+	// memoryAccess is an access the page's permissions don't allow,
+	// such as a write to .text or a jump into the stack
+	memoryAccess
+	// budgetExceeded stops a run that used up --max-insns or --timeout
+	budgetExceeded
+)
+
+var faultKindMap = map[faultKind]string{
+	invalidOpcode:  "InvalidOpcode",
+	stackOverflow:  "StackOverflow",
+	stackUnderflow: "StackUnderflow",
+	aborted:        "Aborted",
+	pageFault:      "PageFault",
+
+	truncatedInstruction: "TruncatedInstruction",
+	internalError:        "InternalError",
+	divideError:          "DivideError",
+	generalProtection:    "GeneralProtection",
+	memoryAccess:         "MemoryAccess",
+	budgetExceeded:       "BudgetExceeded",
+}
+
+// fault is raised (via panic) by instruction handlers when the guest
+// does something the emulator cannot or will not execute. rip is the
+// address of the faulting instruction.
+type fault struct {
+	kind  faultKind
+	rip   uint64
+	bytes []byte
+	// detail is an optional human readable explanation
+	detail string
+}
+
+func (f *fault) Error() string {
+	msg := fmt.Sprintf("%s fault at 0x%x", faultKindMap[f.kind], f.rip)
+	if len(f.bytes) > 0 {
+		var bs []string
+		for _, b := range f.bytes {
+			bs = append(bs, fmt.Sprintf("0x%02x", b))
+		}
+
+		msg += ": " + strings.Join(bs, " ")
+	}
+
+	if f.detail != "" {
+		msg += ": " + f.detail
+	}
+
+	return msg
+}
+
+// recoverFault turns a recovered fault into an error, re-raising any
+// other panic. It is meant to be called with recover() in a deferred
+// function.
+func recoverFault(r interface{}) error {
+	if r == nil {
+		return nil
+	}
+
+	f, ok := r.(*fault)
+	if !ok {
+		panic(r)
+	}
+
+	return f
+}
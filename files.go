@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	sysClose  = 3
+	sysLseek  = 8
+	sysOpenat = 257
+)
+
+const (
+	errnoEIO     = 5
+	errnoEACCES  = 13
+	errnoEEXIST  = 17
+	errnoENOTDIR = 20
+	errnoEISDIR  = 21
+	errnoEMFILE  = 24
+	errnoESPIPE  = 29
+)
+
+// openat flags, as on Linux x86-64
+const (
+	oAccMode   = 0x3
+	oWronly    = 0x1
+	oRdwr      = 0x2
+	oCreat     = 0x40
+	oExcl      = 0x80
+	oTrunc     = 0x200
+	oAppend    = 0x400
+	oDirectory = 0x10000
+)
+
+// atFDCWD makes openat resolve relative paths against the working
+// directory
+const atFDCWD = -100
+
+// maxFiles bounds the guest's descriptor numbers, as RLIMIT_NOFILE does
+const maxFiles = 1024
+
+// guestFile is a host file the guest has open, with the access it was
+// opened for
+type guestFile struct {
+	file     *os.File
+	readable bool
+	writable bool
+}
+
+// newFileTable returns the descriptors a process starts with: the
+// host's stdin, stdout and stderr
+func newFileTable() []*guestFile {
+	return []*guestFile{
+		{file: os.Stdin, readable: true},
+		{file: os.Stdout, writable: true},
+		{file: os.Stderr, writable: true},
+	}
+}
+
+// openFile returns the host file open as fd
+func (c *cpu) openFile(fd uint64) (*os.File, bool) {
+	if fd >= uint64(len(c.files)) || c.files[fd] == nil {
+		return nil, false
+	}
+
+	return c.files[fd].file, true
+}
+
+// readFile returns the host file the guest may read from as fd
+func (c *cpu) readFile(fd uint64) (*os.File, bool) {
+	if fd >= uint64(len(c.files)) || c.files[fd] == nil || !c.files[fd].readable {
+		return nil, false
+	}
+
+	return c.files[fd].file, true
+}
+
+// writeFile returns the host file the guest may write to as fd
+func (c *cpu) writeFile(fd uint64) (*os.File, bool) {
+	if fd >= uint64(len(c.files)) || c.files[fd] == nil || !c.files[fd].writable {
+		return nil, false
+	}
+
+	return c.files[fd].file, true
+}
+
+// hostErrnos are the errno values Linux returns for the errors of host
+// file operations, which needn't share their numbering
+var hostErrnos = []struct {
+	host  syscall.Errno
+	guest int
+}{
+	{syscall.ENOENT, errnoENOENT},
+	{syscall.EACCES, errnoEACCES},
+	{syscall.EEXIST, errnoEEXIST},
+	{syscall.ENOTDIR, errnoENOTDIR},
+	{syscall.EISDIR, errnoEISDIR},
+	{syscall.ESPIPE, errnoESPIPE},
+	{syscall.EBADF, errnoEBADF},
+	{syscall.EINVAL, errnoEINVAL},
+}
+
+// hostErrno converts the error of a host file operation to an errno,
+// EIO when there is no better one
+func hostErrno(err error) int {
+	for _, e := range hostErrnos {
+		if errors.Is(err, e.host) {
+			return e.guest
+		}
+	}
+
+	return errnoEIO
+}
+
+// allowedPath reports whether path, once symbolic links are resolved,
+// lies in one of the --allow-path directories. Every path is allowed
+// when none were given.
+func (c *cpu) allowedPath(path string) bool {
+	if len(c.allowedPaths) == 0 {
+		return true
+	}
+
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return false
+	}
+
+	for _, dir := range c.allowedPaths {
+		if resolved == dir || strings.HasPrefix(resolved, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolvePath makes path absolute and resolves the symbolic links in
+// it. A file that doesn't exist yet, as one about to be created, is
+// resolved through its directory.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved, nil
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+// sysOpenat opens a host file for the guest at the lowest free
+// descriptor. Paths outside the --allow-path directories fail with
+// EACCES.
+func (c *cpu) sysOpenat() uint64 {
+	dirfd := int64(c.regfile.get(rdi))
+	path, err := c.guestString(c.regfile.get(rsi))
+	if err != nil {
+		return errno(errnoEFAULT)
+	}
+
+	flags := c.regfile.get(rdx)
+	mode := os.FileMode(c.regfile.get(r10) & 0777)
+	if !filepath.IsAbs(path) && dirfd != atFDCWD {
+		dir, ok := c.openFile(uint64(dirfd))
+		if !ok {
+			return errno(errnoEBADF)
+		}
+
+		path = filepath.Join(dir.Name(), path)
+	}
+
+	if !c.allowedPath(path) {
+		return errno(errnoEACCES)
+	}
+
+	fd := 0
+	for fd < len(c.files) && c.files[fd] != nil {
+		fd++
+	}
+
+	if fd == maxFiles {
+		return errno(errnoEMFILE)
+	}
+
+	openFlags := os.O_RDONLY
+	gf := &guestFile{readable: true}
+	switch flags & oAccMode {
+	case oWronly:
+		openFlags = os.O_WRONLY
+		gf = &guestFile{writable: true}
+	case oRdwr:
+		openFlags = os.O_RDWR
+		gf = &guestFile{readable: true, writable: true}
+	}
+
+	for _, f := range []struct{ guest, host int }{
+		{oCreat, os.O_CREATE},
+		{oExcl, os.O_EXCL},
+		{oTrunc, os.O_TRUNC},
+		{oAppend, os.O_APPEND},
+	} {
+		if flags&uint64(f.guest) != 0 {
+			openFlags |= f.host
+		}
+	}
+
+	file, err := os.OpenFile(path, openFlags, mode)
+	if err != nil {
+		return errno(hostErrno(err))
+	}
+
+	if flags&oDirectory != 0 {
+		if info, err := file.Stat(); err != nil || !info.IsDir() {
+			file.Close()
+			return errno(errnoENOTDIR)
+		}
+	}
+
+	gf.file = file
+	if fd == len(c.files) {
+		c.files = append(c.files, gf)
+	} else {
+		c.files[fd] = gf
+	}
+
+	return uint64(fd)
+}
+
+// sysClose frees the descriptor. The host's standard files stay open
+// for the emulator's own use.
+func (c *cpu) sysClose() uint64 {
+	fd := c.regfile.get(rdi)
+	f, ok := c.openFile(fd)
+	if !ok {
+		return errno(errnoEBADF)
+	}
+
+	c.files[fd] = nil
+	if f == os.Stdin || f == os.Stdout || f == os.Stderr {
+		return 0
+	}
+
+	if err := f.Close(); err != nil {
+		return errno(hostErrno(err))
+	}
+
+	return 0
+}
+
+func (c *cpu) sysLseek() uint64 {
+	f, ok := c.openFile(c.regfile.get(rdi))
+	if !ok {
+		return errno(errnoEBADF)
+	}
+
+	whence := c.regfile.get(rdx)
+	if whence > io.SeekEnd {
+		return errno(errnoEINVAL)
+	}
+
+	offset, err := f.Seek(int64(c.regfile.get(rsi)), int(whence))
+	if err != nil {
+		return errno(hostErrno(err))
+	}
+
+	return uint64(offset)
+}
+
+// maxPathLength is PATH_MAX, including the terminator
+const maxPathLength = 4096
+
+// guestString reads the NUL terminated string at addr, failing when it
+// runs out of memory or past maxPathLength
+func (c *cpu) guestString(addr uint64) (string, error) {
+	for n := uint64(0); n < maxPathLength; n++ {
+		b, ok := c.guestBuffer(addr+n, 1)
+		if !ok {
+			return "", errors.New("string out of bounds")
+		}
+
+		if b[0] == 0 {
+			return string(c.mem[addr : addr+n]), nil
+		}
+	}
+
+	return "", errors.New("string too long")
+}
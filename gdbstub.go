@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// gdbRegisters are the 64 bit registers at the start of gdb's amd64
+// 'g' packet, in its order. eflags and the segment selectors follow as
+// 32 bit values.
+var gdbRegisters = []register{rax, rbx, rcx, rdx, rsi, rdi, rbp, rsp, r8, r9, r10, r11, r12, r13, r14, r15, rip}
+
+// gdbSegments are the cs, ss, ds, es, fs and gs selectors reported for
+// a Linux user space process
+var gdbSegments = []uint32{0x33, 0x2b, 0, 0, 0, 0}
+
+// Signals reported in stop replies
+const (
+	sigILL  = 4
+	sigTRAP = 5
+	sigABRT = 6
+	sigFPE  = 8
+	sigKILL = 9
+	sigSEGV = 11
+)
+
+// gdbServer speaks the GDB remote serial protocol to one connected
+// debugger.
+type gdbServer struct {
+	c    *cpu
+	conn io.ReadWriter
+	r    *bufio.Reader
+
+	// detached is set once the debugger has gone away and the program
+	// should run on its own
+	detached bool
+	// exited is set once the program's exit has been reported
+	exited bool
+	// killed is set when gdb kills the program
+	killed bool
+}
+
+// serveGDB waits for gdb to connect on port and serves it until the
+// program exits or gdb detaches, after which the program runs to
+// completion. It returns the program's exit status.
+func (c *cpu) serveGDB(port string) (int, error) {
+	address := port
+	if !strings.Contains(address, ":") {
+		address = "localhost:" + port
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Waiting for gdb on %s", l.Addr())
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	s := &gdbServer{c: c, conn: conn, r: bufio.NewReader(conn)}
+	err = s.serve()
+	conn.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	if s.exited {
+		c.stop()
+		return c.exitStatus(), nil
+	}
+
+	if s.killed {
+		c.stop()
+		return 128 + sigKILL, nil
+	}
+
+	return c.run()
+}
+
+func (s *gdbServer) serve() error {
+	for !s.detached && !s.exited {
+		packet, err := s.readPacket()
+		if err == io.EOF {
+			// gdb going away without detaching lets the program run
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Kill has no reply
+		if packet == "k" {
+			s.killed = true
+			return nil
+		}
+
+		if err := s.writePacket(s.handle(packet)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readPacket returns the data of the next $data#checksum packet,
+// acknowledging it. Acks from gdb and interrupts while the program is
+// stopped are skipped.
+func (s *gdbServer) readPacket() (string, error) {
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		if b != '$' {
+			continue
+		}
+
+		data, err := s.r.ReadString('#')
+		if err != nil {
+			return "", err
+		}
+
+		data = data[:len(data)-1]
+		var sum [2]byte
+		if _, err := io.ReadFull(s.r, sum[:]); err != nil {
+			return "", err
+		}
+
+		want, err := strconv.ParseUint(string(sum[:]), 16, 8)
+		if err != nil || byte(want) != gdbChecksum(data) {
+			// Ask for the packet again
+			if _, err := s.conn.Write([]byte("-")); err != nil {
+				return "", err
+			}
+
+			continue
+		}
+
+		if _, err := s.conn.Write([]byte("+")); err != nil {
+			return "", err
+		}
+
+		return data, nil
+	}
+}
+
+func (s *gdbServer) writePacket(data string) error {
+	_, err := fmt.Fprintf(s.conn, "$%s#%02x", data, gdbChecksum(data))
+	return err
+}
+
+func gdbChecksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+
+	return sum
+}
+
+// handle runs one packet and returns the reply. An empty reply tells
+// gdb the packet is not supported.
+func (s *gdbServer) handle(packet string) string {
+	if packet == "" {
+		return ""
+	}
+
+	c := s.c
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		return fmt.Sprintf("S%02x", sigTRAP)
+
+	case 'g':
+		return s.readRegisters()
+
+	case 'G':
+		return s.writeRegisters(args)
+
+	case 'm':
+		addr, length, ok := parseGDBRange(args)
+		if !ok || !s.inMemory(addr, length) {
+			return "E14"
+		}
+
+		return hex.EncodeToString(c.mem[addr : addr+length])
+
+	case 'M':
+		colon := strings.IndexByte(args, ':')
+		if colon < 0 {
+			return "E01"
+		}
+
+		addr, length, ok := parseGDBRange(args[:colon])
+		data, err := hex.DecodeString(args[colon+1:])
+		if !ok || err != nil || uint64(len(data)) != length {
+			return "E01"
+		}
+
+		if !s.inMemory(addr, length) {
+			return "E14"
+		}
+
+		copy(c.mem[addr:], data)
+		return "OK"
+
+	case 'c', 's':
+		if args != "" {
+			addr, err := strconv.ParseUint(args, 16, 64)
+			if err != nil {
+				return "E01"
+			}
+
+			c.regfile.set(rip, addr)
+		}
+
+		return s.resume(packet[0] == 's')
+
+	case 'Z', 'z':
+		// Software and hardware breakpoints are both checked before
+		// each instruction
+		fields := strings.Split(args, ",")
+		if len(fields) != 3 || (fields[0] != "0" && fields[0] != "1") {
+			return ""
+		}
+
+		addr, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return "E01"
+		}
+
+		if packet[0] == 'Z' {
+			c.breakpoints.add(addr)
+		} else if bp := c.breakpoints.at(addr); bp != nil {
+			c.breakpoints.remove(bp.id)
+		}
+
+		return "OK"
+
+	case 'D':
+		s.detached = true
+		return "OK"
+
+	case 'H':
+		return "OK"
+
+	case 'q':
+		return s.query(args)
+	}
+
+	return ""
+}
+
+// query answers the general queries gdb sends while attaching. The
+// emulated process has a single thread.
+func (s *gdbServer) query(q string) string {
+	switch {
+	case strings.HasPrefix(q, "Supported"):
+		return "PacketSize=4000"
+	case q == "Attached":
+		return "1"
+	case q == "C":
+		return "QC1"
+	case q == "fThreadInfo":
+		return "m1"
+	case q == "sThreadInfo":
+		return "l"
+	}
+
+	return ""
+}
+
+func (s *gdbServer) readRegisters() string {
+	var b strings.Builder
+	for _, reg := range gdbRegisters {
+		b.WriteString(gdbHex(s.c.regfile.get(reg), 8))
+	}
+
+	b.WriteString(gdbHex(s.c.regfile.get(rflags), 4))
+	for _, selector := range gdbSegments {
+		b.WriteString(gdbHex(uint64(selector), 4))
+	}
+
+	return b.String()
+}
+
+// writeRegisters sets the registers from a 'G' packet. The segment
+// selectors can't change and are ignored.
+func (s *gdbServer) writeRegisters(data string) string {
+	raw, err := hex.DecodeString(data)
+	if err != nil || len(raw) < len(gdbRegisters)*8+4 {
+		return "E01"
+	}
+
+	for i, reg := range gdbRegisters {
+		s.c.regfile.set(reg, readBytes(raw, uint64(i*8), 8))
+	}
+
+	s.c.regfile.set(rflags, readBytes(raw, uint64(len(gdbRegisters)*8), 4))
+	return "OK"
+}
+
+// resume runs the program until a breakpoint, a fault or its exit, or
+// for a single instruction when step is set, and returns the stop
+// reply. A breakpoint at the current instruction is stepped over.
+func (s *gdbServer) resume(step bool) string {
+	c := s.c
+	for first := true; ; first = false {
+		if c.exited() {
+			s.exited = true
+			return fmt.Sprintf("W%02x", c.exitStatus()&0xFF)
+		}
+
+		if !first && c.breakpoints.at(c.regfile.get(rip)) != nil {
+			return fmt.Sprintf("S%02x", sigTRAP)
+		}
+
+		if err := c.tryExecute(); err != nil {
+			log.Print(err)
+			return fmt.Sprintf("S%02x", faultSignal(err.(*fault)))
+		}
+
+		if step && !c.exited() {
+			return fmt.Sprintf("S%02x", sigTRAP)
+		}
+	}
+}
+
+// faultSignal is the signal Linux would deliver for f
+func faultSignal(f *fault) int {
+	switch f.kind {
+	case invalidOpcode:
+		return sigILL
+	case aborted:
+		return sigABRT
+	case divideError:
+		return sigFPE
+	}
+
+	return sigSEGV
+}
+
+func (s *gdbServer) inMemory(addr, length uint64) bool {
+	return addr <= uint64(len(s.c.mem)) && length <= uint64(len(s.c.mem))-addr
+}
+
+// parseGDBRange parses the "addr,length" of memory packets
+func parseGDBRange(args string) (uint64, uint64, bool) {
+	comma := strings.IndexByte(args, ',')
+	if comma < 0 {
+		return 0, 0, false
+	}
+
+	addr, err := strconv.ParseUint(args[:comma], 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	length, err := strconv.ParseUint(args[comma+1:], 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return addr, length, true
+}
+
+// gdbHex encodes the low size bytes of v in target (little endian)
+// byte order
+func gdbHex(v uint64, size int) string {
+	b := make([]byte, size)
+	writeBytes(b, 0, size, v)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,96 @@
+package main
+
+// hookAction is returned by pre-instruction hooks to control whether
+// the instruction runs.
+type hookAction int
+
+const (
+	hookContinue hookAction = iota
+	// hookSkip moves rip past the instruction without executing it
+	hookSkip
+	// hookAbort stops execution with an Aborted fault, leaving rip on
+	// the instruction
+	hookAbort
+)
+
+// instructionEvent describes the instruction a hook is called for.
+type instructionEvent struct {
+	rip uint64
+	// code holds the instruction's bytes. Before execution its length
+	// comes from the disassembler and covers only the bytes examined
+	// when the instruction could not be decoded.
+	code []byte
+
+	// opcode and before, the register file as it was before the
+	// instruction, are only set for post-instruction hooks.
+	opcode uint16
+	before registerFile
+}
+
+type preInstructionHook func(c *cpu, ev *instructionEvent) hookAction
+type postInstructionHook func(c *cpu, ev *instructionEvent)
+
+type hooks struct {
+	pre  []preInstructionHook
+	post []postInstructionHook
+}
+
+// addPreHook registers h to run before every instruction, after any
+// hooks registered earlier. The first hook not returning hookContinue
+// decides the instruction's fate and later hooks are not called.
+func (c *cpu) addPreHook(h preInstructionHook) {
+	if c.hooks == nil {
+		c.hooks = &hooks{}
+	}
+
+	c.hooks.pre = append(c.hooks.pre, h)
+}
+
+// addPostHook registers h to run after every instruction that executed
+// without faulting, after any hooks registered earlier.
+func (c *cpu) addPostHook(h postInstructionHook) {
+	if c.hooks == nil {
+		c.hooks = &hooks{}
+	}
+
+	c.hooks.post = append(c.hooks.post, h)
+}
+
+func (c *cpu) instructionLength(ip uint64) int {
+	_, n, _ := disassemble(c.mem[ip:], ip)
+	return n
+}
+
+// executeHooked is execute with hooks registered.
+func (c *cpu) executeHooked() {
+	ip := c.regfile.get(rip)
+	ev := &instructionEvent{rip: ip}
+
+	if len(c.hooks.pre) > 0 {
+		c.checkFetch(ip)
+		ev.code = c.mem[ip : ip+uint64(c.instructionLength(ip))]
+		for _, h := range c.hooks.pre {
+			switch h(c, ev) {
+			case hookSkip:
+				c.regfile.set(rip, ip+uint64(len(ev.code)))
+				return
+			case hookAbort:
+				panic(&fault{kind: aborted, rip: ip, detail: "stopped by hook"})
+			}
+		}
+	}
+
+	if len(c.hooks.post) == 0 {
+		c.step()
+		return
+	}
+
+	ev.before = *c.regfile
+	opcode, length := c.step()
+	ev.opcode = opcode
+	ev.code = c.mem[ip : ip+uint64(length)]
+
+	for _, h := range c.hooks.post {
+		h(c, ev)
+	}
+}
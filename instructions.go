@@ -0,0 +1,863 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+type opcode struct {
+	mnemonic string
+	exec     func(c *cpu, ctx *decodeContext)
+}
+
+// oneByteOpcodes and twoByteOpcodes dispatch on the opcode byte, the
+// latter for instructions escaped by 0x0F. Entries without exec are
+// invalid opcodes. The prefixed tables hold the 0x0F instructions
+// selected by a mandatory 0x66, 0xF2 or 0xF3 prefix, which fall back to
+// twoByteOpcodes.
+var (
+	oneByteOpcodes [256]opcode
+	twoByteOpcodes [256]opcode
+
+	twoByteOpcodes66 [256]opcode
+	twoByteOpcodesF2 [256]opcode
+	twoByteOpcodesF3 [256]opcode
+)
+
+func defineOpcode(table *[256]opcode, op byte, mnemonic string, exec func(c *cpu, ctx *decodeContext)) {
+	table[op] = opcode{mnemonic, exec}
+}
+
+// twoByteTable returns the table the 0x0F opcode op dispatches through
+// with the mandatory prefix given, 0 for none
+func twoByteTable(prefix, op byte) *[256]opcode {
+	var table *[256]opcode
+	switch prefix {
+	case 0x66:
+		table = &twoByteOpcodes66
+	case 0xF2:
+		table = &twoByteOpcodesF2
+	case 0xF3:
+		table = &twoByteOpcodesF3
+	}
+
+	if table == nil || table[op].exec == nil {
+		return &twoByteOpcodes
+	}
+
+	return table
+}
+
+// opcodeName names op. 0x0F opcodes shared by instructions with
+// different mandatory prefixes are named by all of them, as in
+// movups/movss/movsd.
+func opcodeName(op uint16) string {
+	if op <= 0xFF {
+		if name := oneByteOpcodes[op].mnemonic; name != "" {
+			return name
+		}
+
+		return "?"
+	}
+
+	var names []string
+	for _, table := range []*[256]opcode{&twoByteOpcodes, &twoByteOpcodes66, &twoByteOpcodesF3, &twoByteOpcodesF2} {
+		if name := table[op&0xFF].mnemonic; name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "?"
+	}
+
+	return strings.Join(names, "/")
+}
+
+func init() {
+	for op := byte(0); op < 8; op++ {
+		defineOpcode(&oneByteOpcodes, op<<3|0, aluNames[op], execALURMReg)
+		defineOpcode(&oneByteOpcodes, op<<3|1, aluNames[op], execALURMReg)
+		defineOpcode(&oneByteOpcodes, op<<3|2, aluNames[op], execALURegRM)
+		defineOpcode(&oneByteOpcodes, op<<3|3, aluNames[op], execALURegRM)
+		defineOpcode(&oneByteOpcodes, op<<3|4, aluNames[op], execALUAccImm)
+		defineOpcode(&oneByteOpcodes, op<<3|5, aluNames[op], execALUAccImm)
+	}
+
+	defineOpcode(&oneByteOpcodes, 0x0F, "", execTwoByte)
+	for r := byte(0); r < 8; r++ {
+		defineOpcode(&oneByteOpcodes, 0x50+r, "push", execPush)
+		defineOpcode(&oneByteOpcodes, 0x58+r, "pop", execPop)
+		defineOpcode(&oneByteOpcodes, 0x90+r, "xchg", execXchgAcc)
+		defineOpcode(&oneByteOpcodes, 0xB8+r, "mov", execMovRegImm)
+	}
+
+	defineOpcode(&oneByteOpcodes, 0x63, "movsxd", execMovsxd)
+	defineOpcode(&oneByteOpcodes, 0x68, "push", execPushImm)
+	defineOpcode(&oneByteOpcodes, 0x69, "imul", execIMulImm)
+	defineOpcode(&oneByteOpcodes, 0x6A, "push", execPushImm)
+	defineOpcode(&oneByteOpcodes, 0x6B, "imul", execIMulImm)
+	for cc := byte(0); cc < 16; cc++ {
+		defineOpcode(&oneByteOpcodes, 0x70+cc, "j"+conditionNames[cc], execJccRel8)
+	}
+
+	defineOpcode(&oneByteOpcodes, 0x80, "grp1", execALURMImm)
+	defineOpcode(&oneByteOpcodes, 0x81, "grp1", execALURMImm)
+	defineOpcode(&oneByteOpcodes, 0x83, "grp1", execALURMImm)
+	defineOpcode(&oneByteOpcodes, 0x84, "test", execTestRMReg)
+	defineOpcode(&oneByteOpcodes, 0x85, "test", execTestRMReg)
+	defineOpcode(&oneByteOpcodes, 0x86, "xchg", execXchgRMReg)
+	defineOpcode(&oneByteOpcodes, 0x87, "xchg", execXchgRMReg)
+	defineOpcode(&oneByteOpcodes, 0x88, "mov", execMovRMReg)
+	defineOpcode(&oneByteOpcodes, 0x89, "mov", execMovRMReg)
+	defineOpcode(&oneByteOpcodes, 0x8A, "mov", execMovRegRM)
+	defineOpcode(&oneByteOpcodes, 0x8B, "mov", execMovRegRM)
+	defineOpcode(&oneByteOpcodes, 0x8D, "lea", execLea)
+	defineOpcode(&oneByteOpcodes, 0x90, "nop", execXchgAcc)
+	defineOpcode(&oneByteOpcodes, 0x98, "cdqe", execSignExtendAcc)
+	defineOpcode(&oneByteOpcodes, 0x99, "cqo", execSignExtendAcc)
+	defineOpcode(&oneByteOpcodes, 0x9C, "pushfq", execPushf)
+	defineOpcode(&oneByteOpcodes, 0x9D, "popfq", execPopf)
+	defineOpcode(&oneByteOpcodes, 0x9E, "sahf", execSahf)
+	defineOpcode(&oneByteOpcodes, 0x9F, "lahf", execLahf)
+	defineOpcode(&oneByteOpcodes, 0xA8, "test", execTestAccImm)
+	defineOpcode(&oneByteOpcodes, 0xA9, "test", execTestAccImm)
+	defineOpcode(&oneByteOpcodes, 0xC0, "grp2", execShift)
+	defineOpcode(&oneByteOpcodes, 0xC1, "grp2", execShift)
+	defineOpcode(&oneByteOpcodes, 0xC3, "ret", execRet)
+	defineOpcode(&oneByteOpcodes, 0xC6, "mov", execMovRMImm)
+	defineOpcode(&oneByteOpcodes, 0xC7, "mov", execMovRMImm)
+	defineOpcode(&oneByteOpcodes, 0xC9, "leave", execLeave)
+	for op := byte(0xD0); op <= 0xD3; op++ {
+		defineOpcode(&oneByteOpcodes, op, "grp2", execShift)
+	}
+	defineOpcode(&oneByteOpcodes, 0xE8, "call", execCallRel32)
+	defineOpcode(&oneByteOpcodes, 0xE9, "jmp", execJmpRel32)
+	defineOpcode(&oneByteOpcodes, 0xF6, "grp3", execGroup3)
+	defineOpcode(&oneByteOpcodes, 0xF7, "grp3", execGroup3)
+	defineOpcode(&oneByteOpcodes, 0xEB, "jmp", execJmpRel8)
+	defineOpcode(&oneByteOpcodes, 0xFC, "cld", func(c *cpu, ctx *decodeContext) { c.setFlag(flagDF, false) })
+	defineOpcode(&oneByteOpcodes, 0xFD, "std", func(c *cpu, ctx *decodeContext) { c.setFlag(flagDF, true) })
+	defineOpcode(&oneByteOpcodes, 0xFE, "grp4", execIncDec)
+	defineOpcode(&oneByteOpcodes, 0xFF, "grp5", execGroup5)
+
+	defineOpcode(&twoByteOpcodes, 0x05, "syscall", execSyscall)
+	defineOpcode(&twoByteOpcodes, 0x1E, "nop", execNopRM)
+	defineOpcode(&twoByteOpcodes, 0x1F, "nop", execNopRM)
+	defineOpcode(&twoByteOpcodes, 0x31, "rdtsc", execRdtsc)
+	for cc := byte(0); cc < 16; cc++ {
+		defineOpcode(&twoByteOpcodes, 0x40+cc, "cmov"+conditionNames[cc], execCmov)
+		defineOpcode(&twoByteOpcodes, 0x80+cc, "j"+conditionNames[cc], execJccRel32)
+		defineOpcode(&twoByteOpcodes, 0x90+cc, "set"+conditionNames[cc], execSetcc)
+	}
+	defineOpcode(&twoByteOpcodes, 0xA2, "cpuid", execCpuid)
+	for op := byte(0); op < 4; op++ {
+		defineOpcode(&twoByteOpcodes, 0xA3+op<<3, bitOpNames[op], execBitTestReg)
+	}
+	defineOpcode(&twoByteOpcodes, 0xB0, "cmpxchg", execCmpxchg)
+	defineOpcode(&twoByteOpcodes, 0xB1, "cmpxchg", execCmpxchg)
+	defineOpcode(&twoByteOpcodes, 0xAF, "imul", execIMulRegRM)
+	defineOpcode(&twoByteOpcodes, 0xB6, "movzx", execMovExtend)
+	defineOpcode(&twoByteOpcodes, 0xB7, "movzx", execMovExtend)
+	defineOpcode(&twoByteOpcodes, 0xBA, "grp8", execBitTestImm)
+	defineOpcode(&twoByteOpcodes, 0xBC, "bsf", execBitScan)
+	defineOpcode(&twoByteOpcodes, 0xBD, "bsr", execBitScan)
+	defineOpcode(&twoByteOpcodes, 0xBE, "movsx", execMovExtend)
+	defineOpcode(&twoByteOpcodes, 0xBF, "movsx", execMovExtend)
+	defineOpcode(&twoByteOpcodes, 0xC0, "xadd", execXadd)
+	defineOpcode(&twoByteOpcodes, 0xC1, "xadd", execXadd)
+	for r := byte(0); r < 8; r++ {
+		defineOpcode(&twoByteOpcodes, 0xC8+r, "bswap", execBswap)
+	}
+
+	defineOpcode(&twoByteOpcodesF3, 0xBC, "tzcnt", execTzcnt)
+}
+
+func execTwoByte(c *cpu, ctx *decodeContext) {
+	ctx.ip++
+	ctx.opcode = byte(c.fetch(ctx.ip, 1))
+	ctx.escaped = true
+	c.dispatch(twoByteTable(ctx.mandatoryPrefix, ctx.opcode), ctx)
+}
+
+// immediateOperand reads an immediate of the operand width, at most 32
+// bits, sign extended to 64 bits.
+func (c *cpu) immediateOperand(ctx *decodeContext, m *modrm) uint64 {
+	if ctx.widthPrefix == 16 {
+		return c.immediate(ctx, m, 2)
+	}
+
+	return signExtend(c.immediate(ctx, m, 4), 32)
+}
+
+// operandWidth is 8 for the even opcode of the pairs, such as 0x00 and
+// 0x01, whose even opcode has byte operands, else the operand size
+func operandWidth(ctx *decodeContext) int {
+	if ctx.opcode&1 == 0 {
+		return 8
+	}
+
+	return ctx.widthPrefix
+}
+
+// alu r/m8, r8 or r/m16/32/64, r16/32/64
+func execALURMReg(c *cpu, ctx *decodeContext) {
+	op := ctx.opcode >> 3
+	width := operandWidth(ctx)
+	m := c.decodeModRM(ctx)
+	result := aluOps[op](c, c.readRM(m, width), c.readRM(m.regOperand(ctx), width), width)
+	if op != aluCmp {
+		c.writeRM(m, width, result)
+	}
+}
+
+// alu r8, r/m8 or r16/32/64, r/m16/32/64
+func execALURegRM(c *cpu, ctx *decodeContext) {
+	op := ctx.opcode >> 3
+	width := operandWidth(ctx)
+	m := c.decodeModRM(ctx)
+	reg := m.regOperand(ctx)
+	result := aluOps[op](c, c.readRM(reg, width), c.readRM(m, width), width)
+	if op != aluCmp {
+		c.writeRM(reg, width, result)
+	}
+}
+
+// alu r/m8, imm8 (0x80), r/m16/32/64, imm16/32 (0x81) or imm8 (0x83).
+// The /digit selects the operation.
+func execALURMImm(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	m := c.decodeModRM(ctx)
+	var imm uint64
+	switch ctx.opcode {
+	case 0x80:
+		width = 8
+		imm = c.immediate(ctx, &m, 1)
+	case 0x83:
+		imm = signExtend(c.immediate(ctx, &m, 1), 8)
+	default:
+		imm = c.immediateOperand(ctx, &m)
+	}
+
+	result := aluOps[m.digit](c, c.readRM(m, width), imm, width)
+	if m.digit != aluCmp {
+		c.writeRM(m, width, result)
+	}
+}
+
+// alu al, imm8 (even opcodes) or rax, imm16/32, with the immediate sign
+// extended for 64 bit operands. These short forms have no ModRM byte.
+func execALUAccImm(c *cpu, ctx *decodeContext) {
+	op := ctx.opcode >> 3
+	width, imm := c.accumulatorImmediate(ctx)
+	result := aluOps[op](c, c.regfile.get(rax)&widthMask(width), imm, width)
+	if op != aluCmp {
+		c.regfile.setWidth(rax, width, result)
+	}
+}
+
+// test al, imm8 (0xA8) or rax, imm16/32 (0xA9)
+func execTestAccImm(c *cpu, ctx *decodeContext) {
+	width, imm := c.accumulatorImmediate(ctx)
+	c.logic(c.regfile.get(rax)&imm, width)
+}
+
+// test r/m8, r8 (0x84) or r/m16/32/64, r16/32/64 (0x85)
+func execTestRMReg(c *cpu, ctx *decodeContext) {
+	width := operandWidth(ctx)
+	m := c.decodeModRM(ctx)
+	c.logic(c.readRM(m, width)&c.readRM(m.regOperand(ctx), width), width)
+}
+
+// xchg r/m8, r8 (0x86) or r/m16/32/64, r16/32/64 (0x87). With a memory
+// operand it is locked whether or not there is a LOCK prefix, which
+// changes nothing with a single thread.
+func execXchgRMReg(c *cpu, ctx *decodeContext) {
+	width := operandWidth(ctx)
+	m := c.decodeModRM(ctx)
+	reg := m.regOperand(ctx)
+	a, b := c.readRM(m, width), c.readRM(reg, width)
+	c.writeRM(m, width, b)
+	c.writeRM(reg, width, a)
+}
+
+// accumulatorImmediate reads the immediate of the short accumulator
+// forms, whose even opcodes operate on al with an imm8
+func (c *cpu) accumulatorImmediate(ctx *decodeContext) (int, uint64) {
+	if ctx.opcode&1 == 0 {
+		return 8, c.immediate(ctx, nil, 1)
+	}
+
+	return ctx.widthPrefix, c.immediateOperand(ctx, nil)
+}
+
+// cmpxchg r/m8, r8 (0xB0) or r/m16/32/64, r16/32/64 compares the
+// accumulator with the destination as cmp does. When they are equal the
+// source is stored, else the destination is loaded into the
+// accumulator. A memory destination is written back even then, as the
+// hardware does; a register destination is left alone.
+func execCmpxchg(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	if ctx.opcode == 0xB0 {
+		width = 8
+	}
+
+	m := c.decodeModRM(ctx)
+	dest := c.readRM(m, width)
+	aluOps[aluCmp](c, c.regfile.get(rax)&widthMask(width), dest, width)
+	if c.flag(flagZF) {
+		c.writeRM(m, width, c.readRM(m.regOperand(ctx), width))
+		return
+	}
+
+	if m.mod != 0b11 {
+		c.writeRM(m, width, dest)
+	}
+
+	c.regfile.setWidth(rax, width, dest)
+}
+
+// xadd r/m8, r8 (0xC0) or r/m16/32/64, r16/32/64 stores the sum in the
+// destination and its old value in the source register, setting the
+// flags as add does
+func execXadd(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	if ctx.opcode == 0xC0 {
+		width = 8
+	}
+
+	m := c.decodeModRM(ctx)
+	reg := m.regOperand(ctx)
+	dest := c.readRM(m, width)
+	sum := c.add(dest, c.readRM(reg, width), width)
+	// The destination is written last, so it wins when both operands
+	// are the same register
+	c.writeRM(reg, width, dest)
+	c.writeRM(m, width, sum)
+}
+
+func execPush(c *cpu, ctx *decodeContext) {
+	c.push(c.regfile.get(ctx.opcodeRegister(0x50)))
+}
+
+func execPop(c *cpu, ctx *decodeContext) {
+	c.regfile.set(ctx.opcodeRegister(0x58), c.pop())
+}
+
+// push imm32 (0x68) or imm8 (0x6A), sign extended to 64 bits
+func execPushImm(c *cpu, ctx *decodeContext) {
+	if ctx.opcode == 0x6A {
+		c.push(signExtend(c.immediate(ctx, nil, 1), 8))
+		return
+	}
+
+	c.push(signExtend(c.immediate(ctx, nil, 4), 32))
+}
+
+// movsxd r64, r/m32 sign extends; without REX.W it is a plain 32 or 16
+// bit mov
+func execMovsxd(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	m := c.decodeModRM(ctx)
+	if width == 64 {
+		c.regfile.set(register(m.reg), signExtend(c.readRM(m, 32), 32))
+		return
+	}
+
+	c.regfile.setWidth(register(m.reg), width, c.readRM(m, width))
+}
+
+// imul r16/32/64, r/m16/32/64
+func execIMulRegRM(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	m := c.decodeModRM(ctx)
+	reg := register(m.reg)
+	c.regfile.setWidth(reg, width, c.imul(c.regfile.get(reg), c.readRM(m, width), width))
+}
+
+// imul r16/32/64, r/m16/32/64, imm16/32 (0x69) or imm8 (0x6B)
+func execIMulImm(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	m := c.decodeModRM(ctx)
+	var imm uint64
+	if ctx.opcode == 0x6B {
+		imm = signExtend(c.immediate(ctx, &m, 1), 8)
+	} else {
+		imm = c.immediateOperand(ctx, &m)
+	}
+
+	c.regfile.setWidth(register(m.reg), width, c.imul(c.readRM(m, width), imm, width))
+}
+
+func execJccRel8(c *cpu, ctx *decodeContext) {
+	rel := signExtend(c.immediate(ctx, nil, 1), 8)
+	if c.condition(ctx.opcode & 0xF) {
+		ctx.jump(ctx.ip + 1 + rel)
+	}
+}
+
+func execJccRel32(c *cpu, ctx *decodeContext) {
+	rel := signExtend(c.immediate(ctx, nil, 4), 32)
+	if c.condition(ctx.opcode & 0xF) {
+		ctx.jump(ctx.ip + 1 + rel)
+	}
+}
+
+func execCallRel32(c *cpu, ctx *decodeContext) {
+	rel := signExtend(c.immediate(ctx, nil, 4), 32)
+	c.push(ctx.ip + 1)
+	ctx.jump(ctx.ip + 1 + rel)
+}
+
+func execJmpRel8(c *cpu, ctx *decodeContext) {
+	rel := signExtend(c.immediate(ctx, nil, 1), 8)
+	ctx.jump(ctx.ip + 1 + rel)
+}
+
+func execJmpRel32(c *cpu, ctx *decodeContext) {
+	rel := signExtend(c.immediate(ctx, nil, 4), 32)
+	ctx.jump(ctx.ip + 1 + rel)
+}
+
+// mov r/m8, r8 (0x88) or r/m16/32/64, r16/32/64 (0x89)
+func execMovRMReg(c *cpu, ctx *decodeContext) {
+	width := operandWidth(ctx)
+	m := c.decodeModRM(ctx)
+	c.writeRM(m, width, c.readRM(m.regOperand(ctx), width))
+}
+
+// mov r8, r/m8 (0x8A) or r16/32/64, r/m16/32/64 (0x8B)
+func execMovRegRM(c *cpu, ctx *decodeContext) {
+	width := operandWidth(ctx)
+	m := c.decodeModRM(ctx)
+	c.writeRM(m.regOperand(ctx), width, c.readRM(m, width))
+}
+
+// movzx and movsx r16/32/64, r/m8 (0x0F B6 and BE) or r/m16 (0x0F B7
+// and BF)
+func execMovExtend(c *cpu, ctx *decodeContext) {
+	source := 8
+	if ctx.opcode&1 != 0 {
+		source = 16
+	}
+
+	m := c.decodeModRM(ctx)
+	v := c.readRM(m, source)
+	if ctx.opcode >= 0xBE {
+		v = signExtend(v, source)
+	}
+
+	c.regfile.setWidth(register(m.reg), ctx.widthPrefix, v)
+}
+
+// cmovcc r16/32/64, r/m16/32/64 always reads its source, so a bad
+// address faults even when the condition is false. A 32 bit destination
+// has its upper half cleared either way.
+func execCmov(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	m := c.decodeModRM(ctx)
+	reg := register(m.reg)
+	v := c.readRM(m, width)
+	if !c.condition(ctx.opcode & 0xF) {
+		v = c.regfile.get(reg)
+	}
+
+	c.regfile.setWidth(reg, width, v)
+}
+
+// setcc r/m8 stores 1 when the condition holds, else 0
+func execSetcc(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	var v uint64
+	if c.condition(ctx.opcode & 0xF) {
+		v = 1
+	}
+
+	c.writeRM(m, 8, v)
+}
+
+// cbw/cwde/cdqe (0x98) sign extend the lower half of the accumulator
+// into the whole of it; cwd/cdq/cqo (0x99) sign extend it into rdx
+func execSignExtendAcc(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	ax := c.regfile.get(rax)
+	if ctx.opcode == 0x98 {
+		c.regfile.setWidth(rax, width, signExtend(ax, width/2))
+		return
+	}
+
+	var dx uint64
+	if ax&signBit(width) != 0 {
+		dx = ^uint64(0)
+	}
+
+	c.regfile.setWidth(rdx, width, dx)
+}
+
+// lea r16/32/64, m
+func execLea(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	if m.mod == 0b11 {
+		c.invalidOpcode(ctx)
+	}
+
+	// The effective address is the offset within the segment
+	address := m.address - c.segmentBase(ctx.segment)
+	c.regfile.setWidth(register(m.reg), ctx.widthPrefix, address)
+}
+
+// mov r16/32/64, imm16/32/64
+func execMovRegImm(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	c.regfile.setWidth(ctx.opcodeRegister(0xB8), width, c.immediate(ctx, nil, width/8))
+}
+
+// xchg rax, r16/32/64 (0x90+r). 0x90 without REX.B would exchange rax
+// with itself and is nop, which leaves even the upper half of rax alone.
+func execXchgAcc(c *cpu, ctx *decodeContext) {
+	reg := ctx.opcodeRegister(0x90)
+	if reg == rax {
+		return
+	}
+
+	width := ctx.widthPrefix
+	a, b := c.regfile.get(rax), c.regfile.get(reg)
+	c.regfile.setWidth(rax, width, b)
+	c.regfile.setWidth(reg, width, a)
+}
+
+// shift and rotate r/m8 (even opcodes) or r/m16/32/64 by imm8 (0xC0 and
+// 0xC1), by one (0xD0 and 0xD1) or by cl (0xD2 and 0xD3). The /digit
+// selects the operation.
+func execShift(c *cpu, ctx *decodeContext) {
+	width := operandWidth(ctx)
+	m := c.decodeModRM(ctx)
+	var count uint64
+	switch ctx.opcode {
+	case 0xC0, 0xC1:
+		count = c.immediate(ctx, &m, 1)
+	case 0xD0, 0xD1:
+		count = 1
+	default:
+		count = c.regfile.get(rcx) & 0xFF
+	}
+
+	c.writeRM(m, width, c.shift(m.digit, c.readRM(m, width), count, width))
+}
+
+// mov r/m8, imm8 (0xC6) or r/m16/32/64, imm16/32 (0xC7)
+func execMovRMImm(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	if ctx.opcode == 0xC6 {
+		c.writeRM(m, 8, c.immediate(ctx, &m, 1))
+		return
+	}
+
+	c.writeRM(m, ctx.widthPrefix, c.immediateOperand(ctx, &m))
+}
+
+// group 3 (0xF6 and 0xF7) operates on r/m8 or r/m16/32/64 as the
+// /digit selects: test with an immediate (/0, and its alias /1), not,
+// neg, mul, imul, div and idiv
+func execGroup3(c *cpu, ctx *decodeContext) {
+	width := operandWidth(ctx)
+	m := c.decodeModRM(ctx)
+	switch m.digit {
+	case 0, 1:
+		var imm uint64
+		if width == 8 {
+			imm = c.immediate(ctx, &m, 1)
+		} else {
+			imm = c.immediateOperand(ctx, &m)
+		}
+
+		c.logic(c.readRM(m, width)&imm, width)
+	case 2:
+		c.writeRM(m, width, ^c.readRM(m, width))
+	case 3:
+		c.writeRM(m, width, c.sub(0, c.readRM(m, width), width))
+	case 4, 5:
+		c.multiply(m, width, m.digit == 5)
+	default:
+		c.divideAccumulator(ctx, m, width)
+	}
+}
+
+// multiply is the one operand mul and imul, which multiply rax, or al
+// for a byte operand, by the operand leaving the double width product
+// in rdx:rax, or ax. CF and OF are set when the upper half is needed,
+// which for imul is when it is not just the sign extension of the
+// lower half.
+func (c *cpu) multiply(m modrm, width int, signed bool) {
+	mask := widthMask(width)
+	a, b := c.regfile.get(rax)&mask, c.readRM(m, width)
+	var hi, lo uint64
+	if signed {
+		sa, sb := signExtend(a, width), signExtend(b, width)
+		hi, lo = bits.Mul64(sa, sb)
+		if int64(sa) < 0 {
+			hi -= sb
+		}
+		if int64(sb) < 0 {
+			hi -= sa
+		}
+	} else {
+		hi, lo = bits.Mul64(a, b)
+	}
+
+	if width < 64 {
+		// Both halves fit in lo, the product being at most 64 bits
+		hi = lo >> width & mask
+		lo &= mask
+	}
+
+	overflow := hi != 0
+	if signed {
+		overflow = hi != uint64(int64(signExtend(lo, width))>>63)&mask
+	}
+
+	c.setFlag(flagCF, overflow)
+	c.setFlag(flagOF, overflow)
+	if width == 8 {
+		c.regfile.set16(rax, hi<<8|lo)
+		return
+	}
+
+	c.regfile.setWidth(rax, width, lo)
+	c.regfile.setWidth(rdx, width, hi)
+}
+
+// divideAccumulator is div and idiv (/6 and /7), which divide rdx:rax, or ax for a
+// byte divisor, leaving the quotient in rax, or al, and the remainder
+// in rdx, or ah. A zero divisor and a quotient too large for the
+// operand width raise a divide error. The flags are left as they were,
+// being undefined.
+func (c *cpu) divideAccumulator(ctx *decodeContext, m modrm, width int) {
+	divisor := c.readRM(m, width)
+	ax := c.regfile.get(rax)
+	hi, lo := c.regfile.get(rdx)&widthMask(width), ax&widthMask(width)
+	if width == 8 {
+		hi, lo = ax>>8&0xFF, ax&0xFF
+	}
+
+	op := divide
+	if m.digit == 7 {
+		op = divideSigned
+	}
+
+	q, r, ok := op(hi, lo, divisor, width)
+	if !ok {
+		detail := fmt.Sprintf("quotient overflows %d bits", width)
+		if divisor == 0 {
+			detail = "division by zero"
+		}
+
+		panic(&fault{kind: divideError, rip: ctx.start, detail: detail})
+	}
+
+	if width == 8 {
+		c.regfile.set(rax, ax&^0xFFFF|r<<8|q)
+		return
+	}
+
+	c.regfile.setWidth(rax, width, q)
+	c.regfile.setWidth(rdx, width, r)
+}
+
+// inc and dec r/m8 (0xFE /0 and /1)
+func execIncDec(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	if m.digit > 1 {
+		c.invalidGroupOpcode(ctx, m.digit)
+	}
+
+	c.incDec(m, 8)
+}
+
+// group 5 (0xFF) is inc and dec r/m16/32/64 (/0 and /1) and the near
+// call, jmp and push of r/m64 (/2, /4 and /6)
+func execGroup5(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	switch m.digit {
+	case 0, 1:
+		c.incDec(m, ctx.widthPrefix)
+	case 2:
+		// The target is read before the push, which may overwrite it
+		target := c.readRM(m, 64)
+		c.push(ctx.ip + 1)
+		ctx.jump(target)
+	case 4:
+		ctx.jump(c.readRM(m, 64))
+	case 6:
+		c.push(c.readRM(m, 64))
+	default:
+		c.invalidGroupOpcode(ctx, m.digit)
+	}
+}
+
+// incDec adds or subtracts one (/0 and /1) as add and sub do, but
+// leaves CF as it was
+func (c *cpu) incDec(m modrm, width int) {
+	cf := c.flag(flagCF)
+	op := c.add
+	if m.digit == 1 {
+		op = c.sub
+	}
+
+	result := op(c.readRM(m, width), 1, width)
+	c.setFlag(flagCF, cf)
+	c.writeRM(m, width, result)
+}
+
+func execPushf(c *cpu, ctx *decodeContext) {
+	c.push(c.regfile.get(rflags))
+}
+
+func execPopf(c *cpu, ctx *decodeContext) {
+	flags := c.regfile.get(rflags)
+	c.regfile.set(rflags, flags&^userFlags|c.pop()&userFlags|flagReserved)
+}
+
+func execSahf(c *cpu, ctx *decodeContext) {
+	ah := c.regfile.get(rax) >> 8 & 0xFF
+	flags := c.regfile.get(rflags)
+	c.regfile.set(rflags, flags&^lahfFlags|ah&lahfFlags)
+}
+
+func execLahf(c *cpu, ctx *decodeContext) {
+	ah := c.regfile.get(rflags)&lahfFlags | flagReserved
+	v := c.regfile.get(rax)
+	c.regfile.set(rax, v&^0xFF00|ah<<8)
+}
+
+func execRet(c *cpu, ctx *decodeContext) {
+	ctx.jump(c.pop())
+}
+
+func execLeave(c *cpu, ctx *decodeContext) {
+	c.regfile.set(rsp, c.regfile.get(rbp))
+	c.regfile.set(rbp, c.pop())
+}
+
+func execSyscall(c *cpu, ctx *decodeContext) {
+	c.regfile.set(rcx, ctx.ip+1)
+	c.regfile.set(r11, c.regfile.get(rflags))
+	c.syscall()
+}
+
+// nop r/m16/32
+func execNopRM(c *cpu, ctx *decodeContext) {
+	c.decodeModRM(ctx)
+}
+
+// bswap r32/64
+func execBswap(c *cpu, ctx *decodeContext) {
+	reg := ctx.opcodeRegister(0xC8)
+	v := c.regfile.get(reg)
+	switch ctx.widthPrefix {
+	case 64:
+		c.regfile.set(reg, bits.ReverseBytes64(v))
+	case 32:
+		c.regfile.set32(reg, uint64(bits.ReverseBytes32(uint32(v))))
+	default:
+		// The result of a 16-bit bswap is undefined; hardware commonly
+		// clears the low word, so do the same.
+		c.regfile.set16(reg, 0)
+	}
+}
+
+// bsf and bsr r16/32/64, r/m16/32/64 store the index of the lowest or
+// highest set bit and clear ZF. A zero source sets ZF and leaves the
+// destination alone, as processors do though it is undefined.
+func execBitScan(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	m := c.decodeModRM(ctx)
+	v := c.readRM(m, width)
+	c.setFlag(flagZF, v == 0)
+	if v == 0 {
+		return
+	}
+
+	index := bits.TrailingZeros64(v)
+	if ctx.opcode == 0xBD {
+		index = 63 - bits.LeadingZeros64(v)
+	}
+
+	c.regfile.setWidth(register(m.reg), width, uint64(index))
+}
+
+// tzcnt r16/32/64, r/m16/32/64 counts the trailing zero bits, the
+// operand width for a zero source, setting CF for a zero source and ZF
+// for a zero count. Processors without BMI1 ignore the REP prefix and
+// run bsf, so that is what tzcnt does unless bmi1 is advertised.
+func execTzcnt(c *cpu, ctx *decodeContext) {
+	if !c.cpuidFeatures["bmi1"] {
+		execBitScan(c, ctx)
+		return
+	}
+
+	width := ctx.widthPrefix
+	m := c.decodeModRM(ctx)
+	v := c.readRM(m, width)
+	count := uint64(width)
+	if v != 0 {
+		count = uint64(bits.TrailingZeros64(v))
+	}
+
+	c.setFlag(flagCF, v == 0)
+	c.setFlag(flagZF, count == 0)
+	c.regfile.setWidth(register(m.reg), width, count)
+}
+
+// bitOpNames are indexed by bits 4:3 of the 0x0F A3/AB/B3/BB opcodes
+// and by the /digit minus 4 of the 0x0F BA group.
+var bitOpNames = [4]string{"bt", "bts", "btr", "btc"}
+
+// bitTest copies bit index of the r/m operand into CF, then leaves it,
+// sets it, clears it or complements it depending on op.
+func (c *cpu) bitTest(m modrm, width int, index uint64, op byte) {
+	index &= uint64(width - 1)
+	v := c.readRM(m, width)
+	bit := uint64(1) << index
+	c.setFlag(flagCF, v&bit != 0)
+
+	switch op {
+	case 1:
+		v |= bit
+	case 2:
+		v &^= bit
+	case 3:
+		v ^= bit
+	default:
+		return
+	}
+
+	c.writeRM(m, width, v)
+}
+
+// bt/bts/btr/btc r/m16/32/64, r16/32/64
+func execBitTestReg(c *cpu, ctx *decodeContext) {
+	width := ctx.widthPrefix
+	m := c.decodeModRM(ctx)
+	index := c.regfile.get(register(m.reg)) & widthMask(width)
+	if m.mod != 0b11 {
+		// A register bit offset addresses a bit string starting at the
+		// memory operand, so it may select a different word entirely
+		offset := int64(signExtend(index, width))
+		m.address += uint64(offset>>bits.TrailingZeros(uint(width))) * uint64(width/8)
+	}
+
+	c.bitTest(m, width, index, (ctx.opcode-0xA3)>>3)
+}
+
+// bt/bts/btr/btc r/m16/32/64, imm8
+func execBitTestImm(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	index := c.immediate(ctx, &m, 1)
+	if m.digit < 4 {
+		c.invalidGroupOpcode(ctx, m.digit)
+	}
+
+	c.bitTest(m, ctx.widthPrefix, index, m.digit-4)
+}
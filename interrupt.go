@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync/atomic"
+)
+
+// interruptExitStatus is the status a shell reports for a program
+// killed by SIGINT
+const interruptExitStatus = 128 + 2
+
+// handleInterrupts makes Ctrl-C pause the guest at the next
+// instruction boundary instead of killing the emulator. A second Ctrl-C
+// before the guest has paused, as when it is blocked in a syscall or
+// sitting at the debugger prompt, abandons it.
+func (c *cpu) handleInterrupts() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			if !c.interrupt() {
+				c.abandon(interruptExitStatus)
+			}
+		}
+	}()
+}
+
+// interrupt asks the guest to pause, returning false when a request is
+// already pending
+func (c *cpu) interrupt() bool {
+	return atomic.CompareAndSwapInt32(&c.interrupted, 0, 1)
+}
+
+// takeInterrupt reports whether a pause was requested, clearing the
+// request
+func (c *cpu) takeInterrupt() bool {
+	return atomic.CompareAndSwapInt32(&c.interrupted, 1, 0)
+}
+
+// reportInterrupt says where an interrupted guest paused
+func (c *cpu) reportInterrupt(w io.Writer, intFormat string) {
+	ip := c.regfile.get(rip)
+	fmt.Fprintf(w, "Interrupted at "+intFormat+" in %s\n", ip, c.describeAddress(ip))
+}
@@ -0,0 +1,107 @@
+package main
+
+import "os"
+
+const (
+	sysIoctl = 16
+	sysFcntl = 72
+)
+
+const errnoENOTTY = 25
+
+// tcgets is the ioctl request isatty and stdio issue to read a
+// terminal's settings
+const tcgets = 0x5401
+
+// termiosLength is the size of the kernel's struct termios: four flag
+// words, the line discipline and 19 control characters
+const termiosLength = 36
+
+// Offsets into struct termios
+const (
+	termiosLflag = 12
+	termiosCC    = 17
+)
+
+// defaultTermios is what TCGETS reports for a terminal, the settings of
+// a fresh one in cooked mode: ICRNL|IXON, OPOST|ONLCR, B38400|CS8|CREAD
+// and ISIG|ICANON|ECHO|ECHOE|ECHOK|ECHOCTL|ECHOKE|IEXTEN, followed by
+// ^C, ^\, DEL, ^U and ^D for the first control characters and VMIN 1.
+var defaultTermios = func() [termiosLength]byte {
+	var t [termiosLength]byte
+	writeBytes(t[:], 0, 4, 0x500)
+	writeBytes(t[:], 4, 4, 0x5)
+	writeBytes(t[:], 8, 4, 0xBF)
+	writeBytes(t[:], termiosLflag, 4, 0x8A3B)
+	copy(t[termiosCC:], []byte{0x03, 0x1C, 0x7F, 0x15, 0x04, 0, 1})
+	return t
+}()
+
+// fcntl commands
+const (
+	fGetFD = 1
+	fSetFD = 2
+	fGetFL = 3
+	fSetFL = 4
+)
+
+// isTerminal reports whether f is a terminal. Without a portable
+// TCGETS on the host, any character device but the null device counts.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// sysIoctl answers TCGETS on a terminal with defaultTermios, so that
+// isatty succeeds and stdio line buffers it. Every other request fails
+// with ENOTTY, as it does for requests a device doesn't know.
+func (c *cpu) sysIoctl() uint64 {
+	f, ok := c.openFile(c.regfile.get(rdi))
+	if !ok {
+		return errno(errnoEBADF)
+	}
+
+	if c.regfile.get(rsi) != tcgets || !isTerminal(f) {
+		return errno(errnoENOTTY)
+	}
+
+	buf, ok := c.guestBuffer(c.regfile.get(rdx), termiosLength)
+	if !ok {
+		return errno(errnoEFAULT)
+	}
+
+	copy(buf, defaultTermios[:])
+	return 0
+}
+
+// sysFcntl reports the access mode of a descriptor for F_GETFL and no
+// close-on-exec flag for F_GETFD. F_SETFL and F_SETFD succeed without
+// changing anything.
+func (c *cpu) sysFcntl() uint64 {
+	fd := c.regfile.get(rdi)
+	if _, ok := c.openFile(fd); !ok {
+		return errno(errnoEBADF)
+	}
+
+	switch c.regfile.get(rsi) {
+	case fGetFL:
+		f := c.files[fd]
+		switch {
+		case f.readable && f.writable:
+			return oRdwr
+		case f.writable:
+			return oWronly
+		}
+
+		return 0
+	case fGetFD, fSetFD, fSetFL:
+		return 0
+	}
+
+	return errno(errnoEINVAL)
+}
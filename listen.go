@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+)
+
+// serveREPL serves the debugger REPL on port to one TCP client at a
+// time, the commands read from and their output written to the
+// connection. The program only runs on a client's commands, so one
+// going away leaves it paused for the next; serving ends when a client
+// disconnects after the program exited, and returns its status.
+func (c *cpu) serveREPL(port string) (int, error) {
+	address := port
+	if !strings.Contains(address, ":") {
+		address = "localhost:" + port
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	// Breakpoints, displays and history carry over from one client to
+	// the next
+	d := newDebugger(c, nil, nil)
+	for !c.exited() {
+		log.Printf("Waiting for a debugger client on %s", l.Addr())
+		conn, err := l.Accept()
+		if err != nil {
+			return 0, err
+		}
+
+		d.in, d.out = conn, conn
+		c.codeWriteWarnings = conn
+		d.interactive()
+		conn.Close()
+	}
+
+	return c.exitStatus(), nil
+}
@@ -1,24 +1,83 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"debug/elf"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type process struct {
+	// name is the path the program was loaded from
+	name         string
 	startAddress uint64
 	entryPoint   uint64
 	bin          []byte
+
+	// symbols maps named functions and objects to their addresses, and
+	// symbolSizes to their sizes where the ELF records one
+	symbols     map[string]uint64
+	symbolSizes map[string]uint64
+	// lines is the DWARF line table, if the program has one
+	lines []sourceLine
+
+	// segments are the PT_LOAD program headers, loaded at their
+	// virtual addresses, and relocations are stored once they are
+	segments    []loadSegment
+	relocations []relocation
+
+	// static programs have no interpreter. They start at the ELF entry
+	// point with a Linux process stack rather than by calling main, and
+	// end through the exit syscalls.
+	static bool
+	args   []string
+	env    []string
+
+	// phdr, phent and phnum locate the program headers in memory for
+	// the auxiliary vector
+	phdr  uint64
+	phent uint64
+	phnum uint64
+}
+
+type loadSegment struct {
+	address uint64
+	data    []byte
+	memsz   uint64
+	flags   elf.ProgFlag
+}
+
+// end is the address following the last loaded segment
+func (p *process) end() uint64 {
+	var end uint64
+	for _, seg := range p.segments {
+		if seg.address+seg.memsz > end {
+			end = seg.address + seg.memsz
+		}
+	}
+
+	return end
+}
+
+// entryOptions chooses where an ELF program starts: at address with
+// --start-addr, else at the first of symbols that the program defines.
+// Without either, dynamic programs start at main and static ones at the
+// ELF entry point.
+type entryOptions struct {
+	symbols    []string
+	address    uint64
+	hasAddress bool
 }
 
-func readELF(filename, entrySymbol string) (*process, error) {
+func readELF(filename string, entry entryOptions) (*process, error) {
 	bin, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
@@ -29,26 +88,100 @@ func readELF(filename, entrySymbol string) (*process, error) {
 		return nil, err
 	}
 
+	// Position independent executables are moved up from 0. Addresses
+	// given with --start-addr are where the program is loaded.
+	var bias uint64
+	if elffile.Type == elf.ET_DYN {
+		bias = pieLoadBias
+	}
+
+	// A stripped program has no symbol table, which only matters if
+	// it is to start at a symbol
 	symbols, err := elffile.Symbols()
-	if err != nil {
+	if err != nil && err != elf.ErrNoSymbols {
 		return nil, err
 	}
 
-	var entryPoint uint64
+	named := map[string]uint64{}
+	sizes := map[string]uint64{}
+	functions := map[string]uint64{}
 	for _, sym := range symbols {
-		if sym.Name == entrySymbol && elf.STT_FUNC == elf.ST_TYPE(sym.Info) && elf.STB_GLOBAL == elf.ST_BIND(sym.Info) {
-			entryPoint = sym.Value
+		typ := elf.ST_TYPE(sym.Info)
+		if sym.Name != "" && sym.Value != 0 && (typ == elf.STT_FUNC || typ == elf.STT_OBJECT) {
+			named[sym.Name] = sym.Value + bias
+			sizes[sym.Name] = sym.Size
+		}
+
+		if typ == elf.STT_FUNC && elf.ST_BIND(sym.Info) == elf.STB_GLOBAL && sym.Section != elf.SHN_UNDEF {
+			functions[sym.Name] = sym.Value + bias
 		}
 	}
 
-	if entryPoint == 0 {
-		return nil, fmt.Errorf("Could not find entrypoint symbol: %s", entrySymbol)
+	// debug/elf doesn't expose where the program headers are, read
+	// e_phoff, e_phentsize and e_phnum from the ELF64 header
+	phoff := readBytes(bin, 0x20, 8)
+	static := true
+	var segments []loadSegment
+	var phdr uint64
+	for _, prog := range elffile.Progs {
+		switch prog.Type {
+		case elf.PT_INTERP:
+			static = false
+		case elf.PT_LOAD:
+			if phoff >= prog.Off && phoff < prog.Off+prog.Filesz {
+				phdr = prog.Vaddr + bias + phoff - prog.Off
+			}
+
+			segments = append(segments, loadSegment{
+				address: prog.Vaddr + bias,
+				data:    bin[prog.Off : prog.Off+prog.Filesz],
+				memsz:   prog.Memsz,
+				flags:   prog.Flags,
+			})
+		}
+	}
+
+	var entryPoint uint64
+	found := false
+	switch {
+	case entry.hasAddress:
+		entryPoint, found = entry.address, true
+	case static && len(entry.symbols) == 0:
+		entryPoint, found = elffile.Entry+bias, true
+	default:
+		names := entry.symbols
+		if len(names) == 0 {
+			names = []string{"main"}
+		}
+
+		for _, name := range names {
+			if entryPoint, found = functions[name]; found {
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("Could not find entrypoint symbol: %s", strings.Join(names, ", "))
+		}
+	}
+
+	if !addressLoaded(segments, entryPoint) {
+		return nil, fmt.Errorf("Entry point 0x%x is outside the loaded segments", entryPoint)
+	}
+
+	relocations, err := readRelocations(elffile, bias)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRelocations(relocations, segments); err != nil {
+		return nil, err
 	}
 
 	var startAddress uint64
 	for _, sec := range elffile.Sections {
 		if sec.Type != elf.SHT_NULL {
-			startAddress = sec.Addr - sec.Offset
+			startAddress = sec.Addr + bias - sec.Offset
 			break
 		}
 	}
@@ -58,12 +191,33 @@ func readELF(filename, entrySymbol string) (*process, error) {
 	}
 
 	return &process{
+		name:         filename,
 		startAddress: startAddress,
 		entryPoint:   entryPoint,
 		bin:          bin,
+		symbols:      named,
+		symbolSizes:  sizes,
+		lines:        readLineTable(elffile, bias),
+		segments:     segments,
+		relocations:  relocations,
+		static:       static,
+		phdr:         phdr,
+		phent:        readBytes(bin, 0x36, 2),
+		phnum:        readBytes(bin, 0x38, 2),
 	}, nil
 }
 
+// addressLoaded reports whether address is within one of segments
+func addressLoaded(segments []loadSegment, address uint64) bool {
+	for _, seg := range segments {
+		if address >= seg.address && address < seg.address+seg.memsz {
+			return true
+		}
+	}
+
+	return false
+}
+
 type register int
 
 const (
@@ -119,18 +273,175 @@ func (regfile *registerFile) set(r register, v uint64) {
 	regfile[r] = v
 }
 
+// set32 writes the low 32 bits of r, zeroing the upper half as the
+// hardware does for 32-bit destinations.
+func (regfile *registerFile) set32(r register, v uint64) {
+	regfile[r] = v & 0xFFFFFFFF
+}
+
+// set16 writes the low 16 bits of r, preserving the rest.
+func (regfile *registerFile) set16(r register, v uint64) {
+	regfile[r] = regfile[r]&^0xFFFF | v&0xFFFF
+}
+
+// set8 writes the low 8 bits of r, preserving the rest.
+func (regfile *registerFile) set8(r register, v uint64) {
+	regfile[r] = regfile[r]&^0xFF | v&0xFF
+}
+
+// setWidth writes r with an operand of the given width in bits.
+func (regfile *registerFile) setWidth(r register, width int, v uint64) {
+	switch width {
+	case 8:
+		regfile.set8(r, v)
+	case 16:
+		regfile.set16(r, v)
+	case 32:
+		regfile.set32(r, v)
+	default:
+		regfile.set(r, v)
+	}
+}
+
 type cpu struct {
 	proc    *process
 	mem     []byte
 	regfile *registerFile
-	tick    chan bool
+	xmm     xmmRegisters
+
+	// Segment bases for fs and gs overrides, set through arch_prctl
+	fsBase uint64
+	gsBase uint64
+
+	// brk is the program break, which starts after the loaded
+	// segments and may grow up to the lowest mapping
+	brkStart uint64
+	brk      uint64
+
+	// mappings are the anonymous mmap regions, sorted by address
+	mappings []mapping
+
+	// signals are the handlers and mask set by rt_sigaction and
+	// rt_sigprocmask
+	signals signalState
+
+	// ports are the devices IN and OUT reach
+	ports portBus
+
+	// memcheck, when set, warns about reads of uninitialized memory
+	memcheck *memcheck
+
+	// syscallRecorder logs every syscall for syscallReplayer to feed a
+	// later run the same results
+	syscallRecorder *syscallRecorder
+	syscallReplayer *syscallReplayer
+
+	// exitCalled is set when the program calls exit or exit_group with
+	// status
+	exitCalled bool
+	status     int
+
+	// stackSize bounds how far the stack may grow down from its top
+	stackSize uint64
+	// stackEnd, when set, is the address just above the stack in place
+	// of the end of memory
+	stackEnd uint64
+
+	// snapshotOut, when set, is written when the program stops
+	snapshotOut string
+	// dumpOnExit, when set, receives a JSON state dump when the
+	// program stops
+	dumpOnExit string
+	// jsonSummary, when set, receives a runSummary with the jsonMemory
+	// ranges when the program stops, "-" meaning stdout
+	jsonSummary string
+	jsonMemory  []memoryRange
+	// lastFault is the fault that stopped run, if any
+	lastFault error
+
+	// hooks stays nil until one is registered so that execute costs a
+	// single nil check without them
+	hooks *hooks
+
+	// breakpoints are set from the debugger
+	breakpoints *breakpoints
+
+	// tracers observe every executed instruction
+	tracers []instructionTracer
+
+	// stats, when set, counts executed instructions
+	stats      *stats
+	printStats bool
+	statsJSON  string
+
+	// stopped is set once stop has written out the outputs
+	stopped int32
+	// abandoned receives the status to exit with when the program has
+	// to be given up on between two syscalls; see abandon
+	abandoned chan int
+
+	// coverage, when set, records the opcodes executed for
+	// --opcode-coverage
+	coverage *opcodeCoverage
+
+	// codeStart and codeEnd span the executable segments. Writes there
+	// bump codeVersion and are reported to codeWriteWarnings, if set.
+	codeStart         uint64
+	codeEnd           uint64
+	codeVersion       uint64
+	codeWriteWarnings io.Writer
+
+	// deterministicTime makes the clock syscalls report a fixed time
+	deterministicTime bool
+
+	// retired counts the instructions started, for rdtsc
+	retired uint64
+	// hostTSC makes rdtsc read the host's monotonic clock instead
+	hostTSC bool
+
+	// cpuidFeatures are the features cpuid reports, by name
+	cpuidFeatures map[string]bool
+
+	// maxInstructions, when not zero, bounds how many instructions a
+	// run, or a single debugger run command, may execute
+	maxInstructions uint64
+	// timeout, when not zero, bounds how long a run may take. timedOut
+	// is set, atomically, once it has expired.
+	timeout  time.Duration
+	timedOut int32
+
+	// interrupted is set, atomically, when Ctrl-C asks the guest to
+	// pause
+	interrupted int32
+
+	// files are the guest's open descriptors, indexed by number and nil
+	// once closed
+	files []*guestFile
+	// allowedPaths, when set, are the resolved directories openat may
+	// open files in
+	allowedPaths []string
+
+	// pagePerms are the permission bits of each page, nil when they
+	// aren't enforced: with noNX, set by --no-nx, or for code run
+	// without loading a program
+	pagePerms []byte
+	noNX      bool
 }
 
+// 8 MB, the Linux default
+const defaultStackSize = 0x800000
+
 func newCPU(memory uint64) cpu {
 	return cpu{
-		mem:     make([]byte, memory),
-		regfile: &registerFile{},
-		tick:    make(chan bool, 1),
+		mem:         make([]byte, memory),
+		regfile:     &registerFile{},
+		stackSize:   defaultStackSize,
+		breakpoints: newBreakpoints(),
+		files:       newFileTable(),
+		ports:       newPortBus(),
+		abandoned:   make(chan int, 1),
+
+		cpuidFeatures: newCPUIDFeatures(),
 	}
 }
 
@@ -138,14 +449,14 @@ func hdebug(msg string, b interface{}) {
 	fmt.Printf("%s: %x\n", msg, b)
 }
 
-func hbdebug(msg string, bs []byte) {
+func hbdebug(w io.Writer, msg string, bs []byte) {
 	str := "%s:"
 	args := []interface{}{msg}
 	for _, b := range bs {
 		str = str + " %x"
 		args = append(args, b)
 	}
-	fmt.Printf(str+"\n", args...)
+	fmt.Fprintf(w, str+"\n", args...)
 }
 
 func readBytes(from []byte, start uint64, bytes int) uint64 {
@@ -163,223 +474,954 @@ func writeBytes(to []byte, start uint64, bytes int, val uint64) {
 	}
 }
 
-var prefixBytes = []byte{0x48, 0x66}
+// readMemory and writeMemory are the guest's data accesses, where
+// bounds, page permissions and watchpoints are checked. Instruction
+// fetches read c.mem directly.
+func (c *cpu) readMemory(address uint64, size int) uint64 {
+	c.checkAccess(address, size, "read")
+	c.checkPermission(address, size, permRead)
+	v := readBytes(c.mem, address, size)
+	if len(c.breakpoints.watchpoints) > 0 {
+		c.watch(address, size, false, v, v)
+	}
 
-func (c *cpu) loop(entryReturnAddress uint64) {
-	for {
-		<-c.tick
+	if c.memcheck != nil {
+		c.memcheck.read(c, address, size, v)
+	}
 
-		ip := c.regfile.get(rip)
-		if ip == entryReturnAddress {
-			break
+	return v
+}
+
+func (c *cpu) writeMemory(address uint64, size int, v uint64) {
+	c.checkAccess(address, size, "write")
+	c.checkPermission(address, size, permWrite)
+	c.storeMemory(address, size, v)
+}
+
+// storeMemory is writeMemory without the permission check, for the
+// debugger, which may write anywhere in memory
+func (c *cpu) storeMemory(address uint64, size int, v uint64) {
+	if len(c.breakpoints.watchpoints) > 0 {
+		c.watch(address, size, true, readBytes(c.mem, address, size), v&widthMask(size*8))
+	}
+
+	if c.writesCode(address, size) {
+		c.codeWritten(address)
+	}
+
+	if c.memcheck != nil {
+		c.memcheck.write(c, address, size, v)
+	}
+
+	writeBytes(c.mem, address, size, v)
+}
+
+// checkAccess raises a page fault for accesses outside of memory
+func (c *cpu) checkAccess(address uint64, size int, access string) {
+	if address > uint64(len(c.mem)) || uint64(size) > uint64(len(c.mem))-address {
+		panic(&fault{
+			kind:   pageFault,
+			rip:    c.regfile.get(rip),
+			detail: fmt.Sprintf("%s of %d bytes at 0x%x", access, size, address),
+		})
+	}
+}
+
+// exitTrampoline is the return address pushed for the entry function,
+// and for functions run by callFunction: the start of a page reserved
+// between the mmap area and the TLS scratch block, which no segment is
+// loaded at. Execution reaching it returns with the status in rax.
+func (c *cpu) exitTrampoline() uint64 {
+	return c.stackTop() - c.stackSize - tlsScratchSize - pageSize
+}
+
+func (c *cpu) exited() bool {
+	return c.exitCalled || c.regfile.get(rip) == c.exitTrampoline()
+}
+
+// loop runs the program until it exits, is interrupted between two
+// instructions, or exceeds its instruction budget or timeout
+func (c *cpu) loop() {
+	for executed := uint64(0); !c.exited(); executed++ {
+		if c.takeInterrupt() {
+			return
 		}
 
-		inb1 := c.mem[ip]
+		c.checkBudget(executed)
+		c.execute()
+	}
+}
 
-		widthPrefix := 32
-		for {
-			isPrefixByte := false
-			for _, prefixByte := range prefixBytes {
-				if prefixByte == inb1 {
-					isPrefixByte = true
-					break
-				}
-			}
+// execute runs the instruction at rip along with any registered hooks
+func (c *cpu) execute() {
+	if c.hooks == nil {
+		c.step()
+		return
+	}
 
-			if !isPrefixByte {
-				break
-			}
+	c.executeHooked()
+}
 
-			// 64 bit prefix signifier
-			if inb1 == 0x48 {
-				widthPrefix = 64
-			} else if inb1 == 0x66 { // 16 bit prefix signifier
-				widthPrefix = 16
-			} else {
-				hbdebug("prog", c.mem[ip:ip+10])
-				panic("Unknown prefix instruction")
-			}
+// tryExecute is execute for the debugger: a fault is returned rather
+// than raised, leaving rip on the faulting instruction.
+func (c *cpu) tryExecute() (err error) {
+	defer func() { err = recoverFault(recover()) }()
+
+	c.execute()
+	return nil
+}
+
+// maxInstructionLength is the longest encoding an x86 instruction may
+// have
+const maxInstructionLength = 15
+
+// executeCode runs the single instruction at the start of code as if it
+// were in memory at rip, without a loaded program, and returns the
+// number of bytes it took. It never panics: faults, instructions
+// running past the end of code and errors in the emulator itself are
+// all returned as a *fault. code stays in memory at rip afterwards.
+func (c *cpu) executeCode(code []byte) (consumed int, err error) {
+	ip := c.regfile.get(rip)
+	if len(code) > maxInstructionLength {
+		code = code[:maxInstructionLength]
+	}
+
+	if len(code) == 0 || ip >= uint64(len(c.mem)) || uint64(len(code)) > uint64(len(c.mem))-ip {
+		return 0, &fault{kind: truncatedInstruction, rip: ip, bytes: code}
+	}
+
+	copy(c.mem[ip:], code)
+	// Catch truncation before the instruction has any effect when the
+	// disassembler knows its length
+	if _, n, err := disassemble(c.mem[ip:], ip); err == nil && n > len(code) {
+		return 0, &fault{kind: truncatedInstruction, rip: ip, bytes: code}
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		if f, ok := r.(*fault); ok {
+			err = f
+		} else {
+			err = &fault{kind: internalError, rip: ip, bytes: code, detail: fmt.Sprint(r)}
+		}
+
+		consumed = 0
+	}()
+
+	_, length := c.step()
+	if length > len(code) {
+		return 0, &fault{kind: truncatedInstruction, rip: ip, bytes: code}
+	}
+
+	return length, nil
+}
+
+// stackTop is the address just above the stack, the end of memory
+// unless --stack-top moved it down; the return address for the entry
+// function is the first value on it.
+func (c *cpu) stackTop() uint64 {
+	if c.stackEnd != 0 {
+		return c.stackEnd
+	}
+
+	return uint64(len(c.mem))
+}
+
+// checkStackLayout checks that the stack, with the TLS scratch block and
+// the exit trampoline's page below it, fits in memory above a program
+// ending at end. The mmap area and the heap grow towards each other in
+// what is left between them.
+func (c *cpu) checkStackLayout(end uint64) error {
+	top := c.stackTop()
+	if top%pageSize != 0 || top > uint64(len(c.mem)) {
+		return fmt.Errorf("Stack top 0x%x must be page aligned and at most 0x%x", top, len(c.mem))
+	}
+
+	reserved := c.stackSize + tlsScratchSize + pageSize
+	if reserved > top || end > top-reserved {
+		return fmt.Errorf("The stack of 0x%x bytes below 0x%x overlaps the program, which ends at 0x%x", c.stackSize, top, end)
+	}
+
+	return nil
+}
 
-			ip++
-			inb1 = c.mem[ip]
-		}
-
-		if inb1 >= 0x50 && inb1 < 0x58 { // push
-			regvalue := c.regfile.get(register(inb1 - 0x50))
-			sp := c.regfile.get(rsp)
-			writeBytes(c.mem, sp-8, 8, regvalue)
-			c.regfile.set(rsp, uint64(sp-8))
-		} else if inb1 >= 0x58 && inb1 < 0x60 { // pop
-			lhs := register(inb1 - 0x58)
-			sp := c.regfile.get(rsp)
-			c.regfile.set(lhs, readBytes(c.mem, sp, 8))
-			c.regfile.set(rsp, uint64(sp+8))
-		} else if inb1 == 0x89 { // mov r/m16/32/64, r/m16/32/64
-			ip++
-			inb2 := c.mem[ip]
-			rhs := register((inb2 & 0b00111000) >> 3)
-			lhs := register(inb2 & 0b111)
-			c.regfile.set(lhs, c.regfile.get(rhs))
-		} else if inb1 >= 0xB8 && inb1 < 0xC0 { // mov r16/32/64, imm16/32/64
-			lreg := register(inb1 - 0xB8)
-			val := readBytes(c.mem, ip+uint64(1), widthPrefix/8)
-			ip += uint64(widthPrefix / 8)
-			c.regfile.set(lreg, val)
-		} else if inb1 == 0xC3 { // ret
-			sp := c.regfile.get(rsp)
-			retAddress := readBytes(c.mem, sp, 8)
-			c.regfile.set(rsp, uint64(sp+8))
-			c.regfile.set(rip, retAddress)
-			continue
+// entryStackPointer is rsp at the entry function, which the System V
+// ABI has 8 below a 16 byte boundary as if a call had pushed the return
+// address
+func (c *cpu) entryStackPointer() uint64 {
+	return c.stackTop()&^15 - 8
+}
+
+func (c *cpu) push(v uint64) {
+	sp := c.regfile.get(rsp) - 8
+	if sp < c.stackTop()-c.stackSize || sp > c.stackTop() {
+		panic(&fault{kind: stackOverflow, rip: c.regfile.get(rip), detail: fmt.Sprintf("rsp 0x%x", sp)})
+	}
+
+	c.writeMemory(sp, 8, v)
+	c.regfile.set(rsp, sp)
+}
+
+func (c *cpu) pop() uint64 {
+	sp := c.regfile.get(rsp)
+	if sp+8 > c.stackTop() || sp+8 < sp {
+		panic(&fault{kind: stackUnderflow, rip: c.regfile.get(rip), detail: fmt.Sprintf("rsp 0x%x", sp)})
+	}
+
+	v := c.readMemory(sp, 8)
+	c.regfile.set(rsp, sp+8)
+	return v
+}
+
+// step executes the instruction at rip and returns its opcode and
+// length. Opcodes escaped by 0x0F are returned as 0x0F00 | the second
+// byte.
+func (c *cpu) step() (uint16, int) {
+	c.retired++
+	ctx := &decodeContext{start: c.regfile.get(rip), widthPrefix: 32}
+	ctx.ip = ctx.start
+	c.checkFetch(ctx.start)
+	inb1 := byte(c.fetch(ctx.ip, 1))
+	operandSize := false
+
+	for isPrefix(inb1) {
+		if isREX(inb1) {
+			ctx.rex = inb1
 		} else {
-			hbdebug("prog", c.mem[ip:ip+10])
-			panic("Unknown instruction")
+			// A REX prefix only counts directly before the opcode
+			ctx.rex = 0
+			if inb1 == 0x66 { // 16 bit prefix signifier
+				operandSize = true
+				if ctx.mandatoryPrefix == 0 {
+					ctx.mandatoryPrefix = inb1
+				}
+			} else if inb1 == 0xF2 || inb1 == 0xF3 {
+				ctx.mandatoryPrefix = inb1
+			} else if inb1 == 0xF0 {
+				ctx.lock = true
+			} else if inb1 == 0x67 { // 32 bit addresses
+				ctx.addressSize32 = true
+			} else if inb1 == 0x64 { // fs segment override
+				ctx.segment = segmentFS
+			} else if inb1 == 0x65 { // gs segment override
+				ctx.segment = segmentGS
+			}
 		}
 
+		ctx.ip++
+		inb1 = byte(c.fetch(ctx.ip, 1))
+	}
+
+	if ctx.rex&rexW != 0 {
+		ctx.widthPrefix = 64
+	} else if operandSize {
+		ctx.widthPrefix = 16
+	}
+
+	ctx.opcode = inb1
+	c.dispatch(&oneByteOpcodes, ctx)
+
+	if ctx.jumped {
+		c.regfile.set(rip, ctx.target)
+	} else {
 		// inc instruction pointer
-		c.regfile.set(rip, ip+1)
+		c.regfile.set(rip, ctx.ip+1)
+	}
+
+	length := int(ctx.ip + 1 - ctx.start)
+	if ctx.escaped {
+		return 0x0F00 | uint16(ctx.opcode), length
 	}
+
+	return uint16(ctx.opcode), length
 }
 
-func (c *cpu) run(proc *process) {
-	copy(c.mem[proc.startAddress:proc.startAddress+uint64(len(proc.bin))], proc.bin)
+func (c *cpu) load(proc *process) {
+	c.proc = proc
+	for _, seg := range proc.segments {
+		copy(c.mem[seg.address:seg.address+seg.memsz], seg.data)
+	}
+
+	c.applyRelocations()
+
 	c.regfile.set(rip, proc.entryPoint)
-	initialStackPointer := uint64(len(c.mem) - 8)
-	writeBytes(c.mem, initialStackPointer, 8, initialStackPointer)
+	c.regfile.set(rflags, flagReserved|flagIF)
+	initialStackPointer := c.entryStackPointer()
+	writeBytes(c.mem, initialStackPointer, 8, c.exitTrampoline())
 	c.regfile.set(rsp, initialStackPointer)
-	c.loop(initialStackPointer)
-	os.Exit(int(c.regfile.get(rax)))
+	c.brkStart = pageAlign(proc.end())
+	c.brk = c.brkStart
+	c.setCodeRange()
+	c.initPermissions()
+	if proc.static {
+		c.setupProcessStack()
+	}
+
+	// Until the program sets up its own thread control block, point fs
+	// at a scratch one below the stack so that stack protector canary
+	// reads (fs:0x28) work. The first word points to itself as in glibc.
+	c.fsBase = c.stackTop() - c.stackSize - tlsScratchSize/2
+	writeBytes(c.mem, c.fsBase, 8, c.fsBase)
+	writeBytes(c.mem, c.fsBase+0x28, 8, stackCanary)
+	c.initMemcheck()
 }
 
-func (c *cpu) resolveDebuggerValue(dval string) (uint64, error) {
-	for reg, val := range registerMap {
-		if val == dval {
-			return c.regfile.get(reg), nil
+const (
+	tlsScratchSize = 0x1000
+	stackCanary    = 0x5a17e1a8d4c3b200
+)
+
+// run executes the program until it returns from its entry function,
+// returning its exit status or the fault that stopped it. When it is
+// interrupted instead, the program has not exited and can be resumed.
+func (c *cpu) run() (status int, err error) {
+	defer func() {
+		err = recoverFault(recover())
+		c.lastFault = err
+		if err != nil || c.exited() {
+			c.stop()
 		}
+	}()
+
+	defer c.startTimeout()()
+	c.loop()
+	return c.exitStatus(), nil
+}
+
+// argumentRegisters pass the first integer arguments of a call, as in
+// the System V ABI
+var argumentRegisters = [...]register{rdi, rsi, rdx, rcx, r8, r9}
+
+// callFunction calls the function at addr with up to six integer
+// arguments and runs it until it returns to the exit trampoline,
+// returning rax. Memory keeps the changes the function made but the
+// registers are restored afterwards, so that the program can carry on
+// as if the call never happened. Breakpoints are not checked.
+func (c *cpu) callFunction(addr uint64, args ...uint64) (result uint64, err error) {
+	if len(args) > len(argumentRegisters) {
+		return 0, fmt.Errorf("at most %d arguments can be passed, not %d", len(argumentRegisters), len(args))
 	}
 
-	if len(dval) > 2 && (dval[:2] == "0x" || dval[:2] == "0X") {
-		return strconv.ParseUint(dval[2:], 16, 64)
+	if c.exited() {
+		return 0, errors.New("the program has finished")
 	}
 
-	return strconv.ParseUint(dval, 10, 64)
+	saved, savedXMM := *c.regfile, c.xmm
+	defer func() {
+		if ferr := recoverFault(recover()); ferr != nil {
+			err = ferr
+		}
+
+		if c.exitCalled {
+			err = fmt.Errorf("the program exited with status %d", c.status&0xFF)
+			return
+		}
+
+		*c.regfile = saved
+		c.xmm = savedXMM
+	}()
+
+	for i, arg := range args {
+		c.regfile.set(argumentRegisters[i], arg)
+	}
+
+	// The stack is 16 byte aligned before the call pushes the return
+	// address
+	c.regfile.set(rsp, c.regfile.get(rsp)&^15)
+	c.push(c.exitTrampoline())
+	c.regfile.set(rip, addr)
+	c.loop()
+	if !c.exited() {
+		return 0, fmt.Errorf("interrupted at 0x%x", c.regfile.get(rip))
+	}
+
+	return c.regfile.get(rax), nil
 }
 
-func repl(c *cpu) {
-	fmt.Println("go-amd64-emulator REPL")
-	help := `commands:
-	s/step:				continue to next instruction
-	r/registers [$reg]:		print all register values or just $reg
-	d/decimal:			toggle hex/decimal printing
-	m/memory $from $count:		print memory values starting at $from until $from+$count
-	h/help:				print this`
-	fmt.Println(help)
-	scanner := bufio.NewScanner(os.Stdin)
+// exitStatus is the status of a program that called exit or returned
+// from its entry function, before truncation by the OS.
+func (c *cpu) exitStatus() int {
+	if c.exitCalled {
+		return c.status
+	}
 
-	intFormat := "%d"
-	for {
-		fmt.Printf("> ")
-		if !scanner.Scan() {
-			break
-		}
-		input := scanner.Text()
-		parts := strings.Split(input, " ")
+	return int(c.regfile.get(rax))
+}
 
-		switch parts[0] {
-		case "h":
-			fallthrough
-		case "help":
-			fmt.Println(help)
+// stop writes out everything requested to be produced when the program
+// stops running, the first time it is called.
+func (c *cpu) stop() {
+	if atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		c.writeOutputs()
+	}
+}
 
-		case "m":
-			fallthrough
-		case "memory":
-			msg := "Invalid arguments: m/memory $from $to; use hex (0x10), decimal (10), or register name (rsp)"
-			if len(parts) != 3 {
-				fmt.Println(msg)
-				continue
-			}
+// abandon has main exit with status, once it has written out the
+// outputs, while the program is blocked in a syscall or the debugger
+// is waiting for input and so can't return to main itself
+func (c *cpu) abandon(status int) {
+	select {
+	case c.abandoned <- status:
+	default:
+	}
+}
 
-			from, err := c.resolveDebuggerValue(parts[1])
-			if err != nil {
-				fmt.Println(msg)
-				continue
-			}
+func (c *cpu) writeOutputs() {
+	if c.snapshotOut != "" {
+		if err := c.saveSnapshotFile(c.snapshotOut); err != nil {
+			log.Printf("Could not write snapshot: %s", err)
+		}
+	}
 
-			to, err := c.resolveDebuggerValue(parts[2])
-			if err != nil {
-				fmt.Println(msg)
-				continue
-			}
+	if c.dumpOnExit != "" {
+		if err := c.writeStateDump(c.dumpOnExit, 0, 0); err != nil {
+			log.Printf("Could not write state dump: %s", err)
+		}
+	}
 
-			hbdebug(fmt.Sprintf("memory["+intFormat+":"+intFormat+"]", from, from+to), c.mem[from:from+to])
+	if c.jsonSummary != "" {
+		if err := c.writeRunSummary(c.jsonSummary); err != nil {
+			log.Printf("Could not write summary: %s", err)
+		}
+	}
 
-		case "d":
-			fallthrough
-		case "decimal":
-			if intFormat == "%d" {
-				intFormat = "0x%x"
-				fmt.Println("Numbers displayed as hex")
-			} else {
-				intFormat = "%d"
-				fmt.Println("Numbers displayed as decimal")
-			}
+	for _, t := range c.tracers {
+		if err := t.close(); err != nil {
+			log.Print(err)
+		}
+	}
 
-		case "r":
-			fallthrough
-		case "registers":
-			filter := ""
-			if len(parts) > 1 {
-				filter = parts[1]
-			}
+	if c.memcheck != nil {
+		if err := c.memcheck.close(); err != nil {
+			log.Print(err)
+		}
+	}
 
-			for i := 0; i < len(registerMap); i++ {
-				reg := register(i)
-				name := registerMap[reg]
-				if filter != "" && filter != name {
-					continue
-				}
+	if c.syscallRecorder != nil {
+		if err := c.syscallRecorder.close(); err != nil {
+			log.Printf("Could not write syscall log: %s", err)
+		}
+	}
 
-				fmt.Printf("%s:\t"+intFormat+"\n", name, c.regfile.get(reg))
-			}
+	if c.syscallReplayer != nil {
+		c.syscallReplayer.close()
+	}
 
-		case "s":
-			fallthrough
-		case "step":
-			c.tick <- true
+	if c.printStats {
+		c.stats.print(os.Stderr)
+	}
+
+	if c.statsJSON != "" {
+		if err := c.stats.writeJSON(c.statsJSON); err != nil {
+			log.Printf("Could not write stats: %s", err)
+		}
+	}
+
+	if c.coverage != nil {
+		if err := c.coverage.write(); err != nil {
+			log.Printf("Could not write opcode coverage: %s", err)
 		}
 	}
 }
 
+// parseAddressFlag parses an address given as a symbol or a number
+func parseAddressFlag(proc *process, value string) uint64 {
+	if address, ok := proc.symbols[value]; ok {
+		return address
+	}
+
+	address, err := strconv.ParseUint(value, 0, 64)
+	if err != nil {
+		log.Fatalf("Invalid address %q: not a symbol or number", value)
+	}
+
+	return address
+}
+
+// flagValue returns the argument following the flag at args[*i] and
+// advances *i past it.
+func flagValue(args []string, i *int) string {
+	if *i+1 >= len(args) {
+		log.Fatalf("Missing value for %s", args[*i])
+	}
+
+	*i++
+	return args[*i]
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		log.Fatal("Binary not provided")
 	}
 
-	proc, err := readELF(os.Args[1], "main")
+	if os.Args[1] == "--coverage-report" {
+		if len(os.Args) != 3 {
+			log.Fatal("Usage: --coverage-report file")
+		}
+
+		if err := coverageReport(os.Stdout, os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if os.Args[1] == "--eval" {
+		evalCode(os.Args[2:])
+		return
+	}
+
+	proc, err := readProgram(os.Args[1], os.Args[2:])
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
 	debug := false
-	for _, arg := range os.Args[1:] {
-		switch arg {
+	script := ""
+	batch := false
+	batchStrict := false
+	snapshotIn := ""
+	snapshotOut := ""
+	dumpOnExit := ""
+	jsonSummary := ""
+	var jsonMemory []memoryRange
+	record := ""
+	replay := ""
+	printStats := false
+	statsJSON := ""
+	opcodeCoverage := ""
+	stackSize := uint64(defaultStackSize)
+	stackTop := uint64(0)
+	maxInstructions := uint64(0)
+	gdbPort := ""
+	listen := ""
+	deterministicTime := false
+	noNX := false
+	timeout := time.Duration(0)
+	cpuidFeatures := ""
+	hostTSC := false
+	var allowedPaths []string
+	disasm := false
+	disasmStart := uint64(0)
+	trace := false
+	followCalls := false
+	memcheck := false
+	memcheckLog := ""
+	recordSyscalls := ""
+	replaySyscalls := ""
+	traceFile := ""
+	traceStart := uint64(0)
+	traceStop := uint64(0)
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--":
+			// The rest are the program's arguments
+			proc.args = args[i+1:]
+			i = len(args)
+
 		case "--debug":
 			fallthrough
 		case "-d":
 			debug = true
+
+		case "--gdb":
+			gdbPort = flagValue(args, &i)
+
+		case "--listen":
+			listen = flagValue(args, &i)
+			debug = true
+
+		case "-x":
+			script = flagValue(args, &i)
+			debug = true
+
+		case "--batch":
+			batch = true
+
+		case "--batch-strict":
+			batch = true
+			batchStrict = true
+
+		case "--snapshot-in":
+			snapshotIn = flagValue(args, &i)
+
+		case "--snapshot-out":
+			snapshotOut = flagValue(args, &i)
+
+		case "--dump-on-exit":
+			dumpOnExit = flagValue(args, &i)
+
+		case "--json-summary":
+			jsonSummary = flagValue(args, &i)
+
+		case "--json-memory":
+			r, err := parseMemoryRange(proc, flagValue(args, &i))
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			jsonMemory = append(jsonMemory, r)
+
+		case "--record":
+			record = flagValue(args, &i)
+
+		case "--replay":
+			replay = flagValue(args, &i)
+
+		case "--raw":
+			// Handled by readProgram
+
+		case "--base", "--raw-entry", "--entry", "--start-addr":
+			flagValue(args, &i)
+
+		case "--trace":
+			trace = true
+
+		case "--trace-file":
+			traceFile = flagValue(args, &i)
+
+		case "--follow-calls":
+			followCalls = true
+
+		case "--memcheck":
+			memcheck = true
+
+		case "--record-syscalls":
+			recordSyscalls = flagValue(args, &i)
+
+		case "--replay-syscalls":
+			replaySyscalls = flagValue(args, &i)
+
+		case "--memcheck-log":
+			memcheck = true
+			memcheckLog = flagValue(args, &i)
+
+		case "--trace-start":
+			traceStart = parseAddressFlag(proc, flagValue(args, &i))
+
+		case "--trace-stop":
+			traceStop = parseAddressFlag(proc, flagValue(args, &i))
+
+		case "--stack-size":
+			stackSize, err = strconv.ParseUint(flagValue(args, &i), 0, 64)
+			if err != nil {
+				log.Fatalf("Invalid stack size: %s", err)
+			}
+
+		case "--stack-top":
+			stackTop, err = strconv.ParseUint(flagValue(args, &i), 0, 64)
+			if err != nil {
+				log.Fatalf("Invalid stack top: %s", err)
+			}
+
+		case "--max-instructions", "--max-insns":
+			maxInstructions, err = strconv.ParseUint(flagValue(args, &i), 0, 64)
+			if err != nil {
+				log.Fatalf("Invalid instruction count: %s", err)
+			}
+
+		case "--timeout":
+			timeout, err = time.ParseDuration(flagValue(args, &i))
+			if err != nil {
+				log.Fatalf("Invalid timeout: %s", err)
+			}
+
+		case "--deterministic-time":
+			deterministicTime = true
+
+		case "--no-nx":
+			noNX = true
+
+		case "--cpuid-features":
+			cpuidFeatures = flagValue(args, &i)
+
+		case "--allow-path":
+			dir, err := resolvePath(flagValue(args, &i))
+			if err != nil {
+				log.Fatalf("Invalid --allow-path: %s", err)
+			}
+
+			allowedPaths = append(allowedPaths, dir)
+
+		case "--rdtsc-host":
+			hostTSC = true
+
+		case "--stats":
+			printStats = true
+
+		case "--stats-json":
+			statsJSON = flagValue(args, &i)
+
+		case "--opcode-coverage":
+			opcodeCoverage = flagValue(args, &i)
+
+		case "--disasm":
+			disasm = true
+			disasmStart = proc.entryPoint
+			// An address may optionally follow
+			if i+1 < len(args) {
+				if addr, err := strconv.ParseUint(args[i+1], 0, 64); err == nil {
+					disasmStart = addr
+					i++
+				}
+			}
+
+		default:
+			log.Fatalf("Unknown flag %s; the program's own arguments go after --", args[i])
+		}
+	}
+
+	if disasm {
+		if err := disassembleELF(os.Stdout, os.Args[1], disasmStart); err != nil {
+			log.Fatal(err)
 		}
+
+		return
 	}
 
 	// 10 MB
 	cpu := newCPU(0x400000 * 10)
+	if proc.end() > uint64(len(cpu.mem)) {
+		log.Fatalf("Program ends at 0x%x, beyond the emulated memory", proc.end())
+	}
+
+	cpu.snapshotOut = snapshotOut
+	cpu.dumpOnExit = dumpOnExit
+	cpu.jsonSummary = jsonSummary
+	cpu.jsonMemory = jsonMemory
+	cpu.stackSize = stackSize
+	cpu.stackEnd = stackTop
+	if err := cpu.checkStackLayout(proc.end()); err != nil {
+		log.Fatal(err)
+	}
+
+	cpu.maxInstructions = maxInstructions
+	cpu.timeout = timeout
+	cpu.deterministicTime = deterministicTime
+	cpu.noNX = noNX
+	cpu.allowedPaths = allowedPaths
+	cpu.hostTSC = hostTSC
+	if cpuidFeatures != "" {
+		if err := parseCPUIDFeatures(cpu.cpuidFeatures, cpuidFeatures); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cpu.printStats = printStats
+	cpu.statsJSON = statsJSON
+	// Counting is always on in the debugger for the stats command, and
+	// for the instruction count of --json-summary
+	if printStats || statsJSON != "" || debug || jsonSummary != "" {
+		cpu.stats = newStats()
+		cpu.addPostHook(cpu.stats.record)
+	}
+
+	if opcodeCoverage != "" {
+		cpu.coverage = newOpcodeCoverage(opcodeCoverage)
+		cpu.addPostHook(cpu.coverage.record)
+	}
+
+	if record != "" && replay != "" {
+		log.Fatal("--record and --replay can't be combined")
+	}
+
+	if record != "" {
+		t, err := newTraceRecorder(record)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cpu.addTracer(t)
+	} else if replay != "" {
+		t, err := newTraceReplayer(replay)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cpu.addTracer(t)
+	}
+
+	// --trace-file writes either trace, but the two don't share a file
+	if followCalls && trace {
+		log.Fatal("--follow-calls and --trace can't be combined")
+	}
+
+	if followCalls {
+		t, err := newCallTracer(traceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cpu.addTracer(t)
+	} else if trace || traceFile != "" {
+		t, err := newTextTracer(traceFile, traceStart, traceStop)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cpu.addTracer(t)
+	}
 
-	go cpu.run(proc)
-	if debug {
-		repl(&cpu)
+	if memcheck {
+		m, err := newMemcheck(memcheckLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cpu.memcheck = m
+	}
+
+	if recordSyscalls != "" && replaySyscalls != "" {
+		log.Fatal("--record-syscalls and --replay-syscalls can't be combined")
+	}
+
+	// A replay runs with the recorded arguments and environment
+	if replaySyscalls != "" {
+		r, err := newSyscallReplayer(replaySyscalls)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		proc.args = r.header.Args
+		proc.env = r.header.Env
+		cpu.syscallReplayer = r
+	}
+
+	if snapshotIn != "" {
+		// Snapshots don't carry symbols, take them from the binary
+		cpu.proc = proc
+		if err := cpu.loadSnapshotFile(snapshotIn); err != nil {
+			log.Fatal(err)
+		}
 	} else {
-		for {
-			cpu.tick <- true
+		cpu.load(proc)
+	}
+
+	if recordSyscalls != "" {
+		r, err := newSyscallRecorder(recordSyscalls, &cpu)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cpu.syscallRecorder = r
+	} else if cpu.syscallReplayer != nil {
+		if err := cpu.syscallReplayer.check(&cpu); err != nil {
+			log.Fatal(err)
 		}
 	}
+
+	// The program runs on a goroutine of its own, so that main can still
+	// write out what was asked for and exit when a timeout or a second
+	// Ctrl-C abandons it blocked in a syscall
+	done := make(chan int, 1)
+	go func() {
+		done <- cpu.session(sessionOptions{
+			gdbPort:     gdbPort,
+			listen:      listen,
+			debug:       debug,
+			script:      script,
+			batch:       batch,
+			batchStrict: batchStrict,
+		})
+	}()
+
+	select {
+	case status := <-done:
+		// Only the low byte of the status is visible to the parent, as
+		// with a real exit(2)
+		os.Exit(status & 0xFF)
+	case status := <-cpu.abandoned:
+		cpu.stop()
+		os.Exit(status)
+	}
+}
+
+// sessionOptions choose how the program is run: served to gdb or to
+// debugger clients, under the debugger, or on its own
+type sessionOptions struct {
+	gdbPort     string
+	listen      string
+	debug       bool
+	script      string
+	batch       bool
+	batchStrict bool
+}
+
+// session runs the loaded program as opts ask and returns the status
+// for the emulator to exit with
+func (c *cpu) session(opts sessionOptions) int {
+	if opts.gdbPort != "" {
+		status, err := c.serveGDB(opts.gdbPort)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+
+		return status
+	}
+
+	c.handleInterrupts()
+	if opts.listen != "" {
+		status, err := c.serveREPL(opts.listen)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+
+		return status
+	}
+
+	if opts.debug {
+		d := newDebugger(c, os.Stdin, os.Stdout)
+		if opts.script != "" {
+			if err := d.source(opts.script, opts.batchStrict); err != nil {
+				log.Print(err)
+				return 1
+			}
+		}
+
+		if !opts.batch {
+			d.interactive()
+		}
+
+		if c.exited() {
+			return c.exitStatus()
+		}
+
+		return 0
+	}
+
+	status, err := c.run()
+	if f, ok := err.(*fault); ok && f.kind == budgetExceeded {
+		log.Print(err)
+		return budgetExitStatus
+	} else if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if !c.exited() {
+		// Interrupted: carry on in the debugger, counting instructions
+		// from here for the stats command
+		if c.stats == nil {
+			c.stats = newStats()
+			c.addPostHook(c.stats.record)
+		}
+
+		d := newDebugger(c, os.Stdin, os.Stdout)
+		c.reportInterrupt(d.out, d.intFormat)
+		d.interactive()
+		if c.exited() {
+			return c.exitStatus()
+		}
+
+		return interruptExitStatus
+	}
+
+	return status
 }
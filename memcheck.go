@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// memcheck tracks which bytes of the stack and heap the program has
+// written, to warn about reads of memory nothing was stored to since
+// load. The loaded segments, the TLS scratch block and the process
+// stack are written by the loader; the stack below the initial rsp and
+// memory brk hands out start uninitialized. Buffers passed to syscalls
+// count as written, whichever way the data goes.
+type memcheck struct {
+	// undefined has a bit set for each byte of memory not yet written
+	undefined []byte
+	// warned holds the rips already warned about, so that a loop
+	// reading uninitialized memory warns once
+	warned   map[uint64]bool
+	warnings io.Writer
+
+	// log, when set, receives a line per memory access. f is closed
+	// with it.
+	log *bufio.Writer
+	f   *os.File
+}
+
+// newMemcheck returns a memcheck warning on stderr and, with filename
+// set, logging every access to it
+func newMemcheck(filename string) (*memcheck, error) {
+	m := &memcheck{warned: map[uint64]bool{}, warnings: os.Stderr}
+	if filename == "" {
+		return m, nil
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	m.f = f
+	m.log = bufio.NewWriter(f)
+	return m, nil
+}
+
+// initMemcheck marks the stack below rsp uninitialized once the program
+// is loaded
+func (c *cpu) initMemcheck() {
+	if c.memcheck == nil {
+		return
+	}
+
+	c.memcheck.undefined = make([]byte, (len(c.mem)+7)/8)
+	c.memcheck.setUndefined(c.stackTop()-c.stackSize, c.regfile.get(rsp), true)
+}
+
+func (m *memcheck) setUndefined(start, end uint64, undefined bool) {
+	for i := start; i < end && i/8 < uint64(len(m.undefined)); i++ {
+		if undefined {
+			m.undefined[i/8] |= 1 << (i % 8)
+		} else {
+			m.undefined[i/8] &^= 1 << (i % 8)
+		}
+	}
+}
+
+func (m *memcheck) isUndefined(address uint64, size int) bool {
+	for i := address; i < address+uint64(size) && i/8 < uint64(len(m.undefined)); i++ {
+		if m.undefined[i/8]&(1<<(i%8)) != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// read logs a read and warns, once per instruction, if any of its bytes
+// are uninitialized
+func (m *memcheck) read(c *cpu, address uint64, size int, v uint64) {
+	ip := c.regfile.get(rip)
+	if m.log != nil {
+		fmt.Fprintf(m.log, "%8x:\tread of %d bytes at 0x%x = 0x%x\n", ip, size, address, v)
+	}
+
+	if m.isUndefined(address, size) && !m.warned[ip] {
+		m.warned[ip] = true
+		fmt.Fprintf(m.warnings, "memcheck: uninitialized read of %d bytes at 0x%x in %s (rip 0x%x)\n",
+			size, address, c.describeAddress(ip), ip)
+	}
+}
+
+func (m *memcheck) write(c *cpu, address uint64, size int, v uint64) {
+	if m.log != nil {
+		fmt.Fprintf(m.log, "%8x:\twrite of %d bytes at 0x%x = 0x%x\n", c.regfile.get(rip), size, address, v&widthMask(size*8))
+	}
+
+	m.setUndefined(address, address+uint64(size), false)
+}
+
+func (m *memcheck) close() error {
+	if m.f == nil {
+		return nil
+	}
+
+	err := m.log.Flush()
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
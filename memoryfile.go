@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// memoryMismatch is a byte that differs between a file and guest memory
+type memoryMismatch struct {
+	offset uint64
+	file   byte
+	memory byte
+}
+
+// saveMemory writes the length bytes of guest memory at addr to
+// filename
+func (c *cpu) saveMemory(filename string, addr, length uint64) error {
+	buf, err := c.debugBuffer(addr, length)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, buf, 0644)
+}
+
+// loadMemory copies the contents of filename into guest memory at addr
+// through the checked write path, refusing files that don't fit. It
+// returns the number of bytes written.
+func (c *cpu) loadMemory(filename string, addr uint64) (int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := c.debugBuffer(addr, uint64(len(data))); err != nil {
+		return 0, err
+	}
+
+	for i, b := range data {
+		if _, err := c.debugWrite(addr+uint64(i), 1, uint64(b)); err != nil {
+			return i, err
+		}
+	}
+
+	return len(data), nil
+}
+
+// compareMemory compares filename against guest memory at addr,
+// returning up to max of the bytes that differ, the total number that
+// differ and the file's size.
+func (c *cpu) compareMemory(filename string, addr uint64, max int) ([]memoryMismatch, int, int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	buf, err := c.debugBuffer(addr, uint64(len(data)))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var mismatches []memoryMismatch
+	differ := 0
+	for i := range data {
+		if data[i] == buf[i] {
+			continue
+		}
+
+		differ++
+		if len(mismatches) < max {
+			mismatches = append(mismatches, memoryMismatch{uint64(i), data[i], buf[i]})
+		}
+	}
+
+	return mismatches, differ, len(data), nil
+}
+
+// debugBuffer returns the length bytes of guest memory at addr, or the
+// page fault an access to them would raise
+func (c *cpu) debugBuffer(addr, length uint64) ([]byte, error) {
+	if addr > uint64(len(c.mem)) || length > uint64(len(c.mem))-addr {
+		return nil, &fault{
+			kind:   pageFault,
+			rip:    c.regfile.get(rip),
+			detail: fmt.Sprintf("access of %d bytes at 0x%x", length, addr),
+		}
+	}
+
+	return c.mem[addr : addr+length], nil
+}
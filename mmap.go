@@ -0,0 +1,126 @@
+package main
+
+import "sort"
+
+const (
+	mapPrivate   = 0x02
+	mapFixed     = 0x10
+	mapAnonymous = 0x20
+	mapNoReserve = 0x4000
+
+	// mapSupported are the mmap flags handled: anonymous private
+	// mappings, for which MAP_NORESERVE makes no difference
+	mapSupported = mapPrivate | mapAnonymous | mapNoReserve
+)
+
+const errnoENOMEM = 12
+
+// mapping is an anonymous region returned by mmap
+type mapping struct {
+	address uint64
+	length  uint64
+}
+
+// mmapTop is the end of the mmap area, which grows down from just
+// below the exit trampoline's page towards the program break.
+func (c *cpu) mmapTop() uint64 {
+	return c.exitTrampoline()
+}
+
+// mmapBottom is the lowest mapped address, where the program break has
+// to stop growing.
+func (c *cpu) mmapBottom() uint64 {
+	if len(c.mappings) == 0 {
+		return c.mmapTop()
+	}
+
+	return c.mappings[0].address
+}
+
+// allocateMapping finds the highest free range of length bytes in the
+// mmap area, returning false when there is none.
+func (c *cpu) allocateMapping(length uint64) (uint64, bool) {
+	end := c.mmapTop()
+	for i := len(c.mappings) - 1; i >= -1; i-- {
+		start := c.brk
+		if i >= 0 {
+			start = c.mappings[i].address + c.mappings[i].length
+		}
+
+		if end >= start && end-start >= length {
+			return end - length, true
+		}
+
+		if i >= 0 {
+			end = c.mappings[i].address
+		}
+	}
+
+	return 0, false
+}
+
+func (c *cpu) sysMmap() uint64 {
+	length := pageAlign(c.regfile.get(rsi))
+	prot := c.regfile.get(rdx)
+	flags := c.regfile.get(r10)
+	if length == 0 || prot&^protMask != 0 || flags&^mapSupported != 0 || flags&(mapPrivate|mapAnonymous) != mapPrivate|mapAnonymous {
+		return errno(errnoEINVAL)
+	}
+
+	address, ok := c.allocateMapping(length)
+	if !ok {
+		return errno(errnoENOMEM)
+	}
+
+	for i := address; i < address+length; i++ {
+		c.mem[i] = 0
+	}
+
+	c.setPermissions(address, address+length, permMapped|byte(prot))
+	c.mappings = append(c.mappings, mapping{address, length})
+	sort.Slice(c.mappings, func(i, j int) bool { return c.mappings[i].address < c.mappings[j].address })
+	return address
+}
+
+// sysMunmap removes the mapped pages in the range, splitting mappings
+// that are only partly unmapped. Ranges that aren't mapped are ignored
+// as by Linux.
+func (c *cpu) sysMunmap() uint64 {
+	start := c.regfile.get(rdi)
+	length := pageAlign(c.regfile.get(rsi))
+	if start%pageSize != 0 || length == 0 {
+		return errno(errnoEINVAL)
+	}
+
+	end := start + length
+	var kept []mapping
+	for _, m := range c.mappings {
+		mEnd := m.address + m.length
+		if end <= m.address || start >= mEnd {
+			kept = append(kept, m)
+			continue
+		}
+
+		unmapStart, unmapEnd := start, end
+		if unmapStart < m.address {
+			unmapStart = m.address
+		}
+
+		if unmapEnd > mEnd {
+			unmapEnd = mEnd
+		}
+
+		c.setPermissions(unmapStart, unmapEnd, 0)
+
+		if m.address < start {
+			kept = append(kept, mapping{m.address, start - m.address})
+		}
+
+		if end < mEnd {
+			kept = append(kept, mapping{end, mEnd - end})
+		}
+	}
+
+	c.mappings = kept
+	return 0
+}
@@ -0,0 +1,257 @@
+package main
+
+// The SSE2 packed integer instructions treat an xmm register as a
+// vector of bytes, words, doublewords or quadwords, lanes, operating on
+// each independently.
+
+func init() {
+	for op, p := range packedOps {
+		defineOpcode(&twoByteOpcodes66, op, p.mnemonic, execPacked)
+	}
+
+	// The logic operations also have single and double precision
+	// forms, which behave alike; see logicAliases
+	for _, packed := range []struct {
+		table  *[256]opcode
+		suffix string
+	}{{&twoByteOpcodes, "ps"}, {&twoByteOpcodes66, "pd"}} {
+		defineOpcode(packed.table, 0x54, "and"+packed.suffix, execPacked)
+		defineOpcode(packed.table, 0x55, "andn"+packed.suffix, execPacked)
+		defineOpcode(packed.table, 0x56, "or"+packed.suffix, execPacked)
+	}
+
+	for op := byte(0x60); op <= 0x6D; op++ {
+		if name, ok := unpackNames[op]; ok {
+			defineOpcode(&twoByteOpcodes66, op, name, execUnpack)
+		}
+	}
+
+	defineOpcode(&twoByteOpcodes66, 0x70, "pshufd", execPshufd)
+	defineOpcode(&twoByteOpcodes66, 0x71, "grp12", execPackedShift)
+	defineOpcode(&twoByteOpcodes66, 0x72, "grp13", execPackedShift)
+	defineOpcode(&twoByteOpcodes66, 0x73, "grp14", execPackedShift)
+	defineOpcode(&twoByteOpcodes66, 0xD7, "pmovmskb", execPmovmskb)
+}
+
+// packedOp is a lanewise operation on lanes of width bits, given and
+// returning them zero extended
+type packedOp struct {
+	mnemonic string
+	width    int
+	op       func(a, b uint64, width int) uint64
+}
+
+// laneMask returns the all ones lane when cond holds, else zero
+func laneMask(cond bool, width int) uint64 {
+	if cond {
+		return widthMask(width)
+	}
+
+	return 0
+}
+
+func packedAdd(a, b uint64, width int) uint64   { return (a + b) & widthMask(width) }
+func packedSub(a, b uint64, width int) uint64   { return (a - b) & widthMask(width) }
+func packedEqual(a, b uint64, width int) uint64 { return laneMask(a == b, width) }
+
+func packedGreater(a, b uint64, width int) uint64 {
+	return laneMask(int64(signExtend(a, width)) > int64(signExtend(b, width)), width)
+}
+
+// packedOps are the lanewise instructions with a mandatory 0x66
+// prefix, by opcode. The logic operations work on whole quadwords.
+var packedOps = map[byte]packedOp{
+	0x64: {"pcmpgtb", 8, packedGreater},
+	0x65: {"pcmpgtw", 16, packedGreater},
+	0x66: {"pcmpgtd", 32, packedGreater},
+	0x74: {"pcmpeqb", 8, packedEqual},
+	0x75: {"pcmpeqw", 16, packedEqual},
+	0x76: {"pcmpeqd", 32, packedEqual},
+	0xD4: {"paddq", 64, packedAdd},
+	0xDA: {"pminub", 8, func(a, b uint64, width int) uint64 { return laneMask(a < b, width)&a | laneMask(a >= b, width)&b }},
+	0xDB: {"pand", 64, func(a, b uint64, width int) uint64 { return a & b }},
+	0xDE: {"pmaxub", 8, func(a, b uint64, width int) uint64 { return laneMask(a > b, width)&a | laneMask(a <= b, width)&b }},
+	0xDF: {"pandn", 64, func(a, b uint64, width int) uint64 { return ^a & b }},
+	0xEB: {"por", 64, func(a, b uint64, width int) uint64 { return a | b }},
+	0xF8: {"psubb", 8, packedSub},
+	0xF9: {"psubw", 16, packedSub},
+	0xFA: {"psubd", 32, packedSub},
+	0xFB: {"psubq", 64, packedSub},
+	0xFC: {"paddb", 8, packedAdd},
+	0xFD: {"paddw", 16, packedAdd},
+	0xFE: {"paddd", 32, packedAdd},
+}
+
+// logicAliases map andps/andpd, andnps/andnpd and orps/orpd to the
+// packedOps of pand, pandn and por
+var logicAliases = map[byte]byte{0x54: 0xDB, 0x55: 0xDF, 0x56: 0xEB}
+
+// lane returns lane i of width bits of v
+func lane(v [2]uint64, i, width int) uint64 {
+	bit := i * width
+	return v[bit/64] >> (bit % 64) & widthMask(width)
+}
+
+// setLane sets lane i of width bits of v to x
+func setLane(v *[2]uint64, i, width int, x uint64) {
+	bit := i * width
+	mask := widthMask(width) << (bit % 64)
+	v[bit/64] = v[bit/64]&^mask | x<<(bit%64)&mask
+}
+
+// lanewise applies op to each pair of lanes of a and b
+func lanewise(a, b [2]uint64, width int, op func(a, b uint64, width int) uint64) [2]uint64 {
+	var r [2]uint64
+	for i := 0; i < 128/width; i++ {
+		setLane(&r, i, width, op(lane(a, i, width), lane(b, i, width), width))
+	}
+
+	return r
+}
+
+// execPacked runs the packedOps instruction xmm, xmm/m128 of its
+// opcode
+func execPacked(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	c.checkAlignment(ctx, m)
+	op := ctx.opcode
+	if alias, ok := logicAliases[op]; ok {
+		op = alias
+	}
+
+	p := packedOps[op]
+	c.xmm[m.reg] = lanewise(c.xmm[m.reg], c.readXMM(m), p.width, p.op)
+}
+
+// unpackNames are the punpck instructions by opcode; bit 3 selects the
+// high halves and the lane width doubles with each opcode otherwise
+var unpackNames = map[byte]string{
+	0x60: "punpcklbw", 0x61: "punpcklwd", 0x62: "punpckldq", 0x6C: "punpcklqdq",
+	0x68: "punpckhbw", 0x69: "punpckhwd", 0x6A: "punpckhdq", 0x6D: "punpckhqdq",
+}
+
+// execUnpack interleaves the lanes of the low, or high, halves of the
+// destination and source, starting with the destination's
+func execUnpack(c *cpu, ctx *decodeContext) {
+	width := 64
+	if ctx.opcode&0xF < 0xC {
+		width = 8 << (ctx.opcode & 3)
+	}
+
+	first := 0
+	if ctx.opcode&0xF == 0xD || ctx.opcode&0xC == 0x8 {
+		first = 64 / width
+	}
+
+	m := c.decodeModRM(ctx)
+	c.checkAlignment(ctx, m)
+	a, b := c.xmm[m.reg], c.readXMM(m)
+	var r [2]uint64
+	for i := 0; i < 64/width; i++ {
+		setLane(&r, 2*i, width, lane(a, first+i, width))
+		setLane(&r, 2*i+1, width, lane(b, first+i, width))
+	}
+
+	c.xmm[m.reg] = r
+}
+
+// pshufd xmm, xmm/m128, imm8 picks each doubleword of the result from
+// the source, by the two bits of imm8 for it
+func execPshufd(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	c.checkAlignment(ctx, m)
+	order := c.immediate(ctx, &m, 1)
+	v := c.readXMM(m)
+	var r [2]uint64
+	for i := 0; i < 4; i++ {
+		setLane(&r, i, 32, lane(v, int(order>>(2*i)&3), 32))
+	}
+
+	c.xmm[m.reg] = r
+}
+
+// packedShiftNames are the groups 0x71-0x73 by opcode and /digit
+var packedShiftNames = map[byte][8]string{
+	0x71: {2: "psrlw", 4: "psraw", 6: "psllw"},
+	0x72: {2: "psrld", 4: "psrad", 6: "pslld"},
+	0x73: {2: "psrlq", 3: "psrldq", 6: "psllq", 7: "pslldq"},
+}
+
+// execPackedShift shifts the words (0x71), doublewords (0x72) or
+// quadwords (0x73) of an xmm register by imm8, or with 0x73 /3 and /7
+// the whole register by imm8 bytes. Logical shifts by the lane width
+// or more clear the lanes; arithmetic ones fill them with the sign.
+func execPackedShift(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	count := c.immediate(ctx, &m, 1)
+	if m.mod != 0b11 || packedShiftNames[ctx.opcode][m.digit] == "" {
+		c.invalidGroupOpcode(ctx, m.digit)
+	}
+
+	v := c.xmm[m.rm]
+	width := 16 << (ctx.opcode - 0x71)
+	switch m.digit {
+	case 3, 7:
+		if count > 15 {
+			count = 16
+		}
+
+		width, count = 128, count*8
+	}
+
+	var r [2]uint64
+	if width == 128 {
+		switch {
+		case count == 128:
+		case m.digit == 3 && count >= 64:
+			r[0] = v[1] >> (count - 64)
+		case m.digit == 3 && count > 0:
+			r = [2]uint64{v[0]>>count | v[1]<<(64-count), v[1] >> count}
+		case count >= 64:
+			r[1] = v[0] << (count - 64)
+		case count > 0:
+			r = [2]uint64{v[0] << count, v[1]<<count | v[0]>>(64-count)}
+		default:
+			r = v
+		}
+
+		c.xmm[m.rm] = r
+		return
+	}
+
+	for i := 0; i < 128/width; i++ {
+		x := lane(v, i, width)
+		switch {
+		case m.digit == 4 && count >= uint64(width):
+			x = uint64(int64(signExtend(x, width)) >> 63)
+		case m.digit == 4:
+			x = uint64(int64(signExtend(x, width)) >> count)
+		case count >= uint64(width):
+			x = 0
+		case m.digit == 2:
+			x >>= count
+		default:
+			x <<= count
+		}
+
+		setLane(&r, i, width, x&widthMask(width))
+	}
+
+	c.xmm[m.rm] = r
+}
+
+// pmovmskb r32/64, xmm gathers the top bit of each byte of the xmm
+// register into the low 16 bits of a general register
+func execPmovmskb(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	if m.mod != 0b11 {
+		c.invalidOpcode(ctx)
+	}
+
+	var mask uint64
+	for i := 0; i < 16; i++ {
+		mask |= lane(c.xmm[m.rm], i, 8) >> 7 << i
+	}
+
+	c.regfile.set(register(m.reg), mask)
+}
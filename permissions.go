@@ -0,0 +1,162 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// Page permission bits, the same as mmap's PROT_ flags, and whether the
+// page is mapped at all, which a PROT_NONE page is
+const (
+	permRead   byte = 1 << 0
+	permWrite  byte = 1 << 1
+	permExec   byte = 1 << 2
+	permMapped byte = 1 << 3
+
+	protMask = uint64(permRead | permWrite | permExec)
+)
+
+// initPermissions maps the pages of the loaded segments with their
+// flags and the TLS scratch block and stack read-write, leaving the rest
+// unmapped. With --no-nx nothing is enforced.
+func (c *cpu) initPermissions() {
+	c.pagePerms = nil
+	if c.noNX {
+		return
+	}
+
+	c.pagePerms = make([]byte, (uint64(len(c.mem))+pageSize-1)/pageSize)
+	if c.proc != nil {
+		for _, seg := range c.proc.segments {
+			c.setPermissions(seg.address, seg.address+seg.memsz, segmentPermissions(seg))
+		}
+	}
+
+	stackBottom := c.stackTop() - c.stackSize
+	c.setPermissions(stackBottom-tlsScratchSize, c.stackTop(), permMapped|permRead|permWrite)
+}
+
+func segmentPermissions(seg loadSegment) byte {
+	perms := permMapped
+	for _, f := range []struct {
+		flag elf.ProgFlag
+		perm byte
+	}{{elf.PF_R, permRead}, {elf.PF_W, permWrite}, {elf.PF_X, permExec}} {
+		if seg.flags&f.flag != 0 {
+			perms |= f.perm
+		}
+	}
+
+	return perms
+}
+
+// setPermissions sets the permissions of the pages overlapping
+// [start, end)
+func (c *cpu) setPermissions(start, end uint64, perms byte) {
+	if c.pagePerms == nil {
+		return
+	}
+
+	for page := start / pageSize; page < pageAlign(end)/pageSize && page < uint64(len(c.pagePerms)); page++ {
+		c.pagePerms[page] = perms
+	}
+}
+
+// mapped reports whether every page overlapping [start, end) is mapped
+func (c *cpu) mapped(start, end uint64) bool {
+	for page := start / pageSize; page < pageAlign(end)/pageSize; page++ {
+		if page >= uint64(len(c.pagePerms)) || c.pagePerms[page]&permMapped == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkPermission raises a MemoryAccess fault for an access to an
+// unmapped page, a read from a PROT_NONE one or a write to one that
+// isn't writable. As on the hardware, any page mapped with some
+// permission can be read.
+func (c *cpu) checkPermission(address uint64, size int, access byte) {
+	if c.pagePerms == nil {
+		return
+	}
+
+	for page := address / pageSize; page <= (address+uint64(size)-1)/pageSize; page++ {
+		perms := c.pagePerms[page]
+		switch {
+		case perms == 0:
+			c.memoryAccessFault(fmt.Sprintf("%s of %d bytes at unmapped address 0x%x", accessNames[access], size, address))
+		case perms&(permRead|permWrite|permExec) == 0 && access == permRead:
+			c.memoryAccessFault(fmt.Sprintf("read of %d bytes at unreadable address 0x%x", size, address))
+		case perms&permWrite == 0 && access == permWrite:
+			c.memoryAccessFault(fmt.Sprintf("write of %d bytes at read-only address 0x%x", size, address))
+		}
+	}
+}
+
+var accessNames = map[byte]string{permRead: "read", permWrite: "write"}
+
+// checkFetch raises a MemoryAccess fault for executing the instruction
+// at address from outside memory or from a page that isn't executable
+func (c *cpu) checkFetch(address uint64) {
+	if address >= uint64(len(c.mem)) {
+		c.memoryAccessFault(fmt.Sprintf("fetch from 0x%x outside memory", address))
+	}
+
+	if c.pagePerms == nil {
+		return
+	}
+
+	if c.pagePerms[address/pageSize]&permExec == 0 {
+		c.memoryAccessFault(fmt.Sprintf("fetch from non-executable address 0x%x", address))
+	}
+}
+
+// fetch reads size bytes of the instruction being decoded at address,
+// raising a MemoryAccess fault when they run past the end of memory
+func (c *cpu) fetch(address uint64, size int) uint64 {
+	if address >= uint64(len(c.mem)) || uint64(size) > uint64(len(c.mem))-address {
+		c.memoryAccessFault(fmt.Sprintf("fetch of %d bytes at 0x%x outside memory", size, address))
+	}
+
+	return readBytes(c.mem, address, size)
+}
+
+func (c *cpu) memoryAccessFault(detail string) {
+	panic(&fault{kind: memoryAccess, rip: c.regfile.get(rip), detail: detail})
+}
+
+// permissionString formats perms as in "r-x"
+func permissionString(perms byte) string {
+	flags := []byte("---")
+	for i, p := range []byte{permRead, permWrite, permExec} {
+		if perms&p != 0 {
+			flags[i] = "rwx"[i]
+		}
+	}
+
+	return string(flags)
+}
+
+// sysMprotect changes the permissions of mapped pages, failing with
+// ENOMEM when part of the range isn't mapped
+func (c *cpu) sysMprotect() uint64 {
+	start := c.regfile.get(rdi)
+	end := start + pageAlign(c.regfile.get(rsi))
+	prot := c.regfile.get(rdx)
+	if start%pageSize != 0 || end < start || prot&^protMask != 0 {
+		return errno(errnoEINVAL)
+	}
+
+	if c.pagePerms == nil {
+		return 0
+	}
+
+	if !c.mapped(start, end) {
+		return errno(errnoENOMEM)
+	}
+
+	c.setPermissions(start, end, permMapped|byte(prot))
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// portDevice is a device on the I/O port bus, which IN reads from and
+// OUT writes to with an access of width bits
+type portDevice interface {
+	in(port uint16, width int) uint64
+	out(port uint16, width int, value uint64)
+}
+
+// portBus maps the ports that have a device. IN from any other port
+// reads all ones and OUT to it is ignored, as with nothing on the bus.
+type portBus map[uint16]portDevice
+
+// Ports of the first serial port, COM1, and its line status register
+const (
+	com1Port       = 0x3F8
+	com1PortCount  = 8
+	lineStatusPort = com1Port + 5
+)
+
+// lineStatusIdle reports the transmitter holding register and the
+// transmitter empty, so that programs polling before each byte go on
+const lineStatusIdle = 0x60
+
+// newPortBus returns a bus with a serial console on COM1 that writes to
+// stdout
+func newPortBus() portBus {
+	bus := portBus{}
+	bus.attach(com1Port, com1PortCount, &serialConsole{w: os.Stdout})
+	return bus
+}
+
+// attach routes IN and OUT for the count ports from base to d
+func (bus portBus) attach(base uint16, count int, d portDevice) {
+	for i := 0; i < count; i++ {
+		bus[base+uint16(i)] = d
+	}
+}
+
+// addPortDevice registers d for the count ports from base, replacing
+// any device there
+func (c *cpu) addPortDevice(base uint16, count int, d portDevice) {
+	c.ports.attach(base, count, d)
+}
+
+func (c *cpu) portIn(port uint16, width int) uint64 {
+	if d, ok := c.ports[port]; ok {
+		return d.in(port, width)
+	}
+
+	return widthMask(width)
+}
+
+func (c *cpu) portOut(port uint16, width int, value uint64) {
+	if d, ok := c.ports[port]; ok {
+		d.out(port, width, value&widthMask(width))
+	}
+}
+
+// serialConsole is a 16550 UART reduced to what a console needs: bytes
+// written to its data register go to w, and the line is always idle
+type serialConsole struct {
+	w io.Writer
+}
+
+func (s *serialConsole) in(port uint16, width int) uint64 {
+	if port == lineStatusPort {
+		return lineStatusIdle
+	}
+
+	return 0
+}
+
+func (s *serialConsole) out(port uint16, width int, value uint64) {
+	if port == com1Port {
+		s.w.Write([]byte{byte(value)})
+	}
+}
+
+func init() {
+	defineOpcode(&oneByteOpcodes, 0xE4, "in", execIn)
+	defineOpcode(&oneByteOpcodes, 0xE5, "in", execIn)
+	defineOpcode(&oneByteOpcodes, 0xE6, "out", execOut)
+	defineOpcode(&oneByteOpcodes, 0xE7, "out", execOut)
+	defineOpcode(&oneByteOpcodes, 0xEC, "in", execIn)
+	defineOpcode(&oneByteOpcodes, 0xED, "in", execIn)
+	defineOpcode(&oneByteOpcodes, 0xEE, "out", execOut)
+	defineOpcode(&oneByteOpcodes, 0xEF, "out", execOut)
+}
+
+// portOperands returns the port and width of IN or OUT: the port is an
+// 8 bit immediate for the 0xE4 to 0xE7 forms and dx for the rest, and
+// the access is al for even opcodes, else ax or eax. REX.W doesn't
+// widen it further.
+func (c *cpu) portOperands(ctx *decodeContext) (uint16, int) {
+	width := ctx.widthPrefix
+	if ctx.opcode&1 == 0 {
+		width = 8
+	} else if width == 64 {
+		width = 32
+	}
+
+	if ctx.opcode < 0xE8 {
+		ctx.ip++
+		return uint16(c.fetch(ctx.ip, 1)), width
+	}
+
+	return uint16(c.regfile.get(rdx)), width
+}
+
+func execIn(c *cpu, ctx *decodeContext) {
+	port, width := c.portOperands(ctx)
+	c.regfile.setWidth(rax, width, c.portIn(port, width))
+}
+
+func execOut(c *cpu, ctx *decodeContext) {
+	port, width := c.portOperands(ctx)
+	c.portOut(port, width, c.regfile.get(rax))
+}
@@ -0,0 +1,86 @@
+package main
+
+// Auxiliary vector entry types, see getauxval(3)
+const (
+	atNull   = 0
+	atPhdr   = 3
+	atPhent  = 4
+	atPhnum  = 5
+	atPagesz = 6
+	atEntry  = 9
+	atUID    = 11
+	atEUID   = 12
+	atGID    = 13
+	atEGID   = 14
+	atSecure = 23
+	atRandom = 25
+	atExecfn = 31
+)
+
+const pageSize = 0x1000
+
+func pageAlign(address uint64) uint64 {
+	return (address + pageSize - 1) &^ (pageSize - 1)
+}
+
+// setupProcessStack lays out argc, argv, envp and the auxiliary vector
+// below the stack top as the kernel does for a new process, leaving rsp
+// pointing at argc.
+func (c *cpu) setupProcessStack() {
+	sp := c.stackTop() - 8
+
+	// AT_RANDOM seeds the stack protector and pointer guard. Use fixed
+	// bytes so that runs are reproducible.
+	sp -= 16
+	random := sp
+	copy(c.mem[random:], "go-amd64-emulatr")
+
+	pushString := func(s string) uint64 {
+		sp -= uint64(len(s)) + 1
+		copy(c.mem[sp:], s)
+		c.mem[sp+uint64(len(s))] = 0
+		return sp
+	}
+
+	args := append([]string{c.proc.name}, c.proc.args...)
+	execfn := pushString(c.proc.name)
+	var argv, envp []uint64
+	for _, arg := range args {
+		argv = append(argv, pushString(arg))
+	}
+	for _, env := range c.proc.env {
+		envp = append(envp, pushString(env))
+	}
+
+	auxv := []uint64{
+		atPhdr, c.proc.phdr,
+		atPhent, c.proc.phent,
+		atPhnum, c.proc.phnum,
+		atPagesz, pageSize,
+		atEntry, c.proc.entryPoint,
+		atUID, 0,
+		atEUID, 0,
+		atGID, 0,
+		atEGID, 0,
+		atSecure, 0,
+		atRandom, random,
+		atExecfn, execfn,
+		atNull, 0,
+	}
+
+	var words []uint64
+	words = append(words, uint64(len(argv)))
+	words = append(words, argv...)
+	words = append(words, 0)
+	words = append(words, envp...)
+	words = append(words, 0)
+	words = append(words, auxv...)
+
+	// rsp must be 16 byte aligned at the entry point
+	sp = (sp - uint64(len(words))*8) &^ 15
+	for i, w := range words {
+		writeBytes(c.mem, sp+uint64(i)*8, 8, w)
+	}
+
+	c.regfile.set(rsp, sp)
+}
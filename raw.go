@@ -0,0 +1,97 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultRawBase is where --raw loads a blob without --base
+const defaultRawBase = 0x1000
+
+// readRaw makes a process of a flat binary: the bytes of filename, or
+// of stdin for "-", loaded at base and entered at entry like main, so
+// that a blob ending in ret exits with rax as its status.
+func readRaw(filename string, base, entry uint64) (*process, error) {
+	var bin []byte
+	var err error
+	if filename == "-" {
+		bin, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		bin, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newRawProcess(filename, bin, base, entry)
+}
+
+// newRawProcess makes a process of the machine code in bin
+func newRawProcess(name string, bin []byte, base, entry uint64) (*process, error) {
+	if len(bin) == 0 {
+		return nil, fmt.Errorf("%s is empty", name)
+	}
+
+	if entry < base || entry >= base+uint64(len(bin)) {
+		return nil, fmt.Errorf("Entry point 0x%x is outside the blob at 0x%x+%d", entry, base, len(bin))
+	}
+
+	return &process{
+		name:         name,
+		startAddress: base,
+		entryPoint:   entry,
+		bin:          bin,
+		symbols:      map[string]uint64{},
+		segments: []loadSegment{{
+			address: base,
+			data:    bin,
+			memsz:   uint64(len(bin)),
+			flags:   elf.PF_R | elf.PF_W | elf.PF_X,
+		}},
+	}, nil
+}
+
+// readProgram loads the program named by the first argument, as an ELF
+// file or, with --raw among the flags, a flat binary. An ELF program
+// starts at the first of the comma separated --entry symbols it defines,
+// or at the --start-addr address.
+func readProgram(filename string, args []string) (*process, error) {
+	raw := false
+	base := uint64(defaultRawBase)
+	entry := uint64(0)
+	var elfEntry entryOptions
+	for i := 0; i < len(args) && args[i] != "--"; i++ {
+		var err error
+		switch args[i] {
+		case "--raw":
+			raw = true
+		case "--base":
+			base, err = strconv.ParseUint(flagValue(args, &i), 0, 64)
+		case "--raw-entry":
+			entry, err = strconv.ParseUint(flagValue(args, &i), 0, 64)
+		case "--entry":
+			elfEntry.symbols = strings.Split(flagValue(args, &i), ",")
+		case "--start-addr":
+			elfEntry.address, err = strconv.ParseUint(flagValue(args, &i), 0, 64)
+			elfEntry.hasAddress = true
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address: %s", err)
+		}
+	}
+
+	if !raw {
+		return readELF(filename, elfEntry)
+	}
+
+	if entry == 0 {
+		entry = base
+	}
+
+	return readRaw(filename, base, entry)
+}
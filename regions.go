@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// memoryRegion is a named range of guest memory in use, from start up
+// to but not including end, as a line of /proc/pid/maps describes
+type memoryRegion struct {
+	start uint64
+	end   uint64
+	// perms are the permissions, as in "r-x"
+	perms string
+	name  string
+}
+
+// memoryRegions lists the memory in use by address: the loaded
+// segments, named after the program with their zero filled tails as
+// [bss], the heap grown by brk, mmap mappings, the exit trampoline's
+// page, the TLS scratch block and the stack. When page permissions are
+// enforced they are shown as the pages have them, after any mprotect.
+func (c *cpu) memoryRegions() []memoryRegion {
+	var regions []memoryRegion
+	if c.proc != nil {
+		name := filepath.Base(c.proc.name)
+		for _, seg := range c.proc.segments {
+			perms := segmentFlags(seg)
+			fileEnd := seg.address + uint64(len(seg.data))
+			end := seg.address + seg.memsz
+			if fileEnd > seg.address {
+				regions = append(regions, memoryRegion{seg.address, fileEnd, perms, name})
+			}
+
+			if end > fileEnd {
+				regions = append(regions, memoryRegion{fileEnd, end, perms, "[bss]"})
+			}
+		}
+	}
+
+	if c.brk > c.brkStart {
+		regions = append(regions, memoryRegion{c.brkStart, c.brk, "rw-", "[heap]"})
+	}
+
+	for _, m := range c.mappings {
+		regions = append(regions, memoryRegion{m.address, m.address + m.length, "rw-", "[mmap]"})
+	}
+
+	trampoline := c.exitTrampoline()
+	stackBottom := c.stackTop() - c.stackSize
+	regions = append(regions,
+		memoryRegion{trampoline, trampoline + pageSize, "---", "[exit]"},
+		memoryRegion{stackBottom - tlsScratchSize, stackBottom, "rw-", "[tls]"},
+		memoryRegion{stackBottom, c.stackTop(), "rw-", "[stack]"},
+	)
+
+	sort.Slice(regions, func(i, j int) bool { return regions[i].start < regions[j].start })
+	if c.pagePerms == nil {
+		return regions
+	}
+
+	var split []memoryRegion
+	for _, r := range regions {
+		split = append(split, c.splitByPermissions(r)...)
+	}
+
+	return split
+}
+
+// splitByPermissions divides r where the permissions of its pages
+// differ
+func (c *cpu) splitByPermissions(r memoryRegion) []memoryRegion {
+	var split []memoryRegion
+	for start := r.start; start < r.end; {
+		perms := c.pagePerms[start/pageSize]
+		end := start
+		for end < r.end && c.pagePerms[end/pageSize] == perms {
+			end = (end/pageSize + 1) * pageSize
+		}
+
+		if end > r.end {
+			end = r.end
+		}
+
+		split = append(split, memoryRegion{start, end, permissionString(perms), r.name})
+		start = end
+	}
+
+	return split
+}
+
+// printMemoryRegions prints the regions in use for info maps
+func (c *cpu) printMemoryRegions(w io.Writer, intFormat string) {
+	fmt.Fprintln(w, "Start\t\tEnd\t\tSize\tPerms\tName")
+	for _, r := range c.memoryRegions() {
+		fmt.Fprintf(w, intFormat+"\t"+intFormat+"\t"+intFormat+"\t%s\t%s\n", r.start, r.end, r.end-r.start, r.perms, r.name)
+	}
+}
+
+// segmentFlags formats the permissions of a loaded segment, as in "r-x"
+func segmentFlags(seg loadSegment) string {
+	return permissionString(segmentPermissions(seg))
+}
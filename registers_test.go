@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestSetWidth(t *testing.T) {
+	const before, value = 0x1122334455667788, 0xFFEEDDCCBBAA9988
+	want := map[int]uint64{
+		8:  0x1122334455667788&^0xFF | 0x88,
+		16: 0x1122334455667788&^0xFFFF | 0x9988,
+		32: 0xBBAA9988,
+		64: value,
+	}
+
+	for _, r := range []register{rax, rsp, r8, r15} {
+		for _, width := range []int{8, 16, 32, 64} {
+			var regfile registerFile
+			regfile.set(r, before)
+			regfile.setWidth(r, width, value)
+			if got := regfile.get(r); got != want[width] {
+				t.Errorf("%d bit write to %s: got 0x%x, want 0x%x", width, registerMap[r], got, want[width])
+			}
+
+			for other := rax; other <= r15; other++ {
+				if other != r && regfile.get(other) != 0 {
+					t.Errorf("%d bit write to %s changed %s", width, registerMap[r], registerMap[other])
+				}
+			}
+		}
+	}
+}
+
+// TestDestinationWidth runs moves of each operand size to check that
+// the handlers write their destinations through setWidth
+func TestDestinationWidth(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+		reg  register
+		want uint64
+	}{
+		{"mov eax, imm32", []byte{0xb8, 0x44, 0x33, 0x22, 0x11}, rax, 0x11223344},
+		{"mov ax, imm16", []byte{0x66, 0xb8, 0x22, 0x11}, rax, 0xFFFFFFFFFFFF1122},
+		{"mov r9d, ebx", []byte{0x41, 0x89, 0xd9}, r9, 0x80000000},
+		{"mov r9w, bx", []byte{0x66, 0x41, 0x89, 0xd9}, r9, 0xFFFFFFFFFFFF0000},
+		{"add ecx, 1", []byte{0x83, 0xc1, 0x01}, rcx, 0},
+		{"add cx, 1", []byte{0x66, 0x83, 0xc1, 0x01}, rcx, 0xFFFFFFFFFFFF0000},
+	}
+
+	for _, tt := range tests {
+		c := fuzzCPU()
+		c.regfile.set(rip, 0x1000)
+		for _, r := range []register{rax, rcx, r9} {
+			c.regfile.set(r, ^uint64(0))
+		}
+		c.regfile.set(rbx, 0x80000000)
+
+		if _, err := c.executeCode(tt.code); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		if got := c.regfile.get(tt.reg); got != tt.want {
+			t.Errorf("%s: %s is 0x%x, want 0x%x", tt.name, registerMap[tt.reg], got, tt.want)
+		}
+	}
+}
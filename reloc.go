@@ -0,0 +1,102 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// pieLoadBias is where position independent executables (ET_DYN), whose
+// segments start at 0, are loaded. Their addresses and symbols are
+// moved up by it, and their relocations applied.
+const pieLoadBias = 0x400000
+
+// rela64Size is the size of an Elf64_Rela entry: r_offset, r_info and
+// r_addend
+const rela64Size = 24
+
+// relocation is a quadword the loader stores once the segments are in
+// memory
+type relocation struct {
+	address uint64
+	value   uint64
+}
+
+// readRelocations computes the relocations of the SHT_RELA sections that
+// don't need a dynamic loader: R_X86_64_RELATIVE, and R_X86_64_64,
+// R_X86_64_GLOB_DAT and R_X86_64_JUMP_SLOT against symbols the program
+// defines itself. The rest, such as references to shared libraries and
+// the R_X86_64_IRELATIVE that static startup code applies on its own,
+// are left alone.
+func readRelocations(elffile *elf.File, bias uint64) ([]relocation, error) {
+	dynamic, err := elffile.DynamicSymbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+
+	var relocations []relocation
+	for _, sec := range elffile.Sections {
+		if sec.Type != elf.SHT_RELA {
+			continue
+		}
+
+		data, err := sec.Data()
+		if err != nil {
+			return nil, err
+		}
+
+		// Symbol indexes refer to the symbol table the section links
+		// to, which for the relocations applied at load is .dynsym
+		var symbols []elf.Symbol
+		if int(sec.Link) < len(elffile.Sections) && elffile.Sections[sec.Link].Type == elf.SHT_DYNSYM {
+			symbols = dynamic
+		}
+
+		for off := uint64(0); off+rela64Size <= uint64(len(data)); off += rela64Size {
+			offset := readBytes(data, off, 8)
+			info := readBytes(data, off+8, 8)
+			addend := readBytes(data, off+16, 8)
+
+			var value uint64
+			switch elf.R_X86_64(elf.R_TYPE64(info)) {
+			case elf.R_X86_64_RELATIVE:
+				value = bias + addend
+			case elf.R_X86_64_64, elf.R_X86_64_GLOB_DAT, elf.R_X86_64_JMP_SLOT:
+				// debug/elf leaves out the null symbol at index 0
+				index := int(elf.R_SYM64(info))
+				if index == 0 || index > len(symbols) || symbols[index-1].Section == elf.SHN_UNDEF {
+					continue
+				}
+
+				value = symbols[index-1].Value + bias
+				if elf.R_X86_64(elf.R_TYPE64(info)) == elf.R_X86_64_64 {
+					value += addend
+				}
+			default:
+				continue
+			}
+
+			relocations = append(relocations, relocation{offset + bias, value})
+		}
+	}
+
+	return relocations, nil
+}
+
+// checkRelocations makes sure every relocation stores within segments
+func checkRelocations(relocations []relocation, segments []loadSegment) error {
+	for _, r := range relocations {
+		if !addressLoaded(segments, r.address) || !addressLoaded(segments, r.address+7) {
+			return fmt.Errorf("Relocation at 0x%x is outside the loaded segments", r.address)
+		}
+	}
+
+	return nil
+}
+
+// applyRelocations stores the program's relocations into the loaded
+// segments
+func (c *cpu) applyRelocations() {
+	for _, r := range c.proc.relocations {
+		writeBytes(c.mem, r.address, 8, r.value)
+	}
+}
@@ -0,0 +1,1279 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// resolveDebuggerValue evaluates a command argument: a register, hex
+// (0x10) or decimal (10) number, or an expression of them
+func (c *cpu) resolveDebuggerValue(dval string) (uint64, error) {
+	return c.evaluate(dval)
+}
+
+const debuggerHelp = `commands:
+	s/step:				continue to next instruction, printing the registers it changed
+	set $reg $value:		set register $reg to $value
+	assert $value $expected:	fail unless $value equals $expected, which stops a
+					--batch-strict script
+	w/write $addr $width $value:	write $width (1, 2, 4 or 8) bytes of $value at $addr
+	asm $bytes:			write machine code given as hex bytes at rip
+	n/next:				step over calls
+	fin/finish:			continue until the current function returns
+	call $addr [$args...]:		call the function at $addr with up to six integer arguments,
+					print what it returns and restore the registers
+	c/continue:			continue until a breakpoint is hit or the program exits
+	u/until $addr:			continue until rip reaches $addr or a breakpoint is hit
+	dis/disassemble [$addr] [$count]:	print $count (10) instructions from $addr (rip); without
+					arguments, the whole function rip is in
+	bt/backtrace:			print the call stack, following frame pointers
+	where:				print rip, the symbol it is in and its source line
+	b/break $addr [if $cond]:	set a breakpoint at $addr or a symbol; with a condition such as
+					rdi == 0 (==, !=, <, <=, >, >=) it only stops when that holds
+	watch $addr $len:		stop when an instruction writes to $len bytes at $addr
+	rwatch $addr $len:		stop when an instruction reads from $len bytes at $addr
+	ignore $n $count:		continue past the next $count hits of breakpoint $n
+	info breakpoints:		list breakpoints with their hit counts
+	info watchpoints:		list watchpoints with their hit counts
+	info maps:			list the memory regions in use with their permissions
+	delete $n:			delete breakpoint or watchpoint $n
+	r/registers [-w] [$reg]:	print all register values, xmm0-15 included, or just $reg;
+					-w adds the 32, 16 and 8 bit views of rax-r15
+	display [$reg | $addr $width]:	print $reg or $width bytes at $addr whenever execution stops
+	undisplay $n:			remove display expression $n
+	d/decimal:			toggle hex/decimal printing
+	m/memory $from $count:		print memory values starting at $from until $from+$count
+	x/$count$format$size $addr:	examine $count values at $addr; formats x, d, u, s (string)
+					and i (instruction), sizes b, h, w and g (1, 2, 4 and 8 bytes)
+	search $value $width [$addr $len]:	print where the $width (1, 2, 4 or 8) byte $value is
+					in memory in use, or in the $len bytes at $addr
+	search-bytes $bytes:		print where the hex $bytes are in memory in use
+	stats:				print instruction statistics
+	save $file:			write a snapshot of the machine state to $file
+	dump $file.json [$addr $count]:	write registers, flags and optionally memory to $file as JSON
+	dump $file $addr $count:	write $count bytes of memory at $addr to $file
+	load $file $addr:		copy the contents of $file into memory at $addr
+	compare $file $addr [$max]:	print up to $max (10) bytes where $file and memory at $addr differ
+	restore $file:			load a snapshot of the machine state from $file
+	history:			list the commands entered; an empty line repeats the last one
+					and !$n runs command $n again
+	h/help:				print this
+
+Values and addresses may be expressions: registers, symbols and numbers
+with + - * and parentheses, and *$addr for the 8 bytes at $addr, e.g.
+rbp-0x20, rsp+8*2 or *(rsp+8). Write them without spaces or quote them.
+Unambiguous prefixes of command names work too, e.g. reg for registers.
+Quote arguments containing spaces: save "my snapshot"`
+
+// debugger runs REPL commands against a cpu, reading interactive input
+// from in and writing all output to out
+type debugger struct {
+	c         *cpu
+	in        io.Reader
+	out       io.Writer
+	intFormat string
+	// depth is the number of source commands being run
+	depth int
+	// history holds the commands entered interactively
+	history []string
+	// examine is the format the x command last used
+	examine examineFormat
+	// displays are printed whenever execution stops
+	displays    []*display
+	nextDisplay int
+}
+
+// printRegisters prints every register, or only the one named filter.
+// With views the general purpose registers are followed by their low
+// 32, 16 and 8 bits, as in eax, ax and al.
+func (d *debugger) printRegisters(filter string, views bool) {
+	c := d.c
+	for i := 0; i < len(registerMap); i++ {
+		reg := register(i)
+		name := registerMap[reg]
+		if filter != "" && filter != name {
+			continue
+		}
+
+		v := c.regfile.get(reg)
+		fmt.Fprintf(d.out, "%s:\t"+d.intFormat, name, v)
+		if views && reg < rip {
+			for i, width := range []int{32, 16, 8} {
+				fmt.Fprintf(d.out, "\t%s: "+d.intFormat, subregisterNames(reg)[i], v&widthMask(width))
+			}
+		}
+
+		fmt.Fprintln(d.out)
+	}
+
+	if filter == "" || filter == "fs_base" {
+		fmt.Fprintf(d.out, "fs_base:\t"+d.intFormat+"\n", c.fsBase)
+	}
+
+	if filter == "" || filter == "gs_base" {
+		fmt.Fprintf(d.out, "gs_base:\t"+d.intFormat+"\n", c.gsBase)
+	}
+
+	// xmm registers are shown as their low and high quadwords
+	for i, v := range c.xmm {
+		name := fmt.Sprintf("xmm%d", i)
+		if filter == "" || filter == name {
+			fmt.Fprintf(d.out, "%s:\t{"+d.intFormat+", "+d.intFormat+"}\n", name, v[0], v[1])
+		}
+	}
+}
+
+// subregisterNames names the low 32, 16 and 8 bits of r
+func subregisterNames(r register) [3]string {
+	low := registerNames[8][r]
+	if r >= rsp && r <= rdi {
+		low = rexByteRegisterNames[r-rsp]
+	}
+
+	return [3]string{registerNames[32][r], registerNames[16][r], low}
+}
+
+// newDebugger also routes self-modifying code warnings to out
+func newDebugger(c *cpu, in io.Reader, out io.Writer) *debugger {
+	c.codeWriteWarnings = out
+	return &debugger{c: c, in: in, out: out, intFormat: "%d", examine: examineFormat{format: 'x', size: 4}}
+}
+
+// prompt names where execution is, as symbol+0xoffset, when the
+// program has symbols
+func (d *debugger) prompt() string {
+	if d.c.symbolTable() == nil {
+		return "> "
+	}
+
+	return d.c.describeAddress(d.c.regfile.get(rip)) + "> "
+}
+
+// printWhere prints rip with the symbol containing it and, when the
+// program has DWARF line information, the source line it comes from.
+func (d *debugger) printWhere() {
+	c := d.c
+	ip := c.regfile.get(rip)
+	line := fmt.Sprintf("rip 0x%x in %s", ip, c.describeAddress(ip))
+	if file, n, ok := c.sourceLine(ip); ok {
+		line += fmt.Sprintf(" at %s:%d", file, n)
+	}
+
+	fmt.Fprintln(d.out, line)
+}
+
+func (d *debugger) interactive() {
+	fmt.Fprintln(d.out, "go-amd64-emulator REPL")
+	fmt.Fprintln(d.out, debuggerHelp)
+	scanner := bufio.NewScanner(d.in)
+	for {
+		fmt.Fprint(d.out, d.prompt())
+		if !scanner.Scan() {
+			break
+		}
+
+		d.command(d.input(scanner.Text()))
+	}
+}
+
+// input records an interactive command in the history and returns it.
+// Empty input repeats the last command and !N the Nth one in the
+// history, which is echoed.
+func (d *debugger) input(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		if len(d.history) == 0 {
+			return ""
+		}
+
+		return d.history[len(d.history)-1]
+	}
+
+	if strings.HasPrefix(line, "!") {
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 1 || n > len(d.history) {
+			fmt.Fprintf(d.out, "No command %s in history\n", line[1:])
+			return ""
+		}
+
+		line = d.history[n-1]
+		fmt.Fprintln(d.out, line)
+	}
+
+	d.history = append(d.history, line)
+	return line
+}
+
+// command runs one REPL command, returning false when it was invalid or
+// failed.
+func (d *debugger) command(input string) bool {
+	c := d.c
+	parts, err := splitArguments(input)
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return false
+	}
+
+	if len(parts) == 0 {
+		return true
+	}
+
+	command, err := resolveCommand(parts[0])
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return false
+	}
+
+	switch command {
+	case "help":
+		fmt.Fprintln(d.out, debuggerHelp)
+
+	case "memory":
+		msg := "Invalid arguments: m/memory $from $to; use hex (0x10), decimal (10), register name (rsp), or an expression (rbp-0x20)"
+		if len(parts) != 3 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		from, err := c.resolveDebuggerValue(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		to, err := c.resolveDebuggerValue(parts[2])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		if from > uint64(len(c.mem)) || to > uint64(len(c.mem))-from {
+			fmt.Fprintln(d.out, "Memory out of range")
+			return false
+		}
+
+		hbdebug(d.out, fmt.Sprintf("memory["+d.intFormat+":"+d.intFormat+"]", from, from+to), c.mem[from:from+to])
+
+	case "x":
+		msg := "Invalid arguments: x/$count$format$size $addr; e.g. x/4gx rsp"
+		if len(parts) != 2 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		f := d.examine
+		f.count = 1
+		if spec := strings.TrimPrefix(parts[0], "x"); spec != "" {
+			var err error
+			if f, err = parseExamineFormat(spec[1:], d.examine); err != nil {
+				fmt.Fprintln(d.out, err)
+				return false
+			}
+		}
+
+		addr, err := c.resolveLocation(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		d.examine = f
+		if err := d.examineMemory(f, addr); err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+	case "decimal":
+		if d.intFormat == "%d" {
+			d.intFormat = "0x%x"
+			fmt.Fprintln(d.out, "Numbers displayed as hex")
+		} else {
+			d.intFormat = "%d"
+			fmt.Fprintln(d.out, "Numbers displayed as decimal")
+		}
+
+	case "registers":
+		filter := ""
+		views := false
+		for _, arg := range parts[1:] {
+			if arg == "-w" {
+				views = true
+			} else if filter == "" {
+				filter = arg
+			} else {
+				fmt.Fprintln(d.out, "Invalid arguments: registers [-w] [$reg]")
+				return false
+			}
+		}
+
+		d.printRegisters(filter, views)
+
+	case "stats":
+		c.stats.print(d.out)
+
+	case "save":
+		if len(parts) != 2 {
+			fmt.Fprintln(d.out, "Invalid arguments: save $file")
+			return false
+		}
+
+		if err := c.saveSnapshotFile(parts[1]); err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+		fmt.Fprintln(d.out, "Snapshot written to "+parts[1])
+
+	case "dump":
+		msg := "Invalid arguments: dump $file.json [$addr $count] or dump $file $addr $count"
+		if len(parts) != 2 && len(parts) != 4 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		var addr, count uint64
+		if len(parts) == 4 {
+			var err error
+			if addr, err = c.resolveLocation(parts[2]); err != nil {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+
+			if count, err = c.resolveDebuggerValue(parts[3]); err != nil {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+		}
+
+		// Raw bytes unless a JSON state dump is asked for
+		if !strings.HasSuffix(parts[1], ".json") {
+			if len(parts) != 4 {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+
+			if err := c.saveMemory(parts[1], addr, count); err != nil {
+				fmt.Fprintln(d.out, err)
+				return false
+			}
+
+			fmt.Fprintf(d.out, "%d bytes written to %s\n", count, parts[1])
+			return true
+		}
+
+		if err := c.writeStateDump(parts[1], addr, count); err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+		fmt.Fprintln(d.out, "State written to "+parts[1])
+
+	case "load":
+		msg := "Invalid arguments: load $file $addr"
+		if len(parts) != 3 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		addr, err := c.resolveLocation(parts[2])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		n, err := c.loadMemory(parts[1], addr)
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+		fmt.Fprintf(d.out, "%d bytes loaded from %s\n", n, parts[1])
+
+	case "compare":
+		msg := "Invalid arguments: compare $file $addr [$max]"
+		if len(parts) != 3 && len(parts) != 4 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		addr, err := c.resolveLocation(parts[2])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		max := uint64(10)
+		if len(parts) == 4 {
+			if max, err = c.resolveDebuggerValue(parts[3]); err != nil {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+		}
+
+		mismatches, differ, size, err := c.compareMemory(parts[1], addr, int(max))
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+		if differ == 0 {
+			fmt.Fprintf(d.out, "%d bytes match %s\n", size, parts[1])
+			return true
+		}
+
+		for _, m := range mismatches {
+			fmt.Fprintf(d.out, "offset "+d.intFormat+": file 0x%02x, memory 0x%02x\n", m.offset, m.file, m.memory)
+		}
+
+		fmt.Fprintf(d.out, "%d of %d bytes differ from %s\n", differ, size, parts[1])
+		return false
+
+	case "restore":
+		if len(parts) != 2 {
+			fmt.Fprintln(d.out, "Invalid arguments: restore $file")
+			return false
+		}
+
+		if err := c.loadSnapshotFile(parts[1]); err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+		fmt.Fprintln(d.out, "Snapshot restored from "+parts[1])
+
+	case "step":
+		if c.exited() {
+			c.debugStep(d.out)
+			return true
+		}
+
+		// Decode before executing in case the instruction changes
+		// its own bytes
+		executed := c.disassemblyLine(c.regfile.get(rip), c.symbolTable())
+		before := *c.regfile
+		if !c.debugStep(d.out) {
+			fmt.Fprintln(d.out, executed)
+			if changes := formatRegisterChanges(&before, c.regfile, d.intFormat); changes != "" {
+				fmt.Fprintln(d.out, changes)
+			}
+		}
+
+	case "set":
+		msg := "Invalid arguments: set $reg $value; use hex (0x10), decimal (10), register name (rsp), or an expression (rsp+8*2)"
+		if len(parts) != 3 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		v, err := c.resolveDebuggerValue(parts[2])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		old, ok := c.setDebuggerRegister(parts[1], v)
+		if !ok {
+			fmt.Fprintln(d.out, "Unknown register: "+parts[1])
+			return false
+		}
+
+		fmt.Fprintf(d.out, "%s: "+d.intFormat+" -> "+d.intFormat+"\n", parts[1], old, v)
+
+	case "assert":
+		msg := "Invalid arguments: assert $value $expected; use hex (0x10), decimal (10), register name (rax), or an expression (*(rsp+8))"
+		if len(parts) != 3 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		v, err := c.resolveDebuggerValue(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		expected, err := c.resolveDebuggerValue(parts[2])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		if v != expected {
+			fmt.Fprintf(d.out, "Assertion failed: %s = "+d.intFormat+", expected "+d.intFormat+"\n", parts[1], v, expected)
+			return false
+		}
+
+		fmt.Fprintf(d.out, "%s = "+d.intFormat+"\n", parts[1], v)
+
+	case "write":
+		msg := "Invalid arguments: w/write $addr $width $value; $width is 1, 2, 4 or 8 bytes"
+		if len(parts) != 4 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		addr, err := c.resolveLocation(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		width, err := strconv.Atoi(parts[2])
+		if err != nil || (width != 1 && width != 2 && width != 4 && width != 8) {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		v, err := c.resolveDebuggerValue(parts[3])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		old, err := c.debugWrite(addr, width, v)
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+		fmt.Fprintf(d.out, "memory["+d.intFormat+"]: "+d.intFormat+" -> "+d.intFormat+"\n", addr, old, v&widthMask(width*8))
+		if hit := c.breakpoints.watchHit; hit != nil {
+			c.breakpoints.watchHit = nil
+			c.reportStop(d.out, &debugStop{watch: hit}, d.intFormat)
+		}
+
+	case "search":
+		msg := "Invalid arguments: search $value $width [$addr $len]; $width is 1, 2, 4 or 8 bytes"
+		if len(parts) != 3 && len(parts) != 5 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		v, err := c.resolveDebuggerValue(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		width, err := strconv.Atoi(parts[2])
+		if err != nil || (width != 1 && width != 2 && width != 4 && width != 8) {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		var from, length uint64
+		if len(parts) == 5 {
+			if from, err = c.resolveLocation(parts[3]); err != nil {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+
+			if length, err = c.resolveDebuggerValue(parts[4]); err != nil || length == 0 {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+		}
+
+		pattern := make([]byte, width)
+		writeBytes(pattern, 0, width, v)
+		d.printSearch(pattern, from, length)
+
+	case "search-bytes":
+		if len(parts) < 2 {
+			fmt.Fprintln(d.out, "Invalid arguments: search-bytes $bytes; e.g. search-bytes 7f 45 4c 46")
+			return false
+		}
+
+		pattern, err := parseHexBytes(strings.Join(parts[1:], " "))
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+		d.printSearch(pattern, 0, 0)
+
+	case "asm":
+		if len(parts) < 2 {
+			fmt.Fprintln(d.out, `Invalid arguments: asm $bytes; e.g. asm 48 c7 c0 05 00 00 00 or asm \x48\xc7`)
+			return false
+		}
+
+		code, err := parseHexBytes(strings.Join(parts[1:], " "))
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+		ip := c.regfile.get(rip)
+		if _, err := c.debugBuffer(ip, uint64(len(code))); err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+		// Written directly: these are not the program's own writes to
+		// warn about
+		copy(c.mem[ip:], code)
+		if c.writesCode(ip, len(code)) {
+			c.codeVersion++
+		}
+
+		fmt.Fprintf(d.out, "Wrote %d byte(s) at "+d.intFormat+"\n", len(code), ip)
+		c.printDisassembly(d.out, ip, 1)
+
+	case "next":
+		c.debugNext(d.out, d.intFormat)
+
+	case "finish":
+		c.debugFinish(d.out, d.intFormat)
+
+	case "call":
+		msg := "Invalid arguments: call $addr [$args...]; use a symbol (main), hex (0x10), decimal (10), register name (rsp), or an expression (rbp-8)"
+		if len(parts) < 2 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		addr, err := c.resolveLocation(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		var args []uint64
+		for _, part := range parts[2:] {
+			v, err := c.resolveDebuggerValue(part)
+			if err != nil {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+
+			args = append(args, v)
+		}
+
+		finished := c.exited()
+		result, err := c.callFunction(addr, args...)
+		if err != nil {
+			// The function may have exited the program
+			if !finished && c.exited() {
+				c.stop()
+			}
+
+			fmt.Fprintf(d.out, "Call failed: %s\n", err)
+			return false
+		}
+
+		fmt.Fprintf(d.out, "Returned "+d.intFormat+"\n", result)
+
+	case "backtrace":
+		c.printBacktrace(d.out)
+
+	case "where":
+		d.printWhere()
+
+	case "disassemble":
+		msg := "Invalid arguments: dis/disassemble [$addr] [$count]; use a symbol (main), hex (0x10), decimal (10), or register name (rip)"
+		if len(parts) > 3 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		addr := c.regfile.get(rip)
+		count := uint64(10)
+		var err error
+		// Without arguments, all of the function rip is in
+		if start, end, ok := c.symbolTable().extent(addr); ok && len(parts) == 1 {
+			c.printDisassemblyRange(d.out, start, end, end-start)
+			return true
+		}
+
+		if len(parts) > 1 {
+			if addr, err = c.resolveLocation(parts[1]); err != nil {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+		}
+
+		if len(parts) > 2 {
+			if count, err = c.resolveDebuggerValue(parts[2]); err != nil {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+		}
+
+		c.printDisassembly(d.out, addr, count)
+
+	case "until":
+		msg := "Invalid arguments: u/until $addr; use a symbol (main), hex (0x10), decimal (10), register name (rsp), or an expression (*rsp)"
+		if len(parts) != 2 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		target, err := c.resolveLocation(parts[1])
+		if err != nil {
+			if similar := c.similarSymbols(parts[1]); len(similar) > 0 {
+				fmt.Fprintf(d.out, "No symbol %s; did you mean %s?\n", parts[1], strings.Join(similar, ", "))
+			} else {
+				fmt.Fprintln(d.out, msg)
+			}
+
+			return false
+		}
+
+		stop, executed, _ := c.debugContinue(d.out, func() bool { return c.regfile.get(rip) == target })
+		if stop != nil {
+			c.reportStop(d.out, stop, d.intFormat)
+		} else if c.regfile.get(rip) == target && !c.exited() {
+			fmt.Fprintf(d.out, "Stopped at "+d.intFormat+" after %d instructions\n", target, executed)
+		}
+
+	case "continue":
+		if stop, _, _ := c.debugContinue(d.out, nil); stop != nil {
+			c.reportStop(d.out, stop, d.intFormat)
+		}
+
+	case "break":
+		msg := "Invalid arguments: b/break $addr [if $cond]; use a symbol (main), hex (0x10), decimal (10), or register name (rip)"
+		if len(parts) != 2 && (len(parts) < 4 || parts[2] != "if") {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		address, err := c.resolveLocation(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		bp, added := c.breakpoints.add(address)
+		if len(parts) > 2 {
+			// A condition replaces that of an existing breakpoint
+			bp.condition = strings.Join(parts[3:], " ")
+			fmt.Fprintf(d.out, "Breakpoint %d at "+d.intFormat+" if %s\n", bp.id, bp.address, bp.condition)
+			return true
+		}
+
+		if !added {
+			fmt.Fprintf(d.out, "Breakpoint %d already set at "+d.intFormat+"\n", bp.id, bp.address)
+			return true
+		}
+
+		fmt.Fprintf(d.out, "Breakpoint %d at "+d.intFormat+"\n", bp.id, bp.address)
+
+	case "watch", "rwatch":
+		msg := "Invalid arguments: " + command + " $addr $len; use a symbol (main), hex (0x10), decimal (10), or register name (rsp)"
+		if len(parts) != 3 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		address, err := c.resolveLocation(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		length, err := c.resolveDebuggerValue(parts[2])
+		if err != nil || length == 0 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		wp := c.breakpoints.addWatchpoint(address, length, command == "watch")
+		fmt.Fprintf(d.out, "Watchpoint %d: "+d.intFormat+"+%d\n", wp.id, wp.address, wp.length)
+
+	case "info":
+		// Prefixes select the subcommand, as for commands
+		var what string
+		if len(parts) == 2 && parts[1] != "" {
+			if strings.HasPrefix("breakpoints", parts[1]) {
+				what = "breakpoints"
+			} else if strings.HasPrefix("watchpoints", parts[1]) {
+				what = "watchpoints"
+			} else if strings.HasPrefix("maps", parts[1]) {
+				what = "maps"
+			}
+		}
+
+		if what == "" {
+			fmt.Fprintln(d.out, "Invalid arguments: info breakpoints|watchpoints|maps")
+			return false
+		}
+
+		if what == "maps" {
+			c.printMemoryRegions(d.out, d.intFormat)
+			return true
+		}
+
+		if what == "watchpoints" {
+			if len(c.breakpoints.watchpoints) == 0 {
+				fmt.Fprintln(d.out, "No watchpoints")
+				return true
+			}
+
+			fmt.Fprintln(d.out, "Num\tType\tAddress\t\tLength\tHits")
+			for _, wp := range c.breakpoints.watchpoints {
+				kind := "read"
+				if wp.write {
+					kind = "write"
+				}
+
+				fmt.Fprintf(d.out, "%d\t%s\t"+d.intFormat+"\t\t%d\t%d\n", wp.id, kind, wp.address, wp.length, wp.hits)
+			}
+
+			return true
+		}
+
+		list := c.breakpoints.list()
+		if len(list) == 0 {
+			fmt.Fprintln(d.out, "No breakpoints")
+			return true
+		}
+
+		fmt.Fprintln(d.out, "Num\tAddress\t\tHits")
+		for _, bp := range list {
+			fmt.Fprintf(d.out, "%d\t"+d.intFormat+"\t\t%d\n", bp.id, bp.address, bp.hits)
+			if bp.condition != "" {
+				fmt.Fprintf(d.out, "\tstop only if %s\n", bp.condition)
+			}
+
+			if bp.ignore > 0 {
+				fmt.Fprintf(d.out, "\tignoring the next %d hit(s)\n", bp.ignore)
+			}
+		}
+
+	case "ignore":
+		msg := "Invalid arguments: ignore $n $count"
+		if len(parts) != 3 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		count, err := strconv.ParseUint(parts[2], 0, 64)
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		bp := c.breakpoints.byID(id)
+		if bp == nil {
+			fmt.Fprintf(d.out, "No breakpoint number %d\n", id)
+			return false
+		}
+
+		bp.ignore = count
+		if count == 0 {
+			fmt.Fprintf(d.out, "Breakpoint %d will stop the next time it is reached\n", id)
+		} else {
+			fmt.Fprintf(d.out, "Breakpoint %d will ignore the next %d hit(s)\n", id, count)
+		}
+
+	case "delete":
+		msg := "Invalid arguments: delete $n"
+		if len(parts) != 2 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		if !c.breakpoints.remove(id) {
+			fmt.Fprintf(d.out, "No breakpoint or watchpoint number %d\n", id)
+			return false
+		}
+
+		fmt.Fprintf(d.out, "Deleted %d\n", id)
+
+	case "display":
+		msg := "Invalid arguments: display $reg or display $addr $width; $width is 1, 2, 4 or 8"
+		if len(parts) == 1 {
+			d.printDisplays()
+			return true
+		}
+
+		var disp *display
+		switch len(parts) {
+		case 2:
+			if !isRegisterName(parts[1]) {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+
+			disp = d.addDisplay(parts[1], 0)
+		case 3:
+			width, err := strconv.Atoi(parts[2])
+			if err != nil || (width != 1 && width != 2 && width != 4 && width != 8) {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+
+			if _, err := c.resolveLocation(parts[1]); err != nil {
+				fmt.Fprintln(d.out, msg)
+				return false
+			}
+
+			disp = d.addDisplay(parts[1], width)
+		default:
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		d.printDisplay(disp)
+
+	case "undisplay":
+		msg := "Invalid arguments: undisplay $n"
+		if len(parts) != 2 {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			fmt.Fprintln(d.out, msg)
+			return false
+		}
+
+		if !d.removeDisplay(id) {
+			fmt.Fprintf(d.out, "No display number %d\n", id)
+			return false
+		}
+
+	case "history":
+		for i, line := range d.history {
+			fmt.Fprintf(d.out, "%d\t%s\n", i+1, line)
+		}
+
+	case "source":
+		if len(parts) != 2 {
+			fmt.Fprintln(d.out, "Invalid arguments: source $file")
+			return false
+		}
+
+		// A sourced script may source one more
+		if d.depth >= 2 {
+			fmt.Fprintln(d.out, "source is nested too deeply")
+			return false
+		}
+
+		if err := d.source(parts[1], false); err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+
+	}
+
+	if runCommands[command] {
+		d.printDisplays()
+	}
+
+	return true
+}
+
+// debuggerCommands are the REPL commands with their short aliases. Any
+// unambiguous prefix of a name selects the command too.
+var debuggerCommands = []struct {
+	name  string
+	alias string
+}{
+	{"help", "h"},
+	{"memory", "m"},
+	{"x", ""},
+	{"decimal", "d"},
+	{"registers", "r"},
+	{"stats", ""},
+	{"search", ""},
+	{"search-bytes", ""},
+	{"save", ""},
+	{"dump", ""},
+	{"load", ""},
+	{"compare", ""},
+	{"restore", ""},
+	{"step", "s"},
+	{"set", ""},
+	{"assert", ""},
+	{"write", "w"},
+	{"asm", ""},
+	{"next", "n"},
+	{"finish", "fin"},
+	{"call", ""},
+	{"backtrace", "bt"},
+	{"where", ""},
+	{"disassemble", "dis"},
+	{"until", "u"},
+	{"continue", "c"},
+	{"break", "b"},
+	{"watch", ""},
+	{"rwatch", ""},
+	{"info", "i"},
+	{"ignore", ""},
+	{"delete", ""},
+	{"display", ""},
+	{"undisplay", ""},
+	{"history", ""},
+	{"source", ""},
+}
+
+// resolveCommand returns the name of the command word selects, by name,
+// alias or unambiguous prefix. x takes its format after a slash, as in
+// x/4gx.
+func resolveCommand(word string) (string, error) {
+	if strings.HasPrefix(word, "x/") {
+		return "x", nil
+	}
+
+	var matches []string
+	for _, command := range debuggerCommands {
+		if word == command.name || word == command.alias {
+			return command.name, nil
+		}
+
+		if strings.HasPrefix(command.name, word) {
+			matches = append(matches, command.name)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("Unknown command: %s; h/help lists commands", word)
+	case 1:
+		return matches[0], nil
+	}
+
+	return "", fmt.Errorf("Ambiguous command %s: %s", word, strings.Join(matches, ", "))
+}
+
+// splitArguments splits input into words at spaces. Single or double
+// quotes keep spaces in a word, and within double quotes a backslash
+// escapes the next character.
+func splitArguments(input string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(input); i++ {
+		b := input[i]
+		switch {
+		case quote != 0 && b == quote:
+			quote = 0
+		case quote == '"' && b == '\\' && i+1 < len(input):
+			i++
+			word.WriteByte(input[i])
+		case quote != 0:
+			word.WriteByte(b)
+		case b == '"' || b == '\'':
+			quote = b
+			inWord = true
+		case b == ' ' || b == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(b)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated %c quote", quote)
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// runCommands are the commands that execute instructions, after which
+// display expressions are printed
+var runCommands = map[string]bool{"step": true, "next": true, "finish": true, "until": true, "continue": true}
+
+// source runs the commands in filename, echoing each before its output.
+// Blank lines and lines starting with # are skipped. When strict, the
+// first failing command stops the script with an error; otherwise
+// failures are only printed.
+func (d *debugger) source(filename string, strict bool) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d.depth++
+	defer func() { d.depth-- }()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		input := strings.TrimSpace(scanner.Text())
+		if input == "" || strings.HasPrefix(input, "#") {
+			continue
+		}
+
+		fmt.Fprintln(d.out, "> "+input)
+		if !d.command(input) && strict {
+			return fmt.Errorf("%s:%d: command failed: %s", filename, line, input)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// setDebuggerRegister sets a register by name, returning its old value
+func (c *cpu) setDebuggerRegister(name string, v uint64) (uint64, bool) {
+	switch name {
+	case "fs_base":
+		old := c.fsBase
+		c.fsBase = v
+		return old, true
+	case "gs_base":
+		old := c.gsBase
+		c.gsBase = v
+		return old, true
+	}
+
+	for reg, regName := range registerMap {
+		if regName == name {
+			old := c.regfile.get(reg)
+			c.regfile.set(reg, v)
+			return old, true
+		}
+	}
+
+	return 0, false
+}
+
+// debugWrite writes guest memory for the debugger through the checked
+// path the CPU uses, returning the old value or the fault raised.
+func (c *cpu) debugWrite(addr uint64, width int, v uint64) (old uint64, err error) {
+	defer func() {
+		if ferr := recoverFault(recover()); ferr != nil {
+			err = ferr
+		}
+	}()
+
+	c.checkAccess(addr, width, "write")
+	old = readBytes(c.mem, addr, width)
+	c.storeMemory(addr, width, v)
+	return old, nil
+}
+
+// codeAt returns memory from addr on for disassembly, nothing when addr
+// is outside memory
+func (c *cpu) codeAt(addr uint64) []byte {
+	if addr >= uint64(len(c.mem)) {
+		return nil
+	}
+
+	return c.mem[addr:]
+}
+
+// disassemblyLine formats the instruction at addr with its address and
+// bytes. Bytes that cannot be decoded are shown as a single db.
+func (c *cpu) disassemblyLine(addr uint64, symbols *symbolTable) string {
+	if addr >= uint64(len(c.mem)) {
+		return fmt.Sprintf("%8x:\taddress out of range", addr)
+	}
+
+	text, n, err := disassembleWithSymbols(c.mem[addr:], addr, symbols)
+	if err != nil {
+		text, n = fmt.Sprintf("db 0x%02x", c.mem[addr]), 1
+	}
+
+	return fmt.Sprintf("%8x:\t%-30s\t%s", addr, formatInstructionBytes(c.mem[addr:addr+uint64(n)]), text)
+}
+
+func (c *cpu) printDisassembly(w io.Writer, addr, count uint64) {
+	c.printDisassemblyRange(w, addr, uint64(len(c.mem)), count)
+}
+
+// printDisassemblyRange prints up to count instructions starting from
+// addr and before end
+func (c *cpu) printDisassemblyRange(w io.Writer, addr, end, count uint64) {
+	symbols := c.symbolTable()
+	if addr >= uint64(len(c.mem)) {
+		fmt.Fprintln(w, "  ", c.disassemblyLine(addr, symbols))
+		return
+	}
+
+	if end > uint64(len(c.mem)) {
+		end = uint64(len(c.mem))
+	}
+
+	for i := uint64(0); i < count && addr < end; i++ {
+		if name, ok := symbols.at(addr); ok {
+			fmt.Fprintf(w, "<%s>:\n", name)
+		}
+
+		// Mark the instruction that executes next
+		marker := "  "
+		if addr == c.regfile.get(rip) {
+			marker = "=>"
+		}
+
+		fmt.Fprintln(w, marker, c.disassemblyLine(addr, symbols))
+
+		_, n, err := disassemble(c.codeAt(addr), addr)
+		if err != nil {
+			n = 1
+		}
+		addr += uint64(n)
+	}
+}
+
+// debugStep executes one instruction for the debugger, reporting faults
+// and program exit. It returns true when execution cannot continue.
+func (c *cpu) debugStep(w io.Writer) bool {
+	if c.exited() {
+		fmt.Fprintln(w, "The program has finished")
+		return true
+	}
+
+	c.breakpoints.stopped = nil
+	if err := c.tryExecute(); err != nil {
+		fmt.Fprintln(w, err)
+		return true
+	}
+
+	if c.exited() {
+		c.stop()
+		fmt.Fprintln(w, c.exitMessage())
+		return true
+	}
+
+	return false
+}
+
+// exitMessage says how the program exited: by calling exit or
+// exit_group, or by returning from its entry function, named when the
+// symbols know it
+func (c *cpu) exitMessage() string {
+	status := c.exitStatus() & 0xFF
+	if c.exitCalled {
+		return fmt.Sprintf("program called exit with status %d", status)
+	}
+
+	entry := "its entry function"
+	if t := c.symbolTable(); t != nil {
+		if name, ok := t.at(c.proc.entryPoint); ok {
+			entry = name
+		}
+	}
+
+	return fmt.Sprintf("program returned from %s with status %d", entry, status)
+}
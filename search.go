@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// maxSearchMatches bounds how many addresses search prints
+const maxSearchMatches = 100
+
+// searchMemory returns the addresses pattern starts at, looking in the
+// memory in use as info maps lists it rather than all of memory, or
+// only in the length bytes at from when length isn't zero
+func (c *cpu) searchMemory(pattern []byte, from, length uint64) []uint64 {
+	var ranges []memoryRegion
+	if length != 0 {
+		ranges = []memoryRegion{{start: from, end: from + length}}
+	} else {
+		// Adjacent regions are searched as one, so that a match may
+		// span the two
+		for _, r := range c.memoryRegions() {
+			if n := len(ranges); n > 0 && ranges[n-1].end == r.start {
+				ranges[n-1].end = r.end
+			} else {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+
+	var matches []uint64
+	for _, r := range ranges {
+		if r.end > uint64(len(c.mem)) {
+			r.end = uint64(len(c.mem))
+		}
+
+		for start := r.start; start < r.end; {
+			i := bytes.Index(c.mem[start:r.end], pattern)
+			if i < 0 {
+				break
+			}
+
+			matches = append(matches, start+uint64(i))
+			start += uint64(i) + 1
+		}
+	}
+
+	return matches
+}
+
+// printSearch prints where pattern occurs, with the symbol each address
+// falls in
+func (d *debugger) printSearch(pattern []byte, from, length uint64) {
+	c := d.c
+	matches := c.searchMemory(pattern, from, length)
+	if len(matches) == 0 {
+		fmt.Fprintln(d.out, "Pattern not found")
+		return
+	}
+
+	symbols := c.symbolTable()
+	for i, address := range matches {
+		if i == maxSearchMatches {
+			fmt.Fprintf(d.out, "... and %d more\n", len(matches)-i)
+			break
+		}
+
+		if name, ok := symbols.lookup(address); ok {
+			fmt.Fprintf(d.out, d.intFormat+" <%s>\n", address, name)
+		} else {
+			fmt.Fprintf(d.out, d.intFormat+"\n", address)
+		}
+	}
+
+	fmt.Fprintf(d.out, "%d match(es)\n", len(matches))
+}
@@ -0,0 +1,127 @@
+package main
+
+const (
+	sysRtSigaction   = 13
+	sysRtSigprocmask = 14
+)
+
+// numSignals is the number of signals, numbered from 1, that a 64 bit
+// sigset_t holds
+const numSignals = 64
+
+const (
+	sigKill = 9
+	sigStop = 19
+)
+
+// How rt_sigprocmask combines the new set with the blocked mask
+const (
+	sigBlock   = 0
+	sigUnblock = 1
+	sigSetmask = 2
+)
+
+// sigactionSize is the size of the kernel's struct sigaction: the
+// handler, flags, restorer and mask, 8 bytes each
+const sigactionSize = 32
+
+// sigsetSize is the only sigset_t size the syscalls accept
+const sigsetSize = 8
+
+// signalState is what rt_sigaction and rt_sigprocmask record. Signals
+// are never delivered; the state is kept so that libc reads back what
+// it set.
+type signalState struct {
+	// actions are the struct sigactions installed for each signal,
+	// indexed by signal number less one
+	actions [numSignals][sigactionSize]byte
+	// mask is the blocked signal set, bit n-1 for signal n
+	mask uint64
+}
+
+// sysRtSigaction installs and reads back signal handlers without ever
+// calling them. As on Linux, SIGKILL and SIGSTOP keep their default
+// action.
+func (c *cpu) sysRtSigaction() uint64 {
+	sig := c.regfile.get(rdi)
+	act := c.regfile.get(rsi)
+	oldact := c.regfile.get(rdx)
+	if c.regfile.get(r10) != sigsetSize || sig < 1 || sig > numSignals {
+		return errno(errnoEINVAL)
+	}
+
+	if act != 0 && (sig == sigKill || sig == sigStop) {
+		return errno(errnoEINVAL)
+	}
+
+	action := &c.signals.actions[sig-1]
+	var next [sigactionSize]byte
+	if act != 0 {
+		buf, ok := c.guestBuffer(act, sigactionSize)
+		if !ok {
+			return errno(errnoEFAULT)
+		}
+
+		copy(next[:], buf)
+	}
+
+	if oldact != 0 {
+		buf, ok := c.guestBuffer(oldact, sigactionSize)
+		if !ok {
+			return errno(errnoEFAULT)
+		}
+
+		copy(buf, action[:])
+	}
+
+	if act != 0 {
+		*action = next
+	}
+
+	return 0
+}
+
+// sysRtSigprocmask changes the blocked signal mask, which SIGKILL and
+// SIGSTOP can't be part of, writing the previous mask back first
+func (c *cpu) sysRtSigprocmask() uint64 {
+	how := c.regfile.get(rdi)
+	set := c.regfile.get(rsi)
+	oldset := c.regfile.get(rdx)
+	if c.regfile.get(r10) != sigsetSize {
+		return errno(errnoEINVAL)
+	}
+
+	mask := c.signals.mask
+	if set != 0 {
+		buf, ok := c.guestBuffer(set, sigsetSize)
+		if !ok {
+			return errno(errnoEFAULT)
+		}
+
+		v := readBytes(buf, 0, sigsetSize)
+		switch how {
+		case sigBlock:
+			mask |= v
+		case sigUnblock:
+			mask &^= v
+		case sigSetmask:
+			mask = v
+		default:
+			return errno(errnoEINVAL)
+		}
+
+		mask &^= 1<<(sigKill-1) | 1<<(sigStop-1)
+	}
+
+	if oldset != 0 {
+		buf, ok := c.guestBuffer(oldset, sigsetSize)
+		if !ok {
+			return errno(errnoEFAULT)
+		}
+
+		writeBytes(buf, 0, sigsetSize, c.signals.mask)
+	}
+
+	c.signals.mask = mask
+	return 0
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// snapshotVersion is bumped whenever a field of the snapshot is added,
+// removed or changes meaning
+const snapshotVersion = 3
+
+const snapshotPage = 4096
+
+// snapshot is the serialized form of a paused machine. Memory is
+// stored sparsely: pages that are entirely zero are left out.
+type snapshot struct {
+	Version      int
+	MemorySize   uint64
+	Registers    registerFile
+	XMM          xmmRegisters
+	FSBase       uint64
+	GSBase       uint64
+	StartAddress uint64
+	EntryPoint   uint64
+	ImageSize    uint64
+	BrkStart     uint64
+	Brk          uint64
+	Mappings     map[uint64]uint64
+	Segments     []snapshotSegment
+	// PagePermissions are the permissions of each page, left out when
+	// they weren't enforced
+	PagePermissions []byte
+	SignalActions   [numSignals][sigactionSize]byte
+	SignalMask      uint64
+	ExitCalled      bool
+	Status          int
+	Pages           map[uint64][]byte
+}
+
+// snapshotSegment is a loadSegment, the part of it loaded from the file
+// kept as Data
+type snapshotSegment struct {
+	Address uint64
+	Data    []byte
+	MemSize uint64
+	Flags   elf.ProgFlag
+}
+
+func (c *cpu) saveSnapshot(w io.Writer) error {
+	s := snapshot{
+		Version:    snapshotVersion,
+		MemorySize: uint64(len(c.mem)),
+		Registers:  *c.regfile,
+		XMM:        c.xmm,
+		FSBase:     c.fsBase,
+		GSBase:     c.gsBase,
+		BrkStart:   c.brkStart,
+		Brk:        c.brk,
+		Mappings:   map[uint64]uint64{},
+
+		PagePermissions: c.pagePerms,
+		SignalActions:   c.signals.actions,
+		SignalMask:      c.signals.mask,
+		ExitCalled:      c.exitCalled,
+		Status:          c.status,
+		Pages:           map[uint64][]byte{},
+	}
+
+	for _, m := range c.mappings {
+		s.Mappings[m.address] = m.length
+	}
+
+	if c.proc != nil {
+		s.StartAddress = c.proc.startAddress
+		s.EntryPoint = c.proc.entryPoint
+		s.ImageSize = uint64(len(c.proc.bin))
+		for _, seg := range c.proc.segments {
+			s.Segments = append(s.Segments, snapshotSegment{seg.address, seg.data, seg.memsz, seg.flags})
+		}
+	}
+
+	for page := uint64(0); page < uint64(len(c.mem)); page += snapshotPage {
+		end := page + snapshotPage
+		if end > uint64(len(c.mem)) {
+			end = uint64(len(c.mem))
+		}
+
+		for _, b := range c.mem[page:end] {
+			if b != 0 {
+				s.Pages[page] = c.mem[page:end]
+				break
+			}
+		}
+	}
+
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+func (c *cpu) loadSnapshot(r io.Reader) error {
+	var s snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return fmt.Errorf("Could not decode snapshot: %s", err)
+	}
+
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("Unsupported snapshot version: %d", s.Version)
+	}
+
+	if s.MemorySize != uint64(len(c.mem)) {
+		return fmt.Errorf("Snapshot memory size %d does not match cpu memory size %d", s.MemorySize, len(c.mem))
+	}
+
+	// Nothing changes until the whole snapshot is known to fit, so that
+	// a corrupt one leaves the machine as it was
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	for i := range c.mem {
+		c.mem[i] = 0
+	}
+
+	for page, data := range s.Pages {
+		copy(c.mem[page:], data)
+	}
+
+	*c.regfile = s.Registers
+	c.xmm = s.XMM
+	c.fsBase = s.FSBase
+	c.gsBase = s.GSBase
+	c.brkStart = s.BrkStart
+	c.brk = s.Brk
+	c.mappings = nil
+	for address, length := range s.Mappings {
+		c.mappings = append(c.mappings, mapping{address, length})
+	}
+	sort.Slice(c.mappings, func(i, j int) bool { return c.mappings[i].address < c.mappings[j].address })
+	c.pagePerms = nil
+	if !c.noNX {
+		c.pagePerms = s.PagePermissions
+	}
+	c.signals = signalState{actions: s.SignalActions, mask: s.SignalMask}
+	c.exitCalled = s.ExitCalled
+	c.status = s.Status
+	var symbols, sizes map[string]uint64
+	var lines []sourceLine
+	if c.proc != nil {
+		symbols = c.proc.symbols
+		sizes = c.proc.symbolSizes
+		lines = c.proc.lines
+	}
+
+	var segments []loadSegment
+	for _, seg := range s.Segments {
+		segments = append(segments, loadSegment{seg.Address, seg.Data, seg.MemSize, seg.Flags})
+	}
+
+	c.proc = &process{
+		startAddress: s.StartAddress,
+		entryPoint:   s.EntryPoint,
+		bin:          c.mem[s.StartAddress : s.StartAddress+s.ImageSize],
+		symbols:      symbols,
+		symbolSizes:  sizes,
+		lines:        lines,
+		segments:     segments,
+	}
+
+	c.setCodeRange()
+	return nil
+}
+
+// check makes sure everything in the snapshot lies within its memory
+func (s *snapshot) check() error {
+	within := func(address, length uint64) bool {
+		return address <= s.MemorySize && length <= s.MemorySize-address
+	}
+
+	for page, data := range s.Pages {
+		if page%snapshotPage != 0 || !within(page, uint64(len(data))) {
+			return fmt.Errorf("Snapshot page %x out of bounds", page)
+		}
+	}
+
+	if !within(s.StartAddress, s.ImageSize) {
+		return fmt.Errorf("Snapshot image of %d bytes at %x out of bounds", s.ImageSize, s.StartAddress)
+	}
+
+	for address, length := range s.Mappings {
+		if !within(address, length) {
+			return fmt.Errorf("Snapshot mapping of %d bytes at %x out of bounds", length, address)
+		}
+	}
+
+	for _, seg := range s.Segments {
+		if !within(seg.Address, seg.MemSize) || uint64(len(seg.Data)) > seg.MemSize {
+			return fmt.Errorf("Snapshot segment of %d bytes at %x out of bounds", seg.MemSize, seg.Address)
+		}
+	}
+
+	if pages := (s.MemorySize + pageSize - 1) / pageSize; s.PagePermissions != nil && uint64(len(s.PagePermissions)) != pages {
+		return fmt.Errorf("Snapshot has permissions for %d pages, not %d", len(s.PagePermissions), pages)
+	}
+
+	return nil
+}
+
+func (c *cpu) saveSnapshotFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := c.saveSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (c *cpu) loadSnapshotFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.loadSnapshot(f)
+}
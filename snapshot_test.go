@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testMemorySize = 0x400000
+
+// pausedCPU returns a machine with state in every part a snapshot
+// records
+func pausedCPU() cpu {
+	c := newCPU(testMemorySize)
+	c.initPermissions()
+	c.setPermissions(0x1000, 0x2000, permRead|permExec)
+	c.regfile.set(rax, 0x1122334455667788)
+	c.regfile.set(rsp, 0x3ff000)
+	c.regfile.set(rip, 0x1000)
+	c.xmm[3] = [2]uint64{1, 2}
+	c.fsBase = 0x3fe000
+	c.brkStart, c.brk = 0x200000, 0x201000
+	c.mappings = []mapping{{0x300000, 0x2000}, {0x310000, 0x1000}}
+	c.proc = &process{
+		startAddress: 0x1000,
+		entryPoint:   0x1000,
+		bin:          c.mem[0x1000:0x3000],
+		segments: []loadSegment{
+			{0x1000, []byte{0xef, 0xbe, 0xad, 0xde}, 0x1000, elf.PF_R | elf.PF_X},
+			{0x2000, nil, 0x1000, elf.PF_R | elf.PF_W},
+		},
+	}
+	c.signals.mask = 1 << 2
+	writeBytes(c.mem, 0x1000, 8, 0xdeadbeef)
+	writeBytes(c.mem, testMemorySize-8, 8, 42)
+	return c
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	c := pausedCPU()
+	var buf bytes.Buffer
+	if err := c.saveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newCPU(testMemorySize)
+	if err := restored.loadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if *restored.regfile != *c.regfile {
+		t.Errorf("registers %v, want %v", *restored.regfile, *c.regfile)
+	}
+
+	if restored.xmm != c.xmm || restored.fsBase != c.fsBase || restored.brk != c.brk || restored.brkStart != c.brkStart {
+		t.Errorf("xmm, fs or brk differ")
+	}
+
+	if len(restored.mappings) != 2 || restored.mappings[0] != c.mappings[0] || restored.mappings[1] != c.mappings[1] {
+		t.Errorf("mappings %v, want %v", restored.mappings, c.mappings)
+	}
+
+	if restored.signals.mask != c.signals.mask {
+		t.Errorf("signal mask %x, want %x", restored.signals.mask, c.signals.mask)
+	}
+
+	if !bytes.Equal(restored.mem, c.mem) {
+		t.Errorf("memory differs")
+	}
+
+	if !bytes.Equal(restored.pagePerms, c.pagePerms) {
+		t.Errorf("page permissions differ")
+	}
+
+	if len(restored.proc.segments) != len(c.proc.segments) {
+		t.Fatalf("%d segments, want %d", len(restored.proc.segments), len(c.proc.segments))
+	}
+
+	for i, seg := range restored.proc.segments {
+		want := c.proc.segments[i]
+		if seg.address != want.address || seg.memsz != want.memsz || seg.flags != want.flags || !bytes.Equal(seg.data, want.data) {
+			t.Errorf("segment %d is %+v, want %+v", i, seg, want)
+		}
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(s *snapshot)
+	}{
+		{"version", func(s *snapshot) { s.Version = 1 }},
+		{"page outside memory", func(s *snapshot) { s.Pages[testMemorySize] = []byte{1} }},
+		{"page running off memory", func(s *snapshot) { s.Pages[testMemorySize-snapshotPage] = make([]byte, 2*snapshotPage) }},
+		{"unaligned page", func(s *snapshot) { s.Pages[1] = []byte{1} }},
+		{"image", func(s *snapshot) { s.StartAddress, s.ImageSize = 0x1000, ^uint64(0) }},
+		{"mapping", func(s *snapshot) { s.Mappings[^uint64(0)-1] = 4 }},
+		{"permissions", func(s *snapshot) { s.PagePermissions = []byte{7} }},
+		{"segment", func(s *snapshot) { s.Segments[0].MemSize = testMemorySize }},
+		{"segment data", func(s *snapshot) { s.Segments[1].Data = make([]byte, 0x1001) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := pausedCPU()
+			var buf bytes.Buffer
+			if err := c.saveSnapshot(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			var s snapshot
+			if err := gob.NewDecoder(&buf).Decode(&s); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.corrupt(&s)
+			buf.Reset()
+			if err := gob.NewEncoder(&buf).Encode(&s); err != nil {
+				t.Fatal(err)
+			}
+
+			// Loading over a running machine must leave it untouched
+			running := pausedCPU()
+			running.regfile.set(rbx, 7)
+			writeBytes(running.mem, 0x2000, 8, 99)
+			if err := running.loadSnapshot(&buf); err == nil {
+				t.Fatal("loaded a corrupt snapshot")
+			}
+
+			if running.regfile.get(rbx) != 7 || readBytes(running.mem, 0x2000, 8) != 99 {
+				t.Errorf("a failed load changed the machine")
+			}
+		})
+	}
+}
+
+// countdownCode writes "5\n" to "1\n" to stdout and exits with 42:
+//
+//	mov ebx, 5
+//	loop: lea eax, [rbx+0xa30]; mov [rsp-8], eax
+//	mov edi, 1; lea rsi, [rsp-8]; mov edx, 2; mov eax, 1; syscall
+//	dec ebx; jne loop
+//	mov edi, 42; mov eax, 231; syscall
+var countdownCode = []byte{
+	0xbb, 0x05, 0x00, 0x00, 0x00,
+	0x8d, 0x83, 0x30, 0x0a, 0x00, 0x00, 0x89, 0x44, 0x24, 0xf8,
+	0xbf, 0x01, 0x00, 0x00, 0x00, 0x48, 0x8d, 0x74, 0x24, 0xf8, 0xba, 0x02, 0x00, 0x00, 0x00,
+	0xb8, 0x01, 0x00, 0x00, 0x00, 0x0f, 0x05,
+	0xff, 0xcb, 0x75, 0xdc,
+	0xbf, 0x2a, 0x00, 0x00, 0x00, 0xb8, 0xe7, 0x00, 0x00, 0x00, 0x0f, 0x05,
+}
+
+// captureStdout points fd 1 of c at a new file in dir, which is
+// returned
+func captureStdout(t *testing.T, c *cpu, dir, name string) *os.File {
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { f.Close() })
+	c.files[1] = &guestFile{file: f, writable: true}
+	return f
+}
+
+func readCaptured(t *testing.T, f *os.File) string {
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+// TestSnapshotResume snapshots a program part way through, restores it
+// into a fresh machine and checks that both finish the same way
+func TestSnapshotResume(t *testing.T) {
+	dir := t.TempDir()
+	proc, err := newRawProcess("countdown", countdownCode, defaultRawBase, defaultRawBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newCPU(0x400000 * 10)
+	c.load(proc)
+	before := captureStdout(t, &c, dir, "before")
+	// Two of the five writes
+	for i := 0; i < 20; i++ {
+		if err := c.tryExecute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := c.saveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newCPU(0x400000 * 10)
+	if err := restored.loadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	original := captureStdout(t, &c, dir, "original")
+	status, err := c.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := captureStdout(t, &restored, dir, "restored")
+	restoredStatus, err := restored.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != 42 || restoredStatus != status {
+		t.Errorf("restored program exited with %d, the original with %d", restoredStatus, status)
+	}
+
+	if got := readCaptured(t, before) + readCaptured(t, original); got != "5\n4\n3\n2\n1\n" {
+		t.Errorf("original program wrote %q", got)
+	}
+
+	if got, want := readCaptured(t, resumed), readCaptured(t, original); got != want || want != "3\n2\n1\n" {
+		t.Errorf("restored program wrote %q, the original %q", got, want)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// xmmRegisters are the sixteen 128 bit SSE registers, each held as its
+// low and high quadwords
+type xmmRegisters [16][2]uint64
+
+// defaultNaN is the quiet NaN an invalid operation such as 0/0 returns
+const defaultNaN = 0xFFF8000000000000
+
+// quietNaNBit is set in quiet NaNs and clear in signaling ones
+const quietNaNBit = 1 << 51
+
+func init() {
+	// The single and double precision forms of the moves and xor
+	// behave alike
+	for _, packed := range []struct {
+		table  *[256]opcode
+		suffix string
+	}{{&twoByteOpcodes, "ps"}, {&twoByteOpcodes66, "pd"}} {
+		defineOpcode(packed.table, 0x10, "movu"+packed.suffix, execMovXMMLoad)
+		defineOpcode(packed.table, 0x11, "movu"+packed.suffix, execMovXMMStore)
+		defineOpcode(packed.table, 0x12, "movl"+packed.suffix, execMovHalfLoad)
+		defineOpcode(packed.table, 0x13, "movl"+packed.suffix, execMovHalfStore)
+		defineOpcode(packed.table, 0x16, "movh"+packed.suffix, execMovHalfLoad)
+		defineOpcode(packed.table, 0x17, "movh"+packed.suffix, execMovHalfStore)
+		defineOpcode(packed.table, 0x28, "mova"+packed.suffix, execMovXMMLoad)
+		defineOpcode(packed.table, 0x29, "mova"+packed.suffix, execMovXMMStore)
+		defineOpcode(packed.table, 0x57, "xor"+packed.suffix, execXorXMM)
+	}
+
+	defineOpcode(&twoByteOpcodes66, 0x2E, "ucomisd", execCompareDouble)
+	defineOpcode(&twoByteOpcodes66, 0x2F, "comisd", execCompareDouble)
+	defineOpcode(&twoByteOpcodes66, 0x6E, "movd", execMovdToXMM)
+	defineOpcode(&twoByteOpcodes66, 0x6F, "movdqa", execMovXMMLoad)
+	defineOpcode(&twoByteOpcodes66, 0x7E, "movd", execMovdFromXMM)
+	defineOpcode(&twoByteOpcodes66, 0x7F, "movdqa", execMovXMMStore)
+	defineOpcode(&twoByteOpcodes66, 0xD6, "movq", execMovqStore)
+	defineOpcode(&twoByteOpcodes66, 0xEF, "pxor", execXorXMM)
+
+	defineOpcode(&twoByteOpcodesF3, 0x10, "movss", execMovScalarLoad)
+	defineOpcode(&twoByteOpcodesF3, 0x11, "movss", execMovScalarStore)
+	defineOpcode(&twoByteOpcodesF3, 0x6F, "movdqu", execMovXMMLoad)
+	defineOpcode(&twoByteOpcodesF3, 0x7E, "movq", execMovqLoad)
+	defineOpcode(&twoByteOpcodesF3, 0x7F, "movdqu", execMovXMMStore)
+
+	defineOpcode(&twoByteOpcodesF2, 0x10, "movsd", execMovScalarLoad)
+	defineOpcode(&twoByteOpcodesF2, 0x11, "movsd", execMovScalarStore)
+	defineOpcode(&twoByteOpcodesF2, 0x2A, "cvtsi2sd", execCvtsi2sd)
+	defineOpcode(&twoByteOpcodesF2, 0x2C, "cvttsd2si", execCvttsd2si)
+	for _, op := range []byte{0x58, 0x59, 0x5C, 0x5E} {
+		defineOpcode(&twoByteOpcodesF2, op, scalarDoubleNames[op], execScalarDouble)
+	}
+}
+
+var scalarDoubleNames = map[byte]string{0x58: "addsd", 0x59: "mulsd", 0x5C: "subsd", 0x5E: "divsd"}
+
+// readXMM reads the 16 byte xmm register or memory operand of m
+func (c *cpu) readXMM(m modrm) [2]uint64 {
+	if m.mod == 0b11 {
+		return c.xmm[m.rm]
+	}
+
+	return [2]uint64{c.readMemory(m.address, 8), c.readMemory(m.address+8, 8)}
+}
+
+// writeXMM writes the 16 byte xmm register or memory operand of m
+func (c *cpu) writeXMM(m modrm, v [2]uint64) {
+	if m.mod == 0b11 {
+		c.xmm[m.rm] = v
+		return
+	}
+
+	c.writeMemory(m.address, 8, v[0])
+	c.writeMemory(m.address+8, 8, v[1])
+}
+
+// readXMMScalar reads the low width bits of the xmm register or memory
+// operand of m
+func (c *cpu) readXMMScalar(m modrm, width int) uint64 {
+	if m.mod == 0b11 {
+		return c.xmm[m.rm][0] & widthMask(width)
+	}
+
+	return c.readMemory(m.address, width/8)
+}
+
+// requiresAlignment reports whether the instruction's 16 byte memory
+// operand must be aligned, which is all but the unaligned moves
+func requiresAlignment(ctx *decodeContext) bool {
+	switch ctx.opcode {
+	case 0x10, 0x11:
+		return false
+	case 0x6F, 0x7F:
+		return ctx.mandatoryPrefix == 0x66
+	}
+
+	return true
+}
+
+// checkAlignment raises #GP for a misaligned 16 byte memory operand
+func (c *cpu) checkAlignment(ctx *decodeContext, m modrm) {
+	if m.mod != 0b11 && m.address%16 != 0 && requiresAlignment(ctx) {
+		panic(&fault{kind: generalProtection, rip: ctx.start, detail: fmt.Sprintf("misaligned 16 byte access at 0x%x", m.address)})
+	}
+}
+
+// scalarWidth is the width of movss, 32, or movsd, 64
+func scalarWidth(ctx *decodeContext) int {
+	if ctx.mandatoryPrefix == 0xF3 {
+		return 32
+	}
+
+	return 64
+}
+
+func execMovXMMLoad(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	c.checkAlignment(ctx, m)
+	c.xmm[m.reg] = c.readXMM(m)
+}
+
+func execMovXMMStore(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	c.checkAlignment(ctx, m)
+	c.writeXMM(m, c.xmm[m.reg])
+}
+
+// execMovScalarLoad is movss and movsd, which zero the rest of the
+// destination when loading from memory but keep it between registers
+func execMovScalarLoad(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	width := scalarWidth(ctx)
+	v := c.readXMMScalar(m, width)
+	if m.mod == 0b11 {
+		c.xmm[m.reg][0] = c.xmm[m.reg][0]&^widthMask(width) | v
+	} else {
+		c.xmm[m.reg] = [2]uint64{v, 0}
+	}
+}
+
+func execMovScalarStore(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	width := scalarWidth(ctx)
+	v := c.xmm[m.reg][0] & widthMask(width)
+	if m.mod == 0b11 {
+		c.xmm[m.rm][0] = c.xmm[m.rm][0]&^widthMask(width) | v
+	} else {
+		c.writeMemory(m.address, width/8, v)
+	}
+}
+
+// execMovdToXMM is movd, or movq with REX.W, from a general register or
+// memory, zeroing the rest of the xmm register
+func execMovdToXMM(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	width := 32
+	if ctx.rex&rexW != 0 {
+		width = 64
+	}
+
+	c.xmm[m.reg] = [2]uint64{c.readRM(m, width), 0}
+}
+
+func execMovdFromXMM(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	width := 32
+	if ctx.rex&rexW != 0 {
+		width = 64
+	}
+
+	c.writeRM(m, width, c.xmm[m.reg][0]&widthMask(width))
+}
+
+// execMovqLoad is movq xmm, xmm/m64, zeroing the high quadword
+func execMovqLoad(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	c.xmm[m.reg] = [2]uint64{c.readXMMScalar(m, 64), 0}
+}
+
+// execMovqStore is movq xmm/m64, xmm, zeroing the high quadword of a
+// register destination
+func execMovqStore(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	if m.mod == 0b11 {
+		c.xmm[m.rm] = [2]uint64{c.xmm[m.reg][0], 0}
+	} else {
+		c.writeMemory(m.address, 8, c.xmm[m.reg][0])
+	}
+}
+
+// halfIndex is the quadword movlps/movlpd (0x12 and 0x13) or
+// movhps/movhpd (0x16 and 0x17) move
+func halfIndex(ctx *decodeContext) int {
+	if ctx.opcode >= 0x16 {
+		return 1
+	}
+
+	return 0
+}
+
+// execMovHalfLoad loads the low or high quadword of an xmm register
+// from memory, keeping the other. Between registers 0x0F 12 is movhlps,
+// moving the high quadword of the source to the low one of the
+// destination, and 0x0F 16 is movlhps, the other way round.
+func execMovHalfLoad(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	half := halfIndex(ctx)
+	if m.mod == 0b11 {
+		if ctx.mandatoryPrefix == 0x66 {
+			c.invalidOpcode(ctx)
+		}
+
+		c.xmm[m.reg][half] = c.xmm[m.rm][1-half]
+		return
+	}
+
+	c.xmm[m.reg][half] = c.readMemory(m.address, 8)
+}
+
+// execMovHalfStore stores the low or high quadword of an xmm register
+func execMovHalfStore(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	if m.mod == 0b11 {
+		c.invalidOpcode(ctx)
+	}
+
+	c.writeMemory(m.address, 8, c.xmm[m.reg][halfIndex(ctx)])
+}
+
+// execXorXMM is pxor, xorps and xorpd, which differ only in the domain
+// they are meant for
+func execXorXMM(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	c.checkAlignment(ctx, m)
+	v := c.readXMM(m)
+	c.xmm[m.reg][0] ^= v[0]
+	c.xmm[m.reg][1] ^= v[1]
+}
+
+// execScalarDouble is addsd, subsd, mulsd and divsd on the low
+// quadwords, keeping the high quadword of the destination
+func execScalarDouble(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	a, b := c.xmm[m.reg][0], c.readXMMScalar(m, 64)
+	x, y := math.Float64frombits(a), math.Float64frombits(b)
+	var r float64
+	switch ctx.opcode {
+	case 0x58:
+		r = x + y
+	case 0x59:
+		r = x * y
+	case 0x5C:
+		r = x - y
+	case 0x5E:
+		r = x / y
+	}
+
+	c.xmm[m.reg][0] = scalarDoubleResult(a, b, r)
+}
+
+// scalarDoubleResult returns the bits of r as the hardware produces
+// them: a NaN operand is returned quieted, the destination's first,
+// and an invalid operation gives defaultNaN rather than Go's NaN.
+func scalarDoubleResult(a, b uint64, r float64) uint64 {
+	switch {
+	case math.IsNaN(math.Float64frombits(a)):
+		return a | quietNaNBit
+	case math.IsNaN(math.Float64frombits(b)):
+		return b | quietNaNBit
+	case math.IsNaN(r):
+		return defaultNaN
+	}
+
+	return math.Float64bits(r)
+}
+
+// execCompareDouble is comisd and ucomisd, which set ZF, PF and CF as
+// an unsigned compare would, all three when either operand is a NaN,
+// and clear OF, SF and AF
+func execCompareDouble(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	x := math.Float64frombits(c.xmm[m.reg][0])
+	y := math.Float64frombits(c.readXMMScalar(m, 64))
+	unordered := math.IsNaN(x) || math.IsNaN(y)
+	c.setFlag(flagZF, unordered || x == y)
+	c.setFlag(flagPF, unordered)
+	c.setFlag(flagCF, unordered || x < y)
+	c.setFlag(flagOF, false)
+	c.setFlag(flagSF, false)
+	c.setFlag(flagAF, false)
+}
+
+// execCvtsi2sd converts a signed 32 bit, or with REX.W 64 bit, integer
+// to the low quadword of an xmm register
+func execCvtsi2sd(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	width := 32
+	if ctx.rex&rexW != 0 {
+		width = 64
+	}
+
+	v := int64(signExtend(c.readRM(m, width), width))
+	c.xmm[m.reg][0] = math.Float64bits(float64(v))
+}
+
+// execCvttsd2si truncates a double to a signed 32 bit, or with REX.W
+// 64 bit, integer. NaNs and values out of range give the integer
+// indefinite value, the smallest integer.
+func execCvttsd2si(c *cpu, ctx *decodeContext) {
+	m := c.decodeModRM(ctx)
+	width := 32
+	if ctx.rex&rexW != 0 {
+		width = 64
+	}
+
+	limit := math.Ldexp(1, width-1)
+	t := math.Trunc(math.Float64frombits(c.readXMMScalar(m, 64)))
+	v := signBit(width)
+	if t >= -limit && t < limit {
+		v = uint64(int64(t))
+	}
+
+	c.regfile.setWidth(register(m.reg), width, v)
+}
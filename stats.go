@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const statsTopAddresses = 10
+
+type stats struct {
+	instructions uint64
+	opcodes      map[uint16]uint64
+	addresses    map[uint64]uint64
+}
+
+func newStats() *stats {
+	return &stats{
+		opcodes:   map[uint16]uint64{},
+		addresses: map[uint64]uint64{},
+	}
+}
+
+func (s *stats) record(c *cpu, ev *instructionEvent) {
+	s.instructions++
+	s.opcodes[ev.opcode]++
+	s.addresses[ev.rip]++
+}
+
+func formatOpcode(opcode uint16) string {
+	if opcode > 0xFF {
+		return fmt.Sprintf("0x%02x 0x%02x", opcode>>8, opcode&0xFF)
+	}
+
+	return fmt.Sprintf("0x%02x", opcode)
+}
+
+type statsOpcodeCount struct {
+	Opcode   string `json:"opcode"`
+	Mnemonic string `json:"mnemonic"`
+	Count    uint64 `json:"count"`
+}
+
+type statsAddressCount struct {
+	Address string `json:"address"`
+	Count   uint64 `json:"count"`
+}
+
+type statsReport struct {
+	Instructions uint64              `json:"instructions"`
+	Opcodes      []statsOpcodeCount  `json:"opcodes"`
+	HotAddresses []statsAddressCount `json:"hotAddresses"`
+}
+
+// report sorts the collected counts, most frequent first.
+func (s *stats) report() statsReport {
+	r := statsReport{Instructions: s.instructions}
+
+	var opcodes []uint16
+	for opcode := range s.opcodes {
+		opcodes = append(opcodes, opcode)
+	}
+	sort.Slice(opcodes, func(i, j int) bool {
+		a, b := s.opcodes[opcodes[i]], s.opcodes[opcodes[j]]
+		return a > b || (a == b && opcodes[i] < opcodes[j])
+	})
+	for _, opcode := range opcodes {
+		r.Opcodes = append(r.Opcodes, statsOpcodeCount{formatOpcode(opcode), opcodeName(opcode), s.opcodes[opcode]})
+	}
+
+	var addresses []uint64
+	for address := range s.addresses {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		a, b := s.addresses[addresses[i]], s.addresses[addresses[j]]
+		return a > b || (a == b && addresses[i] < addresses[j])
+	})
+	if len(addresses) > statsTopAddresses {
+		addresses = addresses[:statsTopAddresses]
+	}
+	for _, address := range addresses {
+		r.HotAddresses = append(r.HotAddresses, statsAddressCount{fmt.Sprintf("0x%x", address), s.addresses[address]})
+	}
+
+	return r
+}
+
+func (s *stats) print(w io.Writer) {
+	r := s.report()
+	fmt.Fprintf(w, "instructions retired: %d\n", r.Instructions)
+	if r.Instructions == 0 {
+		return
+	}
+
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "%-12s %-8s %12s %8s\n", "opcode", "mnemonic", "count", "percent")
+	for _, o := range r.Opcodes {
+		percent := float64(o.Count) * 100 / float64(r.Instructions)
+		fmt.Fprintf(w, "%-12s %-8s %12d %7.2f%%\n", o.Opcode, o.Mnemonic, o.Count, percent)
+	}
+
+	fmt.Fprintf(w, "\n%-18s %12s\n", "hot address", "count")
+	for _, a := range r.HotAddresses {
+		fmt.Fprintf(w, "%-18s %12d\n", a.Address, a.Count)
+	}
+}
+
+func (s *stats) writeJSON(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.report()); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
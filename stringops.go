@@ -0,0 +1,150 @@
+package main
+
+// String instructions operate on the elements at rsi and rdi, stepping
+// both by the element size, forwards or, with DF set, backwards. With a
+// REP prefix they repeat rcx times; the comparing ones also stop once
+// an element differs (REPE, 0xF3) or matches (REPNE, 0xF2). A whole REP
+// loop runs as one instruction.
+
+func init() {
+	defineOpcode(&oneByteOpcodes, 0xA4, "movs", execMovs)
+	defineOpcode(&oneByteOpcodes, 0xA5, "movs", execMovs)
+	defineOpcode(&oneByteOpcodes, 0xA6, "cmps", execCmps)
+	defineOpcode(&oneByteOpcodes, 0xA7, "cmps", execCmps)
+	defineOpcode(&oneByteOpcodes, 0xAA, "stos", execStos)
+	defineOpcode(&oneByteOpcodes, 0xAB, "stos", execStos)
+	defineOpcode(&oneByteOpcodes, 0xAC, "lods", execLods)
+	defineOpcode(&oneByteOpcodes, 0xAD, "lods", execLods)
+	defineOpcode(&oneByteOpcodes, 0xAE, "scas", execScas)
+	defineOpcode(&oneByteOpcodes, 0xAF, "scas", execScas)
+}
+
+// stringSuffixes name the element size of a string instruction, as in
+// scasb or cmpsq
+var stringSuffixes = map[int]string{8: "b", 16: "w", 32: "d", 64: "q"}
+
+// stringWidth is 8 for the even string opcodes, else the operand size
+func stringWidth(ctx *decodeContext) int {
+	if ctx.opcode&1 == 0 {
+		return 8
+	}
+
+	return ctx.widthPrefix
+}
+
+// stringIndex returns the address in the index register r, which is
+// only its low half with the 0x67 prefix
+func (c *cpu) stringIndex(ctx *decodeContext, r register) uint64 {
+	return ctx.addressMask(c.regfile.get(r))
+}
+
+// advanceString steps the index register r past an element of width
+// bits
+func (c *cpu) advanceString(ctx *decodeContext, r register, width int) {
+	step := uint64(width / 8)
+	if c.flag(flagDF) {
+		step = -step
+	}
+
+	if ctx.addressSize32 {
+		c.regfile.setWidth(r, 32, c.regfile.get(r)+step)
+		return
+	}
+
+	c.regfile.set(r, c.regfile.get(r)+step)
+}
+
+// repeatCompare runs compare once, or with a REPE or REPNE prefix until
+// rcx (ecx with the 0x67 prefix) counts down to zero or the comparison
+// ends the loop. rcx is checked before each iteration, so a count of
+// zero compares nothing and leaves the flags alone.
+func (c *cpu) repeatCompare(ctx *decodeContext, compare func()) {
+	repe := ctx.mandatoryPrefix == 0xF3
+	c.repeat(ctx, func() bool {
+		compare()
+		return c.flag(flagZF) == repe
+	})
+}
+
+// repeat runs step once, or with a REP prefix until rcx (ecx with the
+// 0x67 prefix) counts down to zero or step returns false. Either of
+// 0xF2 and 0xF3 repeats, the instructions that don't compare treating
+// them alike.
+func (c *cpu) repeat(ctx *decodeContext, step func() bool) {
+	if ctx.mandatoryPrefix != 0xF2 && ctx.mandatoryPrefix != 0xF3 {
+		step()
+		return
+	}
+
+	counterWidth := 64
+	if ctx.addressSize32 {
+		counterWidth = 32
+	}
+
+	for count := c.regfile.get(rcx) & widthMask(counterWidth); count != 0; {
+		more := step()
+		count--
+		c.regfile.setWidth(rcx, counterWidth, count)
+		if !more {
+			return
+		}
+	}
+}
+
+// movs copies the element at rsi, which a segment override applies to,
+// to rdi
+func execMovs(c *cpu, ctx *decodeContext) {
+	width := stringWidth(ctx)
+	c.repeat(ctx, func() bool {
+		v := c.readMemory(c.stringIndex(ctx, rsi)+c.segmentBase(ctx.segment), width/8)
+		c.writeMemory(c.stringIndex(ctx, rdi), width/8, v)
+		c.advanceString(ctx, rsi, width)
+		c.advanceString(ctx, rdi, width)
+		return true
+	})
+}
+
+// stos stores the accumulator at rdi
+func execStos(c *cpu, ctx *decodeContext) {
+	width := stringWidth(ctx)
+	c.repeat(ctx, func() bool {
+		c.writeMemory(c.stringIndex(ctx, rdi), width/8, c.regfile.get(rax)&widthMask(width))
+		c.advanceString(ctx, rdi, width)
+		return true
+	})
+}
+
+// lods loads the element at rsi, which a segment override applies to,
+// into the accumulator
+func execLods(c *cpu, ctx *decodeContext) {
+	width := stringWidth(ctx)
+	c.repeat(ctx, func() bool {
+		v := c.readMemory(c.stringIndex(ctx, rsi)+c.segmentBase(ctx.segment), width/8)
+		c.regfile.setWidth(rax, width, v)
+		c.advanceString(ctx, rsi, width)
+		return true
+	})
+}
+
+// cmps compares the element at rsi, which a segment override applies
+// to, with the one at rdi
+func execCmps(c *cpu, ctx *decodeContext) {
+	width := stringWidth(ctx)
+	c.repeatCompare(ctx, func() {
+		source := c.readMemory(c.stringIndex(ctx, rsi)+c.segmentBase(ctx.segment), width/8)
+		dest := c.readMemory(c.stringIndex(ctx, rdi), width/8)
+		c.sub(source, dest, width)
+		c.advanceString(ctx, rsi, width)
+		c.advanceString(ctx, rdi, width)
+	})
+}
+
+// scas compares the accumulator with the element at rdi
+func execScas(c *cpu, ctx *decodeContext) {
+	width := stringWidth(ctx)
+	c.repeatCompare(ctx, func() {
+		dest := c.readMemory(c.stringIndex(ctx, rdi), width/8)
+		c.sub(c.regfile.get(rax)&widthMask(width), dest, width)
+		c.advanceString(ctx, rdi, width)
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runSummaryVersion is bumped whenever a field of runSummary changes
+// meaning or is removed; new fields may be added without it.
+const runSummaryVersion = 1
+
+// runSummary is written by --json-summary when the program exits or
+// faults. As in stateDump, addresses and register values are hex
+// strings.
+type runSummary struct {
+	Version int `json:"version"`
+	// Exited is set when the program exited, with its status
+	Exited bool `json:"exited"`
+	Status *int `json:"status,omitempty"`
+	// Fault is set when the program stopped on a fault instead
+	Fault *faultSummary `json:"fault,omitempty"`
+	// Registers holds all eighteen registers, rip and rflags included
+	Registers    map[string]string `json:"registers"`
+	Instructions uint64            `json:"instructions"`
+	Segments     []segmentSummary  `json:"segments"`
+	// Memory holds the ranges requested with --json-memory
+	Memory []memoryDump `json:"memory,omitempty"`
+}
+
+type faultSummary struct {
+	// Kind names the fault, e.g. InvalidOpcode or PageFault
+	Kind    string `json:"kind"`
+	RIP     string `json:"rip"`
+	Message string `json:"message"`
+}
+
+// segmentSummary is a loaded segment, covering start up to but not
+// including end
+type segmentSummary struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Flags are the segment permissions, as in "r-x"
+	Flags string `json:"flags"`
+}
+
+// memoryRange is a --json-memory addr:len argument
+type memoryRange struct {
+	address uint64
+	length  uint64
+}
+
+// parseMemoryRange parses addr:len, the address being a symbol or a
+// number
+func parseMemoryRange(proc *process, value string) (memoryRange, error) {
+	colon := strings.LastIndexByte(value, ':')
+	if colon < 0 {
+		return memoryRange{}, fmt.Errorf("Invalid memory range %q: want addr:len", value)
+	}
+
+	length, err := strconv.ParseUint(value[colon+1:], 0, 64)
+	if err != nil {
+		return memoryRange{}, fmt.Errorf("Invalid memory range %q: %s", value, err)
+	}
+
+	return memoryRange{parseAddressFlag(proc, value[:colon]), length}, nil
+}
+
+func (c *cpu) summarize() *runSummary {
+	s := &runSummary{
+		Version:   runSummaryVersion,
+		Exited:    c.exited(),
+		Registers: map[string]string{},
+		Segments:  []segmentSummary{},
+	}
+
+	if s.Exited {
+		status := c.exitStatus() & 0xFF
+		s.Status = &status
+	} else if f, ok := c.lastFault.(*fault); ok {
+		s.Fault = &faultSummary{
+			Kind:    faultKindMap[f.kind],
+			RIP:     fmt.Sprintf("0x%x", f.rip),
+			Message: f.Error(),
+		}
+	}
+
+	for reg, name := range registerMap {
+		s.Registers[name] = fmt.Sprintf("0x%x", c.regfile.get(reg))
+	}
+
+	if c.stats != nil {
+		s.Instructions = c.stats.instructions
+	}
+
+	if c.proc != nil {
+		for _, seg := range c.proc.segments {
+			s.Segments = append(s.Segments, segmentSummary{
+				Start: fmt.Sprintf("0x%x", seg.address),
+				End:   fmt.Sprintf("0x%x", seg.address+seg.memsz),
+				Flags: segmentFlags(seg),
+			})
+		}
+	}
+
+	for _, r := range c.jsonMemory {
+		dump := memoryDump{Address: fmt.Sprintf("0x%x", r.address)}
+		if buf, ok := c.guestBuffer(r.address, r.length); ok {
+			dump.Bytes = hex.EncodeToString(buf)
+		} else {
+			dump.Error = fmt.Sprintf("0x%x+%d is out of bounds", r.address, r.length)
+		}
+
+		s.Memory = append(s.Memory, dump)
+	}
+
+	return s
+}
+
+// writeRunSummary writes the summary to filename, or stdout for "-"
+func (c *cpu) writeRunSummary(filename string) error {
+	if filename == "-" {
+		return encodeRunSummary(os.Stdout, c.summarize())
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := encodeRunSummary(f, c.summarize()); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func encodeRunSummary(w io.Writer, s *runSummary) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// symbolTable maps addresses back to the symbols containing them
+type symbolTable struct {
+	addresses []uint64
+	names     []string
+	// sizes are the st_size of each symbol, zero when unknown
+	sizes []uint64
+}
+
+func newSymbolTable(symbols, sizes map[string]uint64) *symbolTable {
+	t := &symbolTable{}
+	for name, address := range symbols {
+		t.addresses = append(t.addresses, address)
+		t.names = append(t.names, name)
+		t.sizes = append(t.sizes, sizes[name])
+	}
+
+	sort.Sort(t)
+	return t
+}
+
+func (t *symbolTable) Len() int { return len(t.addresses) }
+
+func (t *symbolTable) Less(i, j int) bool {
+	if t.addresses[i] != t.addresses[j] {
+		return t.addresses[i] < t.addresses[j]
+	}
+
+	return t.names[i] < t.names[j]
+}
+
+func (t *symbolTable) Swap(i, j int) {
+	t.addresses[i], t.addresses[j] = t.addresses[j], t.addresses[i]
+	t.names[i], t.names[j] = t.names[j], t.names[i]
+	t.sizes[i], t.sizes[j] = t.sizes[j], t.sizes[i]
+}
+
+// containing returns the index of the symbol containing address. A
+// symbol covers its size, or when that is zero everything up to the next
+// symbol.
+func (t *symbolTable) containing(address uint64) (int, bool) {
+	if t == nil {
+		return 0, false
+	}
+
+	i := sort.Search(len(t.addresses), func(i int) bool { return t.addresses[i] > address }) - 1
+	if i < 0 || address >= t.end(i) {
+		return 0, false
+	}
+
+	return i, true
+}
+
+// end returns the address just past symbol i
+func (t *symbolTable) end(i int) uint64 {
+	if t.sizes[i] != 0 {
+		return t.addresses[i] + t.sizes[i]
+	}
+
+	if i+1 < len(t.addresses) {
+		return t.addresses[i+1]
+	}
+
+	return t.addresses[i] + 1
+}
+
+// extent returns the start and end of the symbol containing address
+func (t *symbolTable) extent(address uint64) (uint64, uint64, bool) {
+	i, ok := t.containing(address)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return t.addresses[i], t.end(i), true
+}
+
+// lookup names address as the symbol containing it, with the offset
+// into it when address is not the symbol's start
+func (t *symbolTable) lookup(address uint64) (string, bool) {
+	i, ok := t.containing(address)
+	if !ok {
+		return "", false
+	}
+
+	if t.addresses[i] == address {
+		return t.names[i], true
+	}
+
+	return fmt.Sprintf("%s+0x%x", t.names[i], address-t.addresses[i]), true
+}
+
+// at returns the name of the symbol starting at address
+func (t *symbolTable) at(address uint64) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+
+	i := sort.Search(len(t.addresses), func(i int) bool { return t.addresses[i] >= address })
+	if i == len(t.addresses) || t.addresses[i] != address {
+		return "", false
+	}
+
+	return t.names[i], true
+}
+
+// symbolTable returns the symbols of the loaded program, if any
+func (c *cpu) symbolTable() *symbolTable {
+	if c.proc == nil || len(c.proc.symbols) == 0 {
+		return nil
+	}
+
+	return newSymbolTable(c.proc.symbols, c.proc.symbolSizes)
+}
+
+// describeAddress names the symbol address falls in, as name+0xoffset,
+// or "?" when it is outside all of them.
+func (c *cpu) describeAddress(address uint64) string {
+	if name, ok := c.symbolTable().lookup(address); ok {
+		return name
+	}
+
+	return "?"
+}
+
+// similarSymbols returns the symbols name is likely a misspelling of:
+// those within two edits of it or containing it.
+func (c *cpu) similarSymbols(name string) []string {
+	if c.proc == nil {
+		return nil
+	}
+
+	var similar []string
+	for symbol := range c.proc.symbols {
+		if strings.Contains(symbol, name) || editDistance(symbol, name) <= 2 {
+			similar = append(similar, symbol)
+		}
+	}
+
+	sort.Strings(similar)
+	return similar
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+
+	if c < a {
+		a = c
+	}
+
+	return a
+}
+
+// sourceLine is a row of the DWARF line table: code from address up to
+// the next row's address comes from line of file. Rows ending a
+// sequence have no file.
+type sourceLine struct {
+	address uint64
+	file    string
+	line    int
+}
+
+// readLineTable returns the rows of the program's DWARF line tables,
+// moved up by bias and sorted by address, or nothing when it wasn't
+// built with -g.
+func readLineTable(elffile *elf.File, bias uint64) []sourceLine {
+	data, err := elffile.DWARF()
+	if err != nil {
+		return nil
+	}
+
+	var lines []sourceLine
+	r := data.Reader()
+	for {
+		cu, err := r.Next()
+		if err != nil || cu == nil {
+			break
+		}
+
+		r.SkipChildren()
+		if cu.Tag != dwarf.TagCompileUnit {
+			continue
+		}
+
+		lr, err := data.LineReader(cu)
+		if err != nil || lr == nil {
+			continue
+		}
+
+		var entry dwarf.LineEntry
+		for lr.Next(&entry) == nil {
+			row := sourceLine{address: entry.Address + bias}
+			if !entry.EndSequence && entry.File != nil {
+				row.file = filepath.Base(entry.File.Name)
+				row.line = entry.Line
+			}
+
+			lines = append(lines, row)
+		}
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].address < lines[j].address })
+	return lines
+}
+
+// sourceLine returns the file and line the code at address was compiled
+// from, when the program has line information.
+func (c *cpu) sourceLine(address uint64) (string, int, bool) {
+	if c.proc == nil {
+		return "", 0, false
+	}
+
+	lines := c.proc.lines
+	i := sort.Search(len(lines), func(i int) bool { return lines[i].address > address }) - 1
+	if i < 0 || lines[i].file == "" {
+		return "", 0, false
+	}
+
+	return lines[i].file, lines[i].line, true
+}
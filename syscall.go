@@ -0,0 +1,284 @@
+package main
+
+import "io"
+
+const (
+	sysRead          = 0
+	sysWrite         = 1
+	sysFstat         = 5
+	sysMmap          = 9
+	sysMprotect      = 10
+	sysMunmap        = 11
+	sysBrk           = 12
+	sysReadv         = 19
+	sysWritev        = 20
+	sysGetpid        = 39
+	sysExit          = 60
+	sysGettimeofday  = 96
+	sysArchPrctl     = 158
+	sysSetTIDAddress = 218
+	sysClockGettime  = 228
+	sysExitGroup     = 231
+	sysNewfstatat    = 262
+	sysSetRobustList = 273
+)
+
+const (
+	errnoENOENT = 2
+	errnoEBADF  = 9
+	errnoEFAULT = 14
+	errnoEINVAL = 22
+	errnoENOSYS = 38
+)
+
+const (
+	archSetGS = 0x1001
+	archSetFS = 0x1002
+	archGetFS = 0x1003
+	archGetGS = 0x1004
+)
+
+// syscalls are indexed by the Linux x86-64 syscall number in rax. They
+// read their arguments from rdi, rsi, rdx, r10, r8 and r9 and return
+// the value for rax, a negated errno on failure.
+var syscalls = map[uint64]func(c *cpu) uint64{
+	sysRead:      (*cpu).sysRead,
+	sysWrite:     (*cpu).sysWrite,
+	sysOpenat:    (*cpu).sysOpenat,
+	sysClose:     (*cpu).sysClose,
+	sysLseek:     (*cpu).sysLseek,
+	sysReadv:     (*cpu).sysReadv,
+	sysWritev:    (*cpu).sysWritev,
+	sysFstat:     (*cpu).sysFstat,
+	sysMmap:      (*cpu).sysMmap,
+	sysMunmap:    (*cpu).sysMunmap,
+	sysMprotect:  (*cpu).sysMprotect,
+	sysBrk:       (*cpu).sysBrk,
+	sysExit:      (*cpu).sysExit,
+	sysExitGroup: (*cpu).sysExit,
+	sysArchPrctl: (*cpu).sysArchPrctl,
+
+	sysGettimeofday: (*cpu).sysGettimeofday,
+	sysClockGettime: (*cpu).sysClockGettime,
+	sysNewfstatat:   (*cpu).sysNewfstatat,
+	sysIoctl:        (*cpu).sysIoctl,
+	sysFcntl:        (*cpu).sysFcntl,
+	sysGetpid:       func(c *cpu) uint64 { return fakePID },
+
+	sysRtSigaction:   (*cpu).sysRtSigaction,
+	sysRtSigprocmask: (*cpu).sysRtSigprocmask,
+
+	// Stubs that report success, enough for libc startup
+	sysSetTIDAddress: func(c *cpu) uint64 { return 1 },
+	sysSetRobustList: func(c *cpu) uint64 { return 0 },
+}
+
+// fakePID is the process id getpid reports
+const fakePID = 1000
+
+func errno(e int) uint64 {
+	return uint64(-int64(e))
+}
+
+func (c *cpu) syscall() {
+	number := c.regfile.get(rax)
+	handler, ok := syscalls[number]
+	if !ok {
+		handler = func(c *cpu) uint64 { return errno(errnoENOSYS) }
+	}
+
+	switch {
+	case c.syscallReplayer != nil:
+		c.regfile.set(rax, c.syscallReplayer.replay(c, number, handler))
+	case c.syscallRecorder != nil:
+		c.regfile.set(rax, c.syscallRecorder.record(c, number, handler))
+	default:
+		c.regfile.set(rax, handler(c))
+	}
+}
+
+func (c *cpu) sysArchPrctl() uint64 {
+	code := c.regfile.get(rdi)
+	addr := c.regfile.get(rsi)
+	switch code {
+	case archSetFS:
+		c.fsBase = addr
+	case archSetGS:
+		c.gsBase = addr
+	case archGetFS:
+		c.writeMemory(addr, 8, c.fsBase)
+	case archGetGS:
+		c.writeMemory(addr, 8, c.gsBase)
+	default:
+		return errno(errnoEINVAL)
+	}
+
+	return 0
+}
+
+// guestBuffer returns the count bytes of guest memory at addr, or false
+// if they are out of bounds. With --memcheck they count as initialized.
+func (c *cpu) guestBuffer(addr, count uint64) ([]byte, bool) {
+	if addr > uint64(len(c.mem)) || count > uint64(len(c.mem))-addr {
+		return nil, false
+	}
+
+	if c.memcheck != nil {
+		c.memcheck.setUndefined(addr, addr+count, false)
+	}
+
+	if c.syscallRecorder != nil {
+		c.syscallRecorder.touch(c.mem[addr:addr+count], addr)
+	}
+
+	return c.mem[addr : addr+count], true
+}
+
+func (c *cpu) sysRead() uint64 {
+	f, ok := c.readFile(c.regfile.get(rdi))
+	if !ok {
+		return errno(errnoEBADF)
+	}
+
+	buf, ok := c.guestBuffer(c.regfile.get(rsi), c.regfile.get(rdx))
+	if !ok {
+		return errno(errnoEFAULT)
+	}
+
+	// Short reads are passed on; an error only matters when nothing
+	// was read
+	n, err := f.Read(buf)
+	if n == 0 && err != nil && err != io.EOF {
+		return errno(hostErrno(err))
+	}
+
+	return uint64(n)
+}
+
+func (c *cpu) sysWrite() uint64 {
+	f, ok := c.writeFile(c.regfile.get(rdi))
+	if !ok {
+		return errno(errnoEBADF)
+	}
+
+	buf, ok := c.guestBuffer(c.regfile.get(rsi), c.regfile.get(rdx))
+	if !ok {
+		return errno(errnoEFAULT)
+	}
+
+	n, err := f.Write(buf)
+	if n == 0 && err != nil {
+		return errno(hostErrno(err))
+	}
+
+	return uint64(n)
+}
+
+// iovMax is the most iovec entries readv and writev accept, as on Linux
+const iovMax = 1024
+
+// iovecs returns the buffers described by the array of count struct
+// iovec at addr, each a 64 bit base address followed by a 64 bit
+// length, or the errno for an invalid array.
+func (c *cpu) iovecs(addr, count uint64) ([][]byte, uint64) {
+	if count > iovMax {
+		return nil, errno(errnoEINVAL)
+	}
+
+	array, ok := c.guestBuffer(addr, count*16)
+	if !ok {
+		return nil, errno(errnoEFAULT)
+	}
+
+	buffers := make([][]byte, count)
+	for i := range buffers {
+		base := readBytes(array, uint64(i*16), 8)
+		length := readBytes(array, uint64(i*16+8), 8)
+		if buffers[i], ok = c.guestBuffer(base, length); !ok {
+			return nil, errno(errnoEFAULT)
+		}
+	}
+
+	return buffers, 0
+}
+
+// sysReadv fills the buffers in order, stopping at the first short read
+func (c *cpu) sysReadv() uint64 {
+	f, ok := c.readFile(c.regfile.get(rdi))
+	if !ok {
+		return errno(errnoEBADF)
+	}
+
+	buffers, e := c.iovecs(c.regfile.get(rsi), c.regfile.get(rdx))
+	if e != 0 {
+		return e
+	}
+
+	total := 0
+	for _, buf := range buffers {
+		n, _ := f.Read(buf)
+		total += n
+		if n < len(buf) {
+			break
+		}
+	}
+
+	return uint64(total)
+}
+
+// sysWritev writes the buffers in order, stopping at the first short
+// write
+func (c *cpu) sysWritev() uint64 {
+	f, ok := c.writeFile(c.regfile.get(rdi))
+	if !ok {
+		return errno(errnoEBADF)
+	}
+
+	buffers, e := c.iovecs(c.regfile.get(rsi), c.regfile.get(rdx))
+	if e != 0 {
+		return e
+	}
+
+	total := 0
+	for _, buf := range buffers {
+		n, _ := f.Write(buf)
+		total += n
+		if n < len(buf) {
+			break
+		}
+	}
+
+	return uint64(total)
+}
+
+// sysBrk moves the program break when the requested one is between its
+// start and the lowest mapping, and returns the break in effect.
+func (c *cpu) sysBrk() uint64 {
+	addr := c.regfile.get(rdi)
+	if addr < c.brkStart || addr > c.mmapBottom() {
+		return c.brk
+	}
+
+	if addr > c.brk {
+		// Memory given back and taken again reads as zero
+		for i := c.brk; i < addr; i++ {
+			c.mem[i] = 0
+		}
+	}
+
+	if c.memcheck != nil && addr > c.brk {
+		c.memcheck.setUndefined(c.brk, addr, true)
+	}
+
+	c.setPermissions(pageAlign(addr), pageAlign(c.brk), 0)
+	c.setPermissions(c.brkStart, addr, permMapped|permRead|permWrite)
+	c.brk = addr
+	return c.brk
+}
+
+// sysExit handles both exit and exit_group, there being a single thread
+func (c *cpu) sysExit() uint64 {
+	c.exitCalled = true
+	c.status = int(c.regfile.get(rdi))
+	return 0
+}
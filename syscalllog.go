@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// syscallLogVersion is bumped whenever a field of the syscall log
+// changes meaning or is removed
+const syscallLogVersion = 1
+
+// A syscall log, written by --record-syscalls and read by
+// --replay-syscalls, holds one JSON object per line: a syscallLogHeader
+// followed by a syscallLogEntry for every syscall the program made. As
+// in runSummary, addresses and values are hex strings.
+type syscallLogHeader struct {
+	Version int      `json:"version"`
+	Entry   string   `json:"entry"`
+	Args    []string `json:"args"`
+	Env     []string `json:"env"`
+	// MemoryDigest is the SHA-256 of all memory once the program was
+	// loaded, to tell a replay of a different build apart
+	MemoryDigest string `json:"memoryDigest"`
+}
+
+type syscallLogEntry struct {
+	Number uint64   `json:"number"`
+	Args   []string `json:"args"`
+	Result string   `json:"result"`
+	// Writes are the guest buffers the syscall changed, with their new
+	// contents
+	Writes []memoryDump `json:"writes,omitempty"`
+}
+
+// hostSyscalls are the syscalls that reach the host: files, the
+// terminal and the clocks. A replay returns their recorded results
+// instead of running them; the rest only change the emulator's own
+// state and run as usual.
+var hostSyscalls = map[uint64]bool{
+	sysRead:         true,
+	sysWrite:        true,
+	sysOpenat:       true,
+	sysClose:        true,
+	sysLseek:        true,
+	sysReadv:        true,
+	sysWritev:       true,
+	sysFstat:        true,
+	sysNewfstatat:   true,
+	sysIoctl:        true,
+	sysGettimeofday: true,
+	sysClockGettime: true,
+}
+
+var syscallArgumentRegisters = []register{rdi, rsi, rdx, r10, r8, r9}
+
+func memoryDigest(mem []byte) string {
+	sum := sha256.Sum256(mem)
+	return hex.EncodeToString(sum[:])
+}
+
+// syscallRecorder writes the syscall log of a run
+type syscallRecorder struct {
+	f *os.File
+	w *bufio.Writer
+	// touched are the guest buffers handed to the current syscall, with
+	// their contents before it ran
+	touched []touchedBuffer
+}
+
+type touchedBuffer struct {
+	address uint64
+	before  []byte
+}
+
+// newSyscallRecorder starts the log at filename with the header of the
+// loaded program
+func newSyscallRecorder(filename string, c *cpu) (*syscallRecorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &syscallRecorder{f: f, w: bufio.NewWriter(f)}
+	err = r.writeLine(syscallLogHeader{
+		Version:      syscallLogVersion,
+		Entry:        fmt.Sprintf("0x%x", c.regfile.get(rip)),
+		Args:         append([]string{}, c.proc.args...),
+		Env:          append([]string{}, c.proc.env...),
+		MemoryDigest: memoryDigest(c.mem),
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *syscallRecorder) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	r.w.Write(line)
+	return r.w.WriteByte('\n')
+}
+
+// touch notes a guest buffer the running syscall may write to
+func (r *syscallRecorder) touch(buf []byte, address uint64) {
+	r.touched = append(r.touched, touchedBuffer{address, append([]byte(nil), buf...)})
+}
+
+// record runs the syscall handler and logs it with the buffers it
+// changed
+func (r *syscallRecorder) record(c *cpu, number uint64, handler func(c *cpu) uint64) uint64 {
+	entry := syscallLogEntry{Number: number}
+	for _, reg := range syscallArgumentRegisters {
+		entry.Args = append(entry.Args, fmt.Sprintf("0x%x", c.regfile.get(reg)))
+	}
+
+	r.touched = nil
+	result := handler(c)
+	entry.Result = fmt.Sprintf("0x%x", result)
+	for _, t := range r.touched {
+		after := c.mem[t.address : t.address+uint64(len(t.before))]
+		// Only the span from the first to the last changed byte
+		start, end := 0, len(after)
+		for start < end && after[start] == t.before[start] {
+			start++
+		}
+		for end > start && after[end-1] == t.before[end-1] {
+			end--
+		}
+
+		if start < end {
+			entry.Writes = append(entry.Writes, memoryDump{
+				Address: fmt.Sprintf("0x%x", t.address+uint64(start)),
+				Bytes:   hex.EncodeToString(after[start:end]),
+			})
+		}
+	}
+
+	// A failed write is reported by close
+	r.touched = nil
+	r.writeLine(entry)
+	return result
+}
+
+func (r *syscallRecorder) close() error {
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// syscallReplayer feeds a run the results of the host syscalls from a
+// syscall log
+type syscallReplayer struct {
+	header  syscallLogHeader
+	entries *bufio.Scanner
+	f       *os.File
+	line    int
+}
+
+// newSyscallReplayer opens the log at filename and reads its header,
+// whose arguments and environment the program must be loaded with
+func newSyscallReplayer(filename string) (*syscallReplayer, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &syscallReplayer{f: f, entries: bufio.NewScanner(f)}
+	// Writes of whole buffers make for long lines
+	r.entries.Buffer(nil, 1<<30)
+	if err := r.next(&r.header); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if r.header.Version != syscallLogVersion {
+		f.Close()
+		return nil, fmt.Errorf("%s: syscall log version %d, want %d", filename, r.header.Version, syscallLogVersion)
+	}
+
+	return r, nil
+}
+
+func (r *syscallReplayer) next(v interface{}) error {
+	if !r.entries.Scan() {
+		if err := r.entries.Err(); err != nil {
+			return err
+		}
+
+		return io.EOF
+	}
+
+	r.line++
+	if err := json.Unmarshal(r.entries.Bytes(), v); err != nil {
+		return fmt.Errorf("syscall log line %d: %s", r.line, err)
+	}
+
+	return nil
+}
+
+// check compares the loaded program with the recorded one
+func (r *syscallReplayer) check(c *cpu) error {
+	if entry := fmt.Sprintf("0x%x", c.regfile.get(rip)); entry != r.header.Entry {
+		return fmt.Errorf("Replay starts at %s, the recording at %s", entry, r.header.Entry)
+	}
+
+	if memoryDigest(c.mem) != r.header.MemoryDigest {
+		return fmt.Errorf("Loaded memory differs from the recording's; is this the same program?")
+	}
+
+	return nil
+}
+
+// replay returns the recorded result of the syscall, after writing
+// the buffers it changed, or runs it when it doesn't reach the host. A
+// syscall other than the recorded one stops the program.
+func (r *syscallReplayer) replay(c *cpu, number uint64, handler func(c *cpu) uint64) uint64 {
+	var entry syscallLogEntry
+	if err := r.next(&entry); err == io.EOF {
+		r.diverged(c, fmt.Sprintf("syscall %d after the end of the recording", number))
+	} else if err != nil {
+		r.diverged(c, err.Error())
+	}
+
+	if entry.Number != number {
+		r.diverged(c, fmt.Sprintf("syscall %d where the recording has %d, line %d", number, entry.Number, r.line))
+	}
+
+	if !hostSyscalls[number] {
+		return handler(c)
+	}
+
+	for _, w := range entry.Writes {
+		address, err := strconv.ParseUint(w.Address, 0, 64)
+		data, herr := hex.DecodeString(w.Bytes)
+		if err != nil || herr != nil || address > uint64(len(c.mem)) || uint64(len(data)) > uint64(len(c.mem))-address {
+			r.diverged(c, fmt.Sprintf("bad write at line %d", r.line))
+		}
+
+		copy(c.mem[address:], data)
+	}
+
+	result, err := strconv.ParseUint(entry.Result, 0, 64)
+	if err != nil {
+		r.diverged(c, fmt.Sprintf("bad result at line %d", r.line))
+	}
+
+	return result
+}
+
+func (r *syscallReplayer) diverged(c *cpu, detail string) {
+	panic(&fault{kind: aborted, rip: c.regfile.get(rip), detail: "replay diverged: " + detail})
+}
+
+func (r *syscallReplayer) close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,42 @@
+// Two-limb 128-bit arithmetic: add then adc carries out of the low
+// words, sub then sbb borrows, and the accumulator immediate forms take
+// the carry too. Exits with 88 when every word matches.
+int main() {
+  unsigned long lo = 0xffffffffffffffff, hi = 1;
+  unsigned long sub_lo = 0, sub_hi = 5;
+  __asm__ volatile(
+      // (1 << 64 | 2^64 - 1) + 3 = 2 << 64 | 2
+      "add $3, %0\n"
+      "adc $0, %1\n"
+      // (5 << 64) - 1 = 4 << 64 | 2^64 - 1
+      "sub $1, %2\n"
+      "sbb %4, %3\n"
+      : "+r"(lo), "+r"(hi), "+r"(sub_lo), "+r"(sub_hi)
+      : "r"(0UL)
+      : "cc");
+
+  // 0 - 1 borrows, setting CF for the adc and sbb that follow
+  unsigned long acc_adc = 1, acc_sbb = 0x20000, borrow = 0;
+  __asm__ volatile("sub $1, %1\n"
+                   "adc $0x10000, %%eax\n"
+                   : "+a"(acc_adc), "+r"(borrow)
+                   :
+                   : "cc");
+  borrow = 0;
+  __asm__ volatile("sub $1, %1\n"
+                   "sbb $0x10000, %%eax\n"
+                   : "+a"(acc_sbb), "+r"(borrow)
+                   :
+                   : "cc");
+
+  if (lo != 2 || hi != 2) {
+    return 1;
+  }
+  if (sub_lo != 0xffffffffffffffff || sub_hi != 4) {
+    return 2;
+  }
+  if (acc_adc != 0x10002 || acc_sbb != 0xffff) {
+    return 3;
+  }
+  return 88;
+}
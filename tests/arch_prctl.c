@@ -0,0 +1,41 @@
+// Points fs at block with arch_prctl(ARCH_SET_FS), loads block[1]
+// through an fs-relative access and reads the base back with
+// ARCH_GET_FS, restoring the original base (libc's TLS) afterwards. An
+// unknown code must fail with -EINVAL. Exits with 5 + 0 + 40 - 22 = 23.
+unsigned long block[2] = {0, 5};
+
+int main() {
+  unsigned long saved;
+  unsigned long base;
+  long loaded;
+  long invalid;
+  __asm__ volatile(
+      // Save the current base
+      "mov $158, %%eax\n"
+      "mov $0x1003, %%edi\n"
+      "lea %[saved], %%rsi\n"
+      "syscall\n"
+      "mov $158, %%eax\n"
+      "mov $0x1002, %%edi\n"
+      "mov $block, %%esi\n"
+      "syscall\n"
+      "mov %%fs:8, %%rcx\n"
+      "mov %%rcx, %[loaded]\n"
+      "mov $158, %%eax\n"
+      "mov $0x1003, %%edi\n"
+      "lea %[base], %%rsi\n"
+      "syscall\n"
+      "mov $158, %%eax\n"
+      "mov $0x1002, %%edi\n"
+      "mov %[saved], %%rsi\n"
+      "syscall\n"
+      "mov $158, %%eax\n"
+      "mov $0x9999, %%edi\n"
+      "syscall\n"
+      "mov %%rax, %[invalid]\n"
+      : [saved] "=m"(saved), [base] "=m"(base), [loaded] "=m"(loaded),
+        [invalid] "=m"(invalid)
+      :
+      : "rax", "rcx", "rdx", "rsi", "rdi", "r11", "memory");
+  return loaded + (base - (unsigned long)block) + 40 + invalid;
+}
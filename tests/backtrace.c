@@ -0,0 +1,28 @@
+// Three nested calls for the debugger's bt. Break at leaf for a full
+// backtrace; break at smashed for one through a corrupted saved rbp,
+// which has to stop early. level3 exits directly as its frame is
+// unusable afterwards.
+void leaf() {}
+
+void smashed() {}
+
+void level3() {
+  leaf();
+  __asm__ volatile("movq $0x12345, (%%rbp)\n" : : : "memory");
+  smashed();
+  __asm__ volatile("mov $60, %%eax\n"
+                   "mov $7, %%edi\n"
+                   "syscall\n"
+                   :
+                   :
+                   : "rax", "rdi");
+}
+
+void level2() { level3(); }
+
+void level1() { level2(); }
+
+int main() {
+  level1();
+  return 1;
+}
@@ -0,0 +1,44 @@
+// Byte-sized immediate ALU operations (0x80 group) on memory, on ah and
+// on sil, which needs a REX prefix, checking the result and the flags each leaves behind. Exits
+// with 80 when all of them match.
+int main() {
+  unsigned long memory = 0x1234567880;
+  unsigned long accumulator = 0x1234;
+  unsigned long added;
+  unsigned long compared_ah;
+  unsigned long low = 0x80;
+  unsigned long compared_sil;
+  __asm__ volatile(
+      // 0x80 + 0x90 carries out and overflows into 0x10
+      "addb $0x90, %0\n"
+      "pushfq\n"
+      "pop %2\n"
+      // ah is 0x12, which compares equal
+      "cmpb $0x12, %%ah\n"
+      "pushfq\n"
+      "pop %3\n"
+      // 0x80 - 0x7f overflows without borrowing
+      "cmpb $0x7f, %%sil\n"
+      "pushfq\n"
+      "pop %4\n"
+      : "+m"(memory), "+a"(accumulator), "=&r"(added), "=&r"(compared_ah),
+        "=&r"(compared_sil)
+      : "S"(low)
+      : "cc");
+  if (memory != 0x1234567810) {
+    return 1;
+  }
+  if (added != 0xa03) {
+    return 2;
+  }
+  if (compared_ah != 0x246) {
+    return 3;
+  }
+  if (compared_sil != 0xa12) {
+    return 4;
+  }
+  if (accumulator != 0x1234) {
+    return 5;
+  }
+  return 80;
+}
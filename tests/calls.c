@@ -0,0 +1,23 @@
+// Recursion for the debugger's next and finish, and a callee that never
+// returns because it exits. Exits with 15 + 6 = 21 through the exit
+// syscall.
+int sum_to(int n) {
+  if (n <= 0) {
+    return 0;
+  }
+  return n + sum_to(n - 1);
+}
+
+void finish_with(int status) {
+  __asm__ volatile("mov $60, %%eax\n"
+                   "syscall\n"
+                   :
+                   : "D"(status)
+                   : "rax");
+}
+
+int main() {
+  int total = sum_to(5);
+  finish_with(total + 6);
+  return 1;
+}
@@ -0,0 +1,17 @@
+// Nested calls for --follow-calls, and a jump made with push and ret,
+// which returns without a matching call. Exits with 12.
+int leaf(int n) { return n + n; }
+
+int middle(int n) { return leaf(n) + leaf(n + 1); }
+
+int main() {
+  int total = middle(2);
+  __asm__ volatile("lea 1f(%%rip), %%rax\n"
+                   "push %%rax\n"
+                   "ret\n"
+                   "1:\n"
+                   :
+                   :
+                   : "rax");
+  return total + 2;
+}
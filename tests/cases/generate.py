@@ -0,0 +1,599 @@
+#!/usr/bin/env python3
+"""Generates the instruction cases in this directory by running each
+case's instructions natively and recording the resulting state.
+
+Each case is written in Intel syntax with its initial registers and
+memory. The instructions are assembled with gcc, run on the host between
+loading and saving every general purpose register and rflags, and the
+final registers, status flags and changed memory are written to
+tests/cases/<group>.json for `go test -run TestInstructionCases`.
+
+Memory lives in one page at SCRATCH, which is the top page of the
+emulator's stack, so that cases may point rsp there to push and pop.
+
+Usage: tests/cases/generate.py
+"""
+
+import json
+import os
+import subprocess
+import sys
+import tempfile
+
+REGS = ["rax", "rbx", "rcx", "rdx", "rsi", "rdi", "rbp", "rsp",
+        "r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15"]
+
+SCRATCH = 0x27FF000
+DATA = SCRATCH + 0x800
+STACK = SCRATCH + 0xC00
+
+CF, PF, AF, ZF, SF, OF = 0x1, 0x4, 0x10, 0x40, 0x80, 0x800
+FLAGS = {"CF": CF, "PF": PF, "AF": AF, "ZF": ZF, "SF": SF, "OF": OF}
+LOGIC = ["AF"]
+IMUL = ["SF", "ZF", "AF", "PF"]
+BITTEST = ["OF", "SF", "AF", "PF"]
+DIVIDE = list(FLAGS)
+SHIFT = ["AF", "OF"]
+BITSCAN = ["CF", "OF", "SF", "AF", "PF"]
+
+M64 = 0xFFFFFFFFFFFFFFFF
+
+
+def case(name, asm, regs=None, memory=None, undefined=None, rflags=0x202):
+    return {
+        "name": name,
+        "asm": asm,
+        "registers": regs or {},
+        "rflags": rflags,
+        "memory": memory or {},
+        "undefined": undefined or [],
+    }
+
+
+GROUPS = {
+    "alu": [
+        case("add carry out of bit 63", "add rax, rbx", {"rax": M64, "rbx": 1}),
+        case("add signed overflow", "add rax, rbx", {"rax": 0x7FFFFFFFFFFFFFFF, "rbx": 1}),
+        case("add 32 bit zero extends", "add eax, ebx", {"rax": 0xFFFFFFFF00000001, "rbx": 0xFFFFFFFF}),
+        case("add 16 bit keeps upper bits", "add ax, bx", {"rax": 0x123456789ABCFFFF, "rbx": 2}),
+        case("add reg from rm", "add rcx, rdx", {"rcx": 0x0F, "rdx": 0x01}),
+        case("adc with carry in", "adc rax, rbx", {"rax": 1, "rbx": 2}, rflags=0x203),
+        case("adc carry in overflows", "adc rax, rbx", {"rax": M64, "rbx": 0}, rflags=0x203),
+        case("adc 32 bit", "adc eax, ebx", {"rax": 0x7FFFFFFF, "rbx": 0}, rflags=0x203),
+        case("sub borrow", "sub rax, rbx", {"rax": 0, "rbx": 1}),
+        case("sub signed overflow", "sub rax, rbx", {"rax": 0x8000000000000000, "rbx": 1}),
+        case("sub 16 bit", "sub cx, dx", {"rcx": 0x10000, "rdx": 1}),
+        case("sbb with borrow in", "sbb rax, rbx", {"rax": 5, "rbx": 2}, rflags=0x203),
+        case("sbb 32 bit borrow in to zero", "sbb eax, ebx", {"rax": 1, "rbx": 0}, rflags=0x203),
+        case("cmp equal", "cmp rax, rbx", {"rax": 42, "rbx": 42}),
+        case("cmp less signed", "cmp rsi, rdi", {"rsi": M64, "rdi": 1}),
+        case("cmp 32 bit reg from rm", "cmp r8d, r9d", {"r8": 1, "r9": 2}),
+        case("and sign", "and rax, rbx", {"rax": 0x8000000000000001, "rbx": 0x8000000000000000}, undefined=LOGIC),
+        case("and 32 bit clears upper", "and eax, ebx", {"rax": M64, "rbx": M64}, undefined=LOGIC),
+        case("or parity", "or rcx, rdx", {"rcx": 0x1, "rdx": 0x2}, rflags=0xA03, undefined=LOGIC),
+        case("xor self zero", "xor rax, rax", {"rax": 0x1234}, rflags=0xA03, undefined=LOGIC),
+        case("xor 16 bit", "xor r10w, r11w", {"r10": 0xFFFF0000FFFF, "r11": 0x0F0F}, undefined=LOGIC),
+        case("add r/m from memory", "add rax, [rsi]", {"rax": 1, "rsi": DATA}, {DATA: "ffffffffffffffff"}),
+        case("add to memory", "add [rsi+8], ebx", {"rbx": 0x80000000, "rsi": DATA}, {DATA + 8: "00000080"}),
+        case("sub memory with index", "sub qword ptr [rsi+rcx*8], rdx",
+             {"rsi": DATA, "rcx": 2, "rdx": 3}, {DATA + 16: "0100000000000000"}),
+        case("inc keeps carry", "inc rax", {"rax": M64}, rflags=0x203),
+        case("inc keeps carry clear", "inc rax", {"rax": 1}),
+        case("inc 32 bit overflow", "inc ecx", {"rcx": 0xFFFFFFFF7FFFFFFF}),
+        case("inc 16 bit keeps upper", "inc r9w", {"r9": 0x1111111111110FFF}),
+        case("inc 8 bit high byte", "inc ah", {"rax": 0xFF7F}),
+        case("inc memory", "inc qword ptr [rsi]", {"rsi": DATA}, {DATA: "ff00000000000000"}),
+        case("dec to zero", "dec rdx", {"rdx": 1}, rflags=0x203),
+        case("dec 32 bit borrow", "dec eax", {"rax": 0xFFFFFFFF00000000}),
+        case("dec 8 bit overflow", "dec sil", {"rsi": 0x80}),
+        case("dec memory", "dec word ptr [rsi+2]", {"rsi": DATA}, {DATA + 2: "0000"}),
+        case("add 8 bit r/m reg", "add bl, cl", {"rbx": 0x11FF, "rcx": 1}),
+        case("add 8 bit reg r/m", "add cl, bl", {"rbx": 0x80, "rcx": 0x80}),
+        case("sub 8 bit high byte from low", "sub ah, al", {"rax": 0x0102}),
+        case("xor 8 bit rex", "xor sil, dil", {"rsi": 0xFF, "rdi": 0x0F}, undefined=LOGIC),
+        case("or 8 bit to memory", "or byte ptr [rsi], al", {"rax": 0x80, "rsi": DATA}, {DATA: "01"}, undefined=LOGIC),
+        case("cmp 8 bit reg with memory", "cmp al, byte ptr [rsi]", {"rax": 0x10, "rsi": DATA}, {DATA: "20"}),
+        case("test 64", "test rax, rbx", {"rax": 0x8000000000000000, "rbx": M64}, undefined=LOGIC),
+        case("test 8 bit high byte", "test ah, bl", {"rax": 0x0F00, "rbx": 0xF0}, undefined=LOGIC),
+        case("test memory", "test dword ptr [rsi], ecx", {"rcx": 1, "rsi": DATA}, {DATA: "01000000"}, undefined=LOGIC),
+        case("test imm32 r/m", "test dword ptr [rsi], 0x8000", {"rsi": DATA}, {DATA: "00800000"}, undefined=LOGIC),
+        case("test imm8 r/m", "test bh, 0x81", {"rbx": 0x8000}, undefined=LOGIC),
+        case("not 32 bit zero extends", "not eax", {"rax": 0xFFFFFFFF0000FFFF}),
+        case("not 8 bit", "not cl", {"rcx": 0x1234}),
+        case("neg", "neg rax", {"rax": 1}),
+        case("neg zero clears carry", "neg rax", {"rax": 0}, rflags=0x203),
+        case("neg most negative overflows", "neg ecx", {"rcx": 0x80000000}),
+        case("neg memory", "neg word ptr [rsi]", {"rsi": DATA}, {DATA: "0100"}),
+    ],
+    "alu_imm": [
+        case("add imm8 sign extended", "add rax, -1", {"rax": 1}),
+        case("add imm32", "add rbx, 0x7fffffff", {"rbx": 1}),
+        case("sub imm8 32 bit", "sub ecx, 1", {"rcx": 0}),
+        case("cmp imm8 16 bit", "cmp dx, 0x7f", {"rdx": 0x7F}),
+        case("and imm32 sign extended", "and rsi, -16", {"rsi": 0x123F}, undefined=LOGIC),
+        case("or imm8", "or edi, 0x80", {"rdi": 1}, undefined=LOGIC),
+        case("xor imm32", "xor r8, 0x55555555", {"r8": 0xFFFFFFFF}, undefined=LOGIC),
+        case("adc imm8 carry", "adc r9, 0", {"r9": M64}, rflags=0x203),
+        case("sbb imm8 borrow", "sbb r10, 0", {"r10": 0}, rflags=0x203),
+        case("add byte imm8", "add bl, 0x80", {"rbx": 0x1280}),
+        case("sub byte high register", "sub ah, 1", {"rax": 0x0005}),
+        case("cmp byte", "cmp cl, 0xff", {"rcx": 0x7F}),
+        case("adc eax imm32 accumulator", "adc eax, 0x10", {"rax": 0xFFFFFFF0}, rflags=0x203),
+        case("sbb rax imm32 accumulator", "sbb rax, 0x10", {"rax": 0x10}, rflags=0x203),
+        case("add to memory imm8", "add qword ptr [rsi], 1", {"rsi": DATA}, {DATA: "ffffffffffffffff"}),
+        case("cmp memory byte imm8", "cmp byte ptr [rsi], 0x10", {"rsi": DATA}, {DATA: "10"}),
+        case("add al imm8 accumulator", "add al, 0x90", {"rax": 0x1234567890}),
+        case("add eax imm32 accumulator", "add eax, 0x80000000", {"rax": 0xFFFFFFFF80000000}),
+        case("or rax imm32 accumulator", "or rax, -0x1000", {"rax": 0x123}, undefined=LOGIC),
+        case("and eax imm32 accumulator", "and eax, 0xff00ff00", {"rax": M64}, undefined=LOGIC),
+        case("and al imm8 accumulator", "and al, 0x0f", {"rax": 0xF0}, undefined=LOGIC),
+        case("sub ax imm16 accumulator", "sub ax, 0x1234", {"rax": 0xFFFF00001233}),
+        case("sub al imm8 borrow", "sub al, 0x81", {"rax": 0x80}),
+        case("xor eax imm32 accumulator", "xor eax, 0x12345678", {"rax": 0x1234567812345678}, undefined=LOGIC),
+        case("cmp eax imm32 accumulator", "cmp eax, 0x12345678", {"rax": 0x12345677}),
+        case("cmp rax imm32 sign extended", "cmp rax, -0x1000", {"rax": M64}),
+        case("cmp al imm8 accumulator", "cmp al, 0x80", {"rax": 0x7F}),
+        case("adc al imm8 carry", "adc al, 0xff", {"rax": 1}, rflags=0x203),
+        case("sbb eax imm32 accumulator", "sbb eax, 0x10000", {"rax": 0x10000}, rflags=0x203),
+        case("test al imm8", "test al, 0x80", {"rax": 0x180}, undefined=LOGIC),
+        case("test eax imm32", "test eax, 0x80000000", {"rax": 0x7FFFFFFF}, undefined=LOGIC),
+        case("test rax imm32 sign extended", "test rax, -0x100", {"rax": 0x8000000000000000}, undefined=LOGIC),
+    ],
+    "mov": [
+        case("mov reg to reg 64", "mov rax, rbx", {"rbx": 0x1122334455667788}),
+        case("mov 32 bit zero extends", "mov eax, ebx", {"rax": M64, "rbx": 0x80000000}),
+        case("mov 16 bit keeps upper", "mov ax, bx", {"rax": M64, "rbx": 0x1234}),
+        case("mov imm32 to reg", "mov ecx, 0xdeadbeef", {"rcx": M64}),
+        case("mov imm64", "movabs rdx, 0x1122334455667788"),
+        case("mov imm32 extended register zero extends", "mov r9d, 0x80000000", {"r9": M64}),
+        case("mov imm32 takes four bytes", "mov eax, 0x11223344\nmov ebx, 2", {"rax": M64}),
+        case("mov imm16 keeps upper", "mov cx, 0xbeef", {"rcx": M64}),
+        case("movabs imm64 sign bit", "movabs rax, 0x8000000000000001"),
+        case("movabs takes eight bytes", "movabs r15, 0x0102030405060708\nmov ebx, 2", {"r15": 1}),
+        case("mov r/m imm32 sign extends", "mov rsi, -2"),
+        case("mov load from memory", "mov rax, [rdi+8]", {"rdi": DATA}, {DATA + 8: "8877665544332211"}),
+        case("mov store to memory", "mov [rdi], ecx", {"rdi": DATA, "rcx": 0xCAFEBABE}),
+        case("mov store imm8 byte", "mov byte ptr [rdi+3], 0x7f", {"rdi": DATA}),
+        case("mov store imm32 qword", "mov qword ptr [rdi], -1", {"rdi": DATA}),
+        case("mov r8 extended register", "mov r15, r8", {"r8": 0xABCDEF}),
+        case("lea base index scale", "lea rax, [rbx+rcx*4+0x10]", {"rbx": 0x1000, "rcx": 3}),
+        case("lea 32 bit", "lea eax, [rbx-1]", {"rbx": 0}),
+        case("bswap 32", "bswap eax", {"rax": 0xFFFFFFFF11223344}),
+        case("bswap 64", "bswap r9", {"r9": 0x1122334455667788}),
+        case("bswap 64 rax", "bswap rax", {"rax": 0x0102030405060708}),
+        case("bswap 32 extended zeroes upper", "bswap r8d", {"r8": 0xFFFFFFFF01020304}),
+        case("nop", "nop", {"rax": 1}),
+        case("nop keeps upper half", "nop", {"rax": M64}),
+        case("xchg r8d eax", "xchg r8d, eax", {"rax": 0xFFFFFFFF11111111, "r8": 0xFFFFFFFF22222222}),
+        case("xchg r8 rax", "xchg r8, rax", {"rax": 1, "r8": 2}),
+        case("xchg 16 bit", "xchg cx, ax", {"rax": 0x1111111111111111, "rcx": 0x2222222222222222}),
+        case("nop r/m", "nop dword ptr [rax+rax*1+0x0]", {"rax": 1}),
+        case("endbr64", "endbr64", {"rax": 1}),
+        case("mov 8 bit", "mov bl, al", {"rax": 0x12, "rbx": M64}),
+        case("mov 8 bit high byte", "mov ch, ah", {"rax": 0xAB00, "rcx": 0}),
+        case("mov 8 bit rex low byte", "mov sil, dil", {"rsi": M64, "rdi": 0x7F}),
+        case("mov 8 bit load", "mov al, byte ptr [rsi]", {"rax": M64, "rsi": DATA}, {DATA: "42"}),
+        case("mov 8 bit store", "mov byte ptr [rsi+1], dh", {"rdx": 0x9900, "rsi": DATA}),
+        case("movsxd", "movsxd rax, ebx", {"rbx": 0x80000000}),
+        case("movsxd memory", "movsxd rcx, dword ptr [rsi]", {"rsi": DATA}, {DATA: "feffffff"}),
+        case("movzx byte", "movzx eax, bl", {"rax": M64, "rbx": 0xFF}),
+        case("movzx high byte", "movzx ecx, ah", {"rax": 0x8000}),
+        case("movzx word 64", "movzx rdx, word ptr [rsi]", {"rdx": M64, "rsi": DATA}, {DATA: "ffff"}),
+        case("movsx byte", "movsx eax, bl", {"rax": M64, "rbx": 0x80}),
+        case("movsx byte 64", "movsx rax, byte ptr [rsi]", {"rsi": DATA}, {DATA: "ff"}),
+        case("movsx word", "movsx ecx, dx", {"rdx": 0x8001}),
+        case("movsx byte 16", "movsx cx, dl", {"rcx": M64, "rdx": 0x80}),
+        case("cdqe", "cdqe", {"rax": 0x80000000}),
+        case("cwde", "cwde", {"rax": 0xFFFFFFFF00007FFF}),
+        case("cbw", "cbw", {"rax": 0xFFFF0080}),
+        case("cqo negative", "cqo", {"rax": M64, "rdx": 0}),
+        case("cdq positive", "cdq", {"rax": 1, "rdx": M64}),
+        case("cwd", "cwd", {"rax": 0x8000, "rdx": M64}),
+        case("xchg r/m reg", "xchg rax, rbx", {"rax": 1, "rbx": 2}),
+        case("xchg 8 bit high bytes", "xchg ah, bh", {"rax": 0x1100, "rbx": 0x2200}),
+        case("xchg memory", "xchg dword ptr [rsi], ecx", {"rcx": 0xFFFFFFFF12345678, "rsi": DATA}, {DATA: "efbeadde"}),
+        case("cmove taken", "cmove rax, rbx", {"rax": 1, "rbx": 2}, rflags=0x242),
+        case("cmove not taken", "cmove rax, rbx", {"rax": 1, "rbx": 2}),
+        case("cmovb 32 bit not taken zero extends", "cmovb eax, ebx", {"rax": M64, "rbx": 2}),
+        case("cmovl memory", "cmovl ecx, dword ptr [rsi]", {"rsi": DATA}, {DATA: "07000000"}, rflags=0xA02),
+        case("sete", "sete al", {"rax": M64}, rflags=0x242),
+        case("setne", "setne al", {"rax": M64}, rflags=0x242),
+        case("setg high byte", "setg ah", {"rax": 0}),
+        case("seta memory", "seta byte ptr [rsi]", {"rsi": DATA}, {DATA: "ff"}),
+    ],
+    "addressing": [
+        case("disp8 most negative", "lea rax, [rbp-0x80]", {"rbp": 0x1000}),
+        case("disp8 most positive", "lea rax, [rbp+0x7f]", {"rbp": 0x1000}),
+        case("disp8 wraps below zero", "lea rax, [rbp-0x80]", {"rbp": 0x10}),
+        case("disp8 wraps above 2^64", "lea rax, [rbp+0x7f]", {"rbp": M64}),
+        case("disp32 past disp8 range", "lea rax, [rbp-0x81]", {"rbp": 0x1000}),
+        case("disp32 negative", "lea rax, [rbp-0x1000]", {"rbp": 0x10000}),
+        case("disp32 wraps below zero", "lea rax, [rbp-0x1000]", {"rbp": 0x800}),
+        case("disp32 most negative", "lea rax, [rbp-0x80000000]", {"rbp": 0x100000000}),
+        case("sib disp8 negative", "lea rax, [rsp-0x80]", {"rsp": 0x40}),
+        case("sib index disp32 negative", "lea rax, [rbx+rcx*8-0x1000]", {"rbx": 0x100, "rcx": 2}),
+        case("32 bit result of wrapped address", "lea eax, [rbp-0x80]", {"rax": M64, "rbp": 0x10}),
+        case("load through disp8", "mov rax, [rbp-0x80]", {"rbp": DATA + 0x80}, {DATA: "0123456789abcdef"}),
+        case("store through disp32", "mov [rbp-0x1000], rbx", {"rbp": DATA + 0x1000, "rbx": 0x1122334455667788}),
+    ],
+    "prefixes": [
+        case("lock add to memory", "lock add dword ptr [rdi], eax", {"rdi": DATA, "rax": 5}, {DATA: "01000000"}),
+        case("rep before lock add", ".byte 0xf3\nlock add qword ptr [rdi], 1", {"rdi": DATA}),
+        case("repne before mov", ".byte 0xf2\nmov rax, rbx", {"rbx": 0x1234}),
+        case("rep before mov", ".byte 0xf3\nmov eax, ebx", {"rax": M64, "rbx": 0x5678}),
+        case("addr32 truncates base", "mov eax, [edi]", {"rdi": 0xFFFFFFFF00000000 | DATA}, {DATA: "44332211"}),
+        case("addr32 wraps displacement", "mov rax, [edi-0x10]", {"rdi": DATA + 0x10 + 0x100000000}, {DATA: "8877665544332211"}),
+        case("addr32 index scale", "mov ecx, [ebx+esi*4+4]", {"rbx": 0xABCD000000000000 | DATA, "rsi": 1}, {DATA + 8: "efbeadde"}),
+        case("addr32 store", "mov [esi], ebx", {"rsi": 0x100000000 | DATA, "rbx": 0xCAFE}),
+        case("addr32 lea", "lea eax, [ebx+ecx]", {"rbx": 0xFFFFFFFF, "rcx": 2}),
+        case("cs nopw", ".byte 0x66, 0x2e\nnop dword ptr [rax+rax*1+0x0]", {"rax": 1}),
+        case("ds and ss overrides ignored", ".byte 0x3e, 0x36, 0x26\nmov rax, [rdi]", {"rdi": DATA}, {DATA: "0100000000000000"}),
+        case("lock and addr32 before rex", ".byte 0xf0\nadd qword ptr [edi], rax", {"rdi": DATA, "rax": 3}),
+    ],
+    "stack": [
+        case("push pop", "push rbx\npop rax", {"rbx": 0x1234, "rsp": STACK}),
+        case("push extended register", "push r12", {"r12": 0x5678, "rsp": STACK}),
+        case("pop into extended register", "pop r13", {"rsp": STACK}, {STACK: "efbeadde00000000"}),
+        case("pushfq", "pushfq", {"rsp": STACK}, rflags=0xAD7),
+        case("popfq", "popfq", {"rsp": STACK}, {STACK: "d508000000000000"}),
+        case("leave", "leave", {"rbp": STACK + 0x10, "rsp": STACK}, {STACK + 0x10: "0800000000000000"}),
+        case("sahf", "sahf", {"rax": 0xD500}),
+        case("lahf", "lahf", {"rax": 0}, rflags=0x2D7),
+        case("push imm8 sign extends", "push -2", {"rsp": STACK}),
+        case("push imm32", "push 0x12345678", {"rsp": STACK}),
+        case("push memory", "push qword ptr [rsi]", {"rsi": DATA, "rsp": STACK}, {DATA: "0102030405060708"}),
+    ],
+    "jumps": [
+        case("jz taken", "cmp rax, rax\njz 1f\nmov ebx, 1\n1:", {"rax": 1}),
+        case("jz not taken", "cmp rax, rbx\njz 1f\nmov ecx, 1\n1:", {"rax": 1}),
+        case("jl taken on sign and overflow", "cmp rax, rbx\njl 1f\nmov ecx, 1\n1:", {"rax": 0x8000000000000000, "rbx": 1}),
+        case("jb taken on carry", "cmp eax, ebx\njb 1f\nmov ecx, 1\n1:", {"rax": 1, "rbx": 2}),
+        case("jmp short", "jmp 1f\nmov ecx, 1\n1:"),
+        case("jbe not taken", "cmp rax, rbx\njbe 1f\nmov ecx, 1\n1:", {"rax": 3, "rbx": 2}),
+        case("loop counting down", "mov ecx, 5\n1:\nadd eax, ecx\nsub ecx, 1\njnz 1b"),
+        case("jmp near", "jmp 1f\n.fill 200, 1, 0xcc\n1:"),
+        case("jz near taken", "cmp rax, rax\njz 1f\n.fill 200, 1, 0xcc\n1:", {"rax": 1}),
+        case("jg near not taken", "cmp rax, rbx\njg 1f\nmov ecx, 1\n.fill 200, 1, 0x90\n1:", {"rax": 1, "rbx": 1}),
+        case("jl near backwards", "mov ecx, 3\n1:\nadd eax, 1\n.fill 200, 1, 0x90\nsub ecx, 1\ncmp ecx, 0\njg 1b"),
+        case("call register", "lea rbx, [rip+2f]\ncall rbx\njmp 3f\n2:\nmov eax, 7\nret\n3:\nmov qword ptr [rsp-8], 0\nmov ebx, 0",
+             {"rsp": STACK}),
+        case("call memory", "lea rbx, [rip+2f]\nmov [rsi], rbx\ncall qword ptr [rsi]\njmp 3f\n2:\nmov eax, 7\nret\n3:\n"
+             "mov qword ptr [rsp-8], 0\nmov qword ptr [rsi], 0\nmov ebx, 0", {"rsi": DATA, "rsp": STACK}),
+        case("jmp register", "lea rbx, [rip+1f]\njmp rbx\nmov ecx, 1\n1:\nmov ebx, 0"),
+    ],
+    "shifts": [
+        case("shl 1", "shl rax, 1", {"rax": 0xC000000000000000}, undefined=["AF"]),
+        case("shl cl", "shl eax, cl", {"rax": 0x80000001, "rcx": 4}, undefined=SHIFT),
+        case("shl count masked", "shl rax, cl", {"rax": 1, "rcx": 65}, undefined=["AF"]),
+        case("shl count zero keeps flags", "shl rax, cl", {"rax": 5, "rcx": 0}, rflags=0xAD7),
+        case("shl 8 bit carry", "shl bl, 3", {"rbx": 0x3F}, undefined=SHIFT),
+        case("shl 16 bit memory", "shl word ptr [rsi], 4", {"rsi": DATA}, {DATA: "3412"}, undefined=SHIFT),
+        case("shr 1 overflow from sign", "shr rax, 1", {"rax": 0x8000000000000001}, undefined=["AF"]),
+        case("shr imm", "shr ecx, 31", {"rcx": 0xFFFFFFFF80000000}, undefined=SHIFT),
+        case("shr 8 bit high byte", "shr ah, 2", {"rax": 0xFF00}, undefined=SHIFT),
+        case("sar negative", "sar rax, 4", {"rax": 0x8000000000000010}, undefined=SHIFT),
+        case("sar 32 bit by 31", "sar edx, 31", {"rdx": 0x80000000}, undefined=SHIFT),
+        case("sar 1", "sar bl, 1", {"rbx": 0x81}, undefined=["AF"]),
+        case("rol", "rol rax, 4", {"rax": 0xF000000000000001}, undefined=["OF"]),
+        case("rol 1", "rol eax, 1", {"rax": 0x80000000}),
+        case("rol 8 bit cl", "rol al, cl", {"rax": 0x81, "rcx": 9}, undefined=["OF"]),
+        case("ror", "ror rdx, 8", {"rdx": 0x12}, undefined=["OF"]),
+        case("ror 1", "ror cx, 1", {"rcx": 1}),
+        case("rcl 1", "rcl rax, 1", {"rax": 0x8000000000000000}, rflags=0x203),
+        case("rcl 8 bit", "rcl bl, 3", {"rbx": 0xA5}, rflags=0x203, undefined=["OF"]),
+        case("rcr 1", "rcr eax, 1", {"rax": 1}, rflags=0x203),
+        case("rcr 16 bit", "rcr dx, 5", {"rdx": 0x1234}, undefined=["OF"]),
+    ],
+    "multiply": [
+        case("imul imm8", "imul rax, rbx, 3", {"rbx": 7}, undefined=IMUL),
+        case("imul imm32 overflow", "imul rax, rbx, 0x40000000", {"rbx": 0x200000000}, undefined=IMUL),
+        case("imul 32 bit negative", "imul eax, ebx, -2", {"rbx": 5}, undefined=IMUL),
+        case("imul 16 bit overflow", "imul ax, bx, 0x100", {"rbx": 0x100}, undefined=IMUL),
+        case("imul reg r/m", "imul rax, rbx", {"rax": -3 & M64, "rbx": 5}, undefined=IMUL),
+        case("imul reg r/m overflow", "imul rax, qword ptr [rsi]", {"rax": 1 << 62, "rsi": DATA}, {DATA: "0400000000000000"}, undefined=IMUL),
+        case("imul 32 bit reg r/m zero extends", "imul ecx, edx", {"rcx": M64, "rdx": 2}, undefined=IMUL),
+        case("mul 64", "mul rbx", {"rax": M64, "rbx": M64}, undefined=IMUL),
+        case("mul 64 fits", "mul rbx", {"rax": 3, "rbx": 4, "rdx": M64}, undefined=IMUL),
+        case("mul 32", "mul ecx", {"rax": 0xFFFFFFFF80000000, "rcx": 4}, undefined=IMUL),
+        case("mul 16", "mul cx", {"rax": 0x1111111111118000, "rcx": 2, "rdx": M64}, undefined=IMUL),
+        case("mul 8 into ax", "mul bl", {"rax": 0x12340080, "rbx": 3}, undefined=IMUL),
+        case("imul one operand 64", "imul rbx", {"rax": -2 & M64, "rbx": 3}, undefined=IMUL),
+        case("imul one operand 64 overflow", "imul rbx", {"rax": 1 << 62, "rbx": 4}, undefined=IMUL),
+        case("imul one operand 32 negative", "imul ecx", {"rax": 0xFFFFFFFF, "rcx": 0x80000000}, undefined=IMUL),
+        case("imul one operand 8", "imul byte ptr [rsi]", {"rax": 0x80, "rsi": DATA}, {DATA: "ff"}, undefined=IMUL),
+    ],
+    "divide": [
+        case("div 64", "div rcx", {"rax": 100, "rdx": 0, "rcx": 7}, undefined=DIVIDE),
+        case("div 64 double width dividend", "div rcx", {"rax": 5, "rdx": 3, "rcx": 0x10}, undefined=DIVIDE),
+        case("div 32 zero extends", "div ecx", {"rax": 0xFFFFFFFF00000009, "rdx": 0xFFFFFFFF00000001, "rcx": 0x10}, undefined=DIVIDE),
+        case("div 16 keeps upper bits", "div cx", {"rax": 0x1111111111110064, "rdx": 0x2222222222220000, "rcx": 7}, undefined=DIVIDE),
+        case("div 8 divides ax", "div cl", {"rax": 0x1234, "rcx": 0x80}, undefined=DIVIDE),
+        case("div memory", "div qword ptr [rsi]", {"rax": 1000, "rdx": 0, "rsi": DATA}, {DATA: "0a00000000000000"}, undefined=DIVIDE),
+        case("idiv 64 negative dividend", "idiv rcx", {"rax": (-7) & M64, "rdx": M64, "rcx": 2}, undefined=DIVIDE),
+        case("idiv 64 negative divisor", "idiv rcx", {"rax": 7, "rdx": 0, "rcx": (-2) & M64}, undefined=DIVIDE),
+        case("idiv 64 most negative quotient", "idiv rcx", {"rax": 0x8000000000000000, "rdx": M64, "rcx": 1}, undefined=DIVIDE),
+        case("idiv 32 both negative", "idiv ecx", {"rax": 0xFFFFFFF9, "rdx": 0xFFFFFFFF, "rcx": 0xFFFFFFFE}, undefined=DIVIDE),
+        case("idiv 32 most negative by one", "idiv ecx", {"rax": 0x80000000, "rdx": 0xFFFFFFFF, "rcx": 1}, undefined=DIVIDE),
+        case("idiv 16", "idiv bx", {"rax": 0xFF9C, "rdx": 0xFFFF, "rbx": 3}, undefined=DIVIDE),
+        case("idiv 8 remainder in ah", "idiv bl", {"rax": 0xFF85, "rbx": 0x0A}, undefined=DIVIDE),
+    ],
+    "bits": [
+        case("bt set bit", "bt rax, rbx", {"rax": 0x10, "rbx": 4}, undefined=BITTEST),
+        case("bt bit index wraps", "bt eax, ebx", {"rax": 1, "rbx": 32}, undefined=BITTEST),
+        case("bts", "bts rax, rbx", {"rax": 0, "rbx": 63}, undefined=BITTEST),
+        case("btr", "btr rax, rbx", {"rax": M64, "rbx": 0}, undefined=BITTEST),
+        case("btc", "btc ecx, edx", {"rcx": 0x8, "rdx": 3}, undefined=BITTEST),
+        case("bt imm", "bt rax, 63", {"rax": 0x8000000000000000}, undefined=BITTEST),
+        case("bts imm 16 bit", "bts ax, 17", {"rax": 0}, undefined=BITTEST),
+        case("btr imm memory", "btr dword ptr [rsi], 1", {"rsi": DATA}, {DATA: "ff000000"}, undefined=BITTEST),
+        case("btc imm", "btc rdx, 40", {"rdx": 0}, undefined=BITTEST),
+        case("bt memory bit string", "bt qword ptr [rsi], rbx", {"rsi": DATA, "rbx": 70}, {DATA + 8: "4000000000000000"}, undefined=BITTEST),
+        case("bts memory bit string", "bts dword ptr [rsi], ebx", {"rsi": DATA, "rbx": 33}, undefined=BITTEST),
+        case("bsf", "bsf rax, rbx", {"rbx": 0x80}, undefined=BITSCAN),
+        case("bsf 32 bit top bit", "bsf eax, ebx", {"rax": M64, "rbx": 0x80000000}, undefined=BITSCAN),
+        case("bsf zero source keeps destination", "bsf rax, rbx", {"rax": 0x1234, "rbx": 0}, undefined=BITSCAN),
+        case("bsr", "bsr rcx, qword ptr [rsi]", {"rsi": DATA}, {DATA: "0000000000000001"}, undefined=BITSCAN),
+        case("bsr 16 bit", "bsr dx, ax", {"rax": 0x0101, "rdx": M64}, undefined=BITSCAN),
+        case("btr memory negative offset", "btr qword ptr [rsi+8], rbx", {"rsi": DATA, "rbx": (-1) & M64}, {DATA: "00000000000000ff"}, undefined=BITTEST),
+    ],
+    "exchange": [
+        case("cmpxchg equal stores source", "cmpxchg rbx, rcx", {"rax": 5, "rbx": 5, "rcx": 9}),
+        case("cmpxchg not equal loads accumulator", "cmpxchg rbx, rcx", {"rax": 5, "rbx": 7, "rcx": 9}),
+        case("cmpxchg 32 bit equal", "cmpxchg ebx, ecx", {"rax": 0xFFFFFFFF00000005, "rbx": 0xFFFFFFFF00000005, "rcx": 0xFFFFFFFF00000009}),
+        case("cmpxchg 32 bit not equal", "cmpxchg ebx, ecx", {"rax": 0xFFFFFFFF00000005, "rbx": 0xFFFFFFFF00000007, "rcx": 9}),
+        case("cmpxchg 16 bit", "cmpxchg r8w, r9w", {"rax": 0x1111111111110001, "r8": 0x2222222222220001, "r9": 0xFFFF}),
+        case("cmpxchg 8 bit high byte", "cmpxchg ah, bh", {"rax": 0x1234, "rbx": 0x5600}),
+        case("cmpxchg 8 bit rex", "cmpxchg sil, dil", {"rax": 0x10, "rsi": 0x20, "rdi": 0x30}),
+        case("cmpxchg memory equal", "cmpxchg [rsi], rcx", {"rax": 3, "rcx": M64, "rsi": DATA}, {DATA: "0300000000000000"}),
+        case("cmpxchg memory not equal", "cmpxchg dword ptr [rsi], ecx", {"rax": M64, "rcx": 1, "rsi": DATA}, {DATA: "78563412"}),
+        case("lock cmpxchg memory", "lock cmpxchg [rsi+8], rdx", {"rax": 0, "rdx": 1, "rsi": DATA}, {DATA + 8: "0000000000000000"}),
+        case("xadd", "xadd rax, rbx", {"rax": 2, "rbx": 3}),
+        case("xadd carry", "xadd rax, rbx", {"rax": M64, "rbx": 1}),
+        case("xadd 32 bit overflow", "xadd ecx, edx", {"rcx": 0x7FFFFFFF, "rdx": 0xFFFFFFFF00000001}),
+        case("xadd same register", "xadd rax, rax", {"rax": 21}),
+        case("xadd 8 bit", "xadd al, ch", {"rax": 0xF0, "rcx": 0x2000}),
+        case("lock xadd memory", "lock xadd [rsi], ebx", {"rbx": 1, "rsi": DATA}, {DATA: "29000000"}),
+    ],
+    "strings": [
+        case("scasb match", "scasb", {"rax": 0x41, "rdi": DATA}, {DATA: "41"}),
+        case("scasq below", "scasq", {"rax": 1, "rdi": DATA}, {DATA: "0200000000000000"}),
+        case("scasd backwards", "std\nscasd\ncld", {"rax": 7, "rdi": DATA + 8}, {DATA + 8: "07000000"}),
+        case("repne scasb finds byte", "repne scasb", {"rax": 0x2F, "rcx": 16, "rdi": DATA}, {DATA: "7573722f62696e00"}),
+        case("repne scasb runs out", "repne scasb", {"rax": 0x2F, "rcx": 3, "rdi": DATA}, {DATA: "757372"}),
+        case("repne scasb zero count keeps flags", "repne scasb", {"rax": 0, "rcx": 0, "rdi": DATA}, {DATA: "00"}, rflags=0x2C3),
+        case("cmpsb", "cmpsb", {"rsi": DATA, "rdi": DATA + 16}, {DATA: "05", DATA + 16: "07"}),
+        case("cmpsw backwards", "std\ncmpsw\ncld", {"rsi": DATA + 2, "rdi": DATA + 18}, {DATA + 2: "0080", DATA + 18: "0100"}),
+        case("repe cmpsb stops at difference", "repe cmpsb", {"rcx": 8, "rsi": DATA, "rdi": DATA + 16},
+             {DATA: "6162636465666768", DATA + 16: "6162637865666768"}),
+        case("repe cmpsq all equal", "repe cmpsq", {"rcx": 2, "rsi": DATA, "rdi": DATA + 16},
+             {DATA: "0102030405060708090a0b0c0d0e0f10", DATA + 16: "0102030405060708090a0b0c0d0e0f10"}),
+        case("repe cmpsd 32 bit addresses", "repe cmpsd [esi], [edi]", {"rcx": 0xFFFFFFFF00000002, "rsi": DATA, "rdi": DATA + 16},
+             {DATA: "0100000002000000", DATA + 16: "0100000002000000"}),
+        case("movsb", "movsb", {"rsi": DATA, "rdi": DATA + 16}, {DATA: "41"}),
+        case("movsq backwards", "std\nmovsq\ncld", {"rsi": DATA + 8, "rdi": DATA + 24}, {DATA + 8: "0102030405060708"}),
+        case("rep movsb", "rep movsb", {"rcx": 5, "rsi": DATA, "rdi": DATA + 16}, {DATA: "68656c6c6f"}),
+        case("rep movsd zero count", "rep movsd", {"rcx": 0, "rsi": DATA, "rdi": DATA + 16}, {DATA: "01000000"}),
+        case("stosb", "stosb", {"rax": 0x1234, "rdi": DATA}),
+        case("rep stosq", "rep stosq", {"rax": M64, "rcx": 3, "rdi": DATA}),
+        case("rep stosd 32 bit addresses", "rep stosd [edi]", {"rax": 7, "rcx": 0xFFFFFFFF00000002, "rdi": 0x100000000 | DATA}),
+        case("lodsb keeps upper", "lodsb", {"rax": M64, "rsi": DATA}, {DATA: "00"}),
+        case("lodsd zero extends", "lodsd", {"rax": M64, "rsi": DATA}, {DATA: "78563412"}),
+    ],
+    "sse": [
+        case("pcmpeqb pmovmskb", "movdqu xmm0, [rsi]\nmovdqu xmm1, [rsi+16]\npcmpeqb xmm0, xmm1\npmovmskb eax, xmm0",
+             {"rax": M64, "rsi": DATA}, {DATA: "000102030405060708090a0b0c0d0e0f", DATA + 16: "00ff02ff04ff06ff08ff0aff0cff0eff"}),
+        case("pcmpeqd memory", "movdqu xmm2, [rsi]\npcmpeqd xmm2, [rsi+16]\nmovdqu [rsi+32], xmm2",
+             {"rsi": DATA}, {DATA: "01000000020000000300000004000000", DATA + 16: "01000000000000000300000000000000"}),
+        case("pcmpgtb signed", "movdqu xmm0, [rsi]\nmovdqu xmm1, [rsi+16]\npcmpgtb xmm0, xmm1\nmovdqu [rsi+32], xmm0",
+             {"rsi": DATA}, {DATA: "7f80ff0001020304050607080900ff80", DATA + 16: "807f0000000000000000000000000000"}),
+        case("pminub pmaxub", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqu xmm2, [rsi+16]\npminub xmm0, xmm2\npmaxub xmm1, xmm2\n"
+             "movdqu [rsi+32], xmm0\nmovdqu [rsi+48], xmm1",
+             {"rsi": DATA}, {DATA: "00ff10f020e030d040c050b060a07090", DATA + 16: "ff00f010e020d030c040b050a0609070"}),
+        case("paddb psubb wrap", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqu xmm2, [rsi+16]\npaddb xmm0, xmm2\npsubb xmm1, xmm2\n"
+             "movdqu [rsi+32], xmm0\nmovdqu [rsi+48], xmm1",
+             {"rsi": DATA}, {DATA: "ff7f8001000102030405060708090a0b", DATA + 16: "01010101ff0102030405060708090a0b"}),
+        case("paddd paddq psubq", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqa xmm3, xmm0\nmovdqu xmm2, [rsi+16]\npaddd xmm0, xmm2\n"
+             "paddq xmm1, xmm2\npsubq xmm3, xmm2\nmovdqu [rsi+32], xmm0\nmovdqu [rsi+48], xmm1\nmovdqu [rsi+64], xmm3",
+             {"rsi": DATA}, {DATA: "ffffffff0000000000000000ffffffff", DATA + 16: "01000000000000000100000000000000"}),
+        case("pand pandn por", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqa xmm3, xmm0\nmovdqu xmm2, [rsi+16]\npand xmm0, xmm2\n"
+             "pandn xmm1, xmm2\npor xmm3, xmm2\nmovdqu [rsi+32], xmm0\nmovdqu [rsi+48], xmm1\nmovdqu [rsi+64], xmm3",
+             {"rsi": DATA}, {DATA: "ff00ff00f0f0f0f00123456789abcdef", DATA + 16: "0f0f0f0fff00ff00fedcba9876543210"}),
+        case("andps orps andnpd", "movups xmm0, [rsi]\nmovaps xmm1, xmm0\nmovaps xmm3, xmm0\nmovups xmm2, [rsi+16]\nandps xmm0, xmm2\n"
+             "orps xmm1, xmm2\nandnpd xmm3, xmm2\nmovups [rsi+32], xmm0\nmovups [rsi+48], xmm1\nmovups [rsi+64], xmm3",
+             {"rsi": DATA}, {DATA: "ff00ff00f0f0f0f00123456789abcdef", DATA + 16: "0f0f0f0fff00ff00fedcba9876543210"}),
+        case("punpcklbw punpckhbw", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqu xmm2, [rsi+16]\npunpcklbw xmm0, xmm2\n"
+             "punpckhbw xmm1, xmm2\nmovdqu [rsi+32], xmm0\nmovdqu [rsi+48], xmm1",
+             {"rsi": DATA}, {DATA: "000102030405060708090a0b0c0d0e0f", DATA + 16: "101112131415161718191a1b1c1d1e1f"}),
+        case("punpcklwd punpckhdq", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqu xmm2, [rsi+16]\npunpcklwd xmm0, xmm2\n"
+             "punpckhdq xmm1, xmm2\nmovdqu [rsi+32], xmm0\nmovdqu [rsi+48], xmm1",
+             {"rsi": DATA}, {DATA: "000102030405060708090a0b0c0d0e0f", DATA + 16: "101112131415161718191a1b1c1d1e1f"}),
+        case("punpckldq punpcklqdq punpckhqdq", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqa xmm3, xmm0\nmovdqu xmm2, [rsi+16]\n"
+             "punpckldq xmm0, xmm2\npunpcklqdq xmm1, xmm2\npunpckhqdq xmm3, xmm2\n"
+             "movdqu [rsi+32], xmm0\nmovdqu [rsi+48], xmm1\nmovdqu [rsi+64], xmm3",
+             {"rsi": DATA}, {DATA: "000102030405060708090a0b0c0d0e0f", DATA + 16: "101112131415161718191a1b1c1d1e1f"}),
+        case("pshufd", "movdqu xmm1, [rsi]\npshufd xmm0, xmm1, 0x1b\nmovdqu [rsi+16], xmm0",
+             {"rsi": DATA}, {DATA: "000102030405060708090a0b0c0d0e0f"}),
+        case("psrldq pslldq", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqa xmm2, xmm0\npsrldq xmm0, 3\npslldq xmm1, 9\n"
+             "psrldq xmm2, 16\nmovdqu [rsi+16], xmm0\nmovdqu [rsi+32], xmm1\nmovdqu [rsi+48], xmm2",
+             {"rsi": DATA}, {DATA: "000102030405060708090a0b0c0d0e0f", DATA + 48: "ffffffffffffffffffffffffffffffff"}),
+        case("psrlq psllq psrad", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqa xmm2, xmm0\npsrlq xmm0, 4\npsllq xmm1, 60\n"
+             "psrad xmm2, 40\nmovdqu [rsi+16], xmm0\nmovdqu [rsi+32], xmm1\nmovdqu [rsi+48], xmm2",
+             {"rsi": DATA}, {DATA: "f1debc9a78563412000000800000007f"}),
+        case("psrlw psllw psrld", "movdqu xmm0, [rsi]\nmovdqa xmm1, xmm0\nmovdqa xmm2, xmm0\npsrlw xmm0, 15\npsllw xmm1, 16\n"
+             "psrld xmm2, 1\nmovdqu [rsi+16], xmm0\nmovdqu [rsi+32], xmm1\nmovdqu [rsi+48], xmm2",
+             {"rsi": DATA}, {DATA: "f1debc9a78563412000000800000007f", DATA + 32: "ffffffffffffffffffffffffffffffff"}),
+        case("movhps movlps", "movdqu xmm0, [rsi]\nmovhps xmm0, [rsi+16]\nmovlps xmm0, [rsi+24]\nmovdqu [rsi+32], xmm0\nmovhps [rsi+48], xmm0",
+             {"rsi": DATA}, {DATA: "000102030405060708090a0b0c0d0e0f", DATA + 16: "101112131415161718191a1b1c1d1e1f"}),
+        case("movhpd movlpd", "movdqu xmm0, [rsi]\nmovhpd xmm0, [rsi+16]\nmovlpd xmm0, [rsi+24]\nmovdqu [rsi+32], xmm0\nmovlpd [rsi+48], xmm0",
+             {"rsi": DATA}, {DATA: "000102030405060708090a0b0c0d0e0f", DATA + 16: "101112131415161718191a1b1c1d1e1f"}),
+        case("movlhps movhlps", "movdqu xmm0, [rsi]\nmovdqu xmm1, [rsi+16]\nmovdqa xmm2, xmm0\nmovlhps xmm0, xmm1\nmovhlps xmm2, xmm1\n"
+             "movdqu [rsi+32], xmm0\nmovdqu [rsi+48], xmm2",
+             {"rsi": DATA}, {DATA: "000102030405060708090a0b0c0d0e0f", DATA + 16: "101112131415161718191a1b1c1d1e1f"}),
+    ],
+}
+
+
+def assemble(asm, workdir):
+    """Returns the machine code for asm, in Intel syntax"""
+    src = os.path.join(workdir, "code.s")
+    obj = os.path.join(workdir, "code.o")
+    raw = os.path.join(workdir, "code.bin")
+    with open(src, "w") as f:
+        f.write(".intel_syntax noprefix\n" + asm + "\n")
+    subprocess.run(["gcc", "-c", "-o", obj, src], check=True)
+    subprocess.run(["objcopy", "-O", "binary", "-j", ".text", obj, raw], check=True)
+    with open(raw, "rb") as f:
+        return f.read()
+
+
+def harness(codes):
+    """C source running each of codes between loading state_in and
+    saving state_out"""
+    lines = ["""#include <stdio.h>
+#include <string.h>
+#include <sys/mman.h>
+
+struct state {
+  unsigned long regs[16];
+  unsigned long rflags;
+};
+
+struct state state_in, state_out;
+unsigned long saved_rsp;
+"""]
+    for i, code in enumerate(codes):
+        asm = [".text", ".globl case_%d" % i, "case_%d:" % i,
+               "push %rbx", "push %rbp", "push %r12", "push %r13", "push %r14", "push %r15",
+               "mov %rsp, saved_rsp(%rip)",
+               "pushq state_in+128(%rip)", "popfq"]
+        for n, reg in enumerate(REGS):
+            if reg != "rax":
+                asm.append("mov state_in+%d(%%rip), %%%s" % (n * 8, reg))
+        asm.append("mov state_in(%rip), %rax")
+        asm.append(".byte " + ",".join("0x%02x" % b for b in code))
+        for n, reg in enumerate(REGS):
+            asm.append("mov %%%s, state_out+%d(%%rip)" % (reg, n * 8))
+        asm += ["mov saved_rsp(%rip), %rsp", "pushfq", "popq state_out+128(%rip)",
+                "pop %r15", "pop %r14", "pop %r13", "pop %r12", "pop %rbp", "pop %rbx", "ret"]
+        lines.append("__asm__(\n" + "".join('  "%s\\n"\n' % a for a in asm) + ");")
+        lines.append("void case_%d(void);" % i)
+
+    lines.append("""
+int main(int argc, char **argv) {
+  unsigned char *scratch = mmap((void *)0x%xUL, 0x1000, PROT_READ | PROT_WRITE,
+                                MAP_PRIVATE | MAP_ANONYMOUS | MAP_FIXED_NOREPLACE, -1, 0);
+  if (scratch == MAP_FAILED) {
+    perror("mmap");
+    return 1;
+  }
+
+  for (int i = 0; i < argc - 1; i++) {
+    memset(scratch, 0, 0x1000);
+    FILE *in = fopen(argv[i + 1], "rb");
+    fread(&state_in, sizeof(state_in), 1, in);
+    fread(scratch, 0x1000, 1, in);
+    fclose(in);
+    switch (i) {""" % SCRATCH)
+    for i in range(len(codes)):
+        lines.append("    case %d: case_%d(); break;" % (i, i))
+    lines.append("""    }
+
+    fwrite(&state_out, sizeof(state_out), 1, stdout);
+    fwrite(scratch, 0x1000, 1, stdout);
+  }
+
+  return 0;
+}""")
+    return "\n".join(lines)
+
+
+def run_native(cases, codes, workdir):
+    """Runs every case natively, returning the final registers, rflags
+    and scratch page of each"""
+    src = os.path.join(workdir, "harness.c")
+    exe = os.path.join(workdir, "harness")
+    with open(src, "w") as f:
+        f.write(harness(codes))
+    subprocess.run(["gcc", "-O0", "-no-pie", "-o", exe, src], check=True)
+
+    inputs = []
+    for i, c in enumerate(cases):
+        state = bytearray(136)
+        for reg, value in c["registers"].items():
+            n = REGS.index(reg)
+            state[n * 8:n * 8 + 8] = value.to_bytes(8, "little")
+        state[128:136] = c["rflags"].to_bytes(8, "little")
+        page = bytearray(0x1000)
+        for address, data in c["memory"].items():
+            offset = address - SCRATCH
+            page[offset:offset + len(bytes.fromhex(data))] = bytes.fromhex(data)
+        path = os.path.join(workdir, "in%d" % i)
+        with open(path, "wb") as f:
+            f.write(state + page)
+        inputs.append(path)
+
+    out = subprocess.run([exe] + inputs, check=True, stdout=subprocess.PIPE).stdout
+    results = []
+    size = 136 + 0x1000
+    for i in range(len(cases)):
+        chunk = out[i * size:(i + 1) * size]
+        regs = [int.from_bytes(chunk[n * 8:n * 8 + 8], "little") for n in range(16)]
+        rflags = int.from_bytes(chunk[128:136], "little")
+        results.append((regs, rflags, chunk[136:]))
+    return results
+
+
+def changed_ranges(before, after):
+    """Returns the runs of bytes that differ between before and after"""
+    ranges = []
+    i = 0
+    while i < len(after):
+        if before[i] == after[i]:
+            i += 1
+            continue
+        start = i
+        while i < len(after) and before[i] != after[i]:
+            i += 1
+        ranges.append((start, after[start:i]))
+    return ranges
+
+
+def main():
+    here = os.path.dirname(os.path.abspath(__file__))
+    with tempfile.TemporaryDirectory() as workdir:
+        for group, cases in GROUPS.items():
+            codes = [assemble(c["asm"], workdir) for c in cases]
+            results = run_native(cases, codes, workdir)
+            out = []
+            for c, code, (regs, rflags, page) in zip(cases, codes, results):
+                initial = bytearray(0x1000)
+                memory = []
+                for address, data in c["memory"].items():
+                    offset = address - SCRATCH
+                    initial[offset:offset + len(bytes.fromhex(data))] = bytes.fromhex(data)
+                    memory.append({"address": "0x%x" % address, "bytes": data})
+                mask = sum(FLAGS.values()) & ~sum(FLAGS[f] for f in c["undefined"])
+                out.append({
+                    "name": c["name"],
+                    "asm": c["asm"].replace("\n", "; "),
+                    "code": code.hex(),
+                    "registers": {r: "0x%x" % v for r, v in sorted(c["registers"].items())},
+                    "rflags": "0x%x" % c["rflags"],
+                    "memory": memory,
+                    "expect": {
+                        "registers": {r: "0x%x" % v for r, v in zip(REGS, regs)},
+                        "rflags": "0x%x" % (rflags & mask),
+                        "flagsMask": "0x%x" % mask,
+                        "memory": [{"address": "0x%x" % (SCRATCH + start), "bytes": data.hex()}
+                                   for start, data in changed_ranges(initial, page)],
+                    },
+                })
+            path = os.path.join(here, group + ".json")
+            with open(path, "w") as f:
+                json.dump(out, f, indent=2)
+                f.write("\n")
+            print("%s: %d cases" % (path, len(out)), file=sys.stderr)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,63 @@
+// getpid, clock_gettime and gettimeofday through raw syscalls. The
+// timespec and timeval must be filled in with sane values and an
+// unknown clock must fail with -EINVAL. Exits with 61 when they are.
+// Built with -DFIXED_TIME=<seconds> it instead checks the values
+// --deterministic-time returns.
+struct timespec {
+  long sec;
+  long nsec;
+};
+
+struct timeval {
+  long sec;
+  long usec;
+};
+
+long raw_syscall(long number, long a, long b) {
+  long ret;
+  __asm__ volatile("syscall"
+                   : "=a"(ret)
+                   : "a"(number), "D"(a), "S"(b)
+                   : "rcx", "r11", "memory");
+  return ret;
+}
+
+int main() {
+  struct timespec realtime = {-1, -1};
+  struct timespec monotonic = {-1, -1};
+  struct timeval tv = {-1, -1};
+  long pid = raw_syscall(39, 0, 0);
+  long realtime_ret = raw_syscall(228, 0, (long)&realtime);
+  long monotonic_ret = raw_syscall(228, 1, (long)&monotonic);
+  long invalid_ret = raw_syscall(228, 1000, (long)&monotonic);
+  long tv_ret = raw_syscall(96, (long)&tv, 0);
+  // Limits, zero included, are compared as variables; gcc would compare
+  // against the constants with test and the accumulator forms
+  long zero = 0, second = 1000000000, microsecond = 1000000;
+  long epoch = 1577836800;
+  if (pid <= zero || realtime_ret != 0 || monotonic_ret != 0 || tv_ret != 0) {
+    return 1;
+  }
+  if (invalid_ret != -22) {
+    return 2;
+  }
+#ifdef FIXED_TIME
+  epoch = FIXED_TIME;
+  if (realtime.sec != epoch || realtime.nsec != zero || tv.sec != epoch ||
+      tv.usec != zero || monotonic.sec != zero || monotonic.nsec != zero) {
+    return 3;
+  }
+#else
+  // After 2020 and with the sub-second fields in range
+  if (realtime.sec < epoch || realtime.nsec < zero || realtime.nsec >= second) {
+    return 3;
+  }
+  if (tv.sec < epoch || tv.usec < zero || tv.usec >= microsecond) {
+    return 4;
+  }
+  if (monotonic.sec < zero || monotonic.nsec < zero || monotonic.nsec >= second) {
+    return 5;
+  }
+#endif
+  return 61;
+}
@@ -0,0 +1,30 @@
+// Prints the CPUID vendor string of leaf 0 and exits with 1 when leaf 1
+// reports SSE2, 0 when it doesn't. The vendor differs between hosts, so
+// this only runs under the emulator.
+long raw_syscall(long number, long a, long b, long c) {
+  long ret;
+  __asm__ volatile("syscall"
+                   : "=a"(ret)
+                   : "a"(number), "D"(a), "S"(b), "d"(c)
+                   : "rcx", "r11", "memory");
+  return ret;
+}
+
+int main() {
+  unsigned int max, vendor[3], signature, ebx, ecx, edx;
+  __asm__ volatile("cpuid"
+                   : "=a"(max), "=b"(vendor[0]), "=d"(vendor[1]), "=c"(vendor[2])
+                   : "a"(0));
+  raw_syscall(1, 1, (long)vendor, 12);
+
+  __asm__ volatile("cpuid"
+                   : "=a"(signature), "=b"(ebx), "=c"(ecx), "=d"(edx)
+                   : "a"(1), "c"(0));
+  // Compared as variables; gcc would use the accumulator forms
+  unsigned int sse2 = 1 << 26, none = 0;
+  if ((edx & sse2) == none) {
+    return 0;
+  }
+
+  return 1;
+}
@@ -0,0 +1,27 @@
+// Scalar double arithmetic in xmm registers, passed and returned as the
+// SysV ABI does. Exits with 3, (int)(1.5 + 2.25), when everything else
+// checks out.
+double add(double a, double b) { return a + b; }
+
+double scale(double a, double b) { return (a - b) * b / 4; }
+
+double from_int(long n) { return n; }
+
+double quotient(double a, double b);
+
+int main() {
+  double x = 1.5, y = 2.25;
+  int sum = (int)add(x, y);
+  if (scale(y, x) != 0.28125) {
+    return 1;
+  }
+  if (from_int(-7) > -6.5) {
+    return 2;
+  }
+  if (quotient(7.5, 2.5) != 3) {
+    return 4;
+  }
+  return sum;
+}
+
+double quotient(double a, double b) { return a / b; }
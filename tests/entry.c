@@ -0,0 +1,4 @@
+// Starts at main, or at alternate with --entry or --start-addr
+int alternate() { return 7; }
+
+int main() { return 3; }
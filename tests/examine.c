@@ -0,0 +1,7 @@
+// Data for the debugger's x command: a string and values of each size,
+// some negative to tell the signed and unsigned formats apart.
+const char greeting[] = "hello, x";
+long quads[] = {1, -2, 0x1122334455667788};
+int words[] = {-1, 2, 3};
+
+int main() { return words[1] + 40; }
@@ -0,0 +1,6 @@
+// Faults on ud2 after setting rax, for --json-summary. Not run natively.
+int main() {
+  __asm__ volatile("mov $7, %eax\n"
+                   "ud2\n");
+  return 0;
+}
@@ -0,0 +1,98 @@
+// Opens tests/data/lines.txt, relative to the repository, and writes
+// what follows its first 6 bytes to stdout, checking the errors of
+// descriptors used wrongly along the way. Exits with 13 when openat
+// fails with -EACCES, as outside the --allow-path directories, and
+// with the number of the failed check otherwise. The checks are split
+// into small functions to keep their jumps short.
+long raw_syscall(long number, long a, long b, long c) {
+  long ret;
+  __asm__ volatile("syscall"
+                   : "=a"(ret)
+                   : "a"(number), "D"(a), "S"(b), "d"(c)
+                   : "rcx", "r11", "memory");
+  return ret;
+}
+
+// Compared as variables; gcc would use the accumulator forms
+long enoent = -2, ebadf = -9, efault = -14, zero = 0, six = 6, size = 23;
+
+long open_errors(long fd) {
+  if (raw_syscall(257, -100, (long)"tests/data/missing.txt", 0) != enoent) {
+    return 2;
+  }
+  // Nothing is read into a buffer outside memory
+  if (raw_syscall(0, fd, 0x7fffffffffff0000, 1) != efault) {
+    return 3;
+  }
+  return 0;
+}
+
+// read_rest reads the file from offset 6 into buf, returning the count
+// or minus the failed check
+long read_rest(long fd, char *buf) {
+  if (raw_syscall(8, fd, 6, 0) != six) {
+    return -4;
+  }
+  // A short read of the rest of the file, then end of file
+  long n = raw_syscall(0, fd, (long)buf, 64);
+  if (n != size - six) {
+    return -5;
+  }
+  if (raw_syscall(0, fd, (long)buf + n, 64) != zero) {
+    return -6;
+  }
+  return n;
+}
+
+long close_errors(long fd, char *buf) {
+  if (raw_syscall(8, fd, 0, 2) != size) {
+    return 7;
+  }
+  // The file is open for reading only
+  if (raw_syscall(1, fd, (long)buf, 1) != ebadf) {
+    return 8;
+  }
+  if (raw_syscall(3, fd, 0, 0) != zero) {
+    return 9;
+  }
+  if (raw_syscall(3, fd, 0, 0) != ebadf) {
+    return 10;
+  }
+  return 0;
+}
+
+// copy writes the file from offset 6 to stdout, between the checks
+long copy(long fd) {
+  char buf[64];
+  long n = read_rest(fd, buf);
+  if (n < zero) {
+    return zero - n;
+  }
+  long status = close_errors(fd, buf);
+  if (status != zero) {
+    return status;
+  }
+  raw_syscall(1, 1, (long)buf, n);
+  return 0;
+}
+
+long check(long fd) {
+  long three = 3;
+  if (fd != three) {
+    return 1;
+  }
+  long status = open_errors(fd);
+  if (status != zero) {
+    return status;
+  }
+  return copy(fd);
+}
+
+int main() {
+  long eacces = -13;
+  long fd = raw_syscall(257, -100, (long)"tests/data/lines.txt", 0);
+  if (fd == eacces) {
+    return 13;
+  }
+  return check(fd);
+}
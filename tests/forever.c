@@ -0,0 +1,5 @@
+// Spins forever, for the instruction budget and timeout to stop
+int main() {
+  for (;;) {
+  }
+}
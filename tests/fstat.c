@@ -0,0 +1,51 @@
+// fstat on stdout reports the kind of file it is through st_mode, 24
+// bytes into struct stat. Exits with 1 for a pipe (as under
+// tests/run.sh), 2 for a terminal and 8 for a regular file, and with
+// 9 when fstat of a closed descriptor doesn't fail with -EBADF.
+struct stat {
+  unsigned long dev;
+  unsigned long ino;
+  unsigned long nlink;
+  unsigned int mode;
+  unsigned int uid;
+  unsigned int gid;
+  unsigned int pad;
+  unsigned long rdev;
+  long size;
+  long blksize;
+  long blocks;
+  long times[6];
+  long reserved[3];
+};
+
+long raw_syscall(long number, long a, long b) {
+  long ret;
+  __asm__ volatile("syscall"
+                   : "=a"(ret)
+                   : "a"(number), "D"(a), "S"(b)
+                   : "rcx", "r11", "memory");
+  return ret;
+}
+
+int main() {
+  struct stat st;
+  long ret = raw_syscall(5, 1, (long)&st);
+  long bad = raw_syscall(5, 99, (long)&st);
+  // Compared as variables; gcc would use the accumulator forms
+  long ok = 0, ebadf = -9;
+  unsigned int mask = 0170000, fifo = 0010000, chr = 0020000, reg = 0100000;
+  unsigned int kind = st.mode & mask;
+  if (ret != ok || bad != ebadf) {
+    return 9;
+  }
+  if (kind == fifo) {
+    return 1;
+  }
+  if (kind == chr) {
+    return 2;
+  }
+  if (kind == reg) {
+    return 8;
+  }
+  return 10;
+}
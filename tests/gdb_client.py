@@ -0,0 +1,76 @@
+#!/usr/bin/env python3
+"""Drives the emulator's --gdb stub the way gdb does: sets a breakpoint
+on a function, continues to it, reads registers and memory, steps and
+continues to the end, printing the exit reply.
+
+Usage: gdb_client.py port function_address"""
+import socket
+import sys
+import time
+
+
+def connect(port):
+    for _ in range(100):
+        try:
+            return socket.create_connection(("localhost", port))
+        except OSError:
+            time.sleep(0.05)
+    sys.exit("could not connect to the emulator")
+
+
+class Client:
+    def __init__(self, sock):
+        self.sock = sock
+        self.buf = b""
+
+    def read(self):
+        while True:
+            chunk = self.sock.recv(4096)
+            if not chunk:
+                raise EOFError
+            self.buf += chunk
+            start = self.buf.find(b"$")
+            end = self.buf.find(b"#", start)
+            if start >= 0 and end >= 0 and len(self.buf) >= end + 3:
+                data = self.buf[start + 1:end].decode()
+                want = int(self.buf[end + 1:end + 3], 16)
+                self.buf = self.buf[end + 3:]
+                if sum(data.encode()) % 256 != want:
+                    sys.exit("bad checksum in reply to " + data)
+                return data
+
+    def send(self, data):
+        packet = "$%s#%02x" % (data, sum(data.encode()) % 256)
+        self.sock.sendall(packet.encode())
+        return self.read()
+
+
+def expect(what, got, want):
+    if got != want:
+        sys.exit("%s: got %r, want %r" % (what, got, want))
+
+
+def rip(registers):
+    # rip follows the 16 general purpose registers
+    return int.from_bytes(bytes.fromhex(registers[16 * 16:17 * 16]), "little")
+
+
+def main():
+    port, function = int(sys.argv[1]), int(sys.argv[2], 0)
+    c = Client(connect(port))
+    expect("qSupported", c.send("qSupported:multiprocess+").startswith("PacketSize"), True)
+    expect("qAttached", c.send("qAttached"), "1")
+    expect("?", c.send("?"), "S05")
+    expect("Z0", c.send("Z0,%x,1" % function), "OK")
+    expect("c", c.send("c"), "S05")
+    registers = c.send("g")
+    expect("rip at breakpoint", rip(registers), function)
+    # Functions start with push rbp at -O0
+    expect("m", c.send("m%x,1" % function), "55")
+    expect("z0", c.send("z0,%x,1" % function), "OK")
+    expect("s", c.send("s"), "S05")
+    expect("rip after step", rip(c.send("g")), function + 1)
+    print(c.send("c"))
+
+
+main()
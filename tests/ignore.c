@@ -0,0 +1,13 @@
+// visit is called once per iteration of a 10 iteration loop, with the
+// iteration number, for breakpoints with an ignore count.
+int total;
+
+void visit(int i) { total += i; }
+
+int main() {
+  for (int i = 0; i < 10; i++) {
+    visit(i);
+  }
+
+  return total;
+}
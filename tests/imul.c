@@ -0,0 +1,6 @@
+int main() {
+  int x = 7;
+  unsigned big = 0x10000;
+  // 0x10000 * 100003 overflows 32 bits; the truncated product has a zero low byte
+  return x * 30 + big * 100003;
+}
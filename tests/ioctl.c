@@ -0,0 +1,63 @@
+// Probes stdin with ioctl(TCGETS) as isatty does, and a file of its own
+// with fcntl. Exits with 41 when stdin is a terminal, 40 when it isn't,
+// and below 40 when a syscall answered wrongly.
+long raw_syscall(long number, long a, long b, long c) {
+  long result;
+  __asm__ volatile("syscall"
+                   : "=a"(result)
+                   : "a"(number), "D"(a), "S"(b), "d"(c)
+                   : "rcx", "r11", "memory");
+  return result;
+}
+
+struct termios {
+  int iflag;
+  int oflag;
+  int cflag;
+  int lflag;
+  char line;
+  char cc[19];
+};
+
+int main() {
+  // Results are compared with variables rather than 0, which gcc would
+  // check with a test form the emulator lacks
+  long zero = 0;
+  long enotty = -25;
+  long tty;
+  struct termios t;
+  long result = raw_syscall(16, 0, 0x5401, (long)&t);
+  if (result == zero) {
+    // A terminal in cooked mode has ICANON set
+    int icanon = 2;
+    if ((t.lflag & icanon) != icanon) {
+      return 1;
+    }
+    tty = 1;
+  } else if (result == enotty) {
+    tty = 0;
+  } else {
+    return 2;
+  }
+
+  // openat(AT_FDCWD, "tests/ioctl.c", O_RDONLY)
+  long fd = raw_syscall(257, -100, (long)"tests/ioctl.c", 0);
+  if (fd < 3) {
+    return 3;
+  }
+  if (raw_syscall(16, fd, 0x5401, (long)&t) != enotty) {
+    return 4;
+  }
+  // F_GETFL, whose access mode is O_RDONLY, and F_SETFL
+  if ((raw_syscall(72, fd, 3, 0) & 3) != zero) {
+    return 5;
+  }
+  if (raw_syscall(72, fd, 4, 0x800) != zero) {
+    return 6;
+  }
+  if (raw_syscall(72, 99, 3, 0) != -9) {
+    return 7;
+  }
+  raw_syscall(3, fd, 0, 0);
+  return 40 + tty;
+}
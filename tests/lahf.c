@@ -0,0 +1,25 @@
+// Loads every flag lahf/sahf transfer with sahf, saves them with lahf,
+// clobbers them and restores them with sahf. Exits with 215 (0xD7: SF,
+// ZF, AF, PF and CF plus the always-set bit 1) when they round-trip.
+int main() {
+  unsigned int flags;
+  __asm__ volatile(
+      "mov $0xFF00, %%eax\n"
+      "sahf\n"
+      "lahf\n"
+      "mov %%eax, %%ecx\n"
+      "xor %%edx, %%edx\n"
+      "add $1, %%edx\n"
+      "mov %%ecx, %%eax\n"
+      "sahf\n"
+      "mov $0, %%eax\n"
+      "lahf\n"
+      "mov %%eax, %0\n"
+      : "=r"(flags)
+      :
+      : "rax", "rcx", "rdx", "cc");
+  if (flags == 0xD700) {
+    return 215;
+  }
+  return 1;
+}
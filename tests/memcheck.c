@@ -0,0 +1,13 @@
+// Reads a stack slot before and, in written, after storing to it, for
+// --memcheck started at either function with --entry. Both exit with 7.
+int uninitialized() {
+  volatile int slot;
+  return slot - slot + 7;
+}
+
+int written() {
+  volatile int slot = 7;
+  return slot;
+}
+
+int main() { return uninitialized() + written() - 7; }
@@ -0,0 +1,37 @@
+// Maps an anonymous page with the raw mmap syscall, writes to it and
+// unmaps it, then checks that MAP_FIXED with an unaligned address is
+// refused. Exits with 77 when everything worked.
+int main() {
+  long value;
+  long unmapped;
+  long fixed;
+  __asm__ volatile(
+      "mov $9, %%eax\n"
+      "xor %%edi, %%edi\n"
+      "mov $4096, %%esi\n"
+      "mov $3, %%edx\n"
+      "mov $0x22, %%r10d\n"
+      "mov $-1, %%r8\n"
+      "xor %%r9d, %%r9d\n"
+      "syscall\n"
+      "movq $42, (%%rax)\n"
+      "mov (%%rax), %%rcx\n"
+      "mov %%rcx, %0\n"
+      "mov %%rax, %%rdi\n"
+      "mov $11, %%eax\n"
+      "mov $4096, %%esi\n"
+      "syscall\n"
+      "mov %%rax, %1\n"
+      "add $1, %%rdi\n"
+      "mov $9, %%eax\n"
+      "mov $4096, %%esi\n"
+      "mov $3, %%edx\n"
+      "mov $0x32, %%r10d\n"
+      "syscall\n"
+      "mov %%rax, %2\n"
+      : "=m"(value), "=m"(unmapped), "=m"(fixed)
+      :
+      : "rax", "rcx", "rdx", "rsi", "rdi", "r8", "r9", "r10", "r11", "memory");
+  // 42 read back, 0 from munmap and -EINVAL (-22) for MAP_FIXED
+  return value + unmapped + fixed + 57;
+}
@@ -0,0 +1,5 @@
+int main() {
+  __asm__("nopl 0x0(%rax)");
+  __asm__("nopw 0x0(%rax,%rax,1)");
+  return 3;
+}
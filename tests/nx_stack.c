@@ -0,0 +1,20 @@
+// Calls code on the stack, mov $42, %eax; ret, which faults as the
+// stack isn't executable. With --no-nx it runs and the program exits
+// with 42.
+int main() {
+  unsigned char code[8] = {0xb8, 42, 0, 0, 0, 0xc3};
+  long status;
+  // An indirect call, made of a push of the return address and ret,
+  // below the red zone code is in
+  __asm__ volatile("sub $128, %%rsp\n"
+                   "lea 1f(%%rip), %%rcx\n"
+                   "push %%rcx\n"
+                   "push %1\n"
+                   "ret\n"
+                   "1:\n"
+                   "add $128, %%rsp\n"
+                   : "=a"(status)
+                   : "r"(code)
+                   : "rcx", "memory");
+  return status;
+}
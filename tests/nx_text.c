@@ -0,0 +1,17 @@
+// Patches an instruction in .text without making the page writable
+// first, which faults. With --no-nx the write goes through and the
+// program exits with 42.
+__asm__(".text\n"
+        ".globl patched\n"
+        "patched:\n"
+        "mov $1, %eax\n"
+        "ret\n");
+
+int patched(void);
+
+int main() {
+  // The immediate follows the opcode byte
+  unsigned char *imm = (unsigned char *)patched + 1;
+  *imm = 42;
+  return patched();
+}
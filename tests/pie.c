@@ -0,0 +1,11 @@
+// A position independent executable whose pointers into .data are
+// initialized by R_X86_64_RELATIVE relocations. Started at main, past
+// the dynamic loader, it only exits with 42 when the emulator applied
+// them. Build with -pie.
+long value = 40;
+long offset = 2;
+long *pointers[] = {&value, &offset};
+
+int main() {
+  return *pointers[0] + *pointers[1];
+}
@@ -0,0 +1,11 @@
+// Pops until rsp runs past the top of the stack, which the emulator
+// stops with a StackUnderflow fault
+int main() {
+  __asm__ volatile("1:\n"
+                   "  pop %%rax\n"
+                   "  jmp 1b\n"
+                   :
+                   :
+                   : "rax");
+  return 0;
+}
@@ -0,0 +1,31 @@
+// Saves flags with pushfq after a compare, clobbers them with an add
+// and restores them with popfq, then pops an all-zero value into rflags
+// to check that IF and the reserved bit 1 keep their state. Exits with
+// 151 when the restored flags are 0x297 (IF, SF, AF, PF, CF and bit 1).
+int main() {
+  unsigned long restored;
+  unsigned long cleared;
+  __asm__ volatile(
+      "xor %%eax, %%eax\n"
+      "cmp $1, %%eax\n"
+      "pushfq\n"
+      "add $1, %%eax\n"
+      "popfq\n"
+      "pushfq\n"
+      "pop %0\n"
+      "xor %%ecx, %%ecx\n"
+      "push %%rcx\n"
+      "popfq\n"
+      "pushfq\n"
+      "pop %1\n"
+      : "=r"(restored), "=r"(cleared)
+      :
+      : "rax", "rcx", "cc");
+  if (cleared != 0x202) {
+    return 1;
+  }
+  if (restored != 0x297) {
+    return 2;
+  }
+  return 151;
+}
@@ -0,0 +1,32 @@
+// rdtsc returns the counter split into edx:eax with the upper halves of
+// rax and rdx cleared, and counts up between two reads. Exits with 3.
+void read_tsc(unsigned long *lo, unsigned long *hi) {
+  unsigned long a, d;
+  __asm__ volatile("mov $-1, %%rax\n"
+                   "mov $-1, %%rdx\n"
+                   "rdtsc\n"
+                   : "=a"(a), "=d"(d));
+  *lo = a;
+  *hi = d;
+}
+
+int main() {
+  unsigned long lo1, hi1, lo2, hi2;
+  unsigned long max32 = 0xffffffff;
+  int result = 0;
+  read_tsc(&lo1, &hi1);
+  for (int i = 0; i < 100; i++) {
+    result = result + 0;
+  }
+  read_tsc(&lo2, &hi2);
+
+  if (lo1 <= max32 && hi1 <= max32 && lo2 <= max32 && hi2 <= max32) {
+    result = result + 1;
+  }
+
+  if (hi2 > hi1 || (hi2 == hi1 && lo2 > lo1)) {
+    result = result + 2;
+  }
+
+  return result;
+}
@@ -0,0 +1,82 @@
+#!/usr/bin/env python3
+"""Drives the debugger REPL served by --listen: steps over the first
+instruction of main and reads rip from the registers, reconnects to find
+the program still paused there, and continues it to the end, printing
+the exit message.
+
+Usage: repl_client.py port main_address"""
+import socket
+import sys
+import time
+
+
+def connect(port):
+    for _ in range(100):
+        try:
+            return socket.create_connection(("localhost", port))
+        except OSError:
+            time.sleep(0.05)
+    sys.exit("could not connect to the emulator")
+
+
+class Client:
+    def __init__(self, sock):
+        self.sock = sock
+        self.buf = ""
+
+    def read(self):
+        # Output runs up to the next prompt, such as "main+0x1> "
+        while not self.buf.endswith("> "):
+            chunk = self.sock.recv(4096)
+            if not chunk:
+                raise EOFError
+            self.buf += chunk.decode()
+        lines = self.buf.split("\n")
+        self.buf = ""
+        return lines[:-1], lines[-1]
+
+    def send(self, command):
+        self.sock.sendall((command + "\n").encode())
+        return self.read()
+
+    def close(self):
+        self.sock.close()
+
+
+def expect(what, got, want):
+    if got != want:
+        sys.exit("%s: got %r, want %r" % (what, got, want))
+
+
+def rip(output):
+    for line in output:
+        name, _, value = line.partition(":\t")
+        if name == "rip":
+            return int(value, 0)
+    sys.exit("no rip in %r" % output)
+
+
+def main():
+    port, function = int(sys.argv[1]), int(sys.argv[2], 0)
+    c = Client(connect(port))
+    _, prompt = c.read()
+    expect("prompt", prompt, "main> ")
+    _, prompt = c.send("step")
+    # Functions start with push rbp at -O0
+    expect("prompt after step", prompt, "main+0x1> ")
+    output, _ = c.send("registers")
+    expect("rip after step", rip(output), function + 1)
+    c.close()
+
+    c = Client(connect(port))
+    c.read()
+    output, _ = c.send("registers")
+    expect("rip after reconnecting", rip(output), function + 1)
+    # Closing our side ends the session once continue has run
+    c.sock.sendall(b"continue\n")
+    c.sock.shutdown(socket.SHUT_WR)
+    output = c.sock.makefile().read()
+    print(output.strip().split("\n")[-2])
+
+
+main()
@@ -0,0 +1,705 @@
+#!/bin/bash
+# Builds the emulator and the C programs in this directory, runs each
+# program natively and under the emulator, and checks that the exit
+# status and stdout match.
+#
+# Usage: tests/run.sh [name...]
+set -u
+
+cd "$(dirname "$0")/.."
+out=$(mktemp -d)
+trap 'rm -rf "$out"' EXIT
+
+go build -o "$out/emulator" . || exit 1
+
+# name, gcc flags, program arguments
+cases=(
+	"simple|-no-pie|"
+	"sum|-no-pie|"
+	"calls|-no-pie|"
+	"backtrace|-no-pie -fno-omit-frame-pointer|"
+	"nop|-no-pie|"
+	"imul|-no-pie|"
+	"loop|-no-pie|"
+	"lahf|-no-pie|"
+	"pushf|-no-pie|"
+	"mmap|-no-pie|"
+	"arch_prctl|-no-pie|"
+	"segment|-no-pie|"
+	"byte_alu|-no-pie|"
+	"examine|-no-pie|"
+	"adc|-no-pie|"
+	"clock|-no-pie|"
+	"writev|-no-pie|"
+	"selfmod|-no-pie|"
+	"fstat|-no-pie|"
+	"files|-no-pie|"
+	"double|-no-pie|"
+	"struct_copy|-no-pie -O2|"
+	"symbols|-no-pie|"
+	"ignore|-no-pie|"
+	"rdtsc|-no-pie|"
+	"signals|-no-pie|"
+	"strings|-no-pie|"
+	"stack|-no-pie|"
+	"ioctl|-no-pie|"
+	"exit|-no-pie|"
+	"stack_protector|-no-pie -fstack-protector-all|"
+	"start_static|-static -nostdlib|one two"
+	"hello_static|-static|emulator"
+	"pie|-pie|"
+)
+
+failed=0
+run() {
+	local spec=$1
+	IFS='|' read -r name flags args <<<"$spec"
+	if [ "${selected:-}" != "" ] && [[ " $selected " != *" $name "* ]]; then
+		return
+	fi
+
+	# shellcheck disable=SC2086
+	if ! gcc -O0 $flags -o "$out/$name" "tests/$name.c"; then
+		echo "FAIL $name: does not compile"
+		failed=1
+		return
+	fi
+
+	# shellcheck disable=SC2086
+	want_stdout=$("$out/$name" $args)
+	want_status=$?
+	# shellcheck disable=SC2086
+	got_stdout=$("$out/emulator" "$out/$name" -- $args 2>"$out/$name.stderr")
+	got_status=$?
+
+	if [ "$got_status" = "$want_status" ] && [ "$got_stdout" = "$want_stdout" ]; then
+		echo "ok   $name"
+		return
+	fi
+
+	echo "FAIL $name: status $got_status, want $want_status"
+	if [ "$got_stdout" != "$want_stdout" ]; then
+		echo "     stdout $(printf %q "$got_stdout"), want $(printf %q "$want_stdout")"
+	fi
+	sed 's/^/     /' "$out/$name.stderr"
+	failed=1
+}
+
+selected="$*"
+for spec in "${cases[@]}"; do
+	run "$spec"
+done
+
+# Debugger scripts: tests/scripts/<program>-<name>.cmd is run against
+# tests/<program>.c and its output compared to the .out file next to it.
+# .in files are typed into the interactive REPL instead, and compared
+# from the first prompt, which names the symbol rip is in, on. Programs
+# are built with -g so that source lines can be shown.
+for script in tests/scripts/*.cmd tests/scripts/*.in; do
+	base=$(basename "${script%.*}")
+	name=${base%%-*}
+	if [ "$selected" != "" ] && [[ " $selected " != *" $base "* ]]; then
+		continue
+	fi
+
+	gcc -O0 -no-pie -g -o "$out/$name" "tests/$name.c"
+	if [ "${script##*.}" = in ]; then
+		"$out/emulator" "$out/$name" -d <"$script" 2>&1 | sed -n '/^[^ ]*> /,$p' >"$out/$base.out"
+	else
+		"$out/emulator" "$out/$name" -x "$script" --batch >"$out/$base.out" 2>&1
+	fi
+
+	if diff -u "${script%.*}.out" "$out/$base.out" >"$out/$base.diff"; then
+		echo "ok   $base"
+	else
+		echo "FAIL $base"
+		sed 's/^/     /' "$out/$base.diff"
+		failed=1
+	fi
+done
+
+# The state dump written on exit has to be valid JSON with the return
+# value in rax
+if [ "$selected" = "" ] || [[ " $selected " == *" dump "* ]]; then
+	gcc -O0 -no-pie -o "$out/loop" tests/loop.c
+	"$out/emulator" "$out/loop" --dump-on-exit "$out/dump.json"
+	if python3 -c '
+import json, sys
+d = json.load(open(sys.argv[1]))
+assert d["version"] == 1, d["version"]
+assert d["registers"]["rax"] == "0xa", d["registers"]["rax"]
+assert d["exited"] and d["status"] == 10, d
+' "$out/dump.json"; then
+		echo "ok   dump"
+	else
+		echo "FAIL dump"
+		failed=1
+	fi
+fi
+
+# Flat binaries: mov eax, 42; ret from a file, and from stdin entered
+# past a mov eax, 1; ret to mov eax, 7; ret
+if [ "$selected" = "" ] || [[ " $selected " == *" raw "* ]]; then
+	printf '\xb8\x2a\x00\x00\x00\xc3' >"$out/ret42.bin"
+	"$out/emulator" "$out/ret42.bin" --raw
+	file_status=$?
+	printf '\xb8\x01\x00\x00\x00\xc3\xb8\x07\x00\x00\x00\xc3' |
+		"$out/emulator" - --raw --base 0x2000 --raw-entry 0x2006
+	stdin_status=$?
+	if [ $file_status = 42 ] && [ $stdin_status = 7 ]; then
+		echo "ok   raw"
+	else
+		echo "FAIL raw: status $file_status from a file, $stdin_status from stdin"
+		failed=1
+	fi
+fi
+
+# --eval runs hex bytes given in any of the accepted forms, with a ret
+# appended, and prints the registers
+if [ "$selected" = "" ] || [[ " $selected " == *" eval "* ]]; then
+	rax=$("$out/emulator" --eval '48 c7 c0 05,00,00,00' | head -n 1)
+	hex=$("$out/emulator" --eval '\x48\xc7\xc0\x05 0 0 0 c3' --hex | head -n 1)
+	bad=$("$out/emulator" --eval '48 c7 zz' 2>&1)
+	if [ "$rax" = "$(printf 'rax:\t5')" ] && [ "$hex" = "$(printf 'rax:\t0x5')" ] &&
+		[[ "$bad" == *'Invalid byte "zz" at offset 6' ]]; then
+		echo "ok   eval"
+	else
+		echo "FAIL eval: $rax, $hex, $bad"
+		failed=1
+	fi
+fi
+
+# Jumping outside memory faults on the fetch rather than crashing
+if [ "$selected" = "" ] || [[ " $selected " == *" wild_fetch "* ]]; then
+	wild=$("$out/emulator" --eval '48 b8 ff ff ff ff ff 00 00 00 50 c3' | head -n 1)
+	if [ "$wild" = "MemoryAccess fault at 0xffffffffff: fetch from 0xffffffffff outside memory" ]; then
+		echo "ok   wild_fetch"
+	else
+		echo "FAIL wild_fetch: $wild"
+		failed=1
+	fi
+fi
+
+# Misspelled options and clashing tracers are refused
+if [ "$selected" = "" ] || [[ " $selected " == *" flags "* ]]; then
+	gcc -O0 -no-pie -o "$out/simple" tests/simple.c
+	unknown=$("$out/emulator" "$out/simple" --folow-calls 2>&1)
+	unknown_status=$?
+	clash=$("$out/emulator" "$out/simple" --follow-calls --trace 2>&1)
+	clash_status=$?
+	if [ $unknown_status = 1 ] && [[ "$unknown" == *"Unknown flag --folow-calls; the program's own arguments go after --" ]] &&
+		[ $clash_status = 1 ] && [[ "$clash" == *"--follow-calls and --trace can't be combined" ]]; then
+		echo "ok   flags"
+	else
+		echo "FAIL flags: $unknown_status $unknown, $clash_status $clash"
+		failed=1
+	fi
+fi
+
+# Runaway recursion pushes below the stack and popping keeps going past
+# its top at 0x2800000; both stop the program with a fault and status 1
+if [ "$selected" = "" ] || [[ " $selected " == *" stack_faults "* ]]; then
+	gcc -O0 -no-pie -o "$out/runaway" tests/runaway.c
+	gcc -O0 -no-pie -o "$out/pop_past_top" tests/pop_past_top.c
+	overflow=$("$out/emulator" "$out/runaway" 2>&1)
+	overflow_status=$?
+	underflow=$("$out/emulator" "$out/pop_past_top" 2>&1)
+	underflow_status=$?
+	if [ $overflow_status = 1 ] && [[ "$overflow" == *"StackOverflow fault at 0x"*": rsp 0x1ffff"* ]] &&
+		[ $underflow_status = 1 ] && [[ "$underflow" == *"StackUnderflow fault at 0x"*": rsp 0x2800000" ]]; then
+		echo "ok   stack_faults"
+	else
+		echo "FAIL stack_faults: status $overflow_status, $overflow; status $underflow_status, $underflow"
+		failed=1
+	fi
+fi
+
+# idiv of the most negative value by -1 overflows the quotient, at 32
+# and at 64 bits, which faults rather than producing a value
+if [ "$selected" = "" ] || [[ " $selected " == *" divide_error "* ]]; then
+	idiv32=$("$out/emulator" --eval 'ba ff ff ff ff b8 00 00 00 80 b9 ff ff ff ff f7 f9' | head -n 1)
+	idiv64=$("$out/emulator" --eval '48 c7 c2 ff ff ff ff 48 b8 00 00 00 00 00 00 00 80 48 c7 c1 ff ff ff ff 48 f7 f9' | head -n 1)
+	zero=$("$out/emulator" --eval '31 c9 f7 f1' | head -n 1)
+	if [ "$idiv32" = "DivideError fault at 0x100f: quotient overflows 32 bits" ] &&
+		[ "$idiv64" = "DivideError fault at 0x1018: quotient overflows 64 bits" ] &&
+		[ "$zero" = "DivideError fault at 0x1002: division by zero" ]; then
+		echo "ok   divide_error"
+	else
+		echo "FAIL divide_error: $idiv32, $idiv64, $zero"
+		failed=1
+	fi
+fi
+
+# movaps faults on a misaligned operand, where movups doesn't
+if [ "$selected" = "" ] || [[ " $selected " == *" misaligned "* ]]; then
+	aligned=$("$out/emulator" --eval '48 8d 4c 24 f0 0f 28 01' | head -n 1)
+	unaligned=$("$out/emulator" --eval '48 8d 4c 24 f0 0f 10 01' | head -n 1)
+	if [ "$aligned" = "GeneralProtection fault at 0x1005: misaligned 16 byte access at 0x27fffe8" ] &&
+		[ "$unaligned" = "rax:	0" ]; then
+		echo "ok   misaligned"
+	else
+		echo "FAIL misaligned: $aligned, $unaligned"
+		failed=1
+	fi
+fi
+
+# Writes to .text and jumps into the stack fault, as natively, unless
+# --no-nx turns the page permissions off
+if [ "$selected" = "" ] || [[ " $selected " == *" permissions "* ]]; then
+	gcc -O0 -no-pie -o "$out/nx_text" tests/nx_text.c
+	gcc -O0 -no-pie -o "$out/nx_stack" tests/nx_stack.c
+	text=$("$out/emulator" "$out/nx_text" 2>&1)
+	stack=$("$out/emulator" "$out/nx_stack" 2>&1)
+	"$out/emulator" "$out/nx_text" --no-nx
+	text_status=$?
+	"$out/emulator" "$out/nx_stack" --no-nx
+	stack_status=$?
+	if [[ "$text" == *"MemoryAccess fault at 0x"*": write of 1 bytes at read-only address 0x"* ]] &&
+		[[ "$stack" == *"MemoryAccess fault at 0x"*": fetch from non-executable address 0x"* ]] &&
+		[ $text_status = 42 ] && [ $stack_status = 42 ]; then
+		echo "ok   permissions"
+	else
+		echo "FAIL permissions: $text, $stack, with --no-nx $text_status and $stack_status"
+		failed=1
+	fi
+fi
+
+# --max-insns and --timeout stop a program that never exits, saying where
+# it got to, and --timeout also one blocked in a syscall, still writing
+# its summary
+if [ "$selected" = "" ] || [[ " $selected " == *" budget "* ]]; then
+	gcc -O0 -no-pie -o "$out/forever" tests/forever.c
+	gcc -O0 -no-pie -o "$out/spin" tests/spin.c
+	insns=$("$out/emulator" "$out/forever" --max-insns 1000 2>&1)
+	insns_status=$?
+	timeout=$("$out/emulator" "$out/forever" --timeout 100ms 2>&1)
+	timeout_status=$?
+	blocked=$(sleep 2 | "$out/emulator" "$out/spin" --timeout 100ms --json-summary "$out/blocked.json" 2>&1)
+	blocked_status=$?
+	blocked_summary=$(python3 -c 'import json, sys; print(json.load(open(sys.argv[1]))["exited"])' "$out/blocked.json" 2>&1)
+	if [[ "$insns" == *"BudgetExceeded fault at 0x"*": instruction budget of 1000 exhausted in main+0x"*" after 1000 instructions" ]] &&
+		[[ "$timeout" == *"BudgetExceeded fault at 0x"*": timeout of 100ms expired in main+0x"*" after "*" instructions" ]] &&
+		[[ "$blocked" == *"Timeout of 100ms expired while the program was blocked" ]] &&
+		[ $insns_status = 124 ] && [ $timeout_status = 124 ] && [ $blocked_status = 124 ] &&
+		[ "$blocked_summary" = False ]; then
+		echo "ok   budget"
+	else
+		echo "FAIL budget: $insns ($insns_status), $timeout ($timeout_status), $blocked ($blocked_status), summary $blocked_summary"
+		failed=1
+	fi
+fi
+
+# --entry starts at the first defined symbol of a list and --start-addr at
+# an address, also in a stripped program
+if [ "$selected" = "" ] || [[ " $selected " == *" entry "* ]]; then
+	gcc -O0 -no-pie -o "$out/entry" tests/entry.c
+	strip -o "$out/entry_stripped" "$out/entry"
+	address=0x$(nm "$out/entry" | awk '$3 == "alternate" { print $1 }')
+	"$out/emulator" "$out/entry"
+	main_status=$?
+	"$out/emulator" "$out/entry" --entry missing,alternate
+	symbol_status=$?
+	"$out/emulator" "$out/entry_stripped" --start-addr "$address"
+	address_status=$?
+	missing=$("$out/emulator" "$out/entry" --entry missing,other 2>&1)
+	outside=$("$out/emulator" "$out/entry" --start-addr 0x10 2>&1)
+	if [ $main_status = 3 ] && [ $symbol_status = 7 ] && [ $address_status = 7 ] &&
+		[[ "$missing" == *"Could not find entrypoint symbol: missing, other" ]] &&
+		[[ "$outside" == *"Entry point 0x10 is outside the loaded segments" ]]; then
+		echo "ok   entry"
+	else
+		echo "FAIL entry: statuses $main_status, $symbol_status, $address_status, $missing, $outside"
+		failed=1
+	fi
+fi
+
+# OUT to COM1 is written to stdout and IN reads its line status as idle;
+# ports without a device read all ones and ignore writes
+if [ "$selected" = "" ] || [[ " $selected " == *" ports "* ]]; then
+	# mov eax, 'H'; mov edx, 0x3f8; out dx, al; mov eax, 'i'; out dx, al;
+	# mov eax, '\n'; out dx, al; mov edx, 0x3fd; in al, dx; ret
+	serial=$(printf '\xb8\x48\x00\x00\x00\xba\xf8\x03\x00\x00\xee\xb8\x69\x00\x00\x00\xee\xb8\x0a\x00\x00\x00\xee\xba\xfd\x03\x00\x00\xec\xc3' |
+		"$out/emulator" - --raw)
+	serial_status=$?
+	# out 0x80, al; in al, 0x80; ret
+	printf '\xe6\x80\xe4\x80\xc3' | "$out/emulator" - --raw
+	unhandled_status=$?
+	if [ "$serial" = Hi ] && [ $serial_status = 96 ] && [ $unhandled_status = 255 ]; then
+		echo "ok   ports"
+	else
+		echo "FAIL ports: serial $(printf %q "$serial") ($serial_status), unhandled port $unhandled_status"
+		failed=1
+	fi
+fi
+
+# --memcheck warns about a read of a stack slot nothing was stored to and
+# stays quiet once it was written, and --memcheck-log logs each access
+if [ "$selected" = "" ] || [[ " $selected " == *" memcheck "* ]]; then
+	gcc -O0 -no-pie -o "$out/memcheck" tests/memcheck.c
+	uninitialized=$("$out/emulator" "$out/memcheck" --memcheck --entry uninitialized 2>&1)
+	uninitialized_status=$?
+	written=$("$out/emulator" "$out/memcheck" --memcheck-log "$out/memcheck.log" --entry written 2>&1)
+	written_status=$?
+	if [[ "$uninitialized" == "memcheck: uninitialized read of 4 bytes at 0x"*" in uninitialized+0x4 (rip 0x"* ]] &&
+		[ "$written" = "" ] && [ $uninitialized_status = 7 ] && [ $written_status = 7 ] &&
+		grep -q "write of 4 bytes at 0x.* = 0x7" "$out/memcheck.log"; then
+		echo "ok   memcheck"
+	else
+		echo "FAIL memcheck: $uninitialized ($uninitialized_status), $written ($written_status)"
+		failed=1
+	fi
+fi
+
+# A run recorded with --record-syscalls replays from the log alone, to the
+# same registers, and a different program is refused
+if [ "$selected" = "" ] || [[ " $selected " == *" syscall-log "* ]]; then
+	gcc -O0 -no-pie -o "$out/replay" tests/replay.c
+	gcc -O0 -no-pie -o "$out/loop" tests/loop.c
+	echo hello | "$out/emulator" "$out/replay" --record-syscalls "$out/replay.log" \
+		--json-summary "$out/recorded.json" >/dev/null
+	recorded_status=$?
+	replayed=$("$out/emulator" "$out/replay" --replay-syscalls "$out/replay.log" \
+		--json-summary "$out/replayed.json" </dev/null)
+	replayed_status=$?
+	other=$("$out/emulator" "$out/loop" --replay-syscalls "$out/replay.log" 2>&1)
+	if python3 -c '
+import json, sys
+a, b = (json.load(open(f)) for f in sys.argv[1:])
+sys.exit(a["registers"] != b["registers"])
+' "$out/recorded.json" "$out/replayed.json" &&
+		[ $recorded_status = 6 ] && [ $replayed_status = 6 ] && [ "$replayed" = "" ] &&
+		[[ "$other" == *"Replay starts at 0x"*", the recording at 0x"* ]]; then
+		echo "ok   syscall-log"
+	else
+		echo "FAIL syscall-log: status $recorded_status, replayed $replayed_status $(printf %q "$replayed"), $other"
+		failed=1
+	fi
+fi
+
+# --stack-top moves the stack down, keeping rsp aligned at entry, and a
+# stack top off a page boundary or a stack overlapping the program is
+# refused
+if [ "$selected" = "" ] || [[ " $selected " == *" stack_layout "* ]]; then
+	gcc -O0 -no-pie -o "$out/stack" tests/stack.c
+	"$out/emulator" "$out/stack" --stack-top 0x2000000 --json-summary "$out/stack.json"
+	moved_status=$?
+	unaligned=$("$out/emulator" "$out/stack" --stack-top 0x2000008 2>&1)
+	overlapping=$("$out/emulator" "$out/stack" --stack-size 0x2800000 2>&1)
+	if [ $moved_status = 42 ] && grep -q '"rsp": "0x2000000"' "$out/stack.json" &&
+		[[ "$unaligned" == *"Stack top 0x2000008 must be page aligned"* ]] &&
+		[[ "$overlapping" == *"overlaps the program, which ends at 0x"* ]]; then
+		echo "ok   stack_layout"
+	else
+		echo "FAIL stack_layout: status $moved_status, $unaligned, $overlapping"
+		failed=1
+	fi
+fi
+
+# ioctl(TCGETS) succeeds on a terminal, here a pseudo terminal from
+# script, and fails with ENOTTY on the null device
+if [ "$selected" = "" ] || [[ " $selected " == *" tty "* ]]; then
+	gcc -O0 -no-pie -o "$out/ioctl" tests/ioctl.c
+	script -qec "$out/emulator $out/ioctl" /dev/null >/dev/null
+	terminal_status=$?
+	"$out/emulator" "$out/ioctl" </dev/null
+	null_status=$?
+	if [ $terminal_status = 41 ] && [ $null_status = 40 ]; then
+		echo "ok   tty"
+	else
+		echo "FAIL tty: status $terminal_status on a terminal, $null_status on /dev/null"
+		failed=1
+	fi
+fi
+
+# --opcode-coverage collects the opcodes the cases execute, and
+# --coverage-report lists the implemented ones none of them reach. The
+# list is informational; TestCoverageReport, built with the
+# opcodecoverage tag, checks that ret and syscall ran and that the
+# report's totals match the file.
+if [ "$selected" = "" ] || [[ " $selected " == *" coverage "* ]]; then
+	rm -f "$out/coverage"
+	for spec in "${cases[@]}"; do
+		IFS='|' read -r name flags args <<<"$spec"
+		# shellcheck disable=SC2086
+		if [ -x "$out/$name" ] || gcc -O0 $flags -o "$out/$name" "tests/$name.c"; then
+			# shellcheck disable=SC2086
+			"$out/emulator" "$out/$name" --opcode-coverage "$out/coverage" -- $args >/dev/null 2>&1 </dev/null
+		fi
+	done
+
+	"$out/emulator" --coverage-report "$out/coverage" >"$out/coverage.report"
+	summary=$(tail -n 1 "$out/coverage.report")
+	if report=$(OPCODE_COVERAGE="$out/coverage" go test -tags opcodecoverage -count 1 -run TestCoverageReport .); then
+		echo "ok   coverage: $summary"
+	else
+		echo "FAIL coverage"
+		echo "$report" | sed 's/^/     /'
+		sed 's/^/     /' "$out/coverage.report"
+		failed=1
+	fi
+fi
+
+# cpuid reports the GenuineIntel vendor and SSE2 unless it is hidden
+if [ "$selected" = "" ] || [[ " $selected " == *" cpuid "* ]]; then
+	gcc -O0 -no-pie -o "$out/cpuid" tests/cpuid.c
+	vendor=$("$out/emulator" "$out/cpuid")
+	status=$?
+	"$out/emulator" "$out/cpuid" --cpuid-features -sse2 >/dev/null
+	hidden=$?
+	if [ "$vendor" = GenuineIntel ] && [ $status = 1 ] && [ $hidden = 0 ]; then
+		echo "ok   cpuid"
+	else
+		echo "FAIL cpuid: vendor $vendor, status $status, with -sse2 $hidden"
+		failed=1
+	fi
+fi
+
+# --json-summary describes both an exit and a fault, with the requested
+# memory ranges
+if [ "$selected" = "" ] || [[ " $selected " == *" summary "* ]]; then
+	gcc -O0 -no-pie -o "$out/loop" tests/loop.c
+	gcc -O0 -no-pie -o "$out/fault" tests/fault.c
+	"$out/emulator" "$out/loop" --json-summary "$out/loop.json"
+	"$out/emulator" "$out/fault" --json-summary "$out/fault.json" \
+		--json-memory main:1 --json-memory 0xffffffffff:2 2>/dev/null
+	if python3 -c '
+import json, sys
+d = json.load(open(sys.argv[1]))
+assert d["exited"] and d["status"] == 10, d
+assert d["registers"]["rax"] == "0xa", d["registers"]
+assert d["instructions"] > 0 and len(d["registers"]) == 18, d
+assert any(s["flags"] == "r-x" for s in d["segments"]), d["segments"]
+f = json.load(open(sys.argv[2]))
+assert not f["exited"] and f["fault"]["kind"] == "InvalidOpcode", f
+assert f["registers"]["rax"] == "0x7", f["registers"]
+assert f["registers"]["rip"] == f["fault"]["rip"], f
+assert f["memory"][0]["bytes"] == "55", f["memory"]
+assert "error" in f["memory"][1], f["memory"]
+' "$out/loop.json" "$out/fault.json"; then
+		echo "ok   summary"
+	else
+		echo "FAIL summary"
+		failed=1
+	fi
+fi
+
+# --deterministic-time reports a fixed wall clock time and zero for the
+# monotonic clocks
+if [ "$selected" = "" ] || [[ " $selected " == *" deterministic_time "* ]]; then
+	gcc -O0 -no-pie -DFIXED_TIME=1700000000 -o "$out/clock_fixed" tests/clock.c
+	"$out/emulator" "$out/clock_fixed" --deterministic-time
+	status=$?
+	if [ $status = 61 ]; then
+		echo "ok   deterministic_time"
+	else
+		echo "FAIL deterministic_time: status $status"
+		failed=1
+	fi
+fi
+
+# --stats of calls compared to a transcript: 97 instructions, one of
+# them the exit syscall, and --stats-json with the same counts
+if [ "$selected" = "" ] || [[ " $selected " == *" stats "* ]]; then
+	gcc -O0 -no-pie -o "$out/calls" tests/calls.c
+	"$out/emulator" "$out/calls" --stats 2>"$out/calls-stats.out"
+	"$out/emulator" "$out/calls" --stats-json "$out/calls-stats.json"
+	if diff -u tests/traces/calls-stats.out "$out/calls-stats.out" >"$out/stats.diff" &&
+		python3 -c '
+import json, sys
+d = json.load(open(sys.argv[1]))
+assert d["instructions"] == 97, d["instructions"]
+syscalls = [o["count"] for o in d["opcodes"] if o["mnemonic"] == "syscall"]
+assert syscalls == [1], d["opcodes"]
+' "$out/calls-stats.json" >>"$out/stats.diff" 2>&1; then
+		echo "ok   stats"
+	else
+		echo "FAIL stats"
+		sed 's/^/     /' "$out/stats.diff"
+		failed=1
+	fi
+fi
+
+# Instruction traces compared to transcripts: all of loop, symbols from
+# first to second and the call tree of calltree
+if [ "$selected" = "" ] || [[ " $selected " == *" trace "* ]]; then
+	gcc -O0 -no-pie -o "$out/loop" tests/loop.c
+	gcc -O0 -no-pie -o "$out/symbols" tests/symbols.c
+	gcc -O0 -no-pie -o "$out/calltree" tests/calltree.c
+	"$out/emulator" "$out/loop" --trace 2>"$out/loop.trace"
+	"$out/emulator" "$out/symbols" --trace-file "$out/symbols-window.trace" \
+		--trace-start first --trace-stop second
+	"$out/emulator" "$out/calltree" --follow-calls --trace-file "$out/calltree.trace"
+	if diff -u tests/traces/loop.out "$out/loop.trace" >"$out/trace.diff" &&
+		diff -u tests/traces/symbols-window.out "$out/symbols-window.trace" >>"$out/trace.diff" &&
+		diff -u tests/traces/calltree.out "$out/calltree.trace" >>"$out/trace.diff"; then
+		echo "ok   trace"
+	else
+		echo "FAIL trace"
+		sed 's/^/     /' "$out/trace.diff"
+		failed=1
+	fi
+fi
+
+# --disasm from main of loop, which runs to the end of .text, compared
+# to a transcript
+if [ "$selected" = "" ] || [[ " $selected " == *" disasm "* ]]; then
+	gcc -O0 -no-pie -o "$out/loop" tests/loop.c
+	main=$(nm "$out/loop" | awk '$3 == "main" { print "0x" $1 }')
+	"$out/emulator" "$out/loop" --disasm "$main" >"$out/loop-disasm.out"
+	if diff -u tests/traces/loop-disasm.out "$out/loop-disasm.out" >"$out/disasm.diff"; then
+		echo "ok   disasm"
+	else
+		echo "FAIL disasm"
+		sed 's/^/     /' "$out/disasm.diff"
+		failed=1
+	fi
+fi
+
+# Register traces recorded with --record replay without diverging, and
+# a recording of loop stops calls at its first instruction. Recording
+# while replaying is refused.
+if [ "$selected" = "" ] || [[ " $selected " == *" replay "* ]]; then
+	gcc -O0 -no-pie -o "$out/loop" tests/loop.c
+	gcc -O0 -no-pie -o "$out/calls" tests/calls.c
+	"$out/emulator" "$out/loop" --replay tests/traces/loop.trace
+	loop_status=$?
+	"$out/emulator" "$out/calls" --replay tests/traces/calls.trace
+	calls_status=$?
+	"$out/emulator" "$out/calls" --replay tests/traces/loop.trace 2>"$out/replay.stderr"
+	diverged_status=$?
+	diverged=$(tail -n 1 "$out/replay.stderr")
+	both=$("$out/emulator" "$out/loop" --record "$out/both.trace" --replay tests/traces/loop.trace 2>&1)
+	if [ $loop_status = 10 ] && [ $calls_status = 21 ] && [ $diverged_status = 1 ] &&
+		[[ "$diverged" == *"Aborted fault at 0x"*": replay diverged at instruction 1: registers differ" ]] &&
+		[[ "$both" == *"--record and --replay can't be combined" ]]; then
+		echo "ok   replay"
+	else
+		echo "FAIL replay: status $loop_status, $calls_status, $diverged_status: $diverged; $both"
+		failed=1
+	fi
+fi
+
+# Instruction cases recorded on hardware by tests/cases/generate.py
+if [ "$selected" = "" ] || [[ " $selected " == *" cases "* ]]; then
+	if report=$(go test -run TestInstructionCases .); then
+		echo "ok   cases"
+	else
+		echo "FAIL cases:"
+		echo "$report" | sed 's/^/\t/'
+		failed=1
+	fi
+fi
+
+# Ctrl-C, simulated with SIGINT: it breaks a spinning program into the
+# REPL, started for it unless --debug already had, where the program is
+# let finish with 12. A second one while the program is still blocked
+# reading stdin exits with 130.
+if [ "$selected" = "" ] || [[ " $selected " == *" interrupt "* ]]; then
+	gcc -O0 -no-pie -o "$out/spin" tests/spin.c
+	printf 'xwhere\nwrite done 4 12\ncontinue\n' >"$out/spin.in"
+	"$out/emulator" "$out/spin" <"$out/spin.in" >"$out/spin.out" 2>&1 &
+	emulator=$!
+	sleep 1
+	kill -INT $emulator
+	wait $emulator
+	run_status=$?
+
+	printf 'continue\nwrite done 4 12\ncontinue\n' >"$out/spin-debug.in"
+	"$out/emulator" "$out/spin" -d <"$out/spin-debug.in" >"$out/spin-debug.out" 2>&1 &
+	emulator=$!
+	sleep 1
+	kill -INT $emulator
+	wait $emulator
+	debug_status=$?
+
+	mkfifo "$out/spin.fifo"
+	"$out/emulator" "$out/spin" <"$out/spin.fifo" >/dev/null 2>&1 &
+	emulator=$!
+	exec 3>"$out/spin.fifo"
+	sleep 1
+	kill -INT $emulator
+	sleep 0.2
+	kill -INT $emulator
+	wait $emulator
+	blocked_status=$?
+	exec 3>&-
+
+	if [ $run_status = 12 ] && grep -q '^Interrupted at [0-9]* in main+' "$out/spin.out" &&
+		[ $debug_status = 12 ] && grep -q '> Interrupted at [0-9]* in main+' "$out/spin-debug.out" &&
+		[ $blocked_status = 130 ]; then
+		echo "ok   interrupt"
+	else
+		echo "FAIL interrupt: status $run_status, with --debug $debug_status, while blocked $blocked_status"
+		failed=1
+	fi
+fi
+
+# A line read from stdin comes back uppercased, as it does natively
+if [ "$selected" = "" ] || [[ " $selected " == *" upper "* ]]; then
+	gcc -O0 -no-pie -o "$out/upper" tests/upper.c
+	want=$(printf 'hello, World 42\nsecond\n' | "$out/upper")
+	got=$(printf 'hello, World 42\nsecond\n' | "$out/emulator" "$out/upper")
+	status=$?
+	if [ "$got" = "$want" ] && [ $status = 0 ]; then
+		echo "ok   upper"
+	else
+		echo "FAIL upper: $(printf %q "$got"), want $(printf %q "$want"), status $status"
+		failed=1
+	fi
+fi
+
+# --allow-path lets files open only in the directories given, failing
+# openat with -EACCES elsewhere
+if [ "$selected" = "" ] || [[ " $selected " == *" allow_path "* ]]; then
+	gcc -O0 -no-pie -o "$out/files" tests/files.c
+	"$out/emulator" "$out/files" --allow-path tests/data >/dev/null
+	inside=$?
+	"$out/emulator" "$out/files" --allow-path tests/scripts >/dev/null
+	outside=$?
+	if [ $inside = 0 ] && [ $outside = 13 ]; then
+		echo "ok   allow_path"
+	else
+		echo "FAIL allow_path: status $inside inside, $outside outside, want 0 and 13"
+		failed=1
+	fi
+fi
+
+# A gdb remote protocol session: break in sum_to, inspect, step and
+# continue until the program exits with 21
+if [ "$selected" = "" ] || [[ " $selected " == *" gdb "* ]]; then
+	gcc -O0 -no-pie -o "$out/calls" tests/calls.c
+	port=$((20000 + RANDOM % 10000))
+	"$out/emulator" "$out/calls" --gdb "$port" 2>"$out/gdb.stderr" &
+	emulator=$!
+	sum_to=0x$(nm "$out/calls" | awk '$3 == "sum_to" { print $1 }')
+	reply=$(python3 tests/gdb_client.py "$port" "$sum_to")
+	wait $emulator
+	status=$?
+	if [ "$reply" = W15 ] && [ $status = 21 ]; then
+		echo "ok   gdb"
+	else
+		echo "FAIL gdb: reply $reply, status $status"
+		failed=1
+	fi
+fi
+
+# The REPL over --listen: step and read the registers, reconnect to find
+# the program paused, and continue until it exits with 10
+if [ "$selected" = "" ] || [[ " $selected " == *" listen "* ]]; then
+	gcc -O0 -no-pie -o "$out/loop" tests/loop.c
+	port=$((20000 + RANDOM % 10000))
+	"$out/emulator" "$out/loop" --listen "$port" 2>"$out/listen.stderr" &
+	emulator=$!
+	main=0x$(nm "$out/loop" | awk '$3 == "main" { print $1 }')
+	reply=$(python3 tests/repl_client.py "$port" "$main")
+	wait $emulator
+	status=$?
+	if [ "$reply" = "program returned from main with status 10" ] && [ $status = 10 ]; then
+		echo "ok   listen"
+	else
+		echo "FAIL listen: reply $reply, status $status"
+		failed=1
+	fi
+fi
+
+exit $failed
@@ -0,0 +1,5 @@
+// Recurses without end, so that the emulator stops it with a
+// StackOverflow fault once rsp leaves the stack
+long deeper(long n) { return deeper(n + 1) + 1; }
+
+int main() { return deeper(0); }
@@ -0,0 +1,10 @@
+# Regression checks: assert compares a value with the one expected and
+# fails, which --batch only prints, when they differ
+break sum_to
+c
+assert rdi 5
+assert rdi 4
+delete 1
+finish
+assert rax 15
+c
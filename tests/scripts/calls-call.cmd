@@ -0,0 +1,13 @@
+# Functions called from the debugger return through the exit trampoline
+# and leave the registers as they were
+break finish_with
+c
+where
+call sum_to 4
+call sum_to rdi-21
+call sum_to 1 2 3 4 5 6 7
+where
+r rdi
+delete 1
+call finish_with 3
+c
@@ -0,0 +1,23 @@
+# Expressions in place of plain values: offsets from rsp, slots of the
+# frame relative to rbp, and the return address read from the stack
+decimal
+break sum_to
+c
+set rcx rsp+8*3
+set rdx rcx-rsp
+set rsi *rsp
+next
+next
+next
+next
+m rbp-4 4
+set r8 *(rbp-8)
+set r9 (rdx+1)*2
+set r9 2*-3+7
+set r9 rsp+
+set r9 (rsp
+set r9 *0x7fffffffffff
+delete 1
+until *(rbp+8)
+r rax
+c
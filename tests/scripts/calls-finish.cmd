@@ -0,0 +1,11 @@
+# finish returns from the recursive frame it was started in, not the
+# innermost one
+break sum_to
+c
+c
+delete 1
+finish
+bt
+finish
+bt
+c
@@ -0,0 +1,6 @@
+# Run to symbols once, without leaving breakpoints behind
+until sum_too
+u sum_to
+until finish_with
+info breakpoints
+c
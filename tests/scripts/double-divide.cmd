@@ -0,0 +1,8 @@
+# divsd leaves a/b in the low quadword of xmm0
+decimal
+break quotient
+c
+finish
+r xmm0
+delete 1
+c
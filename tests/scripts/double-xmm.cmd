@@ -0,0 +1,10 @@
+# Doubles are passed in xmm0 and xmm1 and returned in xmm0
+decimal
+break add
+c
+r xmm0
+r xmm1
+finish
+r xmm0
+delete 1
+c
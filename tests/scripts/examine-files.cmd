@@ -0,0 +1,9 @@
+# Raw memory to and from files, and golden data comparisons
+compare tests/data/greeting.bin greeting
+dump /tmp/go-amd64-emulator-greeting.bin greeting 9
+compare /tmp/go-amd64-emulator-greeting.bin greeting
+load tests/data/shout.bin quads
+x/s quads
+compare tests/data/greeting.bin quads 3
+load tests/data/greeting.bin 0xfffffffff
+dump /tmp/go-amd64-emulator-greeting.bin
@@ -0,0 +1,12 @@
+# gdb style examine; the format and size carry over to later commands
+x/s greeting
+x/2s greeting
+x/3gx quads
+x/3gd quads
+x/3wu words
+x words
+x/9bx greeting
+x/2i main
+x/1gx 0xffffffffff
+x/4q quads
+c
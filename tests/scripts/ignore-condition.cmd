@@ -0,0 +1,16 @@
+# A conditional breakpoint only stops, and counts a hit, in the
+# iteration where its condition holds
+b visit if rdi == 7
+info breakpoints
+c
+r rdi
+info breakpoints
+# Conditions compare unsigned, and a condition that can't be evaluated
+# stops
+b visit if rdi>=8
+c
+r rdi
+b visit if *0x7fffffffffff == 0
+c
+delete 1
+c
@@ -0,0 +1,17 @@
+# Skip the first 5 calls of visit, stopping in the 6th iteration
+b visit
+ignore 1 5
+info breakpoints
+c
+r rdi
+info breakpoints
+# Without an ignore count the next hit stops again
+c
+r rdi
+ignore 1 2
+c
+r rdi
+info breakpoints
+ignore 2 1
+delete 1
+c
@@ -0,0 +1,7 @@
+# Replace the start of main with mov eax, 42; ret and run it
+asm b8 2a 00 00 00 c3
+asm \xb8\x2a,0,0,0
+asm b8 zz
+step
+r rax
+step
@@ -0,0 +1,17 @@
+# The program starts paused at its entry point, and a breakpoint set
+# there still fires on the first continue. One inside the loop is hit
+# on every iteration, until it is deleted.
+b rip
+b 4198682
+c
+r rip
+c
+c
+c
+c
+c
+info breakpoints
+delete 3
+delete 2
+info breakpoints
+c
@@ -0,0 +1,10 @@
+# Breakpoints on the entry point and inside the loop
+b main
+b 0x40111a
+c
+r rip
+c
+c
+info breakpoints
+delete 2
+c
@@ -0,0 +1,17 @@
+# Changed registers after each step, and expressions shown at each stop
+d
+display rax
+display rsp 8
+display rip
+s
+s
+undisplay 3
+b 0x40111a
+c
+s
+s
+s
+s
+undisplay 9
+display
+display 0x40111a
@@ -0,0 +1,7 @@
+# disassemble without arguments shows all of the function rip is in,
+# marking the next instruction
+break 0x40111a
+c
+disassemble
+delete 1
+c
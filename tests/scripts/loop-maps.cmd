@@ -0,0 +1,4 @@
+# The loaded segments, the trampoline, the TLS block and the stack
+decimal
+info maps
+c
@@ -0,0 +1,14 @@
+# search finds a value written to the stack wherever memory is in use,
+# or only in the range given; search-bytes finds a byte pattern
+decimal
+break main
+c
+write rsp-16 8 0x1122334455667788
+search 0x1122334455667788 8
+search 0x1122334455667788 8 rsp-16 16
+search-bytes 66 55 44
+search-bytes 7f 45 4c 46
+# main starts with push rbp; mov rbp, rsp
+search-bytes 55 48 89 e5
+delete 1
+c
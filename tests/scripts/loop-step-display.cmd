@@ -0,0 +1,15 @@
+# disassemble shows the instructions from an address, marking the next
+# one, and each step prints the instruction it executed. An address
+# outside memory is reported rather than decoded.
+break main
+c
+disassemble rip 4
+step
+step
+next
+disassemble rip 2
+set rip 0xffffffffff
+step
+next
+finish
+disassemble rip 2
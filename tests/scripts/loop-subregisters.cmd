@@ -0,0 +1,11 @@
+# The low 32, 16 and 8 bits of registers whose halves differ
+decimal
+set rax 0x1122334455667788
+set rsi 0xffffffff000080ff
+set r9 0x8000000000000001
+r -w rax
+r -w rsi
+r r9 -w
+r -w rip
+r -w rax rbx
+c
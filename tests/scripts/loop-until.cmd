@@ -0,0 +1,8 @@
+# Run to an address inside the loop body, once per iteration, and past
+# the end of the program, where it stops at exit instead
+until 0x40111a
+r rip
+until 0x40111a
+r rip
+info breakpoints
+until 0x401000
@@ -0,0 +1,3 @@
+# call reports a fault outside memory and leaves the program as it was
+call 0xffffffffff
+registers rip
@@ -0,0 +1,4 @@
+# Stores into .text are reported, whether from the program or the
+# debugger
+w main 1 0x55
+c
@@ -0,0 +1,9 @@
+# The 8-byte store to counter straddles a watch on its last 4 bytes and
+# one on the byte before it and its first, which both count a hit, but
+# not one ending just before it
+watch counter-4 4
+watch counter+4 4
+watch counter-1 2
+c
+info watchpoints
+c
@@ -0,0 +1,29 @@
+// Points gs at block with arch_prctl(ARCH_SET_GS), then stores and loads
+// through gs-relative operands, including one with an index register,
+// and checks the stores landed in block. Exits with 9 + 30 + 4 = 43.
+unsigned long block[4] = {0, 9, 0, 0};
+
+int main() {
+  long loaded;
+  long indexed;
+  __asm__ volatile(
+      "mov $158, %%eax\n"
+      "mov $0x1001, %%edi\n"
+      "mov $block, %%esi\n"
+      "syscall\n"
+      "mov %%gs:8, %%rcx\n"
+      "mov %%rcx, %[loaded]\n"
+      "movq $30, %%gs:16\n"
+      "mov $3, %%edx\n"
+      "movq $4, %%gs:(,%%rdx,8)\n"
+      "mov %%gs:16, %%rcx\n"
+      "mov %%rcx, %[indexed]\n"
+      "mov $158, %%eax\n"
+      "mov $0x1001, %%edi\n"
+      "xor %%esi, %%esi\n"
+      "syscall\n"
+      : [loaded] "=m"(loaded), [indexed] "=m"(indexed)
+      :
+      : "rax", "rcx", "rdx", "rsi", "rdi", "r11", "memory");
+  return loaded + indexed + block[3];
+}
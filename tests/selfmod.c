@@ -0,0 +1,33 @@
+// Patches the immediate of an instruction in .text and calls it, after
+// making the page writable. Exits with 42 once the patched instruction
+// has run; the emulator warns about the write in the debugger and when
+// tracing.
+__asm__(".text\n"
+        ".globl patched\n"
+        "patched:\n"
+        "mov $1, %eax\n"
+        "ret\n");
+
+int patched(void);
+
+long raw_syscall(long number, long a, long b, long c) {
+  long ret;
+  __asm__ volatile("syscall"
+                   : "=a"(ret)
+                   : "a"(number), "D"(a), "S"(b), "d"(c)
+                   : "rcx", "r11", "memory");
+  return ret;
+}
+
+int main() {
+  // The immediate follows the opcode byte
+  unsigned char *imm = (unsigned char *)patched + 1;
+  // The mask is a variable; gcc would use the accumulator form of and
+  long mask = -4096;
+  long page = (long)imm & mask;
+  // PROT_READ | PROT_WRITE | PROT_EXEC; two pages in case imm is at the
+  // end of one
+  long protected = raw_syscall(10, page, 8192, 7);
+  *imm = 42;
+  return patched() - protected;
+}
@@ -0,0 +1,74 @@
+// Blocks SIGUSR1 with the raw rt_sigprocmask syscall and installs
+// SIG_IGN for it with rt_sigaction, reading back the old mask and action
+// each time. Exits with 42 when everything worked.
+long raw_syscall(long number, long a, long b, long c) {
+  long result;
+  register long sigsetsize __asm__("r10") = 8;
+  __asm__ volatile("syscall"
+                   : "=a"(result)
+                   : "a"(number), "D"(a), "S"(b), "d"(c), "r"(sigsetsize)
+                   : "rcx", "r11", "memory");
+  return result;
+}
+
+struct kernel_sigaction {
+  long handler;
+  long flags;
+  long restorer;
+  long mask;
+};
+
+int main() {
+  // Loaded values are compared with variables rather than constants,
+  // which gcc would check with test and cmp forms the emulator lacks
+  long zero = 0;
+  long einval = -22;
+  long result;
+  long usr1 = 1L << 9;
+  long old = -1;
+  result = raw_syscall(14, 0, (long)&usr1, (long)&old);
+  if (result != 0 || old != zero) {
+    return 1;
+  }
+
+  // SIGKILL and SIGSTOP can't be blocked
+  long all = -1;
+  long blockable = -1L - (1L << 8) - (1L << 18);
+  result = raw_syscall(14, 0, (long)&all, (long)&old);
+  if (result != 0 || old != usr1) {
+    return 2;
+  }
+
+  result = raw_syscall(14, 2, (long)&usr1, (long)&old);
+  if (result != 0 || old != blockable) {
+    return 3;
+  }
+
+  result = raw_syscall(14, 5, (long)&usr1, 0);
+  if (result != einval) {
+    return 4;
+  }
+
+  struct kernel_sigaction ignore = {1, 0, 0, 0};
+  struct kernel_sigaction previous = {-1, -1, -1, -1};
+  result = raw_syscall(13, 10, (long)&ignore, (long)&previous);
+  if (result != 0 || previous.handler != zero || previous.mask != zero) {
+    return 5;
+  }
+
+  result = raw_syscall(13, 10, 0, (long)&previous);
+  if (result != 0 || previous.handler != 1) {
+    return 6;
+  }
+
+  result = raw_syscall(13, 9, (long)&ignore, 0);
+  if (result != einval) {
+    return 7;
+  }
+
+  // Leave SIGUSR1 unblocked and at its default action again
+  struct kernel_sigaction fallback = {0, 0, 0, 0};
+  raw_syscall(13, 10, (long)&fallback, 0);
+  raw_syscall(14, 2, (long)&zero, 0);
+  return 42;
+}
@@ -0,0 +1,22 @@
+// spin reads a byte from stdin and then runs until something else sets
+// done to 12, for interrupting with Ctrl-C while it waits and while it
+// runs. The read is a raw syscall, as programs don't get a libc.
+volatile int done;
+
+static long read_byte(char *c) {
+  long n;
+  asm volatile("syscall"
+               : "=a"(n)
+               : "a"(0), "D"(0), "S"(c), "d"(1)
+               : "rcx", "r11", "memory");
+  return n;
+}
+
+int main() {
+  char c;
+  read_byte(&c);
+  while (done != 12) {
+  }
+
+  return done;
+}
@@ -0,0 +1,17 @@
+// main is entered with rsp 8 below a 16 byte boundary, as after a call,
+// and its frame is above the end of the loaded image. Exits with 42 when
+// both hold.
+extern char end[];
+
+int main() {
+  long zero = 0;
+  // The frame pointer is rsp at entry less the pushed rbp
+  long frame = (long)__builtin_frame_address(0);
+  if ((frame & 15) != zero) {
+    return 1;
+  }
+  if (frame < (long)end) {
+    return 2;
+  }
+  return 42;
+}
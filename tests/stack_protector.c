@@ -0,0 +1,4 @@
+// Build with -fstack-protector-all to exercise fs:0x28 canary reads
+int main() {
+  return 254;
+}
@@ -0,0 +1,18 @@
+// A static program without libc: _start writes a greeting and exits
+// with argc + 40 through the raw syscalls. Build with
+// gcc -static -nostdlib.
+char greeting[] = "hello from _start\n";
+
+__asm__(
+    ".text\n"
+    ".globl _start\n"
+    "_start:\n"
+    "  mov $1, %eax\n"
+    "  mov $1, %edi\n"
+    "  mov $greeting, %esi\n"
+    "  mov $18, %edx\n"
+    "  syscall\n"
+    "  mov (%rsp), %rdi\n"
+    "  add $40, %rdi\n"
+    "  mov $60, %eax\n"
+    "  syscall\n");
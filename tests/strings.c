@@ -0,0 +1,69 @@
+// strlen with repne scasb, memcmp with repe cmpsb and a backwards scan
+// with the direction flag set. Exits with 42 when all of them agree with
+// the C library's answers.
+long scan_strlen(const char *s) {
+  long count = -1;
+  __asm__ volatile("xor %%eax, %%eax\n"
+                   "repne scasb\n"
+                   : "+D"(s), "+c"(count)
+                   :
+                   : "rax", "memory", "cc");
+  // rcx counted down past every byte and the terminator
+  return -2 - count;
+}
+
+long cmps_memcmp(const char *a, const char *b, long n) {
+  long result;
+  // Zero sets ZF for n == 0, where repe cmpsb compares nothing
+  __asm__ volatile("xor %%eax, %%eax\n"
+                   "repe cmpsb\n"
+                   "jz 1f\n"
+                   "mov $1, %%eax\n"
+                   "ja 1f\n"
+                   "mov $-1, %%rax\n"
+                   "1:\n"
+                   : "=a"(result), "+S"(a), "+D"(b), "+c"(n)
+                   :
+                   : "memory", "cc");
+  return result;
+}
+
+// last_slash returns the index of the last '/' in the n bytes at s
+long last_slash(const char *s, long n) {
+  const char *p = s + n - 1;
+  __asm__ volatile("std\n"
+                   "repne scasb\n"
+                   "cld\n"
+                   : "+D"(p), "+c"(n)
+                   : "a"('/')
+                   : "memory", "cc");
+  return p + 1 - s;
+}
+
+int main() {
+  // Results are compared with a variable rather than 0, which gcc would
+  // check with a test form the emulator lacks
+  long zero = 0;
+  if (scan_strlen("hello, world") != 12) {
+    return 1;
+  }
+  if (scan_strlen("") != zero) {
+    return 2;
+  }
+  if (cmps_memcmp("abcdef", "abcdef", 6) != zero) {
+    return 3;
+  }
+  if (cmps_memcmp("abcdef", "abcxef", 6) != -1) {
+    return 4;
+  }
+  if (cmps_memcmp("abcz", "abca", 4) != 1) {
+    return 5;
+  }
+  if (cmps_memcmp("abc", "xyz", 0) != zero) {
+    return 6;
+  }
+  if (last_slash("usr/local/bin", 13) != 9) {
+    return 7;
+  }
+  return 42;
+}
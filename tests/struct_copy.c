@@ -0,0 +1,16 @@
+// Copies a 32 byte struct, which gcc does with movups/movdqu pairs once
+// optimizing, and exits with the sum of the copy's fields, 36.
+struct block {
+  long a, b, c, d;
+};
+
+__attribute__((noinline)) void copy(struct block *dst, const struct block *src) {
+  *dst = *src;
+}
+
+int main() {
+  struct block src = {3, 7, 11, 15};
+  struct block dst;
+  copy(&dst, &src);
+  return dst.a + dst.b + dst.c + dst.d;
+}
@@ -0,0 +1,33 @@
+// Adjacent functions for symbol lookups: first has a size and is
+// followed by code outside any symbol, second has no size and extends
+// to third.
+__asm__(".text\n"
+        ".globl first\n"
+        ".type first, @function\n"
+        "first:\n"
+        "  nop\n"
+        "  nop\n"
+        "  jmp .Lgap\n"
+        ".size first, .-first\n"
+        ".Lgap:\n"
+        "  nop\n"
+        "  jmp second\n"
+        ".globl second\n"
+        ".type second, @function\n"
+        "second:\n"
+        "  nop\n"
+        "  ret\n"
+        ".globl third\n"
+        ".type third, @function\n"
+        "third:\n"
+        "  mov $42, %eax\n"
+        "  ret\n"
+        ".size third, .-third\n");
+
+void first(void);
+int third(void);
+
+int main() {
+  first();
+  return third();
+}
@@ -0,0 +1,52 @@
+// Reads a line from stdin a byte at a time and writes it back
+// uppercased, for reads and writes through the descriptor table. Bytes
+// are compared in assembly: gcc would load them with movzx.
+long raw_syscall(long number, long a, long b, long c) {
+  long ret;
+  __asm__ volatile("syscall"
+                   : "=a"(ret)
+                   : "a"(number), "D"(a), "S"(b), "d"(c)
+                   : "rcx", "r11", "memory");
+  return ret;
+}
+
+// uppercase clears the lowercase bit of an ASCII letter, returning 1
+// when the byte was the newline
+long uppercase(char *c) {
+  long newline = 0;
+  __asm__ volatile("cmpb $10, (%1)\n"
+                   "jne 1f\n"
+                   "mov $1, %0\n"
+                   "1:\n"
+                   "cmpb $0x61, (%1)\n"
+                   "jb 2f\n"
+                   "cmpb $0x7a, (%1)\n"
+                   "ja 2f\n"
+                   "andb $0xdf, (%1)\n"
+                   "2:\n"
+                   : "+r"(newline)
+                   : "r"(c)
+                   : "cc", "memory");
+  return newline;
+}
+
+int main() {
+  char line[128];
+  long n = 0;
+  long size = 128;
+  long one = 1;
+  while (n < size) {
+    if (raw_syscall(0, 0, (long)(line + n), 1) != one) {
+      break;
+    }
+    n++;
+    if (uppercase(line + n - 1) == one) {
+      break;
+    }
+  }
+
+  if (raw_syscall(1, 1, (long)line, n) != n) {
+    return 1;
+  }
+  return 0;
+}
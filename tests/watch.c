@@ -0,0 +1,10 @@
+// counter is written with a single 8-byte store. A write watchpoint on
+// the bytes just before it whose last byte is counter's first, e.g.
+// `watch <counter-4> 5`, must fire although the store starts at the
+// range's last byte; one ending just before counter must not.
+unsigned long counter;
+
+int main() {
+  counter = 0xAB00000000000001;
+  return 0;
+}
@@ -0,0 +1,25 @@
+// writev with a two element iovec prints "hello, writev" in one call.
+// More than 1024 entries fail with -EINVAL and a bad base with -EFAULT.
+// Exits with 14 + 22 + 14 = 50.
+struct iovec {
+  const char *base;
+  unsigned long len;
+};
+
+long raw_syscall(long number, long a, long b, long c) {
+  long ret;
+  __asm__ volatile("syscall"
+                   : "=a"(ret)
+                   : "a"(number), "D"(a), "S"(b), "d"(c)
+                   : "rcx", "r11", "memory");
+  return ret;
+}
+
+int main() {
+  struct iovec iov[2] = {{"hello, ", 7}, {"writev\n", 7}};
+  struct iovec bad[1] = {{(const char *)-4096, 7}};
+  long written = raw_syscall(20, 1, (long)iov, 2);
+  long too_many = raw_syscall(20, 1, (long)iov, 1025);
+  long fault = raw_syscall(20, 1, (long)bad, 1);
+  return written - too_many - fault;
+}
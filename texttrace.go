@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// textTracer prints one line per executed instruction: its address,
+// bytes and disassembly followed by the registers it changed. With a
+// start address set, lines are only printed from that instruction on
+// until the one at stop has run.
+type textTracer struct {
+	w *bufio.Writer
+	// f is closed with the tracer unless the trace goes to stderr
+	f       *os.File
+	start   uint64
+	stop    uint64
+	active  bool
+	symbols *symbolTable
+	loaded  bool
+}
+
+func newTextTracer(filename string, start, stop uint64) (*textTracer, error) {
+	t := &textTracer{start: start, stop: stop, active: start == 0}
+	if filename == "" {
+		t.w = bufio.NewWriter(os.Stderr)
+		return t, nil
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	t.f = f
+	t.w = bufio.NewWriter(f)
+	return t, nil
+}
+
+func (t *textTracer) after(c *cpu, ev *instructionEvent) {
+	if ev.rip == t.start {
+		t.active = true
+	}
+
+	if !t.active {
+		return
+	}
+
+	if ev.rip == t.stop {
+		t.active = false
+	}
+
+	// The program is loaded after the tracer is registered
+	if !t.loaded {
+		t.symbols = c.symbolTable()
+		t.loaded = true
+	}
+
+	text, _, err := disassembleWithSymbols(ev.code, ev.rip, t.symbols)
+	if err != nil {
+		text = "(bad)"
+	}
+
+	fmt.Fprintf(t.w, "%8x:\t%-30s\t%s", ev.rip, formatInstructionBytes(ev.code), text)
+	if writes := formatTraceWrites(newTraceRecord(c, ev).writes); writes != "" {
+		fmt.Fprintf(t.w, "\t%s", writes)
+	}
+
+	t.w.WriteByte('\n')
+	// Keep the trace in step with the program's own output
+	if t.f == nil {
+		t.w.Flush()
+	}
+}
+
+// formatTraceWrites lists written registers as reg=0xvalue
+func formatTraceWrites(writes []traceWrite) string {
+	var fields []string
+	for _, w := range writes {
+		fields = append(fields, fmt.Sprintf("%s=0x%x", registerMap[w.reg], w.value))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func (t *textTracer) close() error {
+	err := t.w.Flush()
+	if t.f == nil {
+		return err
+	}
+
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Trace files start with traceMagic followed by one record per executed
+// instruction:
+//
+//	uvarint rip, uvarint opcode, byte count, count * (byte register, uvarint value)
+//
+// Only registers whose value changed are recorded, and rip is left out
+// of the written set since it changes on every instruction.
+const traceMagic = "amd64trace\x02"
+
+type traceWrite struct {
+	reg   register
+	value uint64
+}
+
+type traceRecord struct {
+	rip    uint64
+	opcode uint16
+	writes []traceWrite
+}
+
+// instructionTracer is registered as a post-instruction hook.
+type instructionTracer interface {
+	after(c *cpu, ev *instructionEvent)
+	close() error
+}
+
+// addTracer registers t as a post-instruction hook, to be closed when
+// the program stops. Self-modifying code is reported on stderr
+// alongside the trace.
+func (c *cpu) addTracer(t instructionTracer) {
+	c.tracers = append(c.tracers, t)
+	c.addPostHook(t.after)
+	c.codeWriteWarnings = os.Stderr
+}
+
+func newTraceRecord(c *cpu, ev *instructionEvent) traceRecord {
+	rec := traceRecord{rip: ev.rip, opcode: ev.opcode}
+	for reg := rax; reg <= rflags; reg++ {
+		if reg == rip {
+			continue
+		}
+
+		if v := c.regfile.get(reg); v != ev.before.get(reg) {
+			rec.writes = append(rec.writes, traceWrite{reg, v})
+		}
+	}
+
+	return rec
+}
+
+type traceRecorder struct {
+	f   *os.File
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func newTraceRecorder(filename string) (*traceRecorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	if _, err := w.WriteString(traceMagic); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &traceRecorder{f: f, w: w}, nil
+}
+
+func (t *traceRecorder) writeUvarint(v uint64) {
+	n := binary.PutUvarint(t.buf[:], v)
+	t.w.Write(t.buf[:n])
+}
+
+func (t *traceRecorder) after(c *cpu, ev *instructionEvent) {
+	if t.err != nil {
+		return
+	}
+
+	rec := newTraceRecord(c, ev)
+	t.writeUvarint(rec.rip)
+	t.writeUvarint(uint64(rec.opcode))
+	t.w.WriteByte(byte(len(rec.writes)))
+	for _, w := range rec.writes {
+		t.w.WriteByte(byte(w.reg))
+		t.writeUvarint(w.value)
+	}
+
+	// bufio.Writer errors are sticky, so checking the last write is enough
+	_, t.err = t.w.Write(nil)
+}
+
+func (t *traceRecorder) close() error {
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+
+	if err := t.f.Close(); t.err == nil {
+		t.err = err
+	}
+
+	return t.err
+}
+
+type traceReplayer struct {
+	f     *os.File
+	r     *bufio.Reader
+	count uint64
+	// diverged is set once a divergence has been reported
+	diverged bool
+}
+
+func newTraceReplayer(filename string) (*traceReplayer, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(traceMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != traceMagic {
+		f.Close()
+		return nil, fmt.Errorf("Not a trace file: %s", filename)
+	}
+
+	return &traceReplayer{f: f, r: r}, nil
+}
+
+func (t *traceReplayer) next() (*traceRecord, error) {
+	ip, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return nil, err
+	}
+
+	opcode, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := traceRecord{rip: ip, opcode: uint16(opcode)}
+
+	count, err := t.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < int(count); i++ {
+		reg, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := binary.ReadUvarint(t.r)
+		if err != nil {
+			return nil, err
+		}
+
+		rec.writes = append(rec.writes, traceWrite{register(reg), value})
+	}
+
+	return &rec, nil
+}
+
+func (t *traceReplayer) after(c *cpu, ev *instructionEvent) {
+	t.count++
+	actual := newTraceRecord(c, ev)
+	expected, err := t.next()
+	if err == io.EOF {
+		printTraceDiff(nil, &actual)
+		t.diverge(ev, "recording ended")
+	} else if err != nil {
+		t.diverge(ev, "could not read trace: "+err.Error())
+	}
+
+	if !traceRecordsEqual(expected, &actual) {
+		printTraceDiff(expected, &actual)
+		t.diverge(ev, "registers differ")
+	}
+}
+
+// diverge stops the program at the instruction that departed from the
+// recording, whose differences have been printed
+func (t *traceReplayer) diverge(ev *instructionEvent, detail string) {
+	t.diverged = true
+	panic(&fault{kind: aborted, rip: ev.rip, detail: fmt.Sprintf("replay diverged at instruction %d: %s", t.count, detail)})
+}
+
+func (t *traceReplayer) close() error {
+	defer t.f.Close()
+	if t.diverged {
+		return nil
+	}
+
+	if _, err := t.next(); err != io.EOF {
+		if err == nil {
+			err = errors.New("program exited before the recording ended")
+		}
+
+		return fmt.Errorf("Replay diverged after instruction %d: %s", t.count, err)
+	}
+
+	return nil
+}
+
+func traceRecordsEqual(a, b *traceRecord) bool {
+	if a.rip != b.rip || a.opcode != b.opcode || len(a.writes) != len(b.writes) {
+		return false
+	}
+
+	for i := range a.writes {
+		if a.writes[i] != b.writes[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func printTraceDiff(expected, actual *traceRecord) {
+	row := func(name, left, right string) {
+		marker := " "
+		if left != right {
+			marker = "*"
+		}
+
+		fmt.Fprintf(os.Stderr, "%s %-8s %-20s %-20s\n", marker, name, left, right)
+	}
+
+	field := func(rec *traceRecord, f func(*traceRecord) string) string {
+		if rec == nil {
+			return "-"
+		}
+
+		return f(rec)
+	}
+
+	fmt.Fprintf(os.Stderr, "  %-8s %-20s %-20s\n", "", "recorded", "actual")
+	row("rip", field(expected, func(r *traceRecord) string { return fmt.Sprintf("0x%x", r.rip) }),
+		field(actual, func(r *traceRecord) string { return fmt.Sprintf("0x%x", r.rip) }))
+	row("opcode", field(expected, func(r *traceRecord) string { return fmt.Sprintf("0x%x", r.opcode) }),
+		field(actual, func(r *traceRecord) string { return fmt.Sprintf("0x%x", r.opcode) }))
+
+	for reg := rax; reg <= rflags; reg++ {
+		written := func(r *traceRecord) string {
+			for _, w := range r.writes {
+				if w.reg == reg {
+					return fmt.Sprintf("0x%x", w.value)
+				}
+			}
+
+			return "-"
+		}
+
+		left, right := field(expected, written), field(actual, written)
+		if left == "-" && right == "-" {
+			continue
+		}
+
+		row(registerMap[reg], left, right)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countCode sums 5 down to 1 into eax and returns it:
+// mov ecx, 5; xor eax, eax; add eax, ecx; dec ecx; jne .-6; ret
+var countCode = []byte{0xb9, 0x05, 0x00, 0x00, 0x00, 0x31, 0xc0, 0x01, 0xc8, 0xff, 0xc9, 0x75, 0xfa, 0xc3}
+
+// countTrace is countCode recorded with --record
+const countTrace = "tests/traces/count.trace"
+
+func TestTraceRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "count.trace")
+	recorder, err := newTraceRecorder(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := entryCPU(countCode)
+	c.addPostHook(recorder.after)
+	if status, err := c.run(); err != nil || status != 15 {
+		t.Fatalf("status %d, %v", status, err)
+	}
+
+	if err := recorder.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed, err := os.ReadFile(countTrace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(recorded, committed) {
+		t.Errorf("recording differs from %s", countTrace)
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	// mov ecx, 6 runs the same instructions with a different result
+	changed := append([]byte(nil), countCode...)
+	changed[1] = 6
+
+	tests := []struct {
+		name   string
+		code   []byte
+		status int
+		// diverged is the fault the replay stops with, "" for none
+		diverged string
+	}{
+		{"same code", countCode, 15, ""},
+		{"changed result", changed, 0, "Aborted fault at 0x1000: replay diverged at instruction 1: registers differ"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replayer, err := newTraceReplayer(countTrace)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := entryCPU(tt.code)
+			c.addPostHook(replayer.after)
+			status, err := c.run()
+			if closeErr := replayer.close(); closeErr != nil {
+				t.Errorf("close: %s", closeErr)
+			}
+
+			if tt.diverged == "" {
+				if err != nil || status != tt.status {
+					t.Errorf("status %d, %v; want %d", status, err, tt.status)
+				}
+
+				return
+			}
+
+			if f, ok := err.(*fault); !ok || f.kind != aborted || f.Error() != tt.diverged {
+				t.Errorf("got %v, want %s", err, tt.diverged)
+			}
+		})
+	}
+}
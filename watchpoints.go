@@ -0,0 +1,60 @@
+package main
+
+import "sort"
+
+// watchpoint stops continue when an access overlaps length bytes at
+// address: stores for write watchpoints, loads for read watchpoints.
+type watchpoint struct {
+	id      int
+	address uint64
+	length  uint64
+	write   bool
+	hits    uint64
+}
+
+// overlaps compares offsets into the two ranges rather than their ends,
+// which would wrap for ranges reaching the top of the address space
+func (w *watchpoint) overlaps(address uint64, size int) bool {
+	return address-w.address < w.length || w.address-address < uint64(size)
+}
+
+// watchHit records a watched access. old and new are the accessed
+// bytes before and after the access, equal for loads.
+type watchHit struct {
+	watchpoint *watchpoint
+	rip        uint64
+	address    uint64
+	size       int
+	old, new   uint64
+}
+
+func (b *breakpoints) addWatchpoint(address, length uint64, write bool) *watchpoint {
+	wp := &watchpoint{id: b.nextID, address: address, length: length, write: write}
+	b.nextID++
+	b.watchpoints = append(b.watchpoints, wp)
+	sort.Slice(b.watchpoints, func(i, j int) bool { return b.watchpoints[i].id < b.watchpoints[j].id })
+	return wp
+}
+
+// watch is called by the memory accessors for every guest load and
+// store while watchpoints are set.
+func (c *cpu) watch(address uint64, size int, write bool, old, new uint64) {
+	b := c.breakpoints
+	for _, wp := range b.watchpoints {
+		if wp.write != write || !wp.overlaps(address, size) {
+			continue
+		}
+
+		wp.hits++
+		if b.watchHit == nil {
+			b.watchHit = &watchHit{
+				watchpoint: wp,
+				rip:        c.regfile.get(rip),
+				address:    address,
+				size:       size,
+				old:        old,
+				new:        new,
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestWatchpointOverlaps(t *testing.T) {
+	const top = ^uint64(0)
+	tests := []struct {
+		watch, length uint64
+		address       uint64
+		size          int
+		want          bool
+	}{
+		{0x1000, 4, 0x1000, 1, true},
+		{0x1000, 4, 0x1003, 1, true},
+		{0x1000, 4, 0x1004, 1, false},
+		{0x1000, 4, 0xFFF, 1, false},
+		// An 8-byte store straddling either end of a 4-byte watch
+		{0x1004, 4, 0x1000, 8, true},
+		{0x1000, 4, 0xFFD, 8, true},
+		{0x1000, 4, 0xFF8, 8, false},
+		// Ranges at the top of the address space, whose ends wrap
+		{top - 3, 4, top, 1, true},
+		{top - 3, 4, 0, 8, false},
+		{0, 4, top - 3, 4, false},
+		{0x10, 4, top - 7, 8, false},
+		{top - 7, 8, top - 3, 8, true},
+	}
+
+	for _, tt := range tests {
+		w := &watchpoint{address: tt.watch, length: tt.length}
+		if got := w.overlaps(tt.address, tt.size); got != tt.want {
+			t.Errorf("watch %d bytes at 0x%x, %d byte access at 0x%x: got %v, want %v", tt.length, tt.watch, tt.size, tt.address, got, tt.want)
+		}
+	}
+}